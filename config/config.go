@@ -9,6 +9,29 @@ import (
 
 type TiDBConfig struct {
 	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+	// Password is ignored if PasswordFile is set, whose content is the password.
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// Database is the database of the tables, which must exist.
+	Database string        `yaml:"database"`
+	TLS      TiDBTLSConfig `yaml:"tls"`
+	// TablePrefix is prepended to the names of the tables, so that several
+	// deployments can share a database.
+	TablePrefix string `yaml:"table_prefix"`
+
+	// WriteMaxOpenConns and ReadMaxOpenConns are the sizes of the separate
+	// connection pools of ingestion and queries.
+	WriteMaxOpenConns int `yaml:"write_max_open_conns"`
+	ReadMaxOpenConns  int `yaml:"read_max_open_conns"`
+	// MaxIdleConns is the max number of idle connections of each pool, zero
+	// means keeping all the open connections.
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	// OverflowLabels allows metrics to have more labels than the label columns
+	// of flash_metrics_index, the others are stored in a JSON column. It takes
+	// effect on a new database only, as the index table is created differently.
+	OverflowLabels bool `yaml:"overflow_labels"`
 }
 
 type WebConfig struct {
@@ -28,6 +51,121 @@ type ScrapeConfig struct {
 	StaticConfigs  []StaticConfig `yaml:"static_configs"`
 }
 
+type QueryConfig struct {
+	// Engine is either "flash" for the built-in evaluator or "prometheus" for the upstream one.
+	Engine string `yaml:"engine"`
+	// Pushdown enables evaluating queries inside TiDB when using the built-in evaluator.
+	Pushdown bool `yaml:"pushdown"`
+
+	// The limits of a query, zero means no limit.
+	// MaxSeries is the max number of series a selector can select.
+	MaxSeries int `yaml:"max_series"`
+	// MaxMetrics is the max number of metrics a selector can select, which
+	// matters to the selectors without a metric name.
+	MaxMetrics int `yaml:"max_metrics"`
+	// MaxSamples is the max number of samples a query can load.
+	MaxSamples int `yaml:"max_samples"`
+	// MaxRange is the max time range a query can load, including the range of range vectors.
+	MaxRange time.Duration `yaml:"max_range"`
+	// MaxSteps is the max number of steps of a range query.
+	MaxSteps int `yaml:"max_steps"`
+	// Timeout is the max duration of a query.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxConcurrency is the max number of queries running at the same time,
+	// zero means no limit. The others wait in a queue of at most MaxQueueLength
+	// queries, where clients take turns.
+	MaxConcurrency int `yaml:"max_concurrency"`
+	MaxQueueLength int `yaml:"max_queue_length"`
+
+	ResultsCache ResultsCacheConfig `yaml:"results_cache"`
+}
+
+// ResultsCacheConfig configures the cache of range query results, which are
+// split by day and cached once the day is older than MaxFreshness.
+type ResultsCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxEntries is the max number of cached days kept in memory.
+	MaxEntries int `yaml:"max_entries"`
+	// Dir enables the on-disk backend in the directory if not empty.
+	Dir string `yaml:"dir"`
+	// MaxFreshness is how recent results are never cached, as their samples may still arrive.
+	MaxFreshness time.Duration `yaml:"max_freshness"`
+	// AlignQueriesWithStep rounds the start and end of range queries down to
+	// the step, so that the queries not aligned are cached too. Otherwise they
+	// are never cached, as the timestamps of their results would change.
+	AlignQueriesWithStep bool `yaml:"align_queries_with_step"`
+	// TTL is how long a cached day is kept, in memory and on disk.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// RetentionConfig configures the expiry of old samples, a zero period keeps
+// them forever. The daily partitions of flash_metrics_data are dropped once
+// older than the longest period, the samples of metrics with shorter periods
+// are deleted by batches.
+type RetentionConfig struct {
+	Period time.Duration `yaml:"period"`
+	// Metrics override Period for the metrics whose names match, the first
+	// match wins.
+	Metrics []MetricRetentionConfig `yaml:"metrics"`
+	// Interval is how often the retention is enforced.
+	Interval time.Duration `yaml:"interval"`
+	// PartitionsAhead is the number of daily partitions created in advance.
+	PartitionsAhead int `yaml:"partitions_ahead"`
+	// DeleteBatchSize is the max number of rows deleted by a statement.
+	DeleteBatchSize int `yaml:"delete_batch_size"`
+}
+
+type MetricRetentionConfig struct {
+	// Pattern is a regular expression matching the whole metric name.
+	Pattern string        `yaml:"pattern"`
+	Period  time.Duration `yaml:"period"`
+}
+
+// RollupConfig configures the aggregates of samples in buckets of 5m and 1h,
+// which serve the queries with large steps.
+type RollupConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the new buckets are rolled up.
+	Interval time.Duration `yaml:"interval"`
+	// Delay is how long the samples of a bucket are waited for before the
+	// bucket is rolled up. The buckets of later samples, such as the ones of
+	// lagging writers and the replays of the WAL and the dead letter, are
+	// rolled up again.
+	Delay time.Duration `yaml:"delay"`
+	// Retention5m and Retention1h are the retention periods of the rollups,
+	// zero means forever.
+	Retention5m time.Duration `yaml:"retention_5m"`
+	Retention1h time.Duration `yaml:"retention_1h"`
+}
+
+// WALConfig configures the write-ahead log in front of the ingestion, which is
+// disabled if Dir is empty. The writes are acknowledged once persisted in Dir.
+type WALConfig struct {
+	Dir string `yaml:"dir"`
+	// SegmentSize is the max size of a segment file in bytes.
+	SegmentSize int64 `yaml:"segment_size"`
+	// MaxSize is the max size of the writes not yet stored in bytes, the
+	// writes beyond it are rejected with 429 and retried by the clients.
+	MaxSize int64 `yaml:"max_size"`
+}
+
+// RetryConfig configures the retries of the batches failed by the transient
+// errors of TiDB, such as write conflicts and broken connections.
+type RetryConfig struct {
+	// Budget is the max number of retries of a batch.
+	Budget int `yaml:"budget"`
+	// MinBackoff is the wait before the first retry, which doubles with each
+	// retry up to MaxBackoff.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// DeadLetterDir keeps the batches exhausting the retries or failed by
+	// fatal errors in the directory if not empty, they're replayed by the flag
+	// --replay-dead-letter. It's "dead-letter" in the directory of the WAL by
+	// default if the WAL is enabled.
+	DeadLetterDir string `yaml:"dead_letter_dir"`
+}
+
 type LogConfig struct {
 	LogLevel string `yaml:"log_level"`
 	LogFile  string `yaml:"log_file"`
@@ -37,16 +175,63 @@ type FlashMetricsConfig struct {
 	TiDBConfig    TiDBConfig      `yaml:"tidb"`
 	WebConfig     WebConfig       `yaml:"web"`
 	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+	QueryConfig   QueryConfig     `yaml:"query"`
+	Retention     RetentionConfig `yaml:"retention"`
+	Rollup        RollupConfig    `yaml:"rollup"`
+	WAL           WALConfig       `yaml:"wal"`
+	Retry         RetryConfig     `yaml:"retry"`
 	LogConfig     LogConfig       `yaml:"logs"`
 }
 
 var DefaultFlashMetricsConfig = FlashMetricsConfig{
 	TiDBConfig: TiDBConfig{
-		Address: "127.0.0.1:4000",
+		Address:           "127.0.0.1:4000",
+		User:              "root",
+		Database:          "test",
+		WriteMaxOpenConns: 10,
+		ReadMaxOpenConns:  10,
+		ConnMaxLifetime:   3 * time.Minute,
 	},
 	WebConfig: WebConfig{
 		Address: "127.0.0.1:9977",
 	},
+	QueryConfig: QueryConfig{
+		Engine:     "flash",
+		Pushdown:   true,
+		MaxSeries:  100000,
+		MaxMetrics: 1000,
+		MaxSamples: 50000000,
+		MaxSteps:   11000,
+		Timeout:    2 * time.Minute,
+
+		MaxConcurrency: 8,
+		MaxQueueLength: 100,
+
+		ResultsCache: ResultsCacheConfig{
+			Enabled:      true,
+			MaxEntries:   4096,
+			MaxFreshness: 10 * time.Minute,
+			TTL:          24 * time.Hour,
+		},
+	},
+	Retention: RetentionConfig{
+		Interval:        time.Hour,
+		PartitionsAhead: 3,
+		DeleteBatchSize: 10000,
+	},
+	Rollup: RollupConfig{
+		Interval: time.Minute,
+		Delay:    5 * time.Minute,
+	},
+	WAL: WALConfig{
+		SegmentSize: 64 << 20,
+		MaxSize:     1 << 30,
+	},
+	Retry: RetryConfig{
+		Budget:     5,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	},
 	LogConfig: LogConfig{
 		LogLevel: "info",
 	},
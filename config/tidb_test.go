@@ -0,0 +1,43 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDSN(t *testing.T) {
+	cfg := DefaultFlashMetricsConfig.TiDBConfig
+	dsn, err := cfg.DSN()
+	require.NoError(t, err)
+	require.Equal(t, "root@tcp(127.0.0.1:4000)/test", dsn)
+
+	dir, err := ioutil.TempDir("", "flash-metrics-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("p@ss:word\n"), 0600))
+
+	cfg.User = "flash"
+	cfg.Password = "ignored"
+	cfg.PasswordFile = passwordFile
+	cfg.Database = "metrics"
+	cfg.TLS = TiDBTLSConfig{Enabled: true, InsecureSkipVerify: true}
+	dsn, err = cfg.DSN()
+	require.NoError(t, err)
+	require.Equal(t, "flash:p@ss:word@tcp(127.0.0.1:4000)/metrics?tls=flash-metrics", dsn)
+
+	cfg.TLS.CAFile = filepath.Join(dir, "ca.pem")
+	_, err = cfg.DSN()
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(cfg.TLS.CAFile, []byte("not a certificate"), 0600))
+	_, err = cfg.DSN()
+	require.Error(t, err)
+
+	cfg.PasswordFile = filepath.Join(dir, "missing")
+	_, err = cfg.DSN()
+	require.Error(t, err)
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
-	"fmt"
 	stdlog "log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/retention"
+	"github.com/showhand-lab/flash-metrics/rollup"
 	"github.com/showhand-lab/flash-metrics/scrape"
 	"github.com/showhand-lab/flash-metrics/service"
 	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/batch"
+	"github.com/showhand-lab/flash-metrics/store/wal"
 	"github.com/showhand-lab/flash-metrics/table"
 	"github.com/showhand-lab/flash-metrics/utils/printer"
 
@@ -27,15 +32,29 @@ const (
 	nmConfigFilePath = "config.file"
 	nmAddr           = "address"
 	nmTiDBAddr       = "tidb.address"
+	nmTiDBUser       = "tidb.user"
+	nmTiDBDatabase   = "tidb.database"
 	nmLogLevel       = "log.level"
 	nmLogFile        = "log.file"
 	nmCleanup        = "cleanup"
+	nmMigrateOnly    = "migrate-only"
+	nmMigrateDryRun  = "migrate-dry-run"
+	nmReplayDead     = "replay-dead-letter"
+
+	// defaultDeadLetterDir is the dead letter in the directory of the
+	// write-ahead log if not configured.
+	defaultDeadLetterDir = "dead-letter"
 )
 
 var (
 	cfgFilePath = flag.String(nmConfigFilePath, "", "YAML config file path for flashmetrics.")
 	cleanup     = flag.Bool(nmCleanup, false, "Whether to cleanup data during shutting down, set for debug")
+	migrateOnly = flag.Bool(nmMigrateOnly, false, "Migrate the schema and exit")
+	migrateDry  = flag.Bool(nmMigrateDryRun, false, "Print the SQL of the pending schema migrations and exit")
+	replayDead  = flag.Bool(nmReplayDead, false, "Store the batches of the dead letter again and exit")
 	tidbAddr    = flag.String(nmTiDBAddr, config.DefaultFlashMetricsConfig.TiDBConfig.Address, "The address of TiDB")
+	tidbUser    = flag.String(nmTiDBUser, config.DefaultFlashMetricsConfig.TiDBConfig.User, "The user of TiDB")
+	tidbDB      = flag.String(nmTiDBDatabase, config.DefaultFlashMetricsConfig.TiDBConfig.Database, "The database of TiDB")
 	listenAddr  = flag.String(nmAddr, config.DefaultFlashMetricsConfig.WebConfig.Address, "TCP address to listen for http connections")
 	logLevel    = flag.String(nmLogLevel, config.DefaultFlashMetricsConfig.LogConfig.LogLevel, "Log level")
 	logFile     = flag.String(nmLogFile, config.DefaultFlashMetricsConfig.LogConfig.LogFile, "Log file")
@@ -48,6 +67,10 @@ func overrideConfig(config *config.FlashMetricsConfig) {
 			config.WebConfig.Address = *listenAddr
 		case nmTiDBAddr:
 			config.TiDBConfig.Address = *tidbAddr
+		case nmTiDBUser:
+			config.TiDBConfig.User = *tidbUser
+		case nmTiDBDatabase:
+			config.TiDBConfig.Database = *tidbDB
 		case nmLogFile:
 			config.LogConfig.LogFile = *logFile
 		case nmLogLevel:
@@ -70,38 +93,63 @@ func initLogger(cfg *config.FlashMetricsConfig) error {
 	return nil
 }
 
-func initDatabase(cfg *config.FlashMetricsConfig) *sql.DB {
-	now := time.Now()
-	log.Info("setting up database")
-	defer func() {
-		log.Info("init database done", zap.Duration("in", time.Since(now)))
-	}()
-
-	db, err := sql.Open("mysql", fmt.Sprintf("root@(%s)/test", cfg.TiDBConfig.Address))
+func openDatabase(cfg *config.FlashMetricsConfig, maxOpenConns int) *sql.DB {
+	dsn, err := cfg.TiDBConfig.DSN()
+	if err != nil {
+		log.Fatal("failed to build dsn", zap.Error(err))
+	}
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		log.Fatal("failed to open db", zap.Error(err))
 	}
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+	maxIdleConns := cfg.TiDBConfig.MaxIdleConns
+	if maxIdleConns <= 0 || maxIdleConns > maxOpenConns {
+		maxIdleConns = maxOpenConns
+	}
+	db.SetConnMaxLifetime(cfg.TiDBConfig.ConnMaxLifetime)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	return db
+}
 
-	for _, stmt := range []string{table.CreateMeta, table.CreateIndex, table.CreateUpdate, table.CreateData} {
-		if _, err = db.Exec(stmt); err != nil {
-			log.Fatal("failed to create table", zap.String("statement", stmt), zap.Error(err))
-		}
+// migrateDatabase applies the schema migrations and sets the TiFlash replicas,
+// or prints the SQL of the migrations if dry-run.
+func migrateDatabase(cfg *config.FlashMetricsConfig, db *sql.DB) {
+	tables := table.NewTables(cfg.TiDBConfig.TablePrefix)
+	migrations := table.Migrations(table.SchemaOptions{
+		TablePrefix:    cfg.TiDBConfig.TablePrefix,
+		OverflowLabels: cfg.TiDBConfig.OverflowLabels,
+	})
+	if err := table.Migrate(context.Background(), db, tables, migrations, *migrateDry, os.Stdout); err != nil {
+		log.Fatal("failed to migrate schema", zap.Error(err))
+	}
+	if *migrateDry {
+		return
 	}
-	log.Info("create tables successfully")
+	log.Info("migrate schema successfully", zap.Int("version", table.LatestVersion(migrations)))
 
 	for _, stmt := range []string{table.AlterTiflashIndex, table.AlterTiflashUpdate, table.AlterTiflashData} {
-		if _, err = db.Exec(stmt); err != nil {
+		stmt = tables.Rename(stmt)
+		if _, err := db.Exec(stmt); err != nil {
 			log.Warn("failed to set replica", zap.String("statement", stmt), zap.Error(err))
 		}
 	}
+}
 
-	return db
+// initDatabase returns the connection pools of ingestion and queries.
+func initDatabase(cfg *config.FlashMetricsConfig) (*sql.DB, *sql.DB) {
+	now := time.Now()
+	log.Info("setting up database")
+	defer func() {
+		log.Info("init database done", zap.Duration("in", time.Since(now)))
+	}()
+
+	db := openDatabase(cfg, cfg.TiDBConfig.WriteMaxOpenConns)
+	migrateDatabase(cfg, db)
+	return db, openDatabase(cfg, cfg.TiDBConfig.ReadMaxOpenConns)
 }
 
-func closeDatabase(db *sql.DB) {
+func closeDatabase(cfg *config.FlashMetricsConfig, db, readDB *sql.DB) {
 	now := time.Now()
 	log.Info("closing database")
 	defer func() {
@@ -109,7 +157,9 @@ func closeDatabase(db *sql.DB) {
 	}()
 
 	if *cleanup {
-		for _, stmt := range []string{table.DropData, table.DropUpdate, table.DropIndex, table.DropMeta} {
+		tables := table.NewTables(cfg.TiDBConfig.TablePrefix)
+		for _, stmt := range []string{table.DropData, table.DropRollup5m, table.DropRollup1h, table.DropRollupState, table.DropRollupDirty, table.DropGeneration, table.DropUpdate, table.DropIndex, table.DropMeta, table.DropMetadata, table.DropSchemaVersion} {
+			stmt = tables.Rename(stmt)
 			if _, err := db.Exec(stmt); err != nil {
 				log.Warn("failed to drop table", zap.String("statement", stmt), zap.Error(err))
 			}
@@ -117,8 +167,10 @@ func closeDatabase(db *sql.DB) {
 		log.Info("clean up database successfully")
 	}
 
-	if err := db.Close(); err != nil {
-		log.Warn("failed to close database", zap.Error(err))
+	for _, db := range []*sql.DB{readDB, db} {
+		if err := db.Close(); err != nil {
+			log.Warn("failed to close database", zap.Error(err))
+		}
 	}
 }
 
@@ -151,15 +203,67 @@ func main() {
 
 	printer.PrintFlashMetricsInfo()
 
+	if err = table.CheckPrefix(flashMetricsConfig.TiDBConfig.TablePrefix); err != nil {
+		log.Fatal("invalid config", zap.Error(err))
+	}
+
 	if len(flashMetricsConfig.WebConfig.Address) == 0 {
 		log.Fatal("empty listen address", zap.String("listen-address", flashMetricsConfig.WebConfig.Address))
 	}
 
-	db := initDatabase(flashMetricsConfig)
-	defer closeDatabase(db)
+	if *migrateOnly || *migrateDry {
+		db := openDatabase(flashMetricsConfig, 1)
+		migrateDatabase(flashMetricsConfig, db)
+		if err = db.Close(); err != nil {
+			log.Warn("failed to close database", zap.Error(err))
+		}
+		return
+	}
 
-	storage := store.NewDefaultMetricStorage(db)
+	db, readDB := initDatabase(flashMetricsConfig)
+	defer closeDatabase(flashMetricsConfig, db, readDB)
+
+	storage := store.NewDefaultMetricStorageWithTables(db, table.NewTables(flashMetricsConfig.TiDBConfig.TablePrefix))
+	storage.ReadDB = readDB
+	if flashMetricsConfig.TiDBConfig.OverflowLabels {
+		storage.EnableOverflowLabels()
+	}
 	defer storage.Close()
+	retryCfg := flashMetricsConfig.Retry
+	storage.SetRetryPolicy(batch.RetryPolicy{
+		Budget:     retryCfg.Budget,
+		MinBackoff: retryCfg.MinBackoff,
+		MaxBackoff: retryCfg.MaxBackoff,
+	})
+	// the write-ahead log always has a dead letter, so that it's never blocked
+	// by a batch failing for good
+	if retryCfg.DeadLetterDir == "" && flashMetricsConfig.WAL.Dir != "" {
+		retryCfg.DeadLetterDir = filepath.Join(flashMetricsConfig.WAL.Dir, defaultDeadLetterDir)
+	}
+	if retryCfg.DeadLetterDir != "" {
+		if err = storage.EnableDeadLetter(retryCfg.DeadLetterDir); err != nil {
+			log.Fatal("failed to open dead letter", zap.String("dir", retryCfg.DeadLetterDir), zap.Error(err))
+		}
+	}
+	if *replayDead {
+		replayed, failed, err := storage.ReplayDeadLetter(context.Background())
+		if err != nil {
+			log.Error("failed to replay dead letter", zap.Int("replayed", replayed), zap.Int("failed", failed), zap.Error(err))
+			return
+		}
+		log.Info("replay dead letter successfully", zap.Int("replayed", replayed), zap.Int("failed", failed))
+		return
+	}
+	if walCfg := flashMetricsConfig.WAL; walCfg.Dir != "" {
+		err = storage.EnableWAL(walCfg.Dir, wal.Options{SegmentSize: walCfg.SegmentSize, MaxSize: walCfg.MaxSize})
+		if err != nil {
+			log.Fatal("failed to open write-ahead log", zap.String("dir", walCfg.Dir), zap.Error(err))
+		}
+	}
+
+	// enable the rollups before serving queries
+	rollup.Init(flashMetricsConfig, storage)
+	defer rollup.Stop()
 
 	service.Init(flashMetricsConfig, storage)
 	defer service.Stop()
@@ -167,6 +271,9 @@ func main() {
 	scrape.Init(flashMetricsConfig, storage)
 	defer scrape.Stop()
 
+	retention.Init(flashMetricsConfig, storage)
+	defer retention.Stop()
+
 	sig := waitForSigterm()
 	log.Info("received signal", zap.String("sig", sig.String()))
 }
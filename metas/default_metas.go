@@ -20,13 +20,32 @@ var (
 type DefaultMetaStorage struct {
 	sync.Mutex
 
-	db    *sql.DB
-	cache *simplelru.LRU
+	db     *sql.DB
+	tables table.Tables
+	cache  *simplelru.LRU
+
+	maxLabelCount int
 }
 
 func NewDefaultMetaStorage(db *sql.DB) *DefaultMetaStorage {
+	return NewDefaultMetaStorageWithTables(db, table.DefaultTables)
+}
+
+// NewDefaultMetaStorageWithTables returns a DefaultMetaStorage on the tables
+// with a prefix.
+func NewDefaultMetaStorageWithTables(db *sql.DB, tables table.Tables) *DefaultMetaStorage {
 	cache, _ := simplelru.NewLRU(1024, nil)
-	return &DefaultMetaStorage{db: db, cache: cache}
+	return &DefaultMetaStorage{db: db, tables: tables, cache: cache, maxLabelCount: table.MaxLabelCount}
+}
+
+// EnableOverflowLabels allows metrics to have up to
+// table.MaxOverflowLabelCount labels, flash_metrics_index must be created by
+// table.CreateIndexOverflow.
+func (d *DefaultMetaStorage) EnableOverflowLabels() {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	d.maxLabelCount = table.MaxOverflowLabelCount
 }
 
 var _ MetaStorage = &DefaultMetaStorage{}
@@ -69,8 +88,8 @@ func (d *DefaultMetaStorage) StoreMeta(ctx context.Context, metricName string, l
 	}
 
 	newLabelLen := len(*labels)
-	if newLabelLen+len(r.Labels) > table.MaxLabelCount {
-		return nil, fmt.Errorf("failed to add new labels for %s due to exceed label limit: %d", metricName, table.MaxLabelCount)
+	if newLabelLen+len(r.Labels) > d.maxLabelCount {
+		return nil, fmt.Errorf("failed to add new labels for %s due to exceed label limit: %d", metricName, d.maxLabelCount)
 	}
 
 	if newLabelLen > 0 {
@@ -95,7 +114,9 @@ func (d *DefaultMetaStorage) StoreMeta(ctx context.Context, metricName string, l
 		}
 
 		var sb strings.Builder
-		sb.WriteString("INSERT INTO flash_metrics_meta VALUES (?, ?, ?)")
+		sb.WriteString("INSERT INTO ")
+		sb.WriteString(d.tables.Meta)
+		sb.WriteString(" VALUES (?, ?, ?)")
 		for i := 0; i < newLabelLen-1; i++ {
 			sb.WriteString(", (?, ?, ?)")
 		}
@@ -116,7 +137,7 @@ func (d *DefaultMetaStorage) queryMetaWithoutLock(ctx context.Context, metricNam
 		return r, nil
 	}
 
-	rows, err := d.db.QueryContext(ctx, "SELECT label_name, label_id FROM flash_metrics_meta WHERE metric_name = ?", metricName)
+	rows, err := d.db.QueryContext(ctx, "SELECT label_name, label_id FROM "+d.tables.Meta+" WHERE metric_name = ?", metricName)
 	if err != nil {
 		return nil, err
 	}
@@ -3,9 +3,11 @@ package metas_test
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"testing"
 
 	"github.com/showhand-lab/flash-metrics/metas"
+	"github.com/showhand-lab/flash-metrics/table"
 	"github.com/showhand-lab/flash-metrics/utils"
 
 	"github.com/stretchr/testify/suite"
@@ -189,3 +191,26 @@ func (s *testDefaultMetasSuite) TestLabelLimit() {
 		"label-14": 14,
 	})
 }
+
+func (s *testDefaultMetasSuite) TestOverflowLabelLimit() {
+	metaStorage := metas.NewDefaultMetaStorage(s.db)
+	metaStorage.EnableOverflowLabels()
+
+	var labelNames []string
+	for i := 0; i < 20; i++ {
+		labelNames = append(labelNames, fmt.Sprintf("label-%d", i))
+	}
+	m, err := metaStorage.StoreMeta(context.Background(), "metric_overflow", labelNames)
+	s.NoError(err)
+	s.Len(m.Labels, 20)
+	s.True(m.HasOverflow())
+	s.Equal(metas.LabelID(19), m.Labels["label-19"])
+
+	labelNames = labelNames[:0]
+	for i := 0; i <= table.MaxOverflowLabelCount-20; i++ {
+		labelNames = append(labelNames, fmt.Sprintf("more-%d", i))
+	}
+	_, err = metaStorage.StoreMeta(context.Background(), "metric_overflow", labelNames)
+	s.Error(err)
+	s.Contains(err.Error(), "exceed label limit")
+}
@@ -1,5 +1,14 @@
 package metas
 
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/showhand-lab/flash-metrics/table"
+)
+
 type LabelName string
 type LabelID int32
 
@@ -7,3 +16,39 @@ type Meta struct {
 	MetricName string
 	Labels     map[LabelName]LabelID
 }
+
+// HasOverflow returns whether the metric has labels beyond the label columns,
+// whose series have label_overflow and overflow_key in flash_metrics_index.
+func (m *Meta) HasOverflow() bool {
+	return len(m.Labels) > table.MaxLabelCount
+}
+
+// LabelColumn returns the SQL expression of the value of a label in
+// flash_metrics_index, which is empty if the series doesn't have the label.
+// The labels beyond the label columns are in the JSON object label_overflow,
+// keyed by their IDs.
+func LabelColumn(id LabelID) string {
+	if id < table.MaxLabelCount {
+		return "label" + strconv.Itoa(int(id))
+	}
+	return `IFNULL(JSON_UNQUOTE(JSON_EXTRACT(label_overflow, '$."` + strconv.Itoa(int(id)) + `"')), '')`
+}
+
+// OverflowLabels encodes the non-empty values of the labels beyond the label
+// columns in values into label_overflow and overflow_key of
+// flash_metrics_index. Both are empty if there is no such label.
+func OverflowLabels(values map[LabelID]string) (value string, key string) {
+	// the keys of maps are sorted by encoding/json
+	object := make(map[string]string, len(values))
+	for id, v := range values {
+		if id >= table.MaxLabelCount && v != "" {
+			object[strconv.Itoa(int(id))] = v
+		}
+	}
+	if len(object) == 0 {
+		return "", ""
+	}
+	b, _ := json.Marshal(object)
+	sum := sha1.Sum(b)
+	return string(b), hex.EncodeToString(sum[:])
+}
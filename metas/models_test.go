@@ -0,0 +1,33 @@
+package metas_test
+
+import (
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/metas"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelColumn(t *testing.T) {
+	require.Equal(t, "label0", metas.LabelColumn(0))
+	require.Equal(t, "label14", metas.LabelColumn(14))
+	require.Equal(t, `IFNULL(JSON_UNQUOTE(JSON_EXTRACT(label_overflow, '$."15"')), '')`, metas.LabelColumn(15))
+}
+
+func TestOverflowLabels(t *testing.T) {
+	value, key := metas.OverflowLabels(map[metas.LabelID]string{3: "a", 15: "", 16: "b"})
+	require.Equal(t, `{"16":"b"}`, value)
+	require.Len(t, key, 40)
+
+	// the same labels are always encoded the same
+	value2, key2 := metas.OverflowLabels(map[metas.LabelID]string{20: `"c"`, 16: "b"})
+	value3, key3 := metas.OverflowLabels(map[metas.LabelID]string{16: "b", 20: `"c"`})
+	require.Equal(t, `{"16":"b","20":"\"c\""}`, value2)
+	require.Equal(t, value2, value3)
+	require.Equal(t, key2, key3)
+	require.NotEqual(t, key, key2)
+
+	value, key = metas.OverflowLabels(map[metas.LabelID]string{0: "a", 14: "b"})
+	require.Empty(t, value)
+	require.Empty(t, key)
+}
@@ -1,31 +1,492 @@
 package parser
 
 import (
-	"time"
+	"container/heap"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
-func buildAggregationAgg(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+// groupedAggregation is the state of one output group of an aggregation.
+type groupedAggregation struct {
+	labels      labels.Labels
+	value       float64
+	mean        float64
+	groupCount  int
+	heap        vectorByValueHeap
+	reverseHeap vectorByReverseValueHeap
+	values      []float64
 }
 
-func buildAggregationSum(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+func (ev *evaluator) evalAggregateExpr(agg *promql.AggregateExpr) (promql.Value, error) {
+	op := agg.Op.String()
+	switch op {
+	case "sum", "avg", "count", "min", "max", "stddev", "stdvar", "topk", "bottomk", "count_values", "quantile":
+	default:
+		return nil, errors.Errorf("unknown aggregation operator %v", op)
+	}
+
+	var param promql.Expr
+	if agg.Param != nil && op != "count_values" {
+		param = agg.Param
+	}
+	var valueLabel string
+	if op == "count_values" {
+		valueLabel = agg.Param.(*promql.StringLiteral).Val
+		if !model.LabelName(valueLabel).IsValid() {
+			return nil, errors.Errorf("invalid label name %q", valueLabel)
+		}
+	}
+
+	grouping := append([]string(nil), agg.Grouping...)
+	if agg.Without {
+		grouping = append(grouping, labels.MetricName)
+	} else if op == "count_values" {
+		grouping = append(grouping, valueLabel)
+	}
+	sort.Strings(grouping)
+
+	return ev.rangeEval(func(args []promql.Value, _ int64) (promql.Vector, error) {
+		var p float64
+		if param != nil {
+			p = scalarArg(args[1])
+		}
+		return aggregation(op, grouping, agg.Without, valueLabel, p, args[0].(promql.Vector))
+	}, agg.Expr, param)
 }
 
-func buildAggregationCount(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+// aggregation evaluates an aggregation operator over a vector at a single
+// step, following the semantics of Prometheus.
+func aggregation(op string, grouping []string, without bool, valueLabel string, param float64, vec promql.Vector) (promql.Vector, error) {
+	var k int
+	if op == "topk" || op == "bottomk" {
+		if param >= math.MaxInt64 || param <= math.MinInt64 || math.IsNaN(param) {
+			return nil, errors.Errorf("scalar value %v overflows int64", param)
+		}
+		k = int(param)
+		if k < 1 {
+			return promql.Vector{}, nil
+		}
+	}
+
+	var orderedResult []*groupedAggregation
+	result := map[uint64]*groupedAggregation{}
+	for _, s := range vec {
+		metric := s.Metric
+		if op == "count_values" {
+			metric = labels.NewBuilder(metric).Set(valueLabel, strconv.FormatFloat(s.V, 'f', -1, 64)).Labels()
+		}
+
+		var groupingKey uint64
+		if without {
+			groupingKey = metric.HashWithoutLabels(grouping...)
+		} else {
+			groupingKey = metric.HashForLabels(grouping...)
+		}
+
+		group, ok := result[groupingKey]
+		if !ok {
+			var m labels.Labels
+			if without {
+				m = labels.NewBuilder(metric).Del(grouping...).Labels()
+			} else {
+				m = make(labels.Labels, 0, len(grouping))
+				for _, l := range metric {
+					for _, n := range grouping {
+						if l.Name == n {
+							m = append(m, l)
+							break
+						}
+					}
+				}
+			}
+			group = &groupedAggregation{
+				labels:     m,
+				value:      s.V,
+				mean:       s.V,
+				groupCount: 1,
+			}
+			switch op {
+			case "stddev", "stdvar":
+				group.value = 0
+			case "topk":
+				group.heap = make(vectorByValueHeap, 0, k)
+				heap.Push(&group.heap, &promql.Sample{Point: promql.Point{V: s.V}, Metric: s.Metric})
+			case "bottomk":
+				group.reverseHeap = make(vectorByReverseValueHeap, 0, k)
+				heap.Push(&group.reverseHeap, &promql.Sample{Point: promql.Point{V: s.V}, Metric: s.Metric})
+			case "quantile":
+				group.values = []float64{s.V}
+			}
+			result[groupingKey] = group
+			orderedResult = append(orderedResult, group)
+			continue
+		}
+
+		switch op {
+		case "sum":
+			group.value += s.V
+		case "avg":
+			group.groupCount++
+			group.mean += (s.V - group.mean) / float64(group.groupCount)
+		case "max":
+			if group.value < s.V || math.IsNaN(group.value) {
+				group.value = s.V
+			}
+		case "min":
+			if group.value > s.V || math.IsNaN(group.value) {
+				group.value = s.V
+			}
+		case "count", "count_values":
+			group.groupCount++
+		case "stddev", "stdvar":
+			group.groupCount++
+			delta := s.V - group.mean
+			group.mean += delta / float64(group.groupCount)
+			group.value += delta * (s.V - group.mean)
+		case "topk":
+			if len(group.heap) < k || group.heap[0].V < s.V || math.IsNaN(group.heap[0].V) {
+				if len(group.heap) == k {
+					heap.Pop(&group.heap)
+				}
+				heap.Push(&group.heap, &promql.Sample{Point: promql.Point{V: s.V}, Metric: s.Metric})
+			}
+		case "bottomk":
+			if len(group.reverseHeap) < k || group.reverseHeap[0].V > s.V || math.IsNaN(group.reverseHeap[0].V) {
+				if len(group.reverseHeap) == k {
+					heap.Pop(&group.reverseHeap)
+				}
+				heap.Push(&group.reverseHeap, &promql.Sample{Point: promql.Point{V: s.V}, Metric: s.Metric})
+			}
+		case "quantile":
+			group.values = append(group.values, s.V)
+		}
+	}
+
+	var out promql.Vector
+	for _, group := range orderedResult {
+		switch op {
+		case "avg":
+			group.value = group.mean
+		case "count", "count_values":
+			group.value = float64(group.groupCount)
+		case "stddev":
+			group.value = math.Sqrt(group.value / float64(group.groupCount))
+		case "stdvar":
+			group.value = group.value / float64(group.groupCount)
+		case "topk":
+			// the heap keeps the lowest value on top, so reverse it
+			sort.Sort(sort.Reverse(group.heap))
+			for _, s := range group.heap {
+				out = append(out, promql.Sample{Metric: s.Metric, Point: promql.Point{V: s.V}})
+			}
+			continue
+		case "bottomk":
+			sort.Sort(sort.Reverse(group.reverseHeap))
+			for _, s := range group.reverseHeap {
+				out = append(out, promql.Sample{Metric: s.Metric, Point: promql.Point{V: s.V}})
+			}
+			continue
+		case "quantile":
+			group.value = quantile(param, group.values)
+		}
+		out = append(out, promql.Sample{Metric: group.labels, Point: promql.Point{V: group.value}})
+	}
+	return out, nil
+}
+
+type vectorByValueHeap promql.Vector
+
+func (s vectorByValueHeap) Len() int { return len(s) }
+
+func (s vectorByValueHeap) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V < s[j].V
+}
+
+func (s vectorByValueHeap) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s *vectorByValueHeap) Push(x interface{}) {
+	*s = append(*s, *(x.(*promql.Sample)))
+}
+
+func (s *vectorByValueHeap) Pop() interface{} {
+	old := *s
+	n := len(old)
+	el := old[n-1]
+	*s = old[0 : n-1]
+	return el
+}
+
+type vectorByReverseValueHeap promql.Vector
+
+func (s vectorByReverseValueHeap) Len() int { return len(s) }
+
+func (s vectorByReverseValueHeap) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V > s[j].V
+}
+
+func (s vectorByReverseValueHeap) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s *vectorByReverseValueHeap) Push(x interface{}) {
+	*s = append(*s, *(x.(*promql.Sample)))
+}
+
+func (s *vectorByReverseValueHeap) Pop() interface{} {
+	old := *s
+	n := len(old)
+	el := old[n-1]
+	*s = old[0 : n-1]
+	return el
+}
+
+func buildAggregationAvg(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "AVG(x.v)")
+}
+
+func buildAggregationSum(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "SUM(x.v)")
+}
+
+func buildAggregationCount(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "COUNT(*)")
+}
+
+func buildAggregationMax(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "MAX(x.v)")
+}
+
+func buildAggregationMin(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "MIN(x.v)")
+}
+
+func buildAggregationStddev(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "STDDEV_POP(x.v)")
+}
+
+func buildAggregationStdvar(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildGroupedAggregation(agg, ev, "VAR_POP(x.v)")
+}
+
+func buildAggregationTopK(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildAggregationK(agg, ev, "DESC")
+}
+
+func buildAggregationBottomK(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildAggregationK(agg, ev, "ASC")
+}
+
+// buildGroupedAggregation aggregates the input with the SQL aggregate function
+// fn at every step.
+//
+//	SELECT x.l1 AS l0, x.t AS t, SUM(x.v) AS v
+//	FROM (...) x
+//	WHERE x.v IS NOT NULL
+//	GROUP BY x.l1, x.t
+func buildGroupedAggregation(agg *promql.AggregateExpr, ev *evaluator, fn string) (*sqlPlan, error) {
+	input, err := buildInputPlan(agg.Expr, ev)
+	if err != nil || input == nil {
+		return nil, err
+	}
+
+	columns := groupingColumns(input.labels, agg.Grouping, agg.Without)
+	plan := &sqlPlan{args: input.args}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i, column := range columns {
+		plan.labels = append(plan.labels, input.labels[column])
+		sb.WriteString("x.l" + strconv.Itoa(column) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("x.t AS t, " + fn + " AS v\nFROM (")
+	sb.WriteString(input.sql)
+	sb.WriteString("\n) x\nWHERE x.v IS NOT NULL\nGROUP BY ")
+	sb.WriteString(columnList("x", columns, "x.t"))
+	plan.sql = sb.String()
+	return plan, nil
+}
+
+// buildAggregationK keeps the first k series of every group in order.
+//
+//	SELECT y.l0 AS l0, y.l1 AS l1, y.t AS t, y.v AS v
+//	FROM (
+//	  SELECT x.*, ROW_NUMBER() OVER (PARTITION BY x.l1, x.t ORDER BY x.v DESC) AS rn
+//	  FROM (...) x
+//	  WHERE x.v IS NOT NULL
+//	) y
+//	WHERE y.rn <= k
+func buildAggregationK(agg *promql.AggregateExpr, ev *evaluator, order string) (*sqlPlan, error) {
+	k, ok := numberLiteral(agg.Param)
+	if !ok || k >= math.MaxInt64 || k <= math.MinInt64 || math.IsNaN(k) {
+		return nil, nil
+	}
+	input, err := buildInputPlan(agg.Expr, ev)
+	if err != nil || input == nil {
+		return nil, err
+	}
+
+	columns := groupingColumns(input.labels, agg.Grouping, agg.Without)
+	plan := &sqlPlan{labels: input.labels}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i := range input.labels {
+		sb.WriteString("y.l" + strconv.Itoa(i) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("y.t AS t, y.v AS v\nFROM (\n  SELECT x.*, ROW_NUMBER() OVER (PARTITION BY ")
+	sb.WriteString(columnList("x", columns, "x.t"))
+	sb.WriteString(" ORDER BY x.v " + order + ") AS rn\n  FROM (")
+	sb.WriteString(input.sql)
+	sb.WriteString("\n  ) x\n  WHERE x.v IS NOT NULL\n) y\nWHERE y.rn <= ?")
+	plan.args = append(append(plan.args, input.args...), int64(k))
+	plan.sql = sb.String()
+	return plan, nil
+}
+
+// buildAggregationQuantile interpolates between the two values around the
+// rank of the quantile in every group, the same as quantile.
+//
+//	SELECT y.l1 AS l0, y.t AS t,
+//	  SUM(CASE WHEN y.rn = FLOOR(y.qrank) THEN y.v * (1 - (y.qrank - FLOOR(y.qrank)))
+//	    WHEN y.rn = FLOOR(y.qrank) + 1 THEN y.v * (y.qrank - FLOOR(y.qrank)) ELSE 0 END) AS v
+//	FROM (
+//	  SELECT x.*, ROW_NUMBER() OVER (PARTITION BY x.l1, x.t ORDER BY x.v) - 1 AS rn,
+//	    q * (COUNT(*) OVER (PARTITION BY x.l1, x.t) - 1) AS qrank
+//	  FROM (...) x
+//	  WHERE x.v IS NOT NULL
+//	) y
+//	GROUP BY y.l1, y.t
+func buildAggregationQuantile(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	q, ok := numberLiteral(agg.Param)
+	// out of range quantiles are left to quantile
+	if !ok || !(q >= 0 && q <= 1) {
+		return nil, nil
+	}
+	input, err := buildInputPlan(agg.Expr, ev)
+	if err != nil || input == nil {
+		return nil, err
+	}
+
+	columns := groupingColumns(input.labels, agg.Grouping, agg.Without)
+	partition := columnList("x", columns, "x.t")
+	plan = &sqlPlan{}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i, column := range columns {
+		plan.labels = append(plan.labels, input.labels[column])
+		sb.WriteString("y.l" + strconv.Itoa(column) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString(`y.t AS t,
+  SUM(CASE WHEN y.rn = FLOOR(y.qrank) THEN y.v * (1 - (y.qrank - FLOOR(y.qrank)))
+    WHEN y.rn = FLOOR(y.qrank) + 1 THEN y.v * (y.qrank - FLOOR(y.qrank)) ELSE 0 END) AS v
+FROM (
+  SELECT x.*, ROW_NUMBER() OVER (PARTITION BY ` + partition + ` ORDER BY x.v) - 1 AS rn,
+    ? * (COUNT(*) OVER (PARTITION BY ` + partition + `) - 1) AS qrank
+  FROM (`)
+	plan.args = append(append(plan.args, q), input.args...)
+	sb.WriteString(input.sql)
+	sb.WriteString("\n  ) x\n  WHERE x.v IS NOT NULL\n) y\nGROUP BY ")
+	sb.WriteString(columnList("y", columns, "y.t"))
+	plan.sql = sb.String()
+	return plan, nil
+}
+
+// buildAggregationCountValues counts the series of every value in every
+// group. The values are formatted into the value label by execSQLPlan.
+//
+//	SELECT x.l1 AS l0, x.t AS t, x.v AS value, COUNT(*) AS v
+//	FROM (...) x
+//	WHERE x.v IS NOT NULL
+//	GROUP BY x.l1, x.t, x.v
+func buildAggregationCountValues(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	param, ok := agg.Param.(*promql.StringLiteral)
+	if !ok || !model.LabelName(param.Val).IsValid() {
+		return nil, nil
+	}
+	valueLabel := param.Val
+	if agg.Without {
+		for _, name := range agg.Grouping {
+			if name == valueLabel {
+				// the value label is dropped, leave it to aggregation
+				return nil, nil
+			}
+		}
+	}
+
+	input, err := buildInputPlan(agg.Expr, ev)
+	if err != nil || input == nil {
+		return nil, err
+	}
+
+	// the value label takes the place of the label of the same name
+	var columns []int
+	for _, column := range groupingColumns(input.labels, agg.Grouping, agg.Without) {
+		if input.labels[column] != valueLabel {
+			columns = append(columns, column)
+		}
+	}
+	plan = &sqlPlan{args: input.args, valueLabel: valueLabel}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i, column := range columns {
+		plan.labels = append(plan.labels, input.labels[column])
+		sb.WriteString("x.l" + strconv.Itoa(column) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("x.t AS t, x.v AS value, COUNT(*) AS v\nFROM (")
+	sb.WriteString(input.sql)
+	sb.WriteString("\n) x\nWHERE x.v IS NOT NULL\nGROUP BY ")
+	sb.WriteString(columnList("x", columns, "x.t", "x.v"))
+	plan.sql = sb.String()
+	return plan, nil
 }
 
-func buildAggregationMax(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+// groupingColumns returns the indexes of the labels of a plan that are kept
+// by the grouping of an aggregation, labels not in the plan are always empty.
+func groupingColumns(planLabels []string, grouping []string, without bool) []int {
+	var columns []int
+	for i, name := range planLabels {
+		grouped := false
+		for _, g := range grouping {
+			if name == g {
+				grouped = true
+				break
+			}
+		}
+		if without {
+			grouped = !grouped && name != labels.MetricName
+		}
+		if grouped {
+			columns = append(columns, i)
+		}
+	}
+	return columns
 }
 
-func buildAggregationMin(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+// columnList joins the label columns of table, then the extra columns.
+func columnList(table string, columns []int, extra ...string) string {
+	list := make([]string, 0, len(columns)+len(extra))
+	for _, column := range columns {
+		list = append(list, table+".l"+strconv.Itoa(column))
+	}
+	return strings.Join(append(list, extra...), ", ")
 }
 
-func buildAggregationTopK(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	return
+// numberLiteral returns the value of a (parenthesized) number literal.
+func numberLiteral(expr promql.Expr) (float64, bool) {
+	switch x := expr.(type) {
+	case *promql.NumberLiteral:
+		return x.Val, true
+	case *promql.ParenExpr:
+		return numberLiteral(x.Expr)
+	}
+	return 0, false
 }
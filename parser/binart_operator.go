@@ -1,63 +1,689 @@
 package parser
 
 import (
-	"time"
+	"math"
+	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
-func buildBinaryOperatorSUB(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func (ev *evaluator) evalBinaryExpr(bin *promql.BinaryExpr) (promql.Value, error) {
+	op := bin.Op.String()
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+
+	switch {
+	case lt == promql.ValueTypeScalar && rt == promql.ValueTypeScalar:
+		return ev.rangeEval(func(args []promql.Value, _ int64) (promql.Vector, error) {
+			v, keep, err := vectorElemBinop(op, scalarArg(args[0]), scalarArg(args[1]))
+			if err != nil {
+				return nil, err
+			}
+			if isComparisonOperator(op) {
+				// comparisons between scalars always have the bool modifier
+				v = boolValue(keep)
+			}
+			return promql.Vector{promql.Sample{Point: promql.Point{V: v}}}, nil
+		}, bin.LHS, bin.RHS)
+
+	case lt == promql.ValueTypeVector && rt == promql.ValueTypeVector:
+		matching := bin.VectorMatching
+		if matching == nil {
+			matching = &promql.VectorMatching{Card: promql.CardOneToOne}
+		}
+		return ev.rangeEval(func(args []promql.Value, _ int64) (promql.Vector, error) {
+			lhs, rhs := args[0].(promql.Vector), args[1].(promql.Vector)
+			switch op {
+			case "and":
+				return vectorAnd(lhs, rhs, matching), nil
+			case "or":
+				return vectorOr(lhs, rhs, matching), nil
+			case "unless":
+				return vectorUnless(lhs, rhs, matching), nil
+			}
+			return vectorBinop(op, lhs, rhs, matching, bin.ReturnBool)
+		}, bin.LHS, bin.RHS)
+
+	case lt == promql.ValueTypeVector && rt == promql.ValueTypeScalar:
+		return ev.rangeEval(func(args []promql.Value, _ int64) (promql.Vector, error) {
+			return vectorScalarBinop(op, args[0].(promql.Vector), scalarArg(args[1]), false, bin.ReturnBool)
+		}, bin.LHS, bin.RHS)
+
+	case lt == promql.ValueTypeScalar && rt == promql.ValueTypeVector:
+		return ev.rangeEval(func(args []promql.Value, _ int64) (promql.Vector, error) {
+			return vectorScalarBinop(op, args[1].(promql.Vector), scalarArg(args[0]), true, bin.ReturnBool)
+		}, bin.LHS, bin.RHS)
+	}
+
+	return nil, errors.Errorf("binary expression must contain only scalar and instant vector types, got %s and %s", lt, rt)
+}
+
+func (ev *evaluator) evalUnaryExpr(unary *promql.UnaryExpr) (promql.Value, error) {
+	v, err := ev.eval(unary.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if unary.Op.String() != "-" {
+		return v, nil
+	}
+
+	mat := v.(promql.Matrix)
+	for i := range mat {
+		mat[i].Metric = dropMetricName(mat[i].Metric)
+		for j := range mat[i].Points {
+			mat[i].Points[j].V = -mat[i].Points[j].V
+		}
+	}
+	if mat.ContainsSameLabelset() {
+		return nil, errors.New("vector cannot contain metrics with the same labelset")
+	}
+	return mat, nil
+}
+
+func isComparisonOperator(op string) bool {
+	switch op {
+	case "==", "!=", ">", "<", ">=", "<=":
+		return true
+	}
+	return false
+}
+
+// shouldDropMetricName returns whether the metric name should be dropped in
+// the result of the operator.
+func shouldDropMetricName(op string) bool {
+	switch op {
+	case "+", "-", "*", "/", "%", "^":
+		return true
+	}
+	return false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// vectorElemBinop evaluates a binary operator between two values. The bool is
+// false if the result should be filtered out by a comparison.
+func vectorElemBinop(op string, lhs, rhs float64) (float64, bool, error) {
+	switch op {
+	case "+":
+		return lhs + rhs, true, nil
+	case "-":
+		return lhs - rhs, true, nil
+	case "*":
+		return lhs * rhs, true, nil
+	case "/":
+		return lhs / rhs, true, nil
+	case "^":
+		return math.Pow(lhs, rhs), true, nil
+	case "%":
+		return math.Mod(lhs, rhs), true, nil
+	case "==":
+		return lhs, lhs == rhs, nil
+	case "!=":
+		return lhs, lhs != rhs, nil
+	case ">":
+		return lhs, lhs > rhs, nil
+	case "<":
+		return lhs, lhs < rhs, nil
+	case ">=":
+		return lhs, lhs >= rhs, nil
+	case "<=":
+		return lhs, lhs <= rhs, nil
+	}
+	return 0, false, errors.Errorf("operator %q not allowed for operations between vectors and scalars", op)
+}
+
+func vectorScalarBinop(op string, lhs promql.Vector, rhs float64, swap, returnBool bool) (promql.Vector, error) {
+	out := make(promql.Vector, 0, len(lhs))
+	for _, s := range lhs {
+		lv, rv := s.V, rhs
+		if swap {
+			lv, rv = rv, lv
+		}
+		value, keep, err := vectorElemBinop(op, lv, rv)
+		if err != nil {
+			return nil, err
+		}
+		// the vector element is always kept as the value of a comparison,
+		// even if it's on the right hand side
+		if isComparisonOperator(op) && swap {
+			value = rv
+		}
+		if returnBool {
+			value = boolValue(keep)
+			keep = true
+		}
+		if !keep {
+			continue
+		}
+		metric := s.Metric
+		if shouldDropMetricName(op) || returnBool {
+			metric = dropMetricName(metric)
+		}
+		out = append(out, promql.Sample{Metric: metric, Point: promql.Point{V: value}})
+	}
+	return out, nil
+}
+
+// signatureFunc returns the function computing the matching signature of
+// labels, from on/ignoring and the listed labels.
+func signatureFunc(matching *promql.VectorMatching) func(labels.Labels) uint64 {
+	if matching.On {
+		return func(l labels.Labels) uint64 { return l.HashForLabels(matching.MatchingLabels...) }
+	}
+	return func(l labels.Labels) uint64 { return l.HashWithoutLabels(matching.MatchingLabels...) }
+}
+
+func vectorAnd(lhs, rhs promql.Vector, matching *promql.VectorMatching) promql.Vector {
+	sigf := signatureFunc(matching)
+	rightSigs := map[uint64]struct{}{}
+	for _, s := range rhs {
+		rightSigs[sigf(s.Metric)] = struct{}{}
+	}
+
+	var out promql.Vector
+	for _, s := range lhs {
+		if _, ok := rightSigs[sigf(s.Metric)]; ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func vectorOr(lhs, rhs promql.Vector, matching *promql.VectorMatching) promql.Vector {
+	sigf := signatureFunc(matching)
+	leftSigs := map[uint64]struct{}{}
+	out := make(promql.Vector, 0, len(lhs)+len(rhs))
+	for _, s := range lhs {
+		leftSigs[sigf(s.Metric)] = struct{}{}
+		out = append(out, s)
+	}
+	for _, s := range rhs {
+		if _, ok := leftSigs[sigf(s.Metric)]; !ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func vectorUnless(lhs, rhs promql.Vector, matching *promql.VectorMatching) promql.Vector {
+	sigf := signatureFunc(matching)
+	rightSigs := map[uint64]struct{}{}
+	for _, s := range rhs {
+		rightSigs[sigf(s.Metric)] = struct{}{}
+	}
+
+	var out promql.Vector
+	for _, s := range lhs {
+		if _, ok := rightSigs[sigf(s.Metric)]; !ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// vectorBinop evaluates an arithmetic or comparison operator between two
+// vectors, matching the elements by labels.
+func vectorBinop(op string, lhs, rhs promql.Vector, matching *promql.VectorMatching, returnBool bool) (promql.Vector, error) {
+	if matching.Card == promql.CardManyToMany {
+		return nil, errors.New("many-to-many only allowed for set operators")
+	}
+	sigf := signatureFunc(matching)
+
+	// The one side is always on the right, swap the operands for one-to-many.
+	if matching.Card == promql.CardOneToMany {
+		lhs, rhs = rhs, lhs
+	}
+
+	rightSigs := map[uint64]promql.Sample{}
+	for _, s := range rhs {
+		sig := sigf(s.Metric)
+		if _, found := rightSigs[sig]; found {
+			side := "right"
+			if matching.Card == promql.CardOneToMany {
+				side = "left"
+			}
+			return nil, errors.Errorf("found duplicate series for the match group on the %s hand-side of the operation: %s;"+
+				"many-to-many matching not allowed: matching labels must be unique on one side", side, s.Metric)
+		}
+		rightSigs[sig] = s
+	}
+
+	// For one-to-one matching, every left element must match at most one
+	// element on the right. For many-to-one, every result metric must be unique.
+	matchedSigs := map[uint64]map[uint64]struct{}{}
+	var out promql.Vector
+	for _, ls := range lhs {
+		sig := sigf(ls.Metric)
+		rs, found := rightSigs[sig]
+		if !found {
+			continue
+		}
+
+		lv, rv := ls.V, rs.V
+		if matching.Card == promql.CardOneToMany {
+			lv, rv = rv, lv
+		}
+		value, keep, err := vectorElemBinop(op, lv, rv)
+		if err != nil {
+			return nil, err
+		}
+		if returnBool {
+			value = boolValue(keep)
+			keep = true
+		}
+		if !keep {
+			continue
+		}
+
+		metric := resultMetric(ls.Metric, rs.Metric, op, matching, returnBool)
+		insertedSigs, exists := matchedSigs[sig]
+		if matching.Card == promql.CardOneToOne {
+			if exists {
+				return nil, errors.New("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matchedSigs[sig] = nil
+		} else {
+			insertSig := metric.Hash()
+			if !exists {
+				insertedSigs = map[uint64]struct{}{}
+				matchedSigs[sig] = insertedSigs
+			} else if _, duplicate := insertedSigs[insertSig]; duplicate {
+				return nil, errors.New("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			insertedSigs[insertSig] = struct{}{}
+		}
+
+		out = append(out, promql.Sample{Metric: metric, Point: promql.Point{V: value}})
+	}
+	return out, nil
+}
+
+// resultMetric returns the labels of the result of a binary operation between
+// the two elements. lhs is always the "many" side.
+func resultMetric(lhs, rhs labels.Labels, op string, matching *promql.VectorMatching, returnBool bool) labels.Labels {
+	lb := labels.NewBuilder(lhs)
+	if shouldDropMetricName(op) || returnBool {
+		lb.Del(labels.MetricName)
+	}
+
+	if matching.Card == promql.CardOneToOne {
+		if matching.On {
+		Outer:
+			for _, l := range lhs {
+				for _, n := range matching.MatchingLabels {
+					if l.Name == n {
+						continue Outer
+					}
+				}
+				lb.Del(l.Name)
+			}
+		} else {
+			lb.Del(matching.MatchingLabels...)
+		}
+	}
+	for _, ln := range matching.Include {
+		// Included labels from the "one" side overwrite the labels of the "many" side.
+		if v := rhs.Get(ln); v != "" {
+			lb.Set(ln, v)
+		} else {
+			lb.Del(ln)
+		}
+	}
+	return lb.Labels()
+}
+
+func buildBinaryOperatorSUB(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "-")
+}
+
+func buildBinaryOperatorADD(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "+")
+}
+
+func buildBinaryOperatorMUL(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "*")
 }
 
-func buildBinaryOperatorADD(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorMOD(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "%")
 }
 
-func buildBinaryOperatorMUL(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorDIV(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "/")
 }
 
-func buildBinaryOperatorMOD(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorPOW(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "^")
 }
 
-func buildBinaryOperatorDIV(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorLAND(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildVectorFilter(bin, ev, "EXISTS")
 }
 
-func buildBinaryOperatorLAND(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorLOR(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	left, right, matching, err := buildSetOperands(bin, ev)
+	if err != nil || left == nil {
+		return nil, err
+	}
+
+	// all labels of both sides, missing ones are empty
+	plan = &sqlPlan{labels: append([]string(nil), left.labels...)}
+	for _, name := range right.labels {
+		if planColumn(left, "", name) == "''" {
+			plan.labels = append(plan.labels, name)
+		}
+	}
+
+	// SELECT x.l0 AS l0, '' AS l1, x.t AS t, x.v AS v FROM (...) x WHERE x.v IS NOT NULL
+	// UNION ALL
+	// SELECT y.l0 AS l0, y.l1 AS l1, y.t AS t, y.v AS v FROM (...) y WHERE y.v IS NOT NULL
+	//   AND NOT EXISTS (SELECT 1 FROM (...) x WHERE x.v IS NOT NULL AND x.t = y.t AND ...)
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i, name := range plan.labels {
+		sb.WriteString(planColumn(left, "x", name) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("x.t AS t, x.v AS v\nFROM (")
+	sb.WriteString(left.sql)
+	sb.WriteString("\n) x\nWHERE x.v IS NOT NULL\nUNION ALL\nSELECT ")
+	for i, name := range plan.labels {
+		sb.WriteString(planColumn(right, "y", name) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("y.t AS t, y.v AS v\nFROM (")
+	sb.WriteString(right.sql)
+	sb.WriteString("\n) y\nWHERE y.v IS NOT NULL AND NOT EXISTS (\n  SELECT 1 FROM (")
+	sb.WriteString(left.sql)
+	sb.WriteString("\n  ) x\n  WHERE x.v IS NOT NULL AND x.t = y.t")
+	sb.WriteString(matchingCondition(left, right, matching))
+	sb.WriteString("\n)")
+	plan.sql = sb.String()
+	plan.args = append(append(append(plan.args, left.args...), right.args...), left.args...)
+	return plan, nil
 }
 
-func buildBinaryOperatorLOR(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorLUnless(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildVectorFilter(bin, ev, "NOT EXISTS")
 }
 
-func buildBinaryOperatorLUnless(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorEQL(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "==")
 }
 
-func buildBinaryOperatorEQL(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorNEQ(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "!=")
 }
 
-func buildBinaryOperatorNEQ(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorLTE(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "<=")
 }
 
-func buildBinaryOperatorLTE(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func buildBinaryOperatorLSS(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, "<")
+}
+
+func buildBinaryOperatorGTE(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, ">=")
+}
+
+func buildBinaryOperatorGTR(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildBinop(bin, ev, ">")
+}
+
+// sqlOperators are the SQL operators of the PromQL operators computed in SQL.
+// The others can't be pushed down because TiDB has no infinity or NaN, so
+// their results are computed by vectorElemBinop from the operands instead.
+var sqlOperators = map[string]string{
+	"+":  "+",
+	"-":  "-",
+	"*":  "*",
+	"==": "=",
+	"!=": "!=",
+	">":  ">",
+	"<":  "<",
+	">=": ">=",
+	"<=": "<=",
+}
+
+// binopValue returns the select expressions of the value of lv op rv, and
+// the condition filtering out the elements of a comparison.
+func binopValue(plan *sqlPlan, op string, lv, rv, elem string, returnBool bool) (value, cond string) {
+	sqlOp, ok := sqlOperators[op]
+	if !ok {
+		plan.binop = op
+		return lv + " AS lhs, " + rv + " AS rhs", ""
+	}
+
+	if !isComparisonOperator(op) {
+		return lv + " " + sqlOp + " " + rv + " AS v", ""
+	}
+	if returnBool {
+		return "CASE WHEN " + lv + " " + sqlOp + " " + rv + " THEN 1 ELSE 0 END AS v", ""
+	}
+	return elem + " AS v", " AND " + lv + " " + sqlOp + " " + rv
 }
 
-func buildBinaryOperatorLSS(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+// buildBinop builds the plan of an arithmetic or comparison operator whose
+// operands are a vector and a number literal or two vectors.
+func buildBinop(bin *promql.BinaryExpr, ev *evaluator, op string) (*sqlPlan, error) {
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+	switch {
+	case lt == promql.ValueTypeVector && rt == promql.ValueTypeVector:
+		return buildVectorBinop(bin, ev, op)
+	case lt == promql.ValueTypeVector && rt == promql.ValueTypeScalar:
+		return buildVectorScalarBinop(bin, ev, op, bin.LHS, bin.RHS, false)
+	case lt == promql.ValueTypeScalar && rt == promql.ValueTypeVector:
+		return buildVectorScalarBinop(bin, ev, op, bin.RHS, bin.LHS, true)
+	}
+	return nil, nil
+}
+
+// buildVectorScalarBinop is the SQL version of vectorScalarBinop.
+//
+//	SELECT x.l1 AS l0, x.t AS t, x.v + ? AS v
+//	FROM (...) x
+//	WHERE x.v IS NOT NULL
+func buildVectorScalarBinop(bin *promql.BinaryExpr, ev *evaluator, op string, vector, scalar promql.Expr, swap bool) (*sqlPlan, error) {
+	s, ok := numberLiteral(scalar)
+	if !ok || math.IsNaN(s) || math.IsInf(s, 0) {
+		return nil, nil
+	}
+	input, err := buildInputPlan(vector, ev)
+	if err != nil || input == nil {
+		return nil, err
+	}
+
+	plan := &sqlPlan{}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	dropName := shouldDropMetricName(op) || bin.ReturnBool
+	for i, name := range input.labels {
+		if dropName && name == labels.MetricName {
+			continue
+		}
+		sb.WriteString("x.l" + strconv.Itoa(i) + " AS l" + strconv.Itoa(len(plan.labels)) + ", ")
+		plan.labels = append(plan.labels, name)
+	}
+
+	lv, rv := "x.v", "?"
+	if swap {
+		lv, rv = rv, lv
+	}
+	value, cond := binopValue(plan, op, lv, rv, "x.v", bin.ReturnBool)
+	sb.WriteString("x.t AS t, " + value + "\nFROM (")
+	sb.WriteString(input.sql)
+	sb.WriteString("\n) x\nWHERE x.v IS NOT NULL" + cond)
+	plan.sql = sb.String()
+
+	if strings.Contains(value, "?") {
+		plan.args = append(plan.args, s)
+	}
+	plan.args = append(plan.args, input.args...)
+	if cond != "" {
+		plan.args = append(plan.args, s)
+	}
+	return plan, nil
+}
+
+// buildVectorBinop is the SQL version of vectorBinop, the elements are
+// matched by joining the operands on the step and the matching labels.
+// Duplicated matches result in duplicated points, which execSQLPlan rejects.
+//
+//	SELECT x.l1 AS l0, y.l2 AS l1, x.t AS t, x.v / y.v AS v
+//	FROM (...) x INNER JOIN (...) y ON (x.t = y.t AND x.l1 = y.l1)
+//	WHERE x.v IS NOT NULL AND y.v IS NOT NULL
+func buildVectorBinop(bin *promql.BinaryExpr, ev *evaluator, op string) (*sqlPlan, error) {
+	matching := bin.VectorMatching
+	if matching == nil {
+		matching = &promql.VectorMatching{Card: promql.CardOneToOne}
+	}
+	if matching.Card == promql.CardManyToMany {
+		return nil, nil
+	}
+	left, err := buildInputPlan(bin.LHS, ev)
+	if err != nil || left == nil {
+		return nil, err
+	}
+	right, err := buildInputPlan(bin.RHS, ev)
+	if err != nil || right == nil {
+		return nil, err
+	}
+
+	// The labels of the result come from the "many" side.
+	many, one, manyTable, oneTable := left, right, "x", "y"
+	if matching.Card == promql.CardOneToMany {
+		many, one, manyTable, oneTable = right, left, "y", "x"
+	}
+
+	plan := &sqlPlan{}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	dropName := shouldDropMetricName(op) || bin.ReturnBool
+	for i, name := range many.labels {
+		if dropName && name == labels.MetricName || contains(matching.Include, name) {
+			continue
+		}
+		if matching.Card == promql.CardOneToOne && matching.On != contains(matching.MatchingLabels, name) {
+			continue
+		}
+		sb.WriteString(manyTable + ".l" + strconv.Itoa(i) + " AS l" + strconv.Itoa(len(plan.labels)) + ", ")
+		plan.labels = append(plan.labels, name)
+	}
+	for _, name := range matching.Include {
+		// Included labels from the "one" side overwrite the labels of the "many" side.
+		sb.WriteString(planColumn(one, oneTable, name) + " AS l" + strconv.Itoa(len(plan.labels)) + ", ")
+		plan.labels = append(plan.labels, name)
+	}
+
+	value, cond := binopValue(plan, op, "x.v", "y.v", "x.v", bin.ReturnBool)
+	sb.WriteString("x.t AS t, " + value + "\nFROM (")
+	sb.WriteString(left.sql)
+	sb.WriteString("\n) x INNER JOIN (")
+	sb.WriteString(right.sql)
+	sb.WriteString("\n) y ON (x.t = y.t")
+	sb.WriteString(matchingCondition(left, right, matching))
+	sb.WriteString(")\nWHERE x.v IS NOT NULL AND y.v IS NOT NULL" + cond)
+	plan.sql = sb.String()
+	plan.args = append(append(plan.args, left.args...), right.args...)
+	return plan, nil
+}
+
+// buildSetOperands builds the plans of the operands of a set operator.
+func buildSetOperands(bin *promql.BinaryExpr, ev *evaluator) (left, right *sqlPlan, matching *promql.VectorMatching, err error) {
+	if bin.LHS.Type() != promql.ValueTypeVector || bin.RHS.Type() != promql.ValueTypeVector {
+		return nil, nil, nil, nil
+	}
+	matching = bin.VectorMatching
+	if matching == nil {
+		matching = &promql.VectorMatching{Card: promql.CardManyToMany}
+	}
+	left, err = buildInputPlan(bin.LHS, ev)
+	if err != nil || left == nil {
+		return nil, nil, nil, err
+	}
+	right, err = buildInputPlan(bin.RHS, ev)
+	if err != nil || right == nil {
+		return nil, nil, nil, err
+	}
+	return left, right, matching, nil
+}
+
+// buildVectorFilter keeps the elements on the left that have (EXISTS) or
+// don't have (NOT EXISTS) a match on the right, which is "and" or "unless".
+//
+//	SELECT x.l0 AS l0, x.t AS t, x.v AS v
+//	FROM (...) x
+//	WHERE x.v IS NOT NULL AND EXISTS (
+//	  SELECT 1 FROM (...) y WHERE y.v IS NOT NULL AND x.t = y.t AND x.l0 = y.l1
+//	)
+func buildVectorFilter(bin *promql.BinaryExpr, ev *evaluator, exists string) (*sqlPlan, error) {
+	left, right, matching, err := buildSetOperands(bin, ev)
+	if err != nil || left == nil {
+		return nil, err
+	}
+
+	plan := &sqlPlan{labels: left.labels}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i := range left.labels {
+		sb.WriteString("x.l" + strconv.Itoa(i) + " AS l" + strconv.Itoa(i) + ", ")
+	}
+	sb.WriteString("x.t AS t, x.v AS v\nFROM (")
+	sb.WriteString(left.sql)
+	sb.WriteString("\n) x\nWHERE x.v IS NOT NULL AND " + exists + " (\n  SELECT 1 FROM (")
+	sb.WriteString(right.sql)
+	sb.WriteString("\n  ) y\n  WHERE y.v IS NOT NULL AND x.t = y.t")
+	sb.WriteString(matchingCondition(left, right, matching))
+	sb.WriteString("\n)")
+	plan.sql = sb.String()
+	plan.args = append(append(plan.args, left.args...), right.args...)
+	return plan, nil
+}
+
+// matchingCondition returns the join condition of the matching labels of
+// left as x and right as y.
+func matchingCondition(left, right *sqlPlan, matching *promql.VectorMatching) string {
+	names := matching.MatchingLabels
+	if !matching.On {
+		names = nil
+		for _, plan := range []*sqlPlan{left, right} {
+			for _, name := range plan.labels {
+				if name != labels.MetricName && !contains(matching.MatchingLabels, name) && !contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(" AND " + planColumn(left, "x", name) + " = " + planColumn(right, "y", name))
+	}
+	return sb.String()
 }
 
-func buildBinaryOperatorGTE(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+// planColumn returns the column of the label in the plan aliased as table,
+// or an empty string literal if the plan doesn't have the label.
+func planColumn(plan *sqlPlan, table string, name string) string {
+	for i, l := range plan.labels {
+		if l == name {
+			return table + ".l" + strconv.Itoa(i)
+		}
+	}
+	return "''"
 }
 
-func buildBinaryOperatorGTR(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	return
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
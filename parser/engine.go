@@ -0,0 +1,201 @@
+package parser
+
+import (
+	"context"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/pingcap/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"go.uber.org/zap"
+)
+
+const (
+	EngineFlash      = "flash"
+	EnginePrometheus = "prometheus"
+)
+
+// Engine evaluates PromQL queries with the engine chosen by config.
+//
+// The flash engine is the built-in evaluator, which pushes computation down
+// to TiDB where possible unless pushdown is disabled. The prometheus engine is
+// the upstream promql.Engine over a Queryable, which always has the exact
+// upstream semantics and is useful to compare results against.
+type Engine struct {
+	storage  store.MetricStorage
+	pushdown bool
+	cfg      config.QueryConfig
+
+	promEngine *promql.Engine
+	queryable  *Queryable
+	cache      *resultsCache
+}
+
+func NewEngine(storage store.MetricStorage, cfg *config.QueryConfig) (*Engine, error) {
+	e := &Engine{
+		storage:  storage,
+		pushdown: cfg.Pushdown,
+		cfg:      *cfg,
+	}
+
+	switch cfg.Engine {
+	case EngineFlash, "":
+	case EnginePrometheus:
+		opts := promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    50000000,
+			Timeout:       2 * time.Minute,
+		}
+		if cfg.MaxSamples > 0 {
+			opts.MaxSamples = cfg.MaxSamples
+		}
+		if cfg.Timeout > 0 {
+			opts.Timeout = cfg.Timeout
+		}
+		e.promEngine = promql.NewEngine(opts)
+		e.queryable = NewQueryable(storage)
+	default:
+		return nil, errors.Errorf("unknown query engine %q", cfg.Engine)
+	}
+
+	if cfg.ResultsCache.Enabled {
+		cache, err := newResultsCache(&cfg.ResultsCache)
+		if err != nil {
+			return nil, err
+		}
+		// the cached days are invalidated by their generations once the
+		// samples older than the freshness are stored, or the ones in the
+		// past change
+		if s, ok := storage.(interface {
+			Generation(context.Context, time.Time) (int64, error)
+			WatchLateSamples(time.Duration)
+		}); ok {
+			s.WatchLateSamples(cfg.ResultsCache.MaxFreshness)
+			cache.generation = s.Generation
+		}
+		e.cache = cache
+	}
+	return e, nil
+}
+
+func (e *Engine) InstantQuery(ctx context.Context, qry string, ts time.Time) (promql.Value, error) {
+	if err := e.checkRange(qry, ts, ts); err != nil {
+		return nil, err
+	}
+	ctx, cancel := e.queryContext(ctx)
+	defer cancel()
+	defer e.finishStats(ctx, time.Now())
+
+	if e.promEngine == nil {
+		return instantQuery(ctx, e.storage, e.pushdown, qry, ts)
+	}
+
+	q, err := e.promEngine.NewInstantQuery(e.queryable, qry, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	return res.Value, res.Err
+}
+
+func (e *Engine) RangeQuery(ctx context.Context, qry string, start, end time.Time, step time.Duration) (promql.Value, error) {
+	if err := e.checkRange(qry, start, end); err != nil {
+		return nil, err
+	}
+	if err := e.checkSteps(start, end, step); err != nil {
+		return nil, err
+	}
+	ctx, cancel := e.queryContext(ctx)
+	defer cancel()
+	defer e.finishStats(ctx, time.Now())
+
+	if e.cache != nil {
+		return e.cache.rangeQuery(ctx, qry, start, end, step, e.execRangeQuery)
+	}
+	return e.execRangeQuery(ctx, qry, start, end, step)
+}
+
+func (e *Engine) execRangeQuery(ctx context.Context, qry string, start, end time.Time, step time.Duration) (promql.Value, error) {
+	if e.promEngine == nil {
+		return rangeQuery(ctx, e.storage, e.pushdown, qry, start, end, step)
+	}
+
+	if step <= 0 {
+		return nil, errors.New("zero or negative query resolution step widths are not accepted")
+	}
+	q, err := e.promEngine.NewRangeQuery(e.queryable, qry, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	return res.Value, res.Err
+}
+
+// queryContext bounds the data loaded by a query and its duration.
+func (e *Engine) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = store.WithQueryLimits(ctx, store.QueryLimits{
+		MaxSeries:  e.cfg.MaxSeries,
+		MaxMetrics: e.cfg.MaxMetrics,
+		MaxSamples: e.cfg.MaxSamples,
+	})
+	if e.cfg.Timeout > 0 {
+		return context.WithTimeout(ctx, e.cfg.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// finishStats records the total time of a query started at start, and
+// explains its SQL statements in explain mode.
+func (e *Engine) finishStats(ctx context.Context, start time.Time) {
+	stats := store.QueryStatsFromContext(ctx)
+	stats.Finish(time.Since(start))
+
+	if storage, ok := e.storage.(*store.DefaultMetricStorage); ok {
+		if err := stats.ExplainAnalyze(ctx, storage.ReadDB); err != nil {
+			log.Warn("failed to explain query", zap.Error(err))
+		}
+	}
+}
+
+// checkRange checks the time range loaded by a query, which is the range of
+// the query plus the longest range of its range vectors.
+func (e *Engine) checkRange(qry string, start, end time.Time) error {
+	if e.cfg.MaxRange <= 0 {
+		return nil
+	}
+	expr, err := promql.ParseExpr(qry)
+	if err != nil {
+		// the error is returned by the evaluation
+		return nil
+	}
+
+	var selectorRange time.Duration
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		if ms, ok := node.(*promql.MatrixSelector); ok && ms.Range > selectorRange {
+			selectorRange = ms.Range
+		}
+		return nil
+	})
+	if r := end.Sub(start) + selectorRange; r > e.cfg.MaxRange {
+		return store.NewLimitError("query time range %s exceeds the limit of %s", model.Duration(r), model.Duration(e.cfg.MaxRange))
+	}
+	return nil
+}
+
+func (e *Engine) checkSteps(start, end time.Time, step time.Duration) error {
+	if e.cfg.MaxSteps <= 0 || step <= 0 {
+		return nil
+	}
+	if steps := int64(end.Sub(start)/step) + 1; steps > int64(e.cfg.MaxSteps) {
+		return store.NewLimitError("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution (?step=XX)", e.cfg.MaxSteps)
+	}
+	return nil
+}
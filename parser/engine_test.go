@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+// seriesByLabels flattens a query result to points keyed by labels.
+func seriesByLabels(t *testing.T, v promql.Value) map[string][]promql.Point {
+	res := map[string][]promql.Point{}
+	switch val := v.(type) {
+	case promql.Matrix:
+		for _, s := range val {
+			res[s.Metric.String()] = s.Points
+		}
+	case promql.Vector:
+		for _, s := range val {
+			res[s.Metric.String()] = []promql.Point{s.Point}
+		}
+	case promql.Scalar:
+		res[""] = []promql.Point{{T: val.T, V: val.V}}
+	default:
+		t.Fatalf("unexpected result type %T", v)
+	}
+	return res
+}
+
+func requireSameResult(t *testing.T, qry string, expected, actual promql.Value) {
+	exp, act := seriesByLabels(t, expected), seriesByLabels(t, actual)
+	require.NotEmpty(t, exp, qry)
+	require.Len(t, act, len(exp), qry)
+	for metric, points := range exp {
+		require.Contains(t, act, metric, qry)
+		require.Len(t, act[metric], len(points), "%s %s", qry, metric)
+		for i, p := range points {
+			q := act[metric][i]
+			require.Equal(t, p.T, q.T, "%s %s", qry, metric)
+			if math.IsNaN(p.V) {
+				require.True(t, math.IsNaN(q.V), "%s %s", qry, metric)
+				continue
+			}
+			require.InDelta(t, p.V, q.V, 1e-9, "%s %s", qry, metric)
+		}
+	}
+}
+
+func TestEngineCompatibility(t *testing.T) {
+	storage := newTestStorage()
+	flash, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash, Pushdown: true})
+	require.NoError(t, err)
+	prom, err := NewEngine(storage, &config.QueryConfig{Engine: EnginePrometheus})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	start, end := time.Unix(120, 0), time.Unix(600, 0)
+	for _, qry := range []string{
+		`http_requests_total`,
+		`http_requests_total{job=~"a.*", method!="POST"} offset 1m`,
+		`rate(http_requests_total[1m])`,
+		`sum(rate(http_requests_total[2m])) by (job)`,
+		`irate(http_requests_total[1m])`,
+		`delta(instance_capacity[5m])`,
+		`increase(http_requests_total{job="db"}[3m])`,
+		`max_over_time(http_requests_total[2m]) - min_over_time(http_requests_total[2m])`,
+		`avg(http_requests_total) without (instance)`,
+		`topk(2, http_requests_total)`,
+		`bottomk(1, http_requests_total) by (method)`,
+		`count_values("value", instance_capacity)`,
+		`quantile(0.9, http_requests_total)`,
+		`stddev(http_requests_total)`,
+		`histogram_quantile(0.9, sum(rate(request_duration_seconds_bucket[1m])) by (le))`,
+		`http_requests_total / ignoring(method) group_left instance_capacity`,
+		`instance_capacity * on(instance) group_right http_requests_total{job="api"}`,
+		`http_requests_total > bool 30`,
+		`100 - instance_capacity`,
+		`http_requests_total and on(instance) instance_capacity > 15`,
+		`http_requests_total{job="db"} or instance_capacity`,
+		`clamp_max(http_requests_total, 50)`,
+		`scalar(sum(instance_capacity)) * 2`,
+		`time() - timestamp(instance_capacity)`,
+		`-http_requests_total{method="POST"}`,
+		`label_replace(instance_capacity, "host", "$1", "instance", "(.*)")`,
+	} {
+		for _, ts := range []time.Time{start, end} {
+			expected, err := prom.InstantQuery(ctx, qry, ts)
+			require.NoError(t, err, qry)
+			actual, err := flash.InstantQuery(ctx, qry, ts)
+			require.NoError(t, err, qry)
+			requireSameResult(t, qry, expected, actual)
+		}
+
+		expected, err := prom.RangeQuery(ctx, qry, start, end, 45*time.Second)
+		require.NoError(t, err, qry)
+		actual, err := flash.RangeQuery(ctx, qry, start, end, 45*time.Second)
+		require.NoError(t, err, qry)
+		requireSameResult(t, qry, expected, actual)
+	}
+
+	_, err = NewEngine(storage, &config.QueryConfig{Engine: "unknown"})
+	require.Error(t, err)
+}
+
+func TestEngineLimits(t *testing.T) {
+	storage := newTestStorage()
+	ctx := context.Background()
+	start, end := time.Unix(120, 0), time.Unix(600, 0)
+
+	for _, engine := range []string{EngineFlash, EnginePrometheus} {
+		e, err := NewEngine(storage, &config.QueryConfig{Engine: engine, MaxRange: 10 * time.Minute, MaxSteps: 20})
+		require.NoError(t, err)
+
+		_, err = e.RangeQuery(ctx, `rate(http_requests_total[1m])`, start, end, 30*time.Second)
+		require.NoError(t, err)
+		_, err = e.RangeQuery(ctx, `rate(http_requests_total[1m])`, start, end, 15*time.Second)
+		require.IsType(t, &store.LimitError{}, err)
+		_, err = e.RangeQuery(ctx, `rate(http_requests_total[2m])`, start, end, time.Minute)
+		require.NoError(t, err)
+		_, err = e.RangeQuery(ctx, `rate(http_requests_total[3m])`, start, end, time.Minute)
+		require.IsType(t, &store.LimitError{}, err)
+		_, err = e.InstantQuery(ctx, `max_over_time(http_requests_total[11m])`, end)
+		require.IsType(t, &store.LimitError{}, err)
+
+		e, err = NewEngine(storage, &config.QueryConfig{Engine: engine, Timeout: time.Nanosecond})
+		require.NoError(t, err)
+		_, err = e.RangeQuery(ctx, `rate(http_requests_total[1m])`, start, end, 15*time.Second)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,473 @@
+package parser
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const (
+	// defaultLookbackDelta is the maximum distance an instant vector selector
+	// looks back for the latest sample, the same as Prometheus.
+	defaultLookbackDelta = 5 * time.Minute
+)
+
+// evaluator evaluates a PromQL expression at every step in [startMs, endMs].
+// An instant query is evaluated as a range query with a single step.
+//
+// Vector expressions are evaluated into a promql.Matrix holding one point per
+// step, scalars into a promql.Matrix holding a single series without labels.
+type evaluator struct {
+	ctx     context.Context
+	storage store.MetricStorage
+	// db is used to push computation down to TiDB, nil if storage isn't backed by TiDB.
+	db *sql.DB
+	// rollups is whether the selectors may be served from rollups.
+	rollups bool
+
+	startMs    int64
+	endMs      int64
+	intervalMs int64
+	lookbackMs int64
+}
+
+func newEvaluator(ctx context.Context, storage store.MetricStorage, start, end time.Time, interval time.Duration) *evaluator {
+	ev := &evaluator{
+		ctx:        ctx,
+		storage:    storage,
+		startMs:    timeMilliseconds(start),
+		endMs:      timeMilliseconds(end),
+		intervalMs: durationMilliseconds(interval),
+		lookbackMs: durationMilliseconds(defaultLookbackDelta),
+	}
+	if ev.intervalMs <= 0 {
+		ev.intervalMs = 1
+	}
+	if s, ok := storage.(*store.DefaultMetricStorage); ok {
+		ev.db = s.ReadDB
+		ev.rollups = s.RollupsEnabled()
+		// the rollups serve large steps better than pushing down on raw samples
+		if ev.rollupResolution(store.SelectHints{StepMs: ev.intervalMs}) > 0 {
+			ev.db = nil
+		}
+	}
+	return ev
+}
+
+func timeMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func durationMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func (ev *evaluator) eval(expr promql.Expr) (promql.Value, error) {
+	if err := ev.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if ev.db != nil {
+		now := time.Now()
+		plan, err := buildSQLPlan(expr, ev)
+		store.QueryStatsFromContext(ev.ctx).AddPlanTime(time.Since(now))
+		if err != nil {
+			return nil, err
+		}
+		if plan != nil {
+			return ev.execSQLPlan(plan)
+		}
+		if solver := tryMatchQPSPattern(expr); solver != nil {
+			res, err := ev.evalQPSSolver(solver)
+			if err != nil || res != nil {
+				return res, err
+			}
+		}
+	}
+
+	switch e := expr.(type) {
+	case *promql.AggregateExpr:
+		return ev.evalAggregateExpr(e)
+	case *promql.Call:
+		return ev.evalCall(e)
+	case *promql.BinaryExpr:
+		return ev.evalBinaryExpr(e)
+	case *promql.ParenExpr:
+		return ev.eval(e.Expr)
+	case *promql.UnaryExpr:
+		return ev.evalUnaryExpr(e)
+	case *promql.NumberLiteral:
+		return ev.rangeEval(func(_ []promql.Value, _ int64) (promql.Vector, error) {
+			return promql.Vector{promql.Sample{Point: promql.Point{V: e.Val}}}, nil
+		})
+	case *promql.StringLiteral:
+		return promql.String{T: ev.startMs, V: e.Val}, nil
+	case *promql.VectorSelector:
+		return ev.evalVectorSelector(e, nil)
+	case *promql.MatrixSelector:
+		if ev.startMs != ev.endMs {
+			return nil, errors.New("cannot do range evaluation of matrix selector")
+		}
+		return ev.evalMatrixSelector(e)
+	}
+
+	return nil, errors.Errorf("unknown ast node %T", expr)
+}
+
+// rangeEval evaluates exprs, then calls f with their values at every step and
+// assembles the returned vectors into a matrix. String expressions are not
+// evaluated, f is expected to read them from the AST.
+func (ev *evaluator) rangeEval(f func(args []promql.Value, ts int64) (promql.Vector, error), exprs ...promql.Expr) (promql.Matrix, error) {
+	matrixes := make([]promql.Matrix, len(exprs))
+	cursors := make([][]int, len(exprs))
+	for i, e := range exprs {
+		if e == nil || e.Type() == promql.ValueTypeString {
+			continue
+		}
+		v, err := ev.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		matrixes[i] = v.(promql.Matrix)
+		cursors[i] = make([]int, len(matrixes[i]))
+	}
+
+	var res promql.Matrix
+	resIndex := map[uint64]int{}
+	args := make([]promql.Value, len(exprs))
+	vectors := make([]promql.Vector, len(exprs))
+	for ts := ev.startMs; ts <= ev.endMs; ts += ev.intervalMs {
+		// gather input vectors for this step
+		for i := range exprs {
+			vectors[i] = vectors[i][:0]
+			for si, series := range matrixes[i] {
+				pos := cursors[i][si]
+				for pos < len(series.Points) && series.Points[pos].T < ts {
+					pos++
+				}
+				if pos < len(series.Points) && series.Points[pos].T == ts {
+					vectors[i] = append(vectors[i], promql.Sample{Metric: series.Metric, Point: series.Points[pos]})
+					pos++
+				}
+				cursors[i][si] = pos
+			}
+			args[i] = vectors[i]
+		}
+
+		out, err := f(args, ts)
+		if err != nil {
+			return nil, err
+		}
+		if out.ContainsSameLabelset() {
+			return nil, errors.New("vector cannot contain metrics with the same labelset")
+		}
+
+		for _, sample := range out {
+			h := sample.Metric.Hash()
+			index, ok := resIndex[h]
+			if !ok {
+				index = len(res)
+				resIndex[h] = index
+				res = append(res, promql.Series{Metric: sample.Metric})
+			}
+			res[index].Points = append(res[index].Points, promql.Point{T: ts, V: sample.V})
+		}
+	}
+
+	return res, nil
+}
+
+// evalVectorSelector picks the latest sample within the lookback delta for
+// every series and step. If valueOf is not nil, it's used to compute the value
+// of a point from the picked sample.
+func (ev *evaluator) evalVectorSelector(vs *promql.VectorSelector, valueOf func(p promql.Point) float64) (promql.Matrix, error) {
+	offset := durationMilliseconds(vs.Offset)
+	hints := store.SelectHints{StepMs: ev.intervalMs}
+	// the last sample of a bucket may be after the step, so look back one
+	// more bucket if served by rollups
+	lookbackMs := ev.lookbackMs + ev.rollupResolution(hints)
+	series, err := ev.selectSeries(vs.LabelMatchers, ev.startMs-offset-lookbackMs, ev.endMs-offset, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(promql.Matrix, 0, len(series))
+	for _, s := range series {
+		var points []promql.Point
+		pos := 0
+		for ts := ev.startMs; ts <= ev.endMs; ts += ev.intervalMs {
+			refTime := ts - offset
+			for pos < len(s.Points) && s.Points[pos].T <= refTime {
+				pos++
+			}
+			if pos == 0 {
+				continue
+			}
+			p := s.Points[pos-1]
+			if p.T < refTime-lookbackMs {
+				continue
+			}
+			v := p.V
+			if valueOf != nil {
+				v = valueOf(p)
+			}
+			points = append(points, promql.Point{T: ts, V: v})
+		}
+		if len(points) > 0 {
+			res = append(res, promql.Series{Metric: s.Metric, Points: points})
+		}
+	}
+	return res, nil
+}
+
+// evalMatrixSelector returns the raw samples of the range ending at the only
+// evaluation step.
+func (ev *evaluator) evalMatrixSelector(ms *promql.MatrixSelector) (promql.Matrix, error) {
+	maxT := ev.startMs - durationMilliseconds(ms.Offset)
+	minT := maxT - durationMilliseconds(ms.Range)
+	series, err := ev.selectSeries(ms.LabelMatchers, minT, maxT, store.SelectHints{})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(promql.Matrix, 0, len(series))
+	for _, s := range series {
+		if len(s.Points) > 0 {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// selectSeries fetches the samples in [minT, maxT] of all series selected by
+// matchers, which may be served by rollups as planned with hints.
+func (ev *evaluator) selectSeries(matchers []*labels.Matcher, minT, maxT int64, hints store.SelectHints) (promql.Matrix, error) {
+	ctx := ev.ctx
+	if ev.rollupResolution(hints) > 0 {
+		ctx = store.WithSelectHints(ctx, hints)
+	}
+	return selectSeries(ctx, ev.storage, matchers, minT, maxT)
+}
+
+// rollupResolution returns the resolution in milliseconds of the rollups
+// serving a selector described by hints, 0 if served by raw samples.
+func (ev *evaluator) rollupResolution(hints store.SelectHints) int64 {
+	if !ev.rollups {
+		return 0
+	}
+	return durationMilliseconds(store.PlanResolution(hints))
+}
+
+func selectSeries(ctx context.Context, storage store.MetricStorage, matchers []*labels.Matcher, minT, maxT int64) (promql.Matrix, error) {
+	metricName, modelMatchers := toModelMatchers(matchers)
+	timeSeries, err := storage.Query(ctx, minT, maxT, metricName, modelMatchers)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(promql.Matrix, 0, len(timeSeries))
+	for _, ts := range timeSeries {
+		metric := metricOf(ts)
+		// TiDB treats regexps and missing labels a bit differently from
+		// Prometheus, so double check the result here.
+		if !matchAll(matchers, metric) {
+			continue
+		}
+
+		points := make([]promql.Point, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			if s.TimestampMs < minT || s.TimestampMs > maxT {
+				continue
+			}
+			points = append(points, promql.Point{T: s.TimestampMs, V: s.Value})
+		}
+		res = append(res, promql.Series{Metric: metric, Points: points})
+	}
+	return res, nil
+}
+
+// toModelMatchers splits matchers into the metric name and the storage
+// matchers. If the metric name isn't matched by equality, it's empty and the
+// storage selects the metrics by the matchers of __name__.
+func toModelMatchers(matchers []*labels.Matcher) (string, []model.Matcher) {
+	var metricName string
+	modelMatchers := make([]model.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && metricName == "" {
+			metricName = m.Value
+			continue
+		}
+		modelMatchers = append(modelMatchers, toModelMatcher(m))
+	}
+	return metricName, modelMatchers
+}
+
+// metricOf returns the labels of a stored series, including the metric name.
+func metricOf(ts model.TimeSeries) labels.Labels {
+	metric := make(labels.Labels, 0, len(ts.Labels)+1)
+	metric = append(metric, labels.Label{Name: labels.MetricName, Value: ts.Name})
+	for _, l := range ts.Labels {
+		metric = append(metric, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(metric)
+	return metric
+}
+
+// toModelMatcher converts a PromQL label matcher to the storage one. PromQL
+// regexps are fully anchored, but REGEXP in TiDB is not.
+func toModelMatcher(m *labels.Matcher) model.Matcher {
+	res := model.Matcher{
+		LabelName:  m.Name,
+		LabelValue: m.Value,
+		IsRE:       m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp,
+		IsNegative: m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp,
+	}
+	if res.IsRE {
+		res.LabelValue = "^(?:" + m.Value + ")$"
+	}
+	return res
+}
+
+func matchAll(matchers []*labels.Matcher, metric labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(metric.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func dropMetricName(l labels.Labels) labels.Labels {
+	return labels.NewBuilder(l).Del(labels.MetricName).Labels()
+}
+
+// sqlPlan is a SQL statement computing the value of an expression for all
+// evaluation steps inside TiDB. Every returned row is one point: the values
+// of labels in order, the step timestamp in milliseconds, then the value, in
+// columns named l0, l1, ..., t and v so that plans can be nested.
+type sqlPlan struct {
+	sql    string
+	args   []interface{}
+	labels []string
+
+	// valueLabel is the label of count_values, whose value is returned in a
+	// column between t and v.
+	valueLabel string
+	// binop is the operator computing the value from the operands returned
+	// in place of v, for the operators that can't be computed in TiDB.
+	binop string
+	// histogramQuantile is the φ of histogram_quantile if the plan returns
+	// the buckets, the quantiles are interpolated in process.
+	histogramQuantile *float64
+}
+
+func (ev *evaluator) execSQLPlan(plan *sqlPlan) (promql.Matrix, error) {
+	now := time.Now()
+	rows, err := ev.db.QueryContext(ev.ctx, plan.sql, plan.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labelValues := make([]sql.NullString, len(plan.labels))
+	dest := make([]interface{}, 0, len(plan.labels)+2)
+	for i := range labelValues {
+		dest = append(dest, &labelValues[i])
+	}
+	var t int64
+	var value float64
+	var v, rhs sql.NullFloat64
+	dest = append(dest, &t)
+	if plan.valueLabel != "" {
+		dest = append(dest, &value)
+	}
+	dest = append(dest, &v)
+	if plan.binop != "" {
+		dest = append(dest, &rhs)
+	}
+
+	limiter := store.QueryLimiterFromContext(ev.ctx)
+	var res promql.Matrix
+	resIndex := map[string]int{}
+	var sb strings.Builder
+	rowCount := 0
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rowCount++
+		if err = limiter.AddSamples(1); err != nil {
+			return nil, err
+		}
+		if !v.Valid || t < ev.startMs || t > ev.endMs {
+			continue
+		}
+		if plan.binop != "" {
+			if !rhs.Valid {
+				continue
+			}
+			if v.Float64, _, err = vectorElemBinop(plan.binop, v.Float64, rhs.Float64); err != nil {
+				return nil, err
+			}
+		}
+
+		sb.Reset()
+		for _, lv := range labelValues {
+			sb.WriteString(lv.String)
+			sb.WriteByte(0xff)
+		}
+		var formattedValue string
+		if plan.valueLabel != "" {
+			formattedValue = strconv.FormatFloat(value, 'f', -1, 64)
+			sb.WriteString(formattedValue)
+		}
+		index, ok := resIndex[sb.String()]
+		if !ok {
+			if err = limiter.CheckSeries(len(res) + 1); err != nil {
+				return nil, err
+			}
+			var metric labels.Labels
+			for i, name := range plan.labels {
+				if labelValues[i].String != "" {
+					metric = append(metric, labels.Label{Name: name, Value: labelValues[i].String})
+				}
+			}
+			if plan.valueLabel != "" {
+				metric = append(metric, labels.Label{Name: plan.valueLabel, Value: formattedValue})
+			}
+			sort.Sort(metric)
+			index = len(res)
+			resIndex[sb.String()] = index
+			res = append(res, promql.Series{Metric: metric})
+		}
+		res[index].Points = append(res[index].Points, promql.Point{T: t, V: v.Float64})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	store.QueryStatsFromContext(ev.ctx).ObserveSQL(plan.sql, plan.args, rowCount, len(res), time.Since(now))
+
+	for i := range res {
+		points := res[i].Points
+		sort.Slice(points, func(a, b int) bool { return points[a].T < points[b].T })
+		for j := 1; j < len(points); j++ {
+			if points[j].T == points[j-1].T {
+				return nil, errors.New("vector cannot contain metrics with the same labelset")
+			}
+		}
+	}
+	if plan.histogramQuantile != nil {
+		return ev.histogramQuantile(*plan.histogramQuantile, res)
+	}
+	return res, nil
+}
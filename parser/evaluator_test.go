@@ -0,0 +1,349 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+// memStorage is an in-memory store.MetricStorage for evaluator tests.
+type memStorage struct {
+	series []model.TimeSeries
+}
+
+func (m *memStorage) Store(_ context.Context, timeSeries model.TimeSeries) error {
+	m.series = append(m.series, timeSeries)
+	return nil
+}
+
+func (m *memStorage) BatchStore(ctx context.Context, timeSeries []*model.TimeSeries) error {
+	for _, ts := range timeSeries {
+		if err := m.Store(ctx, *ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Query(_ context.Context, startMs, endMs int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+	var res []model.TimeSeries
+Outer:
+	for _, ts := range m.series {
+		if metricsName != "" && ts.Name != metricsName {
+			continue
+		}
+		for _, matcher := range matchers {
+			var value string
+			if matcher.LabelName == labels.MetricName {
+				value = ts.Name
+			}
+			for _, l := range ts.Labels {
+				if l.Name == matcher.LabelName {
+					value = l.Value
+				}
+			}
+			matched := value == matcher.LabelValue
+			if matcher.IsRE {
+				matched = regexp.MustCompile(matcher.LabelValue).MatchString(value)
+			}
+			if matched == matcher.IsNegative {
+				continue Outer
+			}
+		}
+
+		r := model.TimeSeries{Name: ts.Name, Labels: ts.Labels}
+		for _, s := range ts.Samples {
+			if startMs <= s.TimestampMs && s.TimestampMs <= endMs {
+				r.Samples = append(r.Samples, s)
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (m *memStorage) QuerySeries(ctx context.Context, startMs, endMs int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+	timeSeries, err := m.Query(ctx, startMs, endMs, metricsName, matchers)
+	if err != nil {
+		return nil, err
+	}
+	var res []model.TimeSeries
+	for _, ts := range timeSeries {
+		if len(ts.Samples) > 0 {
+			res = append(res, model.TimeSeries{Name: ts.Name, Labels: ts.Labels})
+		}
+	}
+	return res, nil
+}
+
+func (m *memStorage) QueryLabelNames(context.Context, int64, int64) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *memStorage) QueryLabelValues(context.Context, int64, int64, string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *memStorage) Close() {}
+
+// addSeries stores a series with a sample every 15 seconds in [0, n), valued f(i).
+func (m *memStorage) addSeries(name string, lbs map[string]string, n int, f func(i int) float64) {
+	ts := model.TimeSeries{Name: name}
+	for k, v := range lbs {
+		ts.Labels = append(ts.Labels, model.Label{Name: k, Value: v})
+	}
+	for i := 0; i < n; i++ {
+		ts.Samples = append(ts.Samples, model.Sample{TimestampMs: int64(i) * 15000, Value: f(i)})
+	}
+	m.series = append(m.series, ts)
+}
+
+func newTestStorage() *memStorage {
+	m := &memStorage{}
+	counter := func(step float64) func(i int) float64 {
+		return func(i int) float64 { return float64(i) * step }
+	}
+	m.addSeries("http_requests_total", map[string]string{"job": "api", "instance": "0", "method": "GET"}, 41, counter(1))
+	m.addSeries("http_requests_total", map[string]string{"job": "api", "instance": "1", "method": "GET"}, 41, counter(2))
+	m.addSeries("http_requests_total", map[string]string{"job": "api", "instance": "0", "method": "POST"}, 41, counter(3))
+	m.addSeries("http_requests_total", map[string]string{"job": "db", "instance": "0", "method": "GET"}, 41, counter(4))
+	m.addSeries("instance_capacity", map[string]string{"job": "api", "instance": "0"}, 41, func(int) float64 { return 10 })
+	m.addSeries("instance_capacity", map[string]string{"job": "api", "instance": "1"}, 41, func(int) float64 { return 20 })
+	for _, le := range []string{"0.1", "0.5", "1", "+Inf"} {
+		bound := map[string]float64{"0.1": 1, "0.5": 2, "1": 3, "+Inf": 4}[le]
+		m.addSeries("request_duration_seconds_bucket", map[string]string{"job": "api", "le": le}, 41, counter(bound))
+	}
+	return m
+}
+
+func mustInstantQuery(t *testing.T, qry string, ts time.Time) promql.Value {
+	res, err := NewInstantQuery(context.Background(), newTestStorage(), qry, ts)
+	require.NoError(t, err, qry)
+	return res
+}
+
+func vectorOf(t *testing.T, v promql.Value) map[string]float64 {
+	vec, ok := v.(promql.Vector)
+	require.True(t, ok, "%T", v)
+	res := make(map[string]float64, len(vec))
+	for _, s := range vec {
+		res[s.Metric.String()] = s.V
+	}
+	return res
+}
+
+func TestInstantQuerySelector(t *testing.T) {
+	at := time.Unix(600, 0)
+
+	res := vectorOf(t, mustInstantQuery(t, `http_requests_total{job="api", method="GET"}`, at))
+	require.Equal(t, map[string]float64{
+		`{__name__="http_requests_total", instance="0", job="api", method="GET"}`: 40,
+		`{__name__="http_requests_total", instance="1", job="api", method="GET"}`: 80,
+	}, res)
+
+	// lookback picks the latest sample within 5 minutes
+	res = vectorOf(t, mustInstantQuery(t, `http_requests_total{instance="1"}`, time.Unix(607, 0)))
+	require.Equal(t, float64(80), res[`{__name__="http_requests_total", instance="1", job="api", method="GET"}`])
+	require.Len(t, vectorOf(t, mustInstantQuery(t, `http_requests_total`, time.Unix(1000, 0))), 0)
+
+	res = vectorOf(t, mustInstantQuery(t, `http_requests_total{method=~"P.*", job!="db"} offset 5m`, at))
+	require.Equal(t, map[string]float64{
+		`{__name__="http_requests_total", instance="0", job="api", method="POST"}`: 60,
+	}, res)
+
+	// matchers on labels that no series have
+	require.Len(t, vectorOf(t, mustInstantQuery(t, `http_requests_total{cluster="a"}`, at)), 0)
+	require.Len(t, vectorOf(t, mustInstantQuery(t, `http_requests_total{cluster!="a"}`, at)), 4)
+
+	// without a metric name
+	res = vectorOf(t, mustInstantQuery(t, `{__name__=~"http_.*|instance_.*", instance="1"}`, at))
+	require.Equal(t, map[string]float64{
+		`{__name__="http_requests_total", instance="1", job="api", method="GET"}`: 80,
+		`{__name__="instance_capacity", instance="1", job="api"}`:                 20,
+	}, res)
+	require.Len(t, vectorOf(t, mustInstantQuery(t, `{job="db"}`, at)), 1)
+
+	mat, ok := mustInstantQuery(t, `instance_capacity{instance="0"}[1m]`, at).(promql.Matrix)
+	require.True(t, ok)
+	require.Len(t, mat, 1)
+	require.Len(t, mat[0].Points, 5)
+}
+
+func TestInstantQueryFunctions(t *testing.T) {
+	at := time.Unix(600, 0)
+
+	res := vectorOf(t, mustInstantQuery(t, `rate(http_requests_total{instance="0", job="api"}[1m])`, at))
+	require.InDelta(t, 1.0/15, res[`{instance="0", job="api", method="GET"}`], 1e-9)
+	require.InDelta(t, 3.0/15, res[`{instance="0", job="api", method="POST"}`], 1e-9)
+
+	res = vectorOf(t, mustInstantQuery(t, `increase(http_requests_total{job="db"}[2m])`, at))
+	require.InDelta(t, 32, res[`{instance="0", job="db", method="GET"}`], 1e-9)
+
+	res = vectorOf(t, mustInstantQuery(t, `irate(http_requests_total{job="db"}[1m])`, at))
+	require.InDelta(t, 4.0/15, res[`{instance="0", job="db", method="GET"}`], 1e-9)
+
+	res = vectorOf(t, mustInstantQuery(t, `max_over_time(http_requests_total{job="db"}[1m])`, at))
+	require.Equal(t, float64(160), res[`{instance="0", job="db", method="GET"}`])
+
+	res = vectorOf(t, mustInstantQuery(t, `histogram_quantile(0.5, rate(request_duration_seconds_bucket[1m]))`, at))
+	require.InDelta(t, 0.5, res[`{job="api"}`], 1e-9)
+
+	res = vectorOf(t, mustInstantQuery(t, `clamp_max(instance_capacity, 15)`, at))
+	require.Equal(t, map[string]float64{`{instance="0", job="api"}`: 10, `{instance="1", job="api"}`: 15}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `timestamp(instance_capacity{instance="0"})`, time.Unix(610, 0)))
+	require.Equal(t, float64(600), res[`{instance="0", job="api"}`])
+
+	res = vectorOf(t, mustInstantQuery(t, `label_replace(instance_capacity{instance="0"}, "host", "h-$1", "instance", "(.*)")`, at))
+	require.Equal(t, float64(10), res[`{__name__="instance_capacity", host="h-0", instance="0", job="api"}`])
+
+	scalar, ok := mustInstantQuery(t, `time()`, at).(promql.Scalar)
+	require.True(t, ok)
+	require.Equal(t, promql.Scalar{T: 600000, V: 600}, scalar)
+
+	scalar, ok = mustInstantQuery(t, `scalar(http_requests_total)`, at).(promql.Scalar)
+	require.True(t, ok)
+	require.True(t, math.IsNaN(scalar.V))
+}
+
+func TestInstantQueryAggregations(t *testing.T) {
+	at := time.Unix(600, 0)
+
+	res := vectorOf(t, mustInstantQuery(t, `sum(http_requests_total) by (job)`, at))
+	require.Equal(t, map[string]float64{`{job="api"}`: 240, `{job="db"}`: 160}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `avg without (instance, method) (http_requests_total)`, at))
+	require.Equal(t, map[string]float64{`{job="api"}`: 80, `{job="db"}`: 160}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `count(http_requests_total)`, at))
+	require.Equal(t, map[string]float64{`{}`: 4}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `count_values("value", instance_capacity)`, at))
+	require.Equal(t, map[string]float64{`{value="10"}`: 1, `{value="20"}`: 1}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `topk(1, http_requests_total) by (job)`, at))
+	require.Equal(t, map[string]float64{
+		`{__name__="http_requests_total", instance="0", job="api", method="POST"}`: 120,
+		`{__name__="http_requests_total", instance="0", job="db", method="GET"}`:   160,
+	}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `quantile(0.5, instance_capacity)`, at))
+	require.Equal(t, map[string]float64{`{}`: 15}, res)
+}
+
+func TestInstantQueryBinaryOperators(t *testing.T) {
+	at := time.Unix(600, 0)
+
+	res := vectorOf(t, mustInstantQuery(t, `http_requests_total{method="GET", job="api"} / ignoring(method) instance_capacity`, at))
+	require.Equal(t, map[string]float64{`{instance="0", job="api"}`: 4, `{instance="1", job="api"}`: 4}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `http_requests_total{job="api"} / on(instance) group_left instance_capacity`, at))
+	require.Equal(t, map[string]float64{
+		`{instance="0", job="api", method="GET"}`:  4,
+		`{instance="0", job="api", method="POST"}`: 12,
+		`{instance="1", job="api", method="GET"}`:  4,
+	}, res)
+
+	_, err := NewInstantQuery(context.Background(), newTestStorage(), `http_requests_total / on(instance) instance_capacity`, at)
+	require.Error(t, err)
+
+	res = vectorOf(t, mustInstantQuery(t, `instance_capacity > 15`, at))
+	require.Equal(t, map[string]float64{`{__name__="instance_capacity", instance="1", job="api"}`: 20}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `15 < bool instance_capacity`, at))
+	require.Equal(t, map[string]float64{`{instance="0", job="api"}`: 0, `{instance="1", job="api"}`: 1}, res)
+
+	res = vectorOf(t, mustInstantQuery(t, `http_requests_total{job="db"} or instance_capacity`, at))
+	require.Len(t, res, 3)
+
+	res = vectorOf(t, mustInstantQuery(t, `http_requests_total unless on(job) http_requests_total{job="db"}`, at))
+	require.Len(t, res, 3)
+
+	res = vectorOf(t, mustInstantQuery(t, `-instance_capacity{instance="0"}`, at))
+	require.Equal(t, map[string]float64{`{instance="0", job="api"}`: -10}, res)
+
+	scalar, ok := mustInstantQuery(t, `2 * 3 > bool 5`, at).(promql.Scalar)
+	require.True(t, ok)
+	require.Equal(t, float64(1), scalar.V)
+}
+
+func TestInstantQueryErrors(t *testing.T) {
+	for _, qry := range []string{
+		`sum(http_requests_total[1m])`,
+		`http_requests_total +`,
+	} {
+		_, err := NewInstantQuery(context.Background(), newTestStorage(), qry, time.Unix(600, 0))
+		require.Error(t, err, qry)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewInstantQuery(ctx, newTestStorage(), `http_requests_total`, time.Unix(600, 0))
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []bucket{{1, 10}, {2, 8}, {math.Inf(+1), 20}}
+	// counts are not monotonic, the second bucket is treated as 10
+	require.InDelta(t, 1.0, bucketQuantile(0.5, buckets), 1e-9)
+	require.True(t, math.IsNaN(bucketQuantile(0.5, []bucket{{1, 10}, {2, 20}})))
+	require.Equal(t, 2.0, bucketQuantile(0.99, []bucket{{1, 10}, {2, 10}, {math.Inf(+1), 20}}))
+	require.Equal(t, math.Inf(-1), bucketQuantile(-1, buckets))
+}
+
+func mustRangeQuery(t *testing.T, qry string, start, end time.Time, step time.Duration) promql.Matrix {
+	res, err := NewRangeQuery(context.Background(), newTestStorage(), qry, start, end, step)
+	require.NoError(t, err, qry)
+	mat, ok := res.(promql.Matrix)
+	require.True(t, ok, "%T", res)
+	return mat
+}
+
+func TestRangeQuery(t *testing.T) {
+	start, end := time.Unix(300, 0), time.Unix(600, 0)
+
+	mat := mustRangeQuery(t, `sum(rate(http_requests_total[1m])) by (job)`, start, end, time.Minute)
+	require.Len(t, mat, 2)
+	for _, s := range mat {
+		require.Len(t, s.Points, 6)
+		for i, p := range s.Points {
+			require.Equal(t, int64(300000+i*60000), p.T)
+		}
+	}
+	require.Equal(t, `{job="api"}`, mat[0].Metric.String())
+	require.InDelta(t, 6.0/15, mat[0].Points[0].V, 1e-9)
+
+	// series show up only at the steps they have samples
+	mat = mustRangeQuery(t, `http_requests_total{job="db"} offset 5m`, time.Unix(0, 0), end, 2*time.Minute)
+	require.Len(t, mat, 1)
+	require.Len(t, mat[0].Points, 3)
+	require.Equal(t, int64(360000), mat[0].Points[0].T)
+	require.Equal(t, []float64{16, 48, 80}, []float64{mat[0].Points[0].V, mat[0].Points[1].V, mat[0].Points[2].V})
+
+	mat = mustRangeQuery(t, `time() * 2`, start, end, 150*time.Second)
+	require.Equal(t, promql.Matrix{promql.Series{Metric: nil, Points: []promql.Point{
+		{T: 300000, V: 600}, {T: 450000, V: 900}, {T: 600000, V: 1200},
+	}}}, mat)
+
+	mat = mustRangeQuery(t, `instance_capacity > bool on(instance) group_left http_requests_total{method="POST"} / 10`, start, end, time.Minute)
+	require.Len(t, mat, 1)
+	require.Equal(t, []promql.Point{{T: 300000, V: 1}, {T: 360000, V: 1}, {T: 420000, V: 1}, {T: 480000, V: 1}, {T: 540000, V: 0}, {T: 600000, V: 0}}, mat[0].Points)
+
+	for _, qry := range []string{`"foo"`, `http_requests_total[1m]`} {
+		_, err := NewRangeQuery(context.Background(), newTestStorage(), qry, start, end, time.Minute)
+		require.Error(t, err, qry)
+	}
+	_, err := NewRangeQuery(context.Background(), newTestStorage(), `http_requests_total`, start, end, 0)
+	require.Error(t, err)
+	_, err = NewRangeQuery(context.Background(), newTestStorage(), `http_requests_total`, end, start, time.Minute)
+	require.Error(t, err)
+}
@@ -1,27 +1,948 @@
 package parser
 
 import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
-func buildFunctionRate(call *promql.Call, time time.Time) (sql string, err error) {
-	return
+// rangeCall is the input of a function over a range vector, for a single
+// series at a single evaluation step.
+type rangeCall struct {
+	points []promql.Point
+	// scalars are the values of the other arguments, in the order they appear.
+	scalars []float64
+
+	ts         int64
+	rangeStart int64
+	rangeEnd   int64
+	selRange   time.Duration
+}
+
+// rangeFunctions are functions taking a range vector. The returned bool is
+// false if there is no output for the series at the step.
+var rangeFunctions = map[string]func(c *rangeCall) (float64, bool, error){
+	"rate":               funcRate,
+	"increase":           funcIncrease,
+	"delta":              funcDelta,
+	"irate":              funcIRate,
+	"idelta":             funcIDelta,
+	"deriv":              funcDeriv,
+	"predict_linear":     funcPredictLinear,
+	"holt_winters":       funcHoltWinters,
+	"changes":            funcChanges,
+	"resets":             funcResets,
+	"avg_over_time":      funcAvgOverTime,
+	"count_over_time":    funcCountOverTime,
+	"max_over_time":      funcMaxOverTime,
+	"min_over_time":      funcMinOverTime,
+	"sum_over_time":      funcSumOverTime,
+	"quantile_over_time": funcQuantileOverTime,
+	"stddev_over_time":   funcStddevOverTime,
+	"stdvar_over_time":   funcStdvarOverTime,
+}
+
+// instantFunctions are functions taking instant vectors, scalars or strings.
+// Scalar arguments are passed as a vector with a single sample.
+var instantFunctions = map[string]func(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error){
+	"abs":                simpleFunction(math.Abs),
+	"ceil":               simpleFunction(math.Ceil),
+	"floor":              simpleFunction(math.Floor),
+	"exp":                simpleFunction(math.Exp),
+	"sqrt":               simpleFunction(math.Sqrt),
+	"ln":                 simpleFunction(math.Log),
+	"log2":               simpleFunction(math.Log2),
+	"log10":              simpleFunction(math.Log10),
+	"round":              funcRound,
+	"clamp_max":          funcClampMax,
+	"clamp_min":          funcClampMin,
+	"scalar":             funcScalar,
+	"vector":             funcVector,
+	"time":               funcTime,
+	"timestamp":          funcTimestamp,
+	"sort":               funcSort,
+	"sort_desc":          funcSortDesc,
+	"absent":             funcAbsent,
+	"label_replace":      funcLabelReplace,
+	"label_join":         funcLabelJoin,
+	"histogram_quantile": funcHistogramQuantile,
+	"days_in_month": dateFunction(func(t time.Time) float64 {
+		return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	}),
+	"day_of_month": dateFunction(func(t time.Time) float64 { return float64(t.Day()) }),
+	"day_of_week":  dateFunction(func(t time.Time) float64 { return float64(t.Weekday()) }),
+	"hour":         dateFunction(func(t time.Time) float64 { return float64(t.Hour()) }),
+	"minute":       dateFunction(func(t time.Time) float64 { return float64(t.Minute()) }),
+	"month":        dateFunction(func(t time.Time) float64 { return float64(t.Month()) }),
+	"year":         dateFunction(func(t time.Time) float64 { return float64(t.Year()) }),
+}
+
+func (ev *evaluator) evalCall(call *promql.Call) (promql.Value, error) {
+	// timestamp() returns the timestamps of the samples rather than the
+	// evaluation steps, so the selector has to be evaluated specially.
+	if call.Func.Name == "timestamp" {
+		if vs, ok := call.Args[0].(*promql.VectorSelector); ok {
+			mat, err := ev.evalVectorSelector(vs, func(p promql.Point) float64 { return float64(p.T) / 1000 })
+			if err != nil {
+				return nil, err
+			}
+			for i := range mat {
+				mat[i].Metric = dropMetricName(mat[i].Metric)
+			}
+			return mat, nil
+		}
+	}
+
+	matrixArgIndex := -1
+	for i, arg := range call.Args {
+		if _, ok := arg.(*promql.MatrixSelector); ok {
+			matrixArgIndex = i
+			break
+		}
+	}
+
+	if matrixArgIndex < 0 {
+		f, ok := instantFunctions[call.Func.Name]
+		if !ok {
+			return nil, errors.Errorf("unknown function %v", call.Func.Name)
+		}
+		return ev.rangeEval(func(args []promql.Value, ts int64) (promql.Vector, error) {
+			return f(call, args, ts)
+		}, call.Args...)
+	}
+
+	f, ok := rangeFunctions[call.Func.Name]
+	if !ok {
+		return nil, errors.Errorf("unknown function %v", call.Func.Name)
+	}
+	return ev.evalRangeFunction(call, matrixArgIndex, f)
+}
+
+// evalRangeFunction fetches the samples of the range vector argument once,
+// then calls f for every series and step with the samples inside the window.
+func (ev *evaluator) evalRangeFunction(call *promql.Call, matrixArgIndex int, f func(c *rangeCall) (float64, bool, error)) (promql.Matrix, error) {
+	// other arguments are always scalars
+	var scalarArgs []promql.Matrix
+	for i, arg := range call.Args {
+		if i == matrixArgIndex {
+			continue
+		}
+		v, err := ev.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		scalarArgs = append(scalarArgs, v.(promql.Matrix))
+	}
+
+	ms := call.Args[matrixArgIndex].(*promql.MatrixSelector)
+	offset := durationMilliseconds(ms.Offset)
+	selRange := durationMilliseconds(ms.Range)
+	hints := store.SelectHints{StepMs: ev.intervalMs, Func: call.Func.Name, RangeMs: selRange}
+	series, err := ev.selectSeries(ms.LabelMatchers, ev.startMs-offset-selRange, ev.endMs-offset, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rangeCall{
+		scalars:  make([]float64, len(scalarArgs)),
+		selRange: ms.Range,
+	}
+	res := make(promql.Matrix, 0, len(series))
+	for _, s := range series {
+		var points []promql.Point
+		begin, end := 0, 0
+		for step, ts := 0, ev.startMs; ts <= ev.endMs; step, ts = step+1, ts+ev.intervalMs {
+			c.ts = ts
+			c.rangeEnd = ts - offset
+			c.rangeStart = c.rangeEnd - selRange
+			for begin < len(s.Points) && s.Points[begin].T < c.rangeStart {
+				begin++
+			}
+			for end < len(s.Points) && s.Points[end].T <= c.rangeEnd {
+				end++
+			}
+			if begin >= end {
+				continue
+			}
+			c.points = s.Points[begin:end]
+			for i, arg := range scalarArgs {
+				c.scalars[i] = scalarAt(arg, step)
+			}
+
+			v, ok, err := f(c)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				points = append(points, promql.Point{T: ts, V: v})
+			}
+		}
+		if len(points) > 0 {
+			// the only change to the labels of range functions is dropping the metric name
+			res = append(res, promql.Series{Metric: dropMetricName(s.Metric), Points: points})
+		}
+	}
+	if res.ContainsSameLabelset() {
+		return nil, errors.New("vector cannot contain metrics with the same labelset")
+	}
+	return res, nil
+}
+
+// scalarAt returns the value of a scalar at the given step. Scalars always
+// have a value at every step.
+func scalarAt(m promql.Matrix, step int) float64 {
+	if len(m) == 0 || step >= len(m[0].Points) {
+		return math.NaN()
+	}
+	return m[0].Points[step].V
+}
+
+// scalarArg returns the value of a scalar argument of a step.
+func scalarArg(v promql.Value) float64 {
+	vec := v.(promql.Vector)
+	if len(vec) == 0 {
+		return math.NaN()
+	}
+	return vec[0].V
+}
+
+// extrapolatedRate is the common implementation of rate, increase and delta.
+// It takes counter resets into account if isCounter, extrapolates the result
+// to the boundaries of the range and returns a per-second value if isRate.
+func extrapolatedRate(c *rangeCall, isCounter bool, isRate bool) (float64, bool, error) {
+	points := c.points
+	if len(points) < 2 {
+		return 0, false, nil
+	}
+
+	var counterCorrection, lastValue float64
+	for _, p := range points {
+		if isCounter && p.V < lastValue {
+			counterCorrection += lastValue
+		}
+		lastValue = p.V
+	}
+	return extrapolate(c, points[0], points[len(points)-1], len(points), counterCorrection, isCounter, isRate), true, nil
+}
+
+// extrapolate computes extrapolatedRate from the first and the last of the n
+// samples in the range and the counter correction between them.
+func extrapolate(c *rangeCall, first, last promql.Point, n int, counterCorrection float64, isCounter bool, isRate bool) float64 {
+	resultValue := last.V - first.V + counterCorrection
+
+	durationToStart := float64(first.T-c.rangeStart) / 1000
+	durationToEnd := float64(c.rangeEnd-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageDurationBetweenSamples := sampledInterval / float64(n-1)
+
+	if isCounter && resultValue > 0 && first.V >= 0 {
+		// Counters can't be negative, don't extrapolate before the zero point.
+		durationToZero := sampledInterval * (first.V / resultValue)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	// Extrapolate to the boundaries if the first and last samples are close
+	// to them, otherwise to half of the average interval.
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	resultValue = resultValue * (extrapolateToInterval / sampledInterval)
+	if isRate {
+		resultValue = resultValue / c.selRange.Seconds()
+	}
+	return resultValue
+}
+
+func funcRate(c *rangeCall) (float64, bool, error) {
+	return extrapolatedRate(c, true, true)
+}
+
+func funcIncrease(c *rangeCall) (float64, bool, error) {
+	return extrapolatedRate(c, true, false)
+}
+
+func funcDelta(c *rangeCall) (float64, bool, error) {
+	return extrapolatedRate(c, false, false)
+}
+
+// instantValue is the common implementation of irate and idelta, computed
+// from the last two samples of the range.
+func instantValue(c *rangeCall, isRate bool) (float64, bool, error) {
+	if len(c.points) < 2 {
+		return 0, false, nil
+	}
+	v, ok := instantDelta(c.points[len(c.points)-2], c.points[len(c.points)-1], isRate)
+	return v, ok, nil
+}
+
+// instantDelta computes instantValue from the last two samples of the range.
+func instantDelta(previous, last promql.Point, isRate bool) (float64, bool) {
+	var resultValue float64
+	if isRate && last.V < previous.V {
+		// counter reset
+		resultValue = last.V
+	} else {
+		resultValue = last.V - previous.V
+	}
+
+	sampledInterval := last.T - previous.T
+	if sampledInterval == 0 {
+		return 0, false
+	}
+	if isRate {
+		resultValue /= float64(sampledInterval) / 1000
+	}
+	return resultValue, true
+}
+
+func funcIRate(c *rangeCall) (float64, bool, error) {
+	return instantValue(c, true)
+}
+
+func funcIDelta(c *rangeCall) (float64, bool, error) {
+	return instantValue(c, false)
+}
+
+// linearRegression returns the least-square slope and the intercept at
+// interceptTime of points.
+func linearRegression(points []promql.Point, interceptTime int64) (slope, intercept float64) {
+	var n, sumX, sumY, sumXY, sumX2 float64
+	for _, p := range points {
+		x := float64(p.T-interceptTime) / 1e3
+		n += 1.0
+		sumY += p.V
+		sumX += x
+		sumXY += x * p.V
+		sumX2 += x * x
+	}
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+
+	slope = covXY / varX
+	intercept = sumY/n - slope*sumX/n
+	return slope, intercept
+}
+
+func funcDeriv(c *rangeCall) (float64, bool, error) {
+	if len(c.points) < 2 {
+		return 0, false, nil
+	}
+	// use a timestamp near the samples to avoid floating point accuracy issues
+	slope, _ := linearRegression(c.points, c.points[0].T)
+	return slope, true, nil
+}
+
+func funcPredictLinear(c *rangeCall) (float64, bool, error) {
+	if len(c.points) < 2 {
+		return 0, false, nil
+	}
+	slope, intercept := linearRegression(c.points, c.ts)
+	return slope*c.scalars[0] + intercept, true, nil
+}
+
+func funcHoltWinters(c *rangeCall) (float64, bool, error) {
+	sf, tf := c.scalars[0], c.scalars[1]
+	if sf <= 0 || sf >= 1 {
+		return 0, false, errors.Errorf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+	}
+	if tf <= 0 || tf >= 1 {
+		return 0, false, errors.Errorf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+	}
+	if len(c.points) < 2 {
+		return 0, false, nil
+	}
+
+	var s0, s1, b float64
+	s1 = c.points[0].V
+	b = c.points[1].V - c.points[0].V
+	for i := 1; i < len(c.points); i++ {
+		x := sf * c.points[i].V
+		if i > 1 {
+			b = tf*(s1-s0) + (1-tf)*b
+		}
+		y := (1 - sf) * (s1 + b)
+		s0, s1 = s1, x+y
+	}
+	return s1, true, nil
+}
+
+func funcChanges(c *rangeCall) (float64, bool, error) {
+	changes := 0
+	prev := c.points[0].V
+	for _, p := range c.points[1:] {
+		if p.V != prev && !(math.IsNaN(p.V) && math.IsNaN(prev)) {
+			changes++
+		}
+		prev = p.V
+	}
+	return float64(changes), true, nil
+}
+
+func funcResets(c *rangeCall) (float64, bool, error) {
+	resets := 0
+	prev := c.points[0].V
+	for _, p := range c.points[1:] {
+		if p.V < prev {
+			resets++
+		}
+		prev = p.V
+	}
+	return float64(resets), true, nil
+}
+
+func funcAvgOverTime(c *rangeCall) (float64, bool, error) {
+	var mean, count float64
+	for _, p := range c.points {
+		count++
+		mean += (p.V - mean) / count
+	}
+	return mean, true, nil
+}
+
+func funcCountOverTime(c *rangeCall) (float64, bool, error) {
+	return float64(len(c.points)), true, nil
+}
+
+func funcMaxOverTime(c *rangeCall) (float64, bool, error) {
+	max := c.points[0].V
+	for _, p := range c.points {
+		if p.V > max || math.IsNaN(max) {
+			max = p.V
+		}
+	}
+	return max, true, nil
+}
+
+func funcMinOverTime(c *rangeCall) (float64, bool, error) {
+	min := c.points[0].V
+	for _, p := range c.points {
+		if p.V < min || math.IsNaN(min) {
+			min = p.V
+		}
+	}
+	return min, true, nil
+}
+
+func funcSumOverTime(c *rangeCall) (float64, bool, error) {
+	var sum float64
+	for _, p := range c.points {
+		sum += p.V
+	}
+	return sum, true, nil
+}
+
+func funcQuantileOverTime(c *rangeCall) (float64, bool, error) {
+	values := make([]float64, 0, len(c.points))
+	for _, p := range c.points {
+		values = append(values, p.V)
+	}
+	return quantile(c.scalars[0], values), true, nil
 }
 
-func buildFunctionIRate(call *promql.Call, time time.Time) (sql string, err error) {
-	return
+func stdvarOverTime(points []promql.Point) float64 {
+	var aux, count, mean float64
+	for _, p := range points {
+		count++
+		delta := p.V - mean
+		mean += delta / count
+		aux += delta * (p.V - mean)
+	}
+	return aux / count
 }
 
-func buildFunctionHistogramQuantile(call *promql.Call, time time.Time) (sql string, err error) {
-	return
+func funcStddevOverTime(c *rangeCall) (float64, bool, error) {
+	return math.Sqrt(stdvarOverTime(c.points)), true, nil
 }
 
-func buildFunctionDelta(call *promql.Call, time time.Time) (sql string, err error) {
-	return
+func funcStdvarOverTime(c *rangeCall) (float64, bool, error) {
+	return stdvarOverTime(c.points), true, nil
 }
 
-func buildFunctionIncrease(call *promql.Call, time time.Time) (sql string, err error) {
-	return
+// quantile returns the φ-quantile of values, interpolating between the two
+// nearest values. values will be sorted.
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+	sort.Float64s(values)
+
+	n := float64(len(values))
+	rank := q * (n - 1)
+	lowerIndex := math.Max(0, math.Floor(rank))
+	upperIndex := math.Min(n-1, lowerIndex+1)
+
+	weight := rank - math.Floor(rank)
+	return values[int(lowerIndex)]*(1-weight) + values[int(upperIndex)]*weight
+}
+
+func simpleFunction(f func(float64) float64) func(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+	return func(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+		vec := args[0].(promql.Vector)
+		out := make(promql.Vector, 0, len(vec))
+		for _, s := range vec {
+			out = append(out, promql.Sample{
+				Metric: dropMetricName(s.Metric),
+				Point:  promql.Point{V: f(s.V)},
+			})
+		}
+		return out, nil
+	}
+}
+
+func funcRound(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+	toNearest := 1.0
+	if len(args) >= 2 {
+		toNearest = scalarArg(args[1])
+	}
+	// invert as it seems to cause fewer floating point accuracy issues
+	toNearestInverse := 1.0 / toNearest
+	return simpleFunction(func(v float64) float64 {
+		return math.Floor(v*toNearestInverse+0.5) / toNearestInverse
+	})(call, args, ts)
+}
+
+func funcClampMax(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+	max := scalarArg(args[1])
+	return simpleFunction(func(v float64) float64 { return math.Min(max, v) })(call, args, ts)
+}
+
+func funcClampMin(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+	min := scalarArg(args[1])
+	return simpleFunction(func(v float64) float64 { return math.Max(min, v) })(call, args, ts)
+}
+
+func funcScalar(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	vec := args[0].(promql.Vector)
+	if len(vec) != 1 {
+		return promql.Vector{promql.Sample{Point: promql.Point{V: math.NaN()}}}, nil
+	}
+	return promql.Vector{promql.Sample{Point: promql.Point{V: vec[0].V}}}, nil
+}
+
+func funcVector(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	return promql.Vector{promql.Sample{Metric: labels.Labels{}, Point: promql.Point{V: scalarArg(args[0])}}}, nil
+}
+
+func funcTime(_ *promql.Call, _ []promql.Value, ts int64) (promql.Vector, error) {
+	return promql.Vector{promql.Sample{Point: promql.Point{V: float64(ts) / 1000}}}, nil
+}
+
+func funcTimestamp(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	vec := args[0].(promql.Vector)
+	out := make(promql.Vector, 0, len(vec))
+	for _, s := range vec {
+		out = append(out, promql.Sample{
+			Metric: dropMetricName(s.Metric),
+			Point:  promql.Point{V: float64(s.T) / 1000},
+		})
+	}
+	return out, nil
+}
+
+// lessNaNLast orders vector values ascending, with NaN sorting last.
+func lessNaNLast(a, b float64) bool {
+	if math.IsNaN(a) {
+		return false
+	}
+	return math.IsNaN(b) || a < b
+}
+
+func funcSort(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	vec := args[0].(promql.Vector)
+	sort.SliceStable(vec, func(i, j int) bool { return lessNaNLast(vec[i].V, vec[j].V) })
+	return vec, nil
+}
+
+func funcSortDesc(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	vec := args[0].(promql.Vector)
+	sort.SliceStable(vec, func(i, j int) bool { return lessNaNLast(-vec[i].V, -vec[j].V) })
+	return vec, nil
+}
+
+func funcAbsent(call *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	if len(args[0].(promql.Vector)) > 0 {
+		return nil, nil
+	}
+	var metric labels.Labels
+	if vs, ok := call.Args[0].(*promql.VectorSelector); ok {
+		for _, m := range vs.LabelMatchers {
+			if m.Type == labels.MatchEqual && m.Name != labels.MetricName {
+				metric = append(metric, labels.Label{Name: m.Name, Value: m.Value})
+			}
+		}
+	}
+	sort.Sort(metric)
+	return promql.Vector{promql.Sample{Metric: metric, Point: promql.Point{V: 1}}}, nil
+}
+
+func funcLabelReplace(call *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	var (
+		vec      = args[0].(promql.Vector)
+		dst      = call.Args[1].(*promql.StringLiteral).Val
+		repl     = call.Args[2].(*promql.StringLiteral).Val
+		src      = call.Args[3].(*promql.StringLiteral).Val
+		regexStr = call.Args[4].(*promql.StringLiteral).Val
+	)
+
+	regex, err := regexp.Compile("^(?:" + regexStr + ")$")
+	if err != nil {
+		return nil, errors.Errorf("invalid regular expression in label_replace(): %s", regexStr)
+	}
+	if !model.LabelName(dst).IsValid() {
+		return nil, errors.Errorf("invalid destination label name in label_replace(): %s", dst)
+	}
+
+	out := make(promql.Vector, 0, len(vec))
+	for _, s := range vec {
+		srcVal := s.Metric.Get(src)
+		indexes := regex.FindStringSubmatchIndex(srcVal)
+		metric := s.Metric
+		if indexes != nil {
+			res := regex.ExpandString([]byte{}, repl, srcVal, indexes)
+			lb := labels.NewBuilder(s.Metric).Del(dst)
+			if len(res) > 0 {
+				lb.Set(dst, string(res))
+			}
+			metric = lb.Labels()
+		}
+		out = append(out, promql.Sample{Metric: metric, Point: promql.Point{V: s.V}})
+	}
+	return out, nil
+}
+
+func funcLabelJoin(call *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	var (
+		vec = args[0].(promql.Vector)
+		dst = call.Args[1].(*promql.StringLiteral).Val
+		sep = call.Args[2].(*promql.StringLiteral).Val
+	)
+
+	srcLabels := make([]string, 0, len(call.Args)-3)
+	for _, arg := range call.Args[3:] {
+		src := arg.(*promql.StringLiteral).Val
+		if !model.LabelName(src).IsValid() {
+			return nil, errors.Errorf("invalid source label name in label_join(): %s", src)
+		}
+		srcLabels = append(srcLabels, src)
+	}
+	if !model.LabelName(dst).IsValid() {
+		return nil, errors.Errorf("invalid destination label name in label_join(): %s", dst)
+	}
+
+	out := make(promql.Vector, 0, len(vec))
+	srcVals := make([]string, len(srcLabels))
+	for _, s := range vec {
+		for i, src := range srcLabels {
+			srcVals[i] = s.Metric.Get(src)
+		}
+		lb := labels.NewBuilder(s.Metric)
+		if v := strings.Join(srcVals, sep); v == "" {
+			lb.Del(dst)
+		} else {
+			lb.Set(dst, v)
+		}
+		out = append(out, promql.Sample{Metric: lb.Labels(), Point: promql.Point{V: s.V}})
+	}
+	return out, nil
+}
+
+// dateFunction builds a function returning f of the timestamps held by the
+// argument, or of the evaluation step if there is no argument.
+func dateFunction(f func(t time.Time) float64) func(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+	return func(call *promql.Call, args []promql.Value, ts int64) (promql.Vector, error) {
+		if len(args) == 0 {
+			return promql.Vector{promql.Sample{
+				Metric: labels.Labels{},
+				Point:  promql.Point{V: f(time.Unix(ts/1000, 0).UTC())},
+			}}, nil
+		}
+		return simpleFunction(func(v float64) float64 {
+			return f(time.Unix(int64(v), 0).UTC())
+		})(call, args, ts)
+	}
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+func funcHistogramQuantile(_ *promql.Call, args []promql.Value, _ int64) (promql.Vector, error) {
+	q := scalarArg(args[0])
+	vec := args[1].(promql.Vector)
+
+	type metricWithBuckets struct {
+		metric  labels.Labels
+		buckets []bucket
+	}
+	var groups []*metricWithBuckets
+	groupIndex := map[uint64]int{}
+	for _, s := range vec {
+		upperBound, err := strconv.ParseFloat(s.Metric.Get(model.BucketLabel), 64)
+		if err != nil {
+			// no bucket label or malformed label value, skip it
+			continue
+		}
+		h := s.Metric.HashWithoutLabels(labels.MetricName, labels.BucketLabel)
+		index, ok := groupIndex[h]
+		if !ok {
+			index = len(groups)
+			groupIndex[h] = index
+			groups = append(groups, &metricWithBuckets{
+				metric: labels.NewBuilder(s.Metric).Del(labels.BucketLabel, labels.MetricName).Labels(),
+			})
+		}
+		groups[index].buckets = append(groups[index].buckets, bucket{upperBound: upperBound, count: s.V})
+	}
+
+	out := make(promql.Vector, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, promql.Sample{
+			Metric: g.metric,
+			Point:  promql.Point{V: bucketQuantile(q, g.buckets)},
+		})
+	}
+	return out, nil
+}
+
+// bucketQuantile calculates the φ-quantile of buckets, assuming a linear
+// distribution within a bucket, the same as Prometheus. The highest bucket
+// must be +Inf, otherwise NaN is returned.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if !math.IsInf(buckets[len(buckets)-1].upperBound, +1) {
+		return math.NaN()
+	}
+
+	// Buckets are scraped non-atomically, so the counts may not increase
+	// monotonically. Use the envelope of the counts instead.
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	rank := q * buckets[len(buckets)-1].count
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].upperBound
+		count       = buckets[b].count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+func buildFunctionRate(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildExtrapolatedRate(call, ev, true, true)
+}
+
+func buildFunctionIRate(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildInstantValue(call, ev, true)
+}
+
+func buildFunctionIDelta(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildInstantValue(call, ev, false)
+}
+
+// buildFunctionHistogramQuantile pushes down the buckets, usually the rates
+// of them summed by le, and leaves the interpolation to execSQLPlan.
+func buildFunctionHistogramQuantile(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	q, ok := numberLiteral(call.Args[0])
+	if !ok {
+		return nil, nil
+	}
+	plan, err = buildInputPlan(call.Args[1], ev)
+	if err != nil || plan == nil {
+		return nil, err
+	}
+	plan.histogramQuantile = &q
+	return plan, nil
+}
+
+// histogramQuantile evaluates histogram_quantile over the buckets in mat at
+// every step.
+func (ev *evaluator) histogramQuantile(q float64, mat promql.Matrix) (promql.Matrix, error) {
+	vectors := map[int64]promql.Vector{}
+	for _, series := range mat {
+		for _, p := range series.Points {
+			vectors[p.T] = append(vectors[p.T], promql.Sample{Metric: series.Metric, Point: p})
+		}
+	}
+
+	var res promql.Matrix
+	resIndex := map[uint64]int{}
+	phi := promql.Vector{promql.Sample{Point: promql.Point{V: q}}}
+	for ts := ev.startMs; ts <= ev.endMs; ts += ev.intervalMs {
+		buckets, ok := vectors[ts]
+		if !ok {
+			continue
+		}
+		out, err := funcHistogramQuantile(nil, []promql.Value{phi, buckets}, ts)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range out {
+			h := sample.Metric.Hash()
+			index, ok := resIndex[h]
+			if !ok {
+				index = len(res)
+				resIndex[h] = index
+				res = append(res, promql.Series{Metric: sample.Metric})
+			}
+			res[index].Points = append(res[index].Points, promql.Point{T: ts, V: sample.V})
+		}
+	}
+	return res, nil
+}
+
+func buildFunctionDelta(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildExtrapolatedRate(call, ev, false, false)
+}
+
+func buildFunctionIncrease(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
+	return buildExtrapolatedRate(call, ev, true, false)
+}
+
+// buildExtrapolatedRate is the SQL version of extrapolatedRate. The first and
+// last samples of every step and the counter correction are aggregated from
+// the window rows, then the result is extrapolated to the range boundaries.
+func buildExtrapolatedRate(call *promql.Call, ev *evaluator, isCounter bool, isRate bool) (*sqlPlan, error) {
+	ms, ok := call.Args[0].(*promql.MatrixSelector)
+	if !ok {
+		return nil, nil
+	}
+	w, err := ev.buildWindowSQL(ms)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	offset := durationMilliseconds(ms.Offset)
+	selRange := durationMilliseconds(ms.Range)
+
+	var args []interface{}
+	var sb strings.Builder
+	sb.WriteString(`
+SELECT tsid, k, result * (sampled`)
+
+	// Counters can't be negative, don't extrapolate before the zero point.
+	toStart := "to_start"
+	if isCounter {
+		toStart = "LEAST(to_start, CASE WHEN result > 0 AND first_v >= 0 THEN sampled * (first_v / result) ELSE to_start END)"
+	}
+	sb.WriteString(`
+    + CASE WHEN ` + toStart + ` < avg_interval * 1.1 THEN ` + toStart + ` ELSE avg_interval / 2 END
+    + CASE WHEN to_end < avg_interval * 1.1 THEN to_end ELSE avg_interval / 2 END
+  ) / sampled`)
+	if isRate {
+		sb.WriteString(" / ?")
+		args = append(args, float64(selRange)/1000)
+	}
+	sb.WriteString(` AS v
+FROM (
+  SELECT tsid, k, first_v, last_v - first_v + correction AS result,
+    (last_t - first_t) / 1e3 AS sampled,
+    (last_t - first_t) / 1e3 / (n - 1) AS avg_interval,
+    (first_t - (? + k * ?)) / 1e3 AS to_start,
+    (? + k * ? - last_t) / 1e3 AS to_end
+  FROM (
+    SELECT tsid, k, COUNT(*) AS n, MIN(t) AS first_t, MAX(t) AS last_t,
+      MAX(CASE WHEN prev_t IS NULL THEN v END) AS first_v,
+      MAX(CASE WHEN next_t IS NULL THEN v END) AS last_v,`)
+	args = append(args, ev.startMs-offset-selRange, ev.intervalMs, ev.startMs-offset, ev.intervalMs)
+	if isCounter {
+		sb.WriteString(`
+      SUM(CASE WHEN v < prev_v THEN prev_v ELSE 0 END) AS correction`)
+	} else {
+		sb.WriteString(`
+      0 AS correction`)
+	}
+	sb.WriteString(`
+    FROM (`)
+	sb.WriteString(w.sql)
+	args = append(args, w.args...)
+	sb.WriteString(`
+    ) w
+    GROUP BY tsid, k
+    HAVING COUNT(*) >= 2
+  ) a
+) b`)
+	return ev.buildSeriesPlan(w.sel, false, sb.String(), args), nil
+}
+
+// buildInstantValue is the SQL version of instantValue, computed from the
+// last two samples of every step.
+func buildInstantValue(call *promql.Call, ev *evaluator, isRate bool) (*sqlPlan, error) {
+	ms, ok := call.Args[0].(*promql.MatrixSelector)
+	if !ok {
+		return nil, nil
+	}
+	w, err := ev.buildWindowSQL(ms)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	if isRate {
+		sb.WriteString(`
+SELECT tsid, k, CASE WHEN v < prev_v THEN v ELSE v - prev_v END / ((t - prev_t) / 1e3) AS v`)
+	} else {
+		sb.WriteString(`
+SELECT tsid, k, v - prev_v AS v`)
+	}
+	sb.WriteString(`
+FROM (`)
+	sb.WriteString(w.sql)
+	sb.WriteString(`
+) w
+WHERE next_t IS NULL AND prev_t IS NOT NULL AND t != prev_t`)
+	return ev.buildSeriesPlan(w.sel, false, sb.String(), w.args), nil
 }
@@ -1,7 +1,7 @@
 package parser
 
 import (
-	"strconv"
+	"context"
 	"time"
 
 	"github.com/showhand-lab/flash-metrics/store"
@@ -12,173 +12,227 @@ import (
 	"go.uber.org/zap"
 )
 
-func NewRangeQuery(storage store.MetricStorage, qry string, start, end time.Time, step time.Duration) (result promql.Value, err error) {
+// NewRangeQuery evaluates qry at every step in [start, end]. The result is a
+// promql.Matrix, scalar expressions are returned as a single series without labels.
+func NewRangeQuery(ctx context.Context, storage store.MetricStorage, qry string, start, end time.Time, step time.Duration) (result promql.Value, err error) {
+	return rangeQuery(ctx, storage, true, qry, start, end, step)
+}
+
+func rangeQuery(ctx context.Context, storage store.MetricStorage, pushdown bool, qry string, start, end time.Time, step time.Duration) (result promql.Value, err error) {
 	log.Info("", zap.Any("qry", qry))
 
+	if step <= 0 {
+		return nil, errors.New("zero or negative query resolution step widths are not accepted")
+	}
+	if end.Before(start) {
+		return nil, errors.New("end timestamp must not be before start time")
+	}
+
+	now := time.Now()
 	expr, err := promql.ParseExpr(qry)
+	store.QueryStatsFromContext(ctx).AddParseTime(time.Since(now))
 	if err != nil {
 		log.Warn("parse promql failed", zap.Error(err))
 		return nil, err
 	}
+	if t := expr.Type(); t != promql.ValueTypeVector && t != promql.ValueTypeScalar {
+		return nil, errors.Errorf("invalid expression type %q for range query, must be Scalar or instant Vector", t)
+	}
 
-	if solver := tryMatchQPSPattern(expr); solver != nil {
-		log.Debug("QPS Pattern attached!")
-		tsids, err := solver.GetTsIDs(storage.(*store.DefaultMetricStorage))
-		if err != nil {
-			return nil, err
-		}
-
-		solver.args = append(solver.args, float64(step/time.Second))
-		solver.args = append(solver.args, float64(step/time.Second)) // TODO: fix the bug, see TestDoQuery for more details.
-		solver.args = append(solver.args, tsids)
-		solver.args = append(solver.args, start.Unix())
-		solver.args = append(solver.args, end.Unix())
+	ev := newEvaluator(ctx, storage, start, end, step)
+	if !pushdown {
+		ev.db = nil
+	}
+	val, err := ev.eval(expr)
+	if err != nil {
+		log.Warn("evaluate promql failed", zap.Error(err))
+		return nil, err
+	}
 
-		if err = solver.ExecuteQuery(storage.(*store.DefaultMetricStorage)); err != nil {
-			return nil, err
+	mat := val.(promql.Matrix)
+	res := make(promql.Matrix, 0, len(mat))
+	for _, s := range mat {
+		if len(s.Points) > 0 {
+			res = append(res, s)
 		}
-
-		return solver.result, nil
 	}
+	return res, nil
+}
 
-	log.Warn("no promql pattern matched!")
-	return nil, nil
+// NewInstantQuery evaluates qry at ts. The result is a promql.Vector, or a
+// promql.Matrix, promql.Scalar or promql.String depending on the type of qry.
+func NewInstantQuery(ctx context.Context, storage store.MetricStorage, qry string, ts time.Time) (result promql.Value, err error) {
+	return instantQuery(ctx, storage, true, qry, ts)
 }
 
-func NewInstantQuery(storage store.MetricStorage, qry string, time time.Time) (sql string, err error) {
+func instantQuery(ctx context.Context, storage store.MetricStorage, pushdown bool, qry string, ts time.Time) (result promql.Value, err error) {
 	log.Info("", zap.Any("qry", qry))
 
+	now := time.Now()
 	expr, err := promql.ParseExpr(qry)
-
+	store.QueryStatsFromContext(ctx).AddParseTime(time.Since(now))
 	if err != nil {
 		log.Warn("parse promql failed", zap.Error(err))
-		return "", err
+		return nil, err
 	}
 
-	sql, err = buildSQLForInstantQuery(expr, time)
+	ev := newEvaluator(ctx, storage, ts, ts, 0)
+	if !pushdown {
+		ev.db = nil
+	}
+	val, err := ev.eval(expr)
 	if err != nil {
-		log.Warn("build sql failed", zap.Error(err))
-		return sql, err
+		log.Warn("evaluate promql failed", zap.Error(err))
+		return nil, err
 	}
 
-	log.Info("build success", zap.String("sql", sql))
+	switch expr.Type() {
+	case promql.ValueTypeMatrix, promql.ValueTypeString:
+		return val, nil
+	case promql.ValueTypeScalar:
+		return promql.Scalar{T: ev.startMs, V: scalarAt(val.(promql.Matrix), 0)}, nil
+	}
 
-	return sql, err
+	mat := val.(promql.Matrix)
+	vec := make(promql.Vector, 0, len(mat))
+	for _, s := range mat {
+		if len(s.Points) == 0 {
+			continue
+		}
+		vec = append(vec, promql.Sample{Metric: s.Metric, Point: promql.Point{T: ev.startMs, V: s.Points[0].V}})
+	}
+	return vec, nil
 }
 
-func buildSQLForInstantQuery(expr promql.Expr, time time.Time) (sql string, err error) {
+// buildSQLPlan tries to push the computation of expr down to TiDB. It returns
+// a nil plan if expr should be evaluated in process.
+func buildSQLPlan(expr promql.Expr, ev *evaluator) (plan *sqlPlan, err error) {
 	switch x := expr.(type) {
-	case *promql.VectorSelector:
-		return buildVectorSelector(x, time)
-	case *promql.MatrixSelector:
-		return buildMatrixSelector(x, time)
 	case *promql.Call:
-		return buildCall(x, time)
+		return buildCall(x, ev)
 	case *promql.AggregateExpr:
-		return buildAggregateExpr(x, time)
+		return buildAggregateExpr(x, ev)
 	case *promql.BinaryExpr:
-		return buildBinaryExpr(x, time)
-	case *promql.ParenExpr:
-		return buildSQLForInstantQuery(x.Expr, time)
+		return buildBinaryExpr(x, ev)
 	case *promql.UnaryExpr:
-		return buildUnaryExpr(x, time)
+		return buildUnaryExpr(x, ev)
 	}
 
-	return "", errors.Errorf("unkown ast node %T", expr)
-}
-
-func buildVectorSelector(vc *promql.VectorSelector, t time.Time) (sql string, err error) {
-	//var sb strings.Builder
-
-	sql = "select * from flash_metrics_index where metric_name = " + vc.Name + " and timestamp = " + strconv.FormatInt(t.Unix(), 10)
-
-	return sql, nil
+	return nil, nil
 }
 
-func buildMatrixSelector(vc *promql.MatrixSelector, t time.Time) (sql string, err error) {
-	//var sb strings.Builder
-
-	sql = "select * from flash_metrics_index where metric_name = " + vc.Name + " and timestamp = " + strconv.FormatInt(t.Unix(), 10)
-
-	return sql, nil
+// buildInputPlan builds the plan of an argument of a pushed down expression.
+// Unlike buildSQLPlan, vector selectors are pushed down as well, while plans
+// with a value label or computing the value in process are not.
+func buildInputPlan(expr promql.Expr, ev *evaluator) (plan *sqlPlan, err error) {
+	switch x := expr.(type) {
+	case *promql.ParenExpr:
+		return buildInputPlan(x.Expr, ev)
+	case *promql.VectorSelector:
+		return ev.buildVectorSelector(x)
+	}
+	plan, err = buildSQLPlan(expr, ev)
+	if err != nil || plan == nil || plan.valueLabel != "" || plan.binop != "" || plan.histogramQuantile != nil {
+		return nil, err
+	}
+	return plan, nil
 }
 
-func buildCall(call *promql.Call, time time.Time) (sql string, err error) {
+func buildCall(call *promql.Call, ev *evaluator) (plan *sqlPlan, err error) {
 	switch call.Func.Name {
 	case "rate":
-		return buildFunctionRate(call, time)
+		return buildFunctionRate(call, ev)
 	case "histogram_quantile":
-		return buildFunctionHistogramQuantile(call, time)
+		return buildFunctionHistogramQuantile(call, ev)
 	case "irate":
-		return buildFunctionIRate(call, time)
+		return buildFunctionIRate(call, ev)
+	case "idelta":
+		return buildFunctionIDelta(call, ev)
 	case "delta":
-		return buildFunctionDelta(call, time)
+		return buildFunctionDelta(call, ev)
 	case "increase":
-		return buildFunctionIncrease(call, time)
+		return buildFunctionIncrease(call, ev)
 	}
 
-	return "", errors.Errorf("unkown function %v", call.Func.Name)
+	return nil, nil
 }
 
-func buildAggregateExpr(agg *promql.AggregateExpr, time time.Time) (sql string, err error) {
-	switch agg.Op {
-	case 40:
-		return buildAggregationAgg(agg, time)
-	case 41:
-		return buildAggregationCount(agg, time)
-	case 42: //promql.itemSum:
-		return buildAggregationSum(agg, time)
-	case 43:
-		return buildAggregationMin(agg, time)
-	case 44:
-		return buildAggregationMax(agg, time)
-	case 47:
-		return buildAggregationTopK(agg, time)
-	}
-
-	return "", errors.Errorf("unkown agg function %v", agg.Op)
-}
+func buildAggregateExpr(agg *promql.AggregateExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	switch agg.Op.String() {
+	case "avg":
+		return buildAggregationAvg(agg, ev)
+	case "count":
+		return buildAggregationCount(agg, ev)
+	case "sum":
+		return buildAggregationSum(agg, ev)
+	case "min":
+		return buildAggregationMin(agg, ev)
+	case "max":
+		return buildAggregationMax(agg, ev)
+	case "stddev":
+		return buildAggregationStddev(agg, ev)
+	case "stdvar":
+		return buildAggregationStdvar(agg, ev)
+	case "topk":
+		return buildAggregationTopK(agg, ev)
+	case "bottomk":
+		return buildAggregationBottomK(agg, ev)
+	case "quantile":
+		return buildAggregationQuantile(agg, ev)
+	case "count_values":
+		return buildAggregationCountValues(agg, ev)
+	}
 
-func buildBinaryExpr(bin *promql.BinaryExpr, time time.Time) (sql string, err error) {
-	switch bin.Op {
-	case 21:
-		return buildBinaryOperatorSUB(bin, time)
-	case 22:
-		return buildBinaryOperatorADD(bin, time)
-	case 23:
-		return buildBinaryOperatorMUL(bin, time)
-	case 24:
-		return buildBinaryOperatorMOD(bin, time)
-	case 25:
-		return buildBinaryOperatorDIV(bin, time)
-	case 26:
-		return buildBinaryOperatorLAND(bin, time)
-	case 27:
-		return buildBinaryOperatorLOR(bin, time)
-	case 28:
-		return buildBinaryOperatorLUnless(bin, time)
-	case 29:
-		return buildBinaryOperatorEQL(bin, time)
-	case 30:
-		return buildBinaryOperatorNEQ(bin, time)
-	case 31:
-		return buildBinaryOperatorLTE(bin, time)
-	case 32:
-		return buildBinaryOperatorLSS(bin, time)
-	case 33:
-		return buildBinaryOperatorGTE(bin, time)
-	case 34:
-		return buildBinaryOperatorGTR(bin, time)
-	}
-
-	return "", errors.Errorf("unkown binary operator %v", bin.Op)
+	return nil, nil
 }
 
-func buildUnaryExpr(unary *promql.UnaryExpr, time time.Time) (sql string, err error) {
-	switch unary.Op {
-	case 21: // neg
-		return
+func buildBinaryExpr(bin *promql.BinaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	switch bin.Op.String() {
+	case "-":
+		return buildBinaryOperatorSUB(bin, ev)
+	case "+":
+		return buildBinaryOperatorADD(bin, ev)
+	case "*":
+		return buildBinaryOperatorMUL(bin, ev)
+	case "%":
+		return buildBinaryOperatorMOD(bin, ev)
+	case "/":
+		return buildBinaryOperatorDIV(bin, ev)
+	case "^":
+		return buildBinaryOperatorPOW(bin, ev)
+	case "and":
+		return buildBinaryOperatorLAND(bin, ev)
+	case "or":
+		return buildBinaryOperatorLOR(bin, ev)
+	case "unless":
+		return buildBinaryOperatorLUnless(bin, ev)
+	case "==":
+		return buildBinaryOperatorEQL(bin, ev)
+	case "!=":
+		return buildBinaryOperatorNEQ(bin, ev)
+	case "<=":
+		return buildBinaryOperatorLTE(bin, ev)
+	case "<":
+		return buildBinaryOperatorLSS(bin, ev)
+	case ">=":
+		return buildBinaryOperatorGTE(bin, ev)
+	case ">":
+		return buildBinaryOperatorGTR(bin, ev)
 	}
 
-	return "", errors.Errorf("unkown unary operator %v", unary.Op)
+	return nil, nil
+}
+
+func buildUnaryExpr(unary *promql.UnaryExpr, ev *evaluator) (plan *sqlPlan, err error) {
+	if unary.Expr.Type() != promql.ValueTypeVector {
+		return nil, nil
+	}
+	if unary.Op.String() != "-" {
+		return buildInputPlan(unary.Expr, ev)
+	}
+	return buildBinop(&promql.BinaryExpr{
+		Op:  unary.Op,
+		LHS: &promql.NumberLiteral{Val: 0},
+		RHS: unary.Expr,
+	}, ev, "-")
 }
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -24,6 +25,7 @@ func TestQueryParse(t *testing.T) {
 	defer fi.Close()
 
 	br := bufio.NewReader(fi)
+	storage := newTestStorage()
 
 	cnt := 0
 	skipped := 0
@@ -41,9 +43,13 @@ func TestQueryParse(t *testing.T) {
 			continue
 		}
 
-		_, err = NewInstantQuery(nil, line, time.Now())
+		now := time.Now()
+		_, err = NewInstantQuery(context.Background(), storage, line, now)
+		if err == nil {
+			_, err = NewRangeQuery(context.Background(), storage, line, now.Add(-time.Hour), now, time.Minute)
+		}
 		if err != nil {
-			t.Fatalf("already pass %d promqls", cnt)
+			t.Fatalf("already pass %d promqls, %s: %v", cnt, line, err)
 		}
 		cnt++
 	}
@@ -55,7 +61,7 @@ func TestTiFlashRequestQPS(t *testing.T) {
 
 	line := "rate(tiflash_coprocessor_request_count{tidb_cluster=\"$tidb_cluster\", instance=~\"$instance\"}[1m])"
 
-	_, err := NewRangeQuery(nil, line, time.Now(), time.Now(), time.Second)
+	_, err := NewRangeQuery(context.Background(), newTestStorage(), line, time.Now(), time.Now(), time.Second)
 	if err != nil {
 		log.Fatal("parse failed", zap.Error(err))
 	}
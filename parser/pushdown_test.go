@@ -0,0 +1,156 @@
+package parser
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pushdownBase is where the test data is stored, TIMESTAMP columns can't
+// hold the epoch.
+var pushdownBase = time.Unix(1640000000, 0)
+
+// newPushdownStorage stores the series of newTestStorage, moved to
+// pushdownBase, plus a counter with resets.
+func newPushdownStorage(t *testing.T, storage store.MetricStorage) {
+	m := newTestStorage()
+	m.addSeries("process_restarts_total", map[string]string{"job": "api"}, 41, func(i int) float64 {
+		return float64(i % 7 * 5)
+	})
+
+	baseMs := timeMilliseconds(pushdownBase)
+	var timeSeries []*model.TimeSeries
+	for _, ts := range m.series {
+		moved := model.TimeSeries{Name: ts.Name, Labels: ts.Labels}
+		for _, s := range ts.Samples {
+			moved.Samples = append(moved.Samples, model.Sample{TimestampMs: baseMs + s.TimestampMs, Value: s.Value})
+		}
+		timeSeries = append(timeSeries, &moved)
+	}
+	require.NoError(t, storage.BatchStore(context.Background(), timeSeries))
+}
+
+// requireSamePushdown compares the results of queries with and without
+// pushdown on the data of newPushdownStorage in a new database.
+func requireSamePushdown(t *testing.T, dbName string, queries []string) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDB(dbName)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB(dbName, db))
+	}()
+
+	storage := store.NewDefaultMetricStorage(db)
+	defer storage.Close()
+	newPushdownStorage(t, storage)
+
+	pushdown, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash, Pushdown: true})
+	require.NoError(t, err)
+	inProcess, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	start, end := pushdownBase.Add(120*time.Second), pushdownBase.Add(600*time.Second)
+	for _, qry := range queries {
+		for _, ts := range []time.Time{start, end} {
+			expected, err := inProcess.InstantQuery(ctx, qry, ts)
+			require.NoError(t, err, qry)
+			actual, err := pushdown.InstantQuery(ctx, qry, ts)
+			require.NoError(t, err, qry)
+			requireSameResult(t, qry, expected, actual)
+		}
+
+		for _, step := range []time.Duration{15 * time.Second, 45 * time.Second, 5 * time.Minute} {
+			expected, err := inProcess.RangeQuery(ctx, qry, start, end, step)
+			require.NoError(t, err, qry)
+			actual, err := pushdown.RangeQuery(ctx, qry, start, end, step)
+			require.NoError(t, err, qry)
+			requireSameResult(t, qry, expected, actual)
+		}
+	}
+}
+
+func TestFunctionPushdown(t *testing.T) {
+	requireSamePushdown(t, "test_function_pushdown", []string{
+		`rate(http_requests_total[1m])`,
+		`rate(http_requests_total{job=~"a.*", method!="POST"}[2m] offset 1m)`,
+		`rate(process_restarts_total[5m])`,
+		`increase(process_restarts_total[2m])`,
+		`increase(http_requests_total{job="db"}[3m])`,
+		`delta(instance_capacity[5m])`,
+		`delta(process_restarts_total[1m])`,
+		`irate(process_restarts_total[1m])`,
+		`irate(http_requests_total[1m])`,
+		`idelta(process_restarts_total[2m])`,
+	})
+}
+
+func TestAggregationPushdown(t *testing.T) {
+	requireSamePushdown(t, "test_aggregation_pushdown", []string{
+		`sum(http_requests_total)`,
+		`sum(rate(http_requests_total[2m])) by (job)`,
+		`avg(http_requests_total) without (instance)`,
+		`count(http_requests_total{method!="POST"}) by (job, instance)`,
+		`min(http_requests_total offset 1m) by (method)`,
+		`max(rate(http_requests_total[1m])) without (job)`,
+		`stddev(http_requests_total)`,
+		`stdvar(http_requests_total) by (job)`,
+		`topk(2, http_requests_total)`,
+		`bottomk(1, rate(http_requests_total[1m])) by (method)`,
+		`quantile(0.9, http_requests_total)`,
+		`quantile(0.5, http_requests_total) by (instance)`,
+		`count_values("value", instance_capacity)`,
+		`count_values("job", http_requests_total) by (method)`,
+		`sum(sum(http_requests_total) by (job, method)) by (job)`,
+		`sum(http_requests_total) by (__name__)`,
+	})
+}
+
+func TestGroupingColumns(t *testing.T) {
+	planLabels := []string{"__name__", "instance", "job", "method"}
+	require.Equal(t, []int{2}, groupingColumns(planLabels, []string{"job", "le"}, false))
+	require.Equal(t, []int{0}, groupingColumns(planLabels, []string{"__name__"}, false))
+	require.Equal(t, []int{1, 3}, groupingColumns(planLabels, []string{"job"}, true))
+	require.Equal(t, []int(nil), groupingColumns(planLabels, nil, false))
+}
+
+func TestBinaryOperatorPushdown(t *testing.T) {
+	requireSamePushdown(t, "test_binary_operator_pushdown", []string{
+		`http_requests_total / ignoring(method) group_left instance_capacity`,
+		`instance_capacity * on(instance) group_right http_requests_total{job="api"}`,
+		`http_requests_total{method="GET"} - on(job, instance) http_requests_total{method="POST"}`,
+		`rate(http_requests_total[1m]) / on(job) group_left(le) request_duration_seconds_bucket{le="1"}`,
+		`http_requests_total > bool 30`,
+		`30 < http_requests_total`,
+		`http_requests_total != 40`,
+		`100 - instance_capacity`,
+		`instance_capacity % 3`,
+		`2 ^ instance_capacity`,
+		`http_requests_total / 0`,
+		`sum(http_requests_total * 2) by (job)`,
+		`http_requests_total >= ignoring(method) group_left instance_capacity`,
+		`http_requests_total and on(instance) instance_capacity > 15`,
+		`http_requests_total unless on(job) instance_capacity`,
+		`http_requests_total{job="db"} or instance_capacity`,
+		`rate(http_requests_total[1m]) or on(job) instance_capacity`,
+		`-http_requests_total{method="POST"}`,
+	})
+}
+
+func TestHistogramQuantilePushdown(t *testing.T) {
+	requireSamePushdown(t, "test_histogram_quantile_pushdown", []string{
+		`histogram_quantile(0.9, sum(rate(request_duration_seconds_bucket[1m])) by (le))`,
+		`histogram_quantile(0.5, rate(request_duration_seconds_bucket[2m]))`,
+		`histogram_quantile(0.99, sum(increase(request_duration_seconds_bucket[5m])) by (le, job))`,
+		`histogram_quantile(0.75, request_duration_seconds_bucket)`,
+	})
+}
@@ -1,209 +1,379 @@
 package parser
 
 import (
-	"context"
-	"fmt"
-	"reflect"
-	"strconv"
+	"database/sql"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/showhand-lab/flash-metrics/metas"
 	"github.com/showhand-lab/flash-metrics/store"
 
-	"github.com/pingcap/log"
-	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
-	"go.uber.org/zap"
 )
 
-const qpsPattern = `
-select tsid, (unix_timestamp(ts)-unix_timestamp(ts)mod %v)*1000 tsmod, (max(v)-min(v))/%v
-from flash_metrics_data
-where tsid in (%v)
-and unix_timestamp(ts) >= %v and unix_timestamp(ts) <= %v
-group by tsid, tsmod
-order by tsmod
-`
-
+// QPSSolver pushes an aggregation over rate, increase or irate down to TiDB
+// when the range of the matrix selector spans too many steps for
+// buildWindowSQL. Instead of repeating every sample for every step whose range
+// it's in, the samples are summarized into buckets, each range being made of
+// whole buckets, and the ranges are assembled from the buckets in process.
 type QPSSolver struct {
-	groupByNames  []string
-	metricName    string
-	labelMatchers []*labels.Matcher
-
-	// step, step, tsids, start, end
-	args []interface{}
-
-	result            promql.Matrix
-	matrixIndexHelper map[int]int // key means tsid, value means index of result.
+	// op is one of sum, avg, max, min and count.
+	op       string
+	grouping []string
+	without  bool
+	// fn is one of rate, increase and irate.
+	fn string
+	ms *promql.MatrixSelector
 }
 
+// tryMatchQPSPattern returns nil if expr isn't an aggregation the solver
+// supports.
 func tryMatchQPSPattern(expr promql.Expr) *QPSSolver {
-	agg, suc := expr.(*promql.AggregateExpr)
-	if !suc || agg.Op != 42 {
+	agg, ok := expr.(*promql.AggregateExpr)
+	if !ok {
 		return nil
 	}
-	rate, suc := agg.Expr.(*promql.Call)
-	if !suc || rate.Func.Name != "rate" {
+	switch agg.Op.String() {
+	case "sum", "avg", "max", "min", "count":
+	default:
 		return nil
 	}
-	matrix, suc := rate.Args[0].(*promql.MatrixSelector)
-	if !suc {
+
+	inner := agg.Expr
+	for {
+		paren, ok := inner.(*promql.ParenExpr)
+		if !ok {
+			break
+		}
+		inner = paren.Expr
+	}
+	call, ok := inner.(*promql.Call)
+	if !ok {
+		return nil
+	}
+	switch call.Func.Name {
+	case "rate", "increase", "irate":
+	default:
+		return nil
+	}
+	ms, ok := call.Args[0].(*promql.MatrixSelector)
+	if !ok {
 		return nil
 	}
 
 	return &QPSSolver{
-		groupByNames:  agg.Grouping,
-		metricName:    matrix.Name,
-		labelMatchers: matrix.LabelMatchers,
+		op:       agg.Op.String(),
+		grouping: agg.Grouping,
+		without:  agg.Without,
+		fn:       call.Func.Name,
+		ms:       ms,
 	}
 }
 
-func (solver *QPSSolver) GetTsIDs(storage *store.DefaultMetricStorage) (tsids_string string, err error) {
-	m, err := storage.QueryMeta(context.Background(), solver.metricName)
-	if err != nil {
-		return
+// solverBucket summarizes the samples of a series in a bucket.
+type solverBucket struct {
+	b     int64
+	first promql.Point
+	last  promql.Point
+	// previous is the sample before last in the series, which may be in an
+	// earlier bucket.
+	previous promql.Point
+	// firstCorrection is the counter correction between first and the sample
+	// before it, correction is the sum of those of all samples.
+	firstCorrection float64
+	correction      float64
+	count           int
+}
+
+// solverSeries is a series with its buckets in order.
+type solverSeries struct {
+	metric  labels.Labels
+	buckets []solverBucket
+	// counts and corrections are the prefix sums of the buckets, the sums of
+	// buckets[:i] are at i.
+	counts      []int
+	corrections []float64
+}
+
+func (s *solverSeries) add(bucket solverBucket) {
+	if len(s.counts) == 0 {
+		s.counts = append(s.counts, 0)
+		s.corrections = append(s.corrections, 0)
 	}
+	s.buckets = append(s.buckets, bucket)
+	s.counts = append(s.counts, s.counts[len(s.counts)-1]+bucket.count)
+	s.corrections = append(s.corrections, s.corrections[len(s.corrections)-1]+bucket.correction)
+}
 
-	// todo：use interfaceSliceP
-	var args []interface{}
-	var sb strings.Builder
+// rangeSummary is what rate, increase and irate need from the samples in a
+// range.
+type rangeSummary struct {
+	first      promql.Point
+	last       promql.Point
+	previous   promql.Point
+	count      int
+	correction float64
+}
 
-	sb.WriteString(
-		`
-select _tidb_rowid
-`)
-	groupByCount := 0
-	for _, groupByName := range solver.groupByNames {
-		labelID, ok := m.Labels[metas.LabelName(groupByName)]
-		if !ok {
-			log.Error("group by label not found!", zap.String("label", groupByName))
-			return "", errors.Errorf("group by label not found!")
-		}
-		groupByCount++
-		sb.WriteString(", label")
-		sb.WriteString(strconv.Itoa(int(labelID)))
+// summarize summarizes the samples in [rangeStart, rangeEnd], which is made of
+// the sample at rangeStart, which is the last one of bucket lo if any, and
+// the buckets in (lo, hi].
+func (s *solverSeries) summarize(lo, hi int64, rangeStart int64) (rangeSummary, bool) {
+	i := sort.Search(len(s.buckets), func(i int) bool { return s.buckets[i].b > lo })
+	j := sort.Search(len(s.buckets), func(i int) bool { return s.buckets[i].b > hi })
+	onStart := i > 0 && s.buckets[i-1].b == lo && s.buckets[i-1].last.T == rangeStart
+	if i == j && !onStart {
+		return rangeSummary{}, false
 	}
 
-	sb.WriteString(`
-from flash_metrics_index
-where metric_name = ?
-`)
-	args = append(args, solver.metricName)
+	var r rangeSummary
+	r.count = s.counts[j] - s.counts[i]
+	r.correction = s.corrections[j] - s.corrections[i]
+	if onStart {
+		r.first = s.buckets[i-1].last
+		r.count++
+	} else {
+		r.first = s.buckets[i].first
+		// the correction against the sample before the range doesn't count
+		r.correction -= s.buckets[i].firstCorrection
+	}
+	if i < j {
+		r.last = s.buckets[j-1].last
+		r.previous = s.buckets[j-1].previous
+	} else {
+		r.last = r.first
+	}
+	return r, true
+}
 
-	for _, matcher := range solver.labelMatchers {
-		if matcher.Name == "__name__" {
-			continue
-		}
+// value returns the value of the function over the range of c.
+func (solver *QPSSolver) value(r rangeSummary, c *rangeCall) (float64, bool) {
+	if r.count < 2 {
+		return 0, false
+	}
+	switch solver.fn {
+	case "rate":
+		return extrapolate(c, r.first, r.last, r.count, r.correction, true, true), true
+	case "increase":
+		return extrapolate(c, r.first, r.last, r.count, r.correction, true, false), true
+	default:
+		// with at least two samples in the range, the previous sample of the
+		// last one is in the range as well
+		return instantDelta(r.previous, r.last, true)
+	}
+}
 
-		labelID, ok := m.Labels[metas.LabelName(matcher.Name)]
-		if !ok {
-			if (matcher.Type == labels.MatchEqual || matcher.Type == labels.MatchRegexp) && matcher.Value == "" {
-				continue
-			}
-			log.Error("label not found!", zap.String("label", matcher.Name))
-			continue
-		}
-		sb.WriteString("AND label")
-		sb.WriteString(strconv.Itoa(int(labelID)))
-
-		switch matcher.Type {
-		case labels.MatchEqual:
-			sb.WriteString(" = ?\n")
-		case labels.MatchNotEqual:
-			sb.WriteString(" != ?\n")
-		case labels.MatchRegexp:
-			sb.WriteString(" REGEXP ?\n")
-		case labels.MatchNotRegexp:
-			sb.WriteString(" NOT REGEXP ?\n")
-		}
-		args = append(args, matcher.Value)
+// buildSQL returns the buckets of the samples in [minT, maxT] as rows of
+// (tsid, labels..., b, first_t, first_v, first_c, last_t, last_v, prev_t,
+// prev_v, n, sum_c), ordered by tsid and b. The bucket of a sample at t is
+// ceil((t - minT) / size), c is the counter correction of a sample against the
+// sample before it.
+//
+//	SELECT r.tsid, label0, label1, r.b, r.first_t, ...
+//	FROM (
+//	  SELECT tsid, b,
+//	    MAX(IF(asc_rn = 1, t, NULL)) AS first_t, ..., COUNT(*) AS n, SUM(c) AS sum_c
+//	  FROM (
+//	    SELECT tsid, b, t, v, prev_t, prev_v, IF(prev_v > v, prev_v, 0) AS c,
+//	      ROW_NUMBER() OVER (PARTITION BY tsid, b ORDER BY t) AS asc_rn,
+//	      ROW_NUMBER() OVER (PARTITION BY tsid, b ORDER BY t DESC) AS desc_rn
+//	    FROM (
+//	      SELECT tsid, t, v, (t - minT + size - 1) DIV size AS b,
+//	        LAG(t) OVER (PARTITION BY tsid ORDER BY t) AS prev_t,
+//	        LAG(v) OVER (PARTITION BY tsid ORDER BY t) AS prev_v
+//	      FROM (
+//	        SELECT tsid, CAST(UNIX_TIMESTAMP(ts)*1000 AS SIGNED) AS t, v
+//	        FROM flash_metrics_data
+//	        WHERE tsid IN (SELECT _tidb_rowid FROM flash_metrics_index WHERE ...)
+//	        AND minT <= ts AND ts <= maxT
+//	      ) samples
+//	    ) samples
+//	  ) samples
+//	  GROUP BY tsid, b
+//	) r INNER JOIN flash_metrics_index ON (_tidb_rowid = r.tsid)
+//	ORDER BY r.tsid, r.b
+func (solver *QPSSolver) buildSQL(sel *seriesSelector, minT, maxT, size int64) (string, []interface{}) {
+	var args []interface{}
+	var sb strings.Builder
+	sb.WriteString("\nSELECT r.tsid, ")
+	for _, column := range sel.columns {
+		sb.WriteString(column)
+		sb.WriteString(", ")
 	}
+	sb.WriteString(`r.b, r.first_t, r.first_v, r.first_c, r.last_t, r.last_v, r.prev_t, r.prev_v, r.n, r.sum_c
+FROM (
+  SELECT tsid, b,
+    MAX(IF(asc_rn = 1, t, NULL)) AS first_t,
+    MAX(IF(asc_rn = 1, v, NULL)) AS first_v,
+    MAX(IF(asc_rn = 1, c, NULL)) AS first_c,
+    MAX(IF(desc_rn = 1, t, NULL)) AS last_t,
+    MAX(IF(desc_rn = 1, v, NULL)) AS last_v,
+    MAX(IF(desc_rn = 1, prev_t, NULL)) AS prev_t,
+    MAX(IF(desc_rn = 1, prev_v, NULL)) AS prev_v,
+    COUNT(*) AS n,
+    SUM(c) AS sum_c
+  FROM (
+    SELECT tsid, b, t, v, prev_t, prev_v, IF(prev_v > v, prev_v, 0) AS c,
+      ROW_NUMBER() OVER (PARTITION BY tsid, b ORDER BY t) AS asc_rn,
+      ROW_NUMBER() OVER (PARTITION BY tsid, b ORDER BY t DESC) AS desc_rn
+    FROM (
+      SELECT tsid, t, v, (t - ? + ? - 1) DIV ? AS b,
+        LAG(t) OVER (PARTITION BY tsid ORDER BY t) AS prev_t,
+        LAG(v) OVER (PARTITION BY tsid ORDER BY t) AS prev_v
+      FROM (
+        SELECT tsid, CAST(UNIX_TIMESTAMP(ts)*1000 AS SIGNED) AS t, v
+        FROM ` + sel.tables.Data + `
+        WHERE tsid IN (SELECT _tidb_rowid FROM ` + sel.tables.Index + ` WHERE `)
+	args = append(args, minT, size, size)
+	sb.WriteString(sel.cond)
+	args = append(args, sel.args...)
+	sb.WriteString(`)
+        AND ? <= ts AND ts <= ?
+        AND v IS NOT NULL
+      ) samples
+    ) samples
+  ) samples
+  GROUP BY tsid, b
+) r INNER JOIN ` + sel.tables.Index + ` ON (_tidb_rowid = r.tsid)
+ORDER BY r.tsid, r.b`)
+	args = append(args, formatTimestamp(minT), formatTimestamp(maxT))
+	return sb.String(), args
+}
+
+// evalQPSSolver evaluates the solver in TiDB at the steps of ev. It returns
+// nil if the selector can't be pushed down.
+func (ev *evaluator) evalQPSSolver(solver *QPSSolver) (promql.Matrix, error) {
+	sel, err := ev.buildSeriesSelector(solver.ms.LabelMatchers)
+	if err != nil || sel == nil {
+		return nil, err
+	}
+
+	// The range of step k is [minT + k * step, minT + k * step + range], the
+	// buckets are as large as possible for both to be made of whole buckets.
+	step := ev.intervalMs
+	selRange := durationMilliseconds(solver.ms.Range)
+	offset := durationMilliseconds(solver.ms.Offset)
+	size := gcd(selRange, step)
+	minT := ev.startMs - offset - selRange
+	maxT := ev.endMs - offset
 
-	rows, err := storage.DB.Query(sb.String(), args...)
+	series, err := ev.queryBuckets(solver, sel, minT, maxT, size)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer rows.Close()
 
-	solver.matrixIndexHelper = make(map[int]int)
+	grouping := append([]string(nil), solver.grouping...)
+	if solver.without {
+		grouping = append(grouping, labels.MetricName)
+	}
+	sort.Strings(grouping)
+
+	c := &rangeCall{selRange: solver.ms.Range}
+	res := promql.Matrix{}
+	resIndex := map[uint64]int{}
+	vec := make(promql.Vector, 0, len(series))
+	for k, ts := int64(0), ev.startMs; ts <= ev.endMs; k, ts = k+1, ts+step {
+		c.ts = ts
+		c.rangeEnd = ts - offset
+		c.rangeStart = c.rangeEnd - selRange
+		lo := k * step / size
+		hi := lo + selRange/size
 
-	var tsids []string
-	for rows.Next() {
-		row := make([]interface{}, groupByCount+1)
-		for index := range row {
-			if index == 0 {
-				var i int
-				row[index] = &i
-			} else {
-				var s string
-				row[index] = &s
+		vec = vec[:0]
+		for _, s := range series {
+			r, ok := s.summarize(lo, hi, c.rangeStart)
+			if !ok {
+				continue
+			}
+			if v, ok := solver.value(r, c); ok {
+				vec = append(vec, promql.Sample{Metric: s.metric, Point: promql.Point{T: ts, V: v}})
 			}
 		}
-		if err = rows.Scan(row...); err != nil {
-			return "", err
+		if len(vec) == 0 {
+			continue
 		}
 
-		tsid := *row[0].(*int)
-		tsids = append(tsids, strconv.Itoa(tsid))
-
-		var lbs labels.Labels
-		for index, str := range row[1:] {
-			lbs = append(lbs, labels.Label{
-				Name:  solver.groupByNames[index],
-				Value: *str.(*string)})
+		out, err := aggregation(solver.op, grouping, solver.without, "", 0, vec)
+		if err != nil {
+			return nil, err
 		}
-		solver.updateResultLabel(tsid, lbs)
-	}
-
-	return strings.Join(tsids, ","), nil
-}
-
-func (solver *QPSSolver) updateResultLabel(tsid int, lbs labels.Labels) {
-	// naive for loop, because the labels count won't be large.
-	index := 0
-	for ; index < len(solver.result); index++ {
-		if reflect.DeepEqual(solver.result[index].Metric, lbs) {
-			break
+		for _, s := range out {
+			h := s.Metric.Hash()
+			index, ok := resIndex[h]
+			if !ok {
+				index = len(res)
+				resIndex[h] = index
+				res = append(res, promql.Series{Metric: s.Metric})
+			}
+			res[index].Points = append(res[index].Points, promql.Point{T: ts, V: s.V})
 		}
 	}
-	if index >= len(solver.result) {
-		solver.result = append(solver.result, promql.Series{Metric: lbs})
-	}
-	solver.matrixIndexHelper[tsid] = index
+	return res, nil
 }
 
-func (solver *QPSSolver) ExecuteQuery(storage *store.DefaultMetricStorage) (err error) {
-	sql := fmt.Sprintf(qpsPattern, solver.args...)
-	rows, err := storage.DB.Query(sql)
+// queryBuckets returns the series selected by sel with their buckets.
+func (ev *evaluator) queryBuckets(solver *QPSSolver, sel *seriesSelector, minT, maxT, size int64) ([]*solverSeries, error) {
+	query, args := solver.buildSQL(sel, minT, maxT, size)
+	now := time.Now()
+	rows, err := ev.db.QueryContext(ev.ctx, query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
+	var tsid int64
+	labelValues := make([]sql.NullString, len(sel.columns))
+	var bucket solverBucket
+	var previousT sql.NullInt64
+	var previousV sql.NullFloat64
+	dest := []interface{}{&tsid}
+	for i := range labelValues {
+		dest = append(dest, &labelValues[i])
+	}
+	dest = append(dest, &bucket.b, &bucket.first.T, &bucket.first.V, &bucket.firstCorrection,
+		&bucket.last.T, &bucket.last.V, &previousT, &previousV, &bucket.count, &bucket.correction)
+
+	limiter := store.QueryLimiterFromContext(ev.ctx)
+	var series []*solverSeries
+	lastTsid := int64(-1)
+	rowCount := 0
 	for rows.Next() {
-		var tsid int
-		var tsmod float64
-		var value float64
-		if err = rows.Scan(&tsid, &tsmod, &value); err != nil {
-			log.Warn("", zap.Error(err))
-			return err
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rowCount++
+		if err = limiter.AddSamples(1); err != nil {
+			return nil, err
 		}
 
-		// assert order by tsid.
-		series := &solver.result[solver.matrixIndexHelper[tsid]]
-		if series.Points != nil && series.Points[len(series.Points)-1].T == int64(tsmod) {
-			series.Points[len(series.Points)-1].V += value
-		} else {
-			series.Points = append(series.Points, promql.Point{T: int64(tsmod), V: value})
+		if len(series) == 0 || tsid != lastTsid {
+			if err = limiter.CheckSeries(len(series) + 1); err != nil {
+				return nil, err
+			}
+			var metric labels.Labels
+			for i, name := range sel.labels {
+				if labelValues[i].String != "" {
+					metric = append(metric, labels.Label{Name: name, Value: labelValues[i].String})
+				}
+			}
+			series = append(series, &solverSeries{metric: metric})
+			lastTsid = tsid
 		}
-	}
 
-	// mock data
-	//i := 0
-	//	for now := solver.args[3].(int64); now <= solver.args[3].(int64) + int64(solver.args[0].(float64)) * 10; now += int64(solver.args[0].(float64)) {
-	//		solver.result[i].Points = append(solver.result[i].Points, promql.Point{T: now*1000, V: 15})
-	//	}
+		bucket.previous = promql.Point{T: previousT.Int64, V: previousV.Float64}
+		series[len(series)-1].add(bucket)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	store.QueryStatsFromContext(ev.ctx).ObserveSQL(query, args, rowCount, len(series), time.Since(now))
+	return series, nil
+}
 
-	return nil
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
 }
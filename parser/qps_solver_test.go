@@ -2,90 +2,169 @@ package parser
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/showhand-lab/flash-metrics/config"
 	"github.com/showhand-lab/flash-metrics/store"
-	"github.com/showhand-lab/flash-metrics/store/model"
 	"github.com/showhand-lab/flash-metrics/utils"
 
+	"github.com/prometheus/prometheus/promql"
 	"github.com/stretchr/testify/require"
 )
 
-func TestQPSSolver(t *testing.T) {
-	db, err := utils.SetupDB("test_qps_sovler")
-	require.NoError(t, err)
-	defer func() {
-		require.NoError(t, utils.TearDownDB("test_qps_sovler", db))
-	}()
+func TestMatchQPSPattern(t *testing.T) {
+	for _, op := range []string{"sum", "avg", "max", "min", "count"} {
+		for _, fn := range []string{"rate", "increase", "irate"} {
+			qry := op + "((" + fn + `(http_requests_total{job="api"}[5m] offset 1m))) without (instance)`
+			expr, err := promql.ParseExpr(qry)
+			require.NoError(t, err)
+			solver := tryMatchQPSPattern(expr)
+			require.NotNil(t, solver, qry)
+			require.Equal(t, op, solver.op)
+			require.Equal(t, fn, solver.fn)
+			require.Equal(t, []string{"instance"}, solver.grouping)
+			require.True(t, solver.without)
+			require.Equal(t, time.Minute, solver.ms.Offset)
+		}
+	}
 
-	metricStorage := store.NewDefaultMetricStorage(db)
-	defer metricStorage.Close()
-
-	now := time.Now()
-	err = metricStorage.Store(context.Background(), model.TimeSeries{
-		Name: "tiflash_coprocessor_request_count",
-		Labels: []model.Label{{
-			Name:  "tidb_cluster",
-			Value: "",
-		}, {
-			Name:  "instance",
-			Value: "()",
-		}, {
-			Name:  "type",
-			Value: "cop",
-		}},
-		Samples: []model.Sample{{
-			TimestampMs: now.UnixNano() / int64(time.Millisecond),
-			Value:       10,
-		}},
-	})
-	require.NoError(t, err)
+	for _, qry := range []string{
+		`rate(http_requests_total[5m])`,
+		`stddev(rate(http_requests_total[5m]))`,
+		`sum(delta(http_requests_total[5m]))`,
+		`sum(http_requests_total)`,
+		`sum(rate(http_requests_total[5m]) * 2)`,
+	} {
+		expr, err := promql.ParseExpr(qry)
+		require.NoError(t, err)
+		require.Nil(t, tryMatchQPSPattern(expr), qry)
+	}
+}
 
-	_, err = NewRangeQuery(metricStorage, "sum(rate(tiflash_coprocessor_request_count{tidb_cluster=\"\", instance=\"()\"}[1m])) by (type)",
-		now, now.Add(1*time.Second), 15*time.Second)
-	require.NoError(t, err)
+// bucketize summarizes points into buckets the same way as the SQL of the
+// solver.
+func bucketize(points []promql.Point, minT, size int64) *solverSeries {
+	s := &solverSeries{}
+	var bucket *solverBucket
+	for i, p := range points {
+		var correction float64
+		if i > 0 && points[i-1].V > p.V {
+			correction = points[i-1].V
+		}
+		b := (p.T - minT + size - 1) / size
+		if bucket == nil || bucket.b != b {
+			if bucket != nil {
+				s.add(*bucket)
+			}
+			bucket = &solverBucket{b: b, first: p, firstCorrection: correction}
+		}
+		bucket.last = p
+		if i > 0 {
+			bucket.previous = points[i-1]
+		}
+		bucket.correction += correction
+		bucket.count++
+	}
+	if bucket != nil {
+		s.add(*bucket)
+	}
+	return s
 }
 
-func TestDoQuery(t *testing.T) {
-	db, err := utils.SetupDB("test_do_query")
-	require.NoError(t, err)
-	defer func() {
-		require.NoError(t, utils.TearDownDB("test_do_query", db))
-	}()
+func TestSolverSeries(t *testing.T) {
+	// irregular samples with counter resets, some on the bucket boundaries
+	var points []promql.Point
+	v := 0.0
+	for i, ts := 0, int64(0); ts < 3600000; i, ts = i+1, ts+int64(7000+i%5*4000) {
+		v += float64(i % 13)
+		if i%17 == 16 {
+			v = float64(i % 3)
+		}
+		points = append(points, promql.Point{T: ts, V: v})
+	}
+
+	for _, step := range []int64{1000, 15000, 60000} {
+		for _, selRange := range []int64{60000, 300000, 3600000} {
+			startMs, endMs := selRange-5000, int64(3600000)
+			size := gcd(selRange, step)
+			minT := startMs - selRange
+			s := bucketize(points, minT, size)
 
-	metricStorage := store.NewDefaultMetricStorage(db)
-	defer metricStorage.Close()
+			for _, fn := range []string{"rate", "increase", "irate"} {
+				solver := &QPSSolver{fn: fn}
+				c := &rangeCall{selRange: time.Duration(selRange) * time.Millisecond}
+				for k, ts := int64(0), startMs; ts <= endMs; k, ts = k+1, ts+step {
+					c.ts = ts
+					c.rangeEnd = ts
+					c.rangeStart = ts - selRange
+					begin, end := 0, 0
+					for begin < len(points) && points[begin].T < c.rangeStart {
+						begin++
+					}
+					for end < len(points) && points[end].T <= c.rangeEnd {
+						end++
+					}
+					c.points = points[begin:end]
+					expected, expectedOK, err := rangeFunctions[fn](c)
+					require.NoError(t, err)
 
-	solver := &QPSSolver{
-		groupByNames:  []string{"type"},
-		metricName:    "tiflash_coprocessor_request_count",
-		labelMatchers: nil,
-		args:          []interface{}{15.0, 15.0, "101,105,99,107,103,104,100,98,102,106", 1641586050, 1641589650},
+					lo := k * step / size
+					r, ok := s.summarize(lo, lo+selRange/size, c.rangeStart)
+					var actual float64
+					if ok {
+						actual, ok = solver.value(r, c)
+					}
+					require.Equal(t, expectedOK, ok, "%s step %d range %d at %d", fn, step, selRange, ts)
+					require.InDelta(t, expected, actual, 1e-9, "%s step %d range %d at %d", fn, step, selRange, ts)
+				}
+			}
+		}
 	}
+}
 
-	_, err = db.Query("select tsid, ts-ts%15 tsmod, (max(v)-min(v))/15 rate_v from flash_metrics_data where flash_metrics_data.tsid in (101,105,99,107,103,104,100,98,102,106) and ts >= 1641586050 and ts <= 1641589650 group by tsid, tsmod")
+func TestQPSSolver(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDB("test_qps_solver")
 	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_qps_solver", db))
+	}()
 
-	//db.Exec("use test")
-	//db.Exec("set tidb_enforce_mpp=1")
-	//db.Exec(" set tidb_partition_prune_mode=dynamic;")
-	//// will trigger a bug "Wrong precision:18446744073709551615", confusing.
-	//rows, err := metricStorage.DB.Query("select ts % ? x from flash_metrics_data where tsid=1 group by x", 15)
-	//if err != nil {
-	//	log.Error("",zap.Error(err))
-	//	t.Fail()
-	//} else {
-	//	for rows.Next() {
-	//		row := make([]string, 5, 5)
-	//		if err = rows.Scan(&row[0], &row[1], &row[2], &row[3], &row[4]); err != nil {
-	//			log.Error("",zap.Error(err))
-	//			t.Fail()
-	//		}
-	//		log.Info("",zap.Strings("row", row))
-	//	}
-	//}
-
-	err = solver.ExecuteQuery(metricStorage)
+	storage := store.NewDefaultMetricStorage(db)
+	defer storage.Close()
+	newPushdownStorage(t, storage)
+
+	pushdown, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash, Pushdown: true})
+	require.NoError(t, err)
+	inProcess, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash})
 	require.NoError(t, err)
+
+	// the ranges span too many steps for the window SQL
+	start, end := pushdownBase, pushdownBase.Add(650*time.Second)
+	for _, qry := range []string{
+		`sum(rate(http_requests_total[5m])) by (job)`,
+		`avg(increase(http_requests_total[7m] offset 30s)) without (instance)`,
+		`max(irate(process_restarts_total[5m]))`,
+		`min(rate(process_restarts_total[310s])) by (job)`,
+		`count(increase(http_requests_total{method="GET"}[5m]))`,
+		`sum(rate(http_requests_total{job="none"}[5m]))`,
+	} {
+		for _, step := range []time.Duration{time.Second, 700 * time.Millisecond} {
+			expected, err := inProcess.RangeQuery(context.Background(), qry, start, end, step)
+			require.NoError(t, err, qry)
+
+			stats := store.NewQueryStats(true)
+			ctx := store.WithQueryStats(context.Background(), stats)
+			actual, err := pushdown.RangeQuery(ctx, qry, start, end, step)
+			require.NoError(t, err, qry)
+			requireSameResult(t, qry, expected, actual)
+
+			require.Len(t, stats.Statements, 1, qry)
+			require.True(t, strings.Contains(stats.Statements[0].SQL, "asc_rn"), qry)
+		}
+	}
 }
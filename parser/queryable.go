@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"context"
+
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	promstorage "github.com/prometheus/prometheus/storage"
+)
+
+// Queryable adapts a MetricStorage to the storage.Queryable of Prometheus, so
+// that the upstream promql.Engine can evaluate queries against it.
+type Queryable struct {
+	storage store.MetricStorage
+}
+
+func NewQueryable(storage store.MetricStorage) *Queryable {
+	return &Queryable{storage: storage}
+}
+
+// Querier implements interface storage.Queryable
+func (q *Queryable) Querier(ctx context.Context, mint, maxt int64) (promstorage.Querier, error) {
+	return &querier{ctx: ctx, storage: q.storage, mint: mint, maxt: maxt}, nil
+}
+
+type querier struct {
+	ctx     context.Context
+	storage store.MetricStorage
+	mint    int64
+	maxt    int64
+}
+
+// Select implements interface storage.Querier
+func (q *querier) Select(params *promstorage.SelectParams, matchers ...*labels.Matcher) (promstorage.SeriesSet, error) {
+	mint, maxt := q.mint, q.maxt
+	if params != nil {
+		mint, maxt = params.Start, params.End
+	}
+
+	mat, err := selectSeries(q.ctx, q.storage, matchers, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &seriesSet{series: mat, cur: -1}, nil
+}
+
+// LabelValues implements interface storage.Querier
+func (q *querier) LabelValues(name string) ([]string, error) {
+	return nil, errors.New("not support to query label values")
+}
+
+// Close implements interface storage.Querier
+func (q *querier) Close() error {
+	return nil
+}
+
+type seriesSet struct {
+	series promql.Matrix
+	cur    int
+}
+
+func (s *seriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *seriesSet) At() promstorage.Series {
+	return &series{Series: s.series[s.cur]}
+}
+
+func (s *seriesSet) Err() error {
+	return nil
+}
+
+type series struct {
+	promql.Series
+}
+
+func (s *series) Labels() labels.Labels {
+	return s.Metric
+}
+
+func (s *series) Iterator() promstorage.SeriesIterator {
+	return &seriesIterator{points: s.Points, cur: -1}
+}
+
+type seriesIterator struct {
+	points []promql.Point
+	cur    int
+}
+
+// millis is int64, declared as an alias so that vet doesn't mistake Seek for
+// the one of io.Seeker.
+type millis = int64
+
+func (it *seriesIterator) Seek(t millis) bool {
+	if it.cur < 0 {
+		it.cur = 0
+	}
+	for it.cur < len(it.points) && it.points[it.cur].T < t {
+		it.cur++
+	}
+	return it.cur < len(it.points)
+}
+
+func (it *seriesIterator) At() (t int64, v float64) {
+	p := it.points[it.cur]
+	return p.T, p.V
+}
+
+func (it *seriesIterator) Next() bool {
+	it.cur++
+	return it.cur < len(it.points)
+}
+
+func (it *seriesIterator) Err() error {
+	return nil
+}
@@ -0,0 +1,329 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pingcap/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"go.uber.org/zap"
+)
+
+const (
+	// resultsCacheChunk is the range of the results cached as a whole.
+	resultsCacheChunk = 24 * time.Hour
+
+	defaultResultsCacheEntries = 1024
+	defaultResultsCacheTTL     = 24 * time.Hour
+	// maxResultsCacheSweepInterval is how often the expired files are removed
+	// at most.
+	maxResultsCacheSweepInterval = time.Hour
+)
+
+type rangeQueryFunc func(ctx context.Context, qry string, start, end time.Time, step time.Duration) (promql.Value, error)
+
+// generationFunc returns the generation of the samples of the UTC day of t,
+// which is bumped once the samples of the day change.
+type generationFunc func(ctx context.Context, t time.Time) (int64, error)
+
+// resultsCache caches the results of range queries by day. Only the queries
+// whose start is aligned to the step are cached, so that the steps of a query
+// are the same in every day it covers, unless alignStep rounds the start and
+// end down to the step. The days older than maxFreshness are evaluated as a
+// whole and cached, the recent tail is always evaluated. The cached days are
+// keyed by the generations of the samples of the days if any, and expire after
+// ttl.
+type resultsCache struct {
+	sync.Mutex
+	lru *simplelru.LRU
+	// lastSweep is when the expired files are removed last time.
+	lastSweep time.Time
+
+	// dir is the on-disk backend behind the in-memory LRU if not empty.
+	dir          string
+	maxFreshness time.Duration
+	alignStep    bool
+	ttl          time.Duration
+	generation   generationFunc
+	now          func() time.Time
+}
+
+// cachedResult is a cached day in memory.
+type cachedResult struct {
+	m        promql.Matrix
+	cachedAt time.Time
+}
+
+func newResultsCache(cfg *config.ResultsCacheConfig) (*resultsCache, error) {
+	size := cfg.MaxEntries
+	if size <= 0 {
+		size = defaultResultsCacheEntries
+	}
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Dir != "" {
+		if err = os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create the directory of results cache")
+		}
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultResultsCacheTTL
+	}
+	return &resultsCache{
+		lru:          lru,
+		dir:          cfg.Dir,
+		maxFreshness: cfg.MaxFreshness,
+		alignStep:    cfg.AlignQueriesWithStep,
+		ttl:          ttl,
+		now:          time.Now,
+	}, nil
+}
+
+func (c *resultsCache) rangeQuery(ctx context.Context, qry string, start, end time.Time, step time.Duration, exec rangeQueryFunc) (promql.Value, error) {
+	expr, err := promql.ParseExpr(qry)
+	if err != nil || step <= 0 || end.Before(start) {
+		// the error is returned by the evaluation
+		return exec(ctx, qry, start, end, step)
+	}
+
+	stepMs := durationMilliseconds(step)
+	if !c.alignStep && timeMilliseconds(start)%stepMs != 0 {
+		return exec(ctx, qry, start, end, step)
+	}
+	chunkMs := durationMilliseconds(resultsCacheChunk)
+	startMs := floorDiv(timeMilliseconds(start), stepMs) * stepMs
+	endMs := floorDiv(timeMilliseconds(end), stepMs) * stepMs
+	freshMs := timeMilliseconds(c.now().Add(-c.maxFreshness))
+
+	var parts []promql.Matrix
+	for dayMs := floorDiv(startMs, chunkMs) * chunkMs; dayMs <= endMs; dayMs += chunkMs {
+		// the steps in the day
+		from := -floorDiv(-dayMs, stepMs) * stepMs
+		to := floorDiv(dayMs+chunkMs-1, stepMs) * stepMs
+		if from > to {
+			continue
+		}
+
+		if to >= freshMs {
+			m, err := execMatrix(ctx, exec, qry, maxInt64(from, startMs), endMs, step)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, m)
+			break
+		}
+
+		var generation int64
+		if c.generation != nil {
+			if generation, err = c.generation(ctx, time.Unix(0, dayMs*int64(time.Millisecond))); err != nil {
+				log.Warn("failed to get the generation of samples, skip results cache", zap.Error(err))
+				return exec(ctx, qry, start, end, step)
+			}
+		}
+		key := fmt.Sprintf("%s\xff%d\xff%d\xff%d", expr.String(), stepMs, dayMs, generation)
+		m, ok := c.get(key)
+		if !ok {
+			if m, err = execMatrix(ctx, exec, qry, from, to, step); err != nil {
+				return nil, err
+			}
+			c.set(key, m)
+		}
+		parts = append(parts, trimMatrix(m, startMs, endMs))
+	}
+	return mergeMatrices(parts), nil
+}
+
+func execMatrix(ctx context.Context, exec rangeQueryFunc, qry string, startMs, endMs int64, step time.Duration) (promql.Matrix, error) {
+	val, err := exec(ctx, qry, time.Unix(0, startMs*int64(time.Millisecond)), time.Unix(0, endMs*int64(time.Millisecond)), step)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := val.(promql.Matrix)
+	if !ok {
+		return nil, errors.Errorf("unexpected result type %q of range query", val.Type())
+	}
+	return m, nil
+}
+
+func (c *resultsCache) get(key string) (promql.Matrix, bool) {
+	now := c.now()
+	c.Lock()
+	v, ok := c.lru.Get(key)
+	if ok && now.Sub(v.(cachedResult).cachedAt) >= c.ttl {
+		c.lru.Remove(key)
+		ok = false
+	}
+	c.Unlock()
+	if ok {
+		return v.(cachedResult).m, true
+	}
+	if c.dir == "" {
+		return nil, false
+	}
+
+	path := c.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if now.Sub(info.ModTime()) >= c.ttl {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var m promql.Matrix
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		log.Warn("failed to decode cached results", zap.Error(err))
+		return nil, false
+	}
+
+	c.Lock()
+	c.lru.Add(key, cachedResult{m: m, cachedAt: info.ModTime()})
+	c.Unlock()
+	return m, true
+}
+
+func (c *resultsCache) set(key string, m promql.Matrix) {
+	now := c.now()
+	c.Lock()
+	c.lru.Add(key, cachedResult{m: m, cachedAt: now})
+	sweep := c.dir != "" && now.Sub(c.lastSweep) >= c.sweepInterval()
+	if sweep {
+		c.lastSweep = now
+	}
+	c.Unlock()
+	if c.dir == "" {
+		return
+	}
+	if sweep {
+		c.sweep(now)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		log.Warn("failed to encode results", zap.Error(err))
+		return
+	}
+	// write to a temporary file first, so that readers never see a partial file
+	f, err := ioutil.TempFile(c.dir, "tmp-")
+	if err != nil {
+		log.Warn("failed to write cached results", zap.Error(err))
+		return
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		log.Warn("failed to write cached results", zap.Error(err))
+	}
+}
+
+func (c *resultsCache) sweepInterval() time.Duration {
+	if c.ttl < maxResultsCacheSweepInterval {
+		return c.ttl
+	}
+	return maxResultsCacheSweepInterval
+}
+
+// sweep removes the files expired at now, including the ones of the old
+// generations, which are never read again.
+func (c *resultsCache) sweep(now time.Time) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Warn("failed to list cached results", zap.Error(err))
+		return
+	}
+	removed := 0
+	for _, info := range infos {
+		if info.IsDir() || now.Sub(info.ModTime()) < c.ttl {
+			continue
+		}
+		if err = os.Remove(filepath.Join(c.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			log.Warn("failed to remove expired cached results", zap.Error(err))
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Info("remove expired cached results", zap.Int("files", removed))
+	}
+}
+
+func (c *resultsCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// trimMatrix returns the points of m in [startMs, endMs].
+func trimMatrix(m promql.Matrix, startMs, endMs int64) promql.Matrix {
+	var res promql.Matrix
+	for _, s := range m {
+		from := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T >= startMs })
+		to := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > endMs })
+		if from < to {
+			res = append(res, promql.Series{Metric: s.Metric, Points: s.Points[from:to]})
+		}
+	}
+	return res
+}
+
+// mergeMatrices concatenates the series of the matrices of consecutive ranges.
+func mergeMatrices(parts []promql.Matrix) promql.Matrix {
+	res := promql.Matrix{}
+	index := map[uint64]int{}
+	for _, m := range parts {
+		for _, s := range m {
+			h := s.Metric.Hash()
+			i, ok := index[h]
+			if !ok {
+				i = len(res)
+				index[h] = i
+				res = append(res, promql.Series{Metric: s.Metric})
+			}
+			res[i].Points = append(res[i].Points, s.Points...)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return labels.Compare(res[i].Metric, res[j].Metric) < 0 })
+	return res
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultsCache(t *testing.T) {
+	// a sample every 5 minutes for 3 days
+	storage := &memStorage{}
+	for _, job := range []string{"api", "db"} {
+		ts := model.TimeSeries{Name: "http_requests_total", Labels: []model.Label{{Name: "job", Value: job}}}
+		for i := int64(0); i < 3*288; i++ {
+			ts.Samples = append(ts.Samples, model.Sample{TimestampMs: i * 300000, Value: float64(i * int64(len(job)))})
+		}
+		storage.series = append(storage.series, ts)
+	}
+	e, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash})
+	require.NoError(t, err)
+
+	calls := 0
+	exec := func(ctx context.Context, qry string, start, end time.Time, step time.Duration) (promql.Value, error) {
+		calls++
+		return e.execRangeQuery(ctx, qry, start, end, step)
+	}
+
+	dir := t.TempDir()
+	newCache := func() *resultsCache {
+		c, err := newResultsCache(&config.ResultsCacheConfig{Dir: dir, MaxFreshness: time.Hour, AlignQueriesWithStep: true})
+		require.NoError(t, err)
+		c.now = func() time.Time { return time.Unix(0, 0).Add(60 * time.Hour) }
+		return c
+	}
+	cache := newCache()
+
+	ctx := context.Background()
+	day := 24 * time.Hour
+	for _, qry := range []string{`sum(rate(http_requests_total[10m])) by (job)`, `http_requests_total`} {
+		start, end, step := time.Unix(0, 0).Add(3*time.Hour+17*time.Minute), time.Unix(0, 0).Add(2*day+11*time.Hour), 10*time.Minute
+		// the start is aligned to the step
+		expected, err := e.execRangeQuery(ctx, qry, time.Unix(0, 0).Add(3*time.Hour+10*time.Minute), end, step)
+		require.NoError(t, err)
+
+		// two days are cached, the tail is evaluated
+		calls = 0
+		actual, err := cache.rangeQuery(ctx, qry, start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+		requireSameResult(t, qry, expected, actual)
+
+		calls = 0
+		actual, err = cache.rangeQuery(ctx, qry, start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+		requireSameResult(t, qry, expected, actual)
+
+		// on disk
+		calls = 0
+		actual, err = newCache().rangeQuery(ctx, qry, start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+		requireSameResult(t, qry, expected, actual)
+
+		// the key is the normalized query
+		calls = 0
+		actual, err = cache.rangeQuery(ctx, "  "+qry, start, end.Add(-day), step, exec)
+		require.NoError(t, err)
+		require.Equal(t, 0, calls)
+		require.NotEmpty(t, actual)
+	}
+
+	// the queries not aligned to the step are never cached unless aligned
+	unaligned, err := newResultsCache(&config.ResultsCacheConfig{MaxFreshness: time.Hour})
+	require.NoError(t, err)
+	unaligned.now = cache.now
+	qry := `http_requests_total`
+	start, end, step := time.Unix(0, 0).Add(3*time.Hour+17*time.Minute), time.Unix(0, 0).Add(2*day+11*time.Hour), 10*time.Minute
+	expected, err := e.execRangeQuery(ctx, qry, start, end, step)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		calls = 0
+		actual, err := unaligned.rangeQuery(ctx, qry, start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+		requireSameResult(t, qry, expected, actual)
+	}
+	calls = 0
+	_, err = unaligned.rangeQuery(ctx, qry, start.Add(-7*time.Minute), end, step, exec)
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// the cached day is missed once its generation is bumped
+	generations := map[int64]int64{0: 1, 1: 1}
+	cache = newCache()
+	cache.generation = func(_ context.Context, t time.Time) (int64, error) {
+		return generations[t.Unix()/int64(day/time.Second)], nil
+	}
+	for _, expected := range []int{3, 1} {
+		calls = 0
+		_, err = cache.rangeQuery(ctx, qry, start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, expected, calls)
+	}
+	generations[1]++
+	calls = 0
+	_, err = cache.rangeQuery(ctx, qry, start, end, step, exec)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// and evaluated directly if the generation is unknown
+	cache.generation = func(context.Context, time.Time) (int64, error) { return 0, errors.New("unknown generation") }
+	calls = 0
+	_, err = cache.rangeQuery(ctx, qry, start, end, step, exec)
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestResultsCacheTTL(t *testing.T) {
+	storage := &memStorage{}
+	ts := model.TimeSeries{Name: "up"}
+	for i := int64(0); i < 3*288; i++ {
+		ts.Samples = append(ts.Samples, model.Sample{TimestampMs: i * 300000, Value: 1})
+	}
+	storage.series = append(storage.series, ts)
+	e, err := NewEngine(storage, &config.QueryConfig{Engine: EngineFlash})
+	require.NoError(t, err)
+
+	calls := 0
+	exec := func(ctx context.Context, qry string, start, end time.Time, step time.Duration) (promql.Value, error) {
+		calls++
+		return e.execRangeQuery(ctx, qry, start, end, step)
+	}
+
+	dir := t.TempDir()
+	now := time.Unix(0, 0).Add(60 * time.Hour)
+	newCache := func() *resultsCache {
+		c, err := newResultsCache(&config.ResultsCacheConfig{Dir: dir, MaxFreshness: time.Hour, TTL: time.Hour})
+		require.NoError(t, err)
+		c.now = func() time.Time { return now }
+		return c
+	}
+	cache := newCache()
+
+	ctx := context.Background()
+	start, end, step := time.Unix(0, 0), time.Unix(0, 0).Add(59*time.Hour), 10*time.Minute
+	query := func(expected int) {
+		calls = 0
+		_, err := cache.rangeQuery(ctx, "up", start, end, step, exec)
+		require.NoError(t, err)
+		require.Equal(t, expected, calls)
+	}
+	// the files are taken as written at touch
+	touch := func(at time.Time) {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		for _, info := range infos {
+			require.NoError(t, os.Chtimes(filepath.Join(dir, info.Name()), at, at))
+		}
+	}
+	query(3)
+	touch(now)
+	query(1)
+
+	// expired in memory and on disk
+	now = now.Add(time.Hour)
+	query(3)
+	touch(now)
+	cache = newCache()
+	query(1)
+
+	touch(now.Add(-time.Hour))
+	cache = newCache()
+	query(3)
+
+	// and swept once written again
+	stale := filepath.Join(dir, "stale")
+	require.NoError(t, ioutil.WriteFile(stale, nil, 0644))
+	touch(now.Add(-2 * time.Hour))
+	cache = newCache()
+	start = start.Add(-24 * time.Hour)
+	query(4)
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,249 @@
+package parser
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/metas"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/table"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const (
+	// maxWindowSteps is the max number of steps a sample can be in the range
+	// of for range functions to be pushed down, otherwise the SQL gets too large.
+	maxWindowSteps = 256
+)
+
+// seriesSelector is the condition on flash_metrics_index selecting the series
+// of a vector selector.
+type seriesSelector struct {
+	cond string
+	args []interface{}
+	// tables are the tables of the storage.
+	tables table.Tables
+
+	// labels are the label names of the metric in order, and columns are the
+	// corresponding columns of flash_metrics_index.
+	labels  []string
+	columns []string
+}
+
+// buildSeriesSelector returns nil if the selector can't be pushed down.
+func (ev *evaluator) buildSeriesSelector(matchers []*labels.Matcher) (*seriesSelector, error) {
+	storage, ok := ev.storage.(*store.DefaultMetricStorage)
+	if !ok {
+		return nil, nil
+	}
+
+	var metricName string
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			if m.Type != labels.MatchEqual {
+				return nil, nil
+			}
+			metricName = m.Value
+		}
+	}
+	if metricName == "" {
+		return nil, nil
+	}
+
+	meta, err := storage.QueryMeta(ev.ctx, metricName)
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &seriesSelector{tables: storage.Tables()}
+	for name := range meta.Labels {
+		sel.labels = append(sel.labels, string(name))
+	}
+	sort.Strings(sel.labels)
+	for _, name := range sel.labels {
+		sel.columns = append(sel.columns, metas.LabelColumn(meta.Labels[metas.LabelName(name)]))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("metric_name = ?")
+	sel.args = append(sel.args, metricName)
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			continue
+		}
+
+		labelID, ok := meta.Labels[metas.LabelName(m.Name)]
+		if !ok {
+			// The label is empty for all series of the metric.
+			if !m.Matches("") {
+				sb.WriteString(" AND FALSE")
+			}
+			continue
+		}
+
+		sb.WriteString(" AND ")
+		sb.WriteString(metas.LabelColumn(labelID))
+		value := m.Value
+		switch m.Type {
+		case labels.MatchEqual:
+			sb.WriteString(" = ?")
+		case labels.MatchNotEqual:
+			sb.WriteString(" != ?")
+		case labels.MatchRegexp:
+			sb.WriteString(" REGEXP ?")
+			value = "^(?:" + value + ")$"
+		case labels.MatchNotRegexp:
+			sb.WriteString(" NOT REGEXP ?")
+			value = "^(?:" + value + ")$"
+		}
+		sel.args = append(sel.args, value)
+	}
+	sel.cond = sb.String()
+	return sel, nil
+}
+
+// formatTimestamp formats milliseconds the same way as samples are stored.
+func formatTimestamp(ms int64) string {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05.999 -0700")
+}
+
+// windowSQL is the SQL of the samples in the range of a matrix selector at
+// every step. A sample shows up once for every step it's in the range of.
+type windowSQL struct {
+	sel  *seriesSelector
+	sql  string
+	args []interface{}
+}
+
+// buildWindowSQL returns the samples as rows of (tsid, k, t, v, prev_t,
+// prev_v, next_t), where k is the index of the step, t the timestamp in
+// milliseconds, prev_* the previous sample and next_t the timestamp of the
+// next sample of the series in the range of the step. It returns nil if the
+// matrix selector can't be pushed down.
+//
+//	SELECT tsid, k, t, v,
+//	  LAG(t) OVER w AS prev_t, LAG(v) OVER w AS prev_v, LEAD(t) OVER w AS next_t
+//	FROM (
+//	  SELECT tsid, t, v, GREATEST(t + offset - start + step - 1, 0) DIV step + j AS k,
+//	    LEAST((t + offset + range - start) DIV step, steps) AS max_k
+//	  FROM (
+//	    SELECT tsid, CAST(UNIX_TIMESTAMP(ts)*1000 AS SIGNED) AS t, v
+//	    FROM flash_metrics_data
+//	    WHERE tsid IN (SELECT _tidb_rowid FROM flash_metrics_index WHERE ...)
+//	    AND start - offset - range <= ts AND ts <= end - offset
+//	  ) samples, (SELECT 0 AS j UNION ALL SELECT 1 ...) steps
+//	) windows
+//	WHERE k <= max_k
+func (ev *evaluator) buildWindowSQL(ms *promql.MatrixSelector) (*windowSQL, error) {
+	step := ev.intervalMs
+	steps := (ev.endMs - ev.startMs) / step
+	offset := durationMilliseconds(ms.Offset)
+	selRange := durationMilliseconds(ms.Range)
+
+	// the number of steps whose range a sample can be in
+	windowSteps := selRange/step + 1
+	if windowSteps > steps+1 {
+		windowSteps = steps + 1
+	}
+	if windowSteps > maxWindowSteps {
+		return nil, nil
+	}
+
+	sel, err := ev.buildSeriesSelector(ms.LabelMatchers)
+	if err != nil || sel == nil {
+		return nil, err
+	}
+
+	w := &windowSQL{sel: sel}
+	var sb strings.Builder
+	sb.WriteString(`
+SELECT tsid, k, t, v,
+  LAG(t) OVER (PARTITION BY tsid, k ORDER BY t) AS prev_t,
+  LAG(v) OVER (PARTITION BY tsid, k ORDER BY t) AS prev_v,
+  LEAD(t) OVER (PARTITION BY tsid, k ORDER BY t) AS next_t
+FROM (
+  SELECT tsid, t, v,
+    GREATEST(t + ? + ? - 1, 0) DIV ? + j AS k,
+    LEAST((t + ?) DIV ?, ?) AS max_k
+  FROM (
+    SELECT tsid, CAST(UNIX_TIMESTAMP(ts)*1000 AS SIGNED) AS t, v
+    FROM ` + sel.tables.Data + `
+    WHERE tsid IN (SELECT _tidb_rowid FROM ` + sel.tables.Index + ` WHERE `)
+	w.args = append(w.args, offset-ev.startMs, step, step, offset+selRange-ev.startMs, step, steps)
+	sb.WriteString(sel.cond)
+	w.args = append(w.args, sel.args...)
+	sb.WriteString(`)
+    AND ? <= ts AND ts <= ?
+    AND v IS NOT NULL
+  ) samples, (SELECT 0 AS j`)
+	w.args = append(w.args, formatTimestamp(ev.startMs-offset-selRange), formatTimestamp(ev.endMs-offset))
+	for j := int64(1); j < windowSteps; j++ {
+		sb.WriteString(" UNION ALL SELECT ")
+		sb.WriteString(strconv.FormatInt(j, 10))
+	}
+	sb.WriteString(`) steps
+) windows
+WHERE k <= max_k`)
+	w.sql = sb.String()
+	return w, nil
+}
+
+// buildVectorSelector selects the latest sample within the lookback delta at
+// every step, which is the last sample in the window of the range ending at
+// the step.
+func (ev *evaluator) buildVectorSelector(vs *promql.VectorSelector) (*sqlPlan, error) {
+	w, err := ev.buildWindowSQL(&promql.MatrixSelector{
+		Name:          vs.Name,
+		Range:         time.Duration(ev.lookbackMs) * time.Millisecond,
+		Offset:        vs.Offset,
+		LabelMatchers: vs.LabelMatchers,
+	})
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	sql := `
+SELECT tsid, k, v
+FROM (` + w.sql + `
+) w
+WHERE next_t IS NULL`
+	return ev.buildSeriesPlan(w.sel, true, sql, w.args), nil
+}
+
+// buildSeriesPlan joins the result of sql, rows of (tsid, k, v), with the
+// labels of the series selected by sel. The metric name is kept if keepName.
+//
+//	SELECT metric_name AS l0, label0 AS l1, label1 AS l2, start + k * step AS t, r.v AS v
+//	FROM (...) r INNER JOIN flash_metrics_index ON (_tidb_rowid = r.tsid)
+func (ev *evaluator) buildSeriesPlan(sel *seriesSelector, keepName bool, sql string, args []interface{}) *sqlPlan {
+	plan := &sqlPlan{}
+	var columns []string
+	if keepName {
+		plan.labels = append(plan.labels, labels.MetricName)
+		columns = append(columns, "metric_name")
+	}
+	plan.labels = append(plan.labels, sel.labels...)
+	columns = append(columns, sel.columns...)
+
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for i, column := range columns {
+		sb.WriteString(column)
+		sb.WriteString(" AS l")
+		sb.WriteString(strconv.Itoa(i))
+		sb.WriteString(", ")
+	}
+	sb.WriteString("? + r.k * ? AS t, r.v AS v\nFROM (")
+	plan.args = append(plan.args, ev.startMs, ev.intervalMs)
+	sb.WriteString(sql)
+	plan.args = append(plan.args, args...)
+	sb.WriteString("\n) r INNER JOIN ")
+	sb.WriteString(sel.tables.Index)
+	sb.WriteString(" ON (_tidb_rowid = r.tsid)")
+	plan.sql = sb.String()
+	return plan
+}
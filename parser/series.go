@@ -0,0 +1,37 @@
+package parser
+
+import (
+	"context"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Series returns the label sets of the series selected by any of the matcher
+// sets and updated between start and end, without duplicates.
+func Series(ctx context.Context, storage store.SeriesStorage, matcherSets [][]*labels.Matcher, start, end time.Time) ([]labels.Labels, error) {
+	var res []labels.Labels
+	seen := map[uint64]struct{}{}
+	for _, matchers := range matcherSets {
+		metricName, modelMatchers := toModelMatchers(matchers)
+		timeSeries, err := storage.QuerySeries(ctx, timeMilliseconds(start), timeMilliseconds(end), metricName, modelMatchers)
+		if err != nil {
+			return nil, err
+		}
+		for _, ts := range timeSeries {
+			metric := metricOf(ts)
+			if !matchAll(matchers, metric) {
+				continue
+			}
+			h := metric.Hash()
+			if _, ok := seen[h]; ok {
+				continue
+			}
+			seen[h] = struct{}{}
+			res = append(res, metric)
+		}
+	}
+	return res, nil
+}
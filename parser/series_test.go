@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeries(t *testing.T) {
+	storage := newTestStorage()
+	ctx := context.Background()
+	start, end := time.Unix(0, 0), time.Unix(600, 0)
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range []string{
+		`http_requests_total{job="api", method=~"G.*"}`,
+		`http_requests_total{instance="1"}`,
+		`instance_capacity{instance!="1"}`,
+	} {
+		matchers, err := promql.ParseMetricSelector(s)
+		require.NoError(t, err)
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	series, err := Series(ctx, storage, matcherSets, start, end)
+	require.NoError(t, err)
+	var res []string
+	for _, metric := range series {
+		res = append(res, metric.String())
+	}
+	require.ElementsMatch(t, []string{
+		`{__name__="http_requests_total", instance="0", job="api", method="GET"}`,
+		`{__name__="http_requests_total", instance="1", job="api", method="GET"}`,
+		`{__name__="instance_capacity", instance="0", job="api"}`,
+	}, res)
+
+	// no samples in the range
+	series, err = Series(ctx, storage, matcherSets, time.Unix(1000, 0), time.Unix(2000, 0))
+	require.NoError(t, err)
+	require.Empty(t, series)
+
+	// without a metric name
+	matchers, err := promql.ParseMetricSelector(`{__name__=~"http_.*|instance_.*", instance="1"}`)
+	require.NoError(t, err)
+	series, err = Series(ctx, storage, [][]*labels.Matcher{matchers}, start, end)
+	require.NoError(t, err)
+	res = res[:0]
+	for _, metric := range series {
+		res = append(res, metric.String())
+	}
+	require.ElementsMatch(t, []string{
+		`{__name__="http_requests_total", instance="1", job="api", method="GET"}`,
+		`{__name__="instance_capacity", instance="1", job="api"}`,
+	}, res)
+}
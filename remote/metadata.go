@@ -0,0 +1,119 @@
+package remote
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+)
+
+// The field numbers of WriteRequest.metadata and MetricMetadata, which the
+// vendored prompb predates.
+const (
+	writeRequestMetadataField = 3
+
+	metricMetadataTypeField       = 1
+	metricMetadataFamilyNameField = 2
+	metricMetadataHelpField       = 4
+	metricMetadataUnitField       = 5
+)
+
+// metricTypes are the names of MetricMetadata.MetricType by value.
+var metricTypes = []string{"unknown", "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset"}
+
+// protoField is a field of a protobuf message, with the value of wire type 0
+// in varint and of wire type 2 in bytes.
+type protoField struct {
+	num      uint64
+	wireType uint64
+	varint   uint64
+	bytes    []byte
+}
+
+// nextProtoField decodes the field at the head of buf and returns the rest.
+func nextProtoField(buf []byte) (protoField, []byte, error) {
+	var f protoField
+	key, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return f, nil, fmt.Errorf("invalid protobuf field key")
+	}
+	buf = buf[n:]
+	f.num, f.wireType = key>>3, key&7
+
+	switch f.wireType {
+	case 0:
+		if f.varint, n = binary.Uvarint(buf); n <= 0 {
+			return f, nil, fmt.Errorf("invalid varint of field %d", f.num)
+		}
+		return f, buf[n:], nil
+	case 1:
+		if len(buf) < 8 {
+			return f, nil, fmt.Errorf("invalid fixed64 of field %d", f.num)
+		}
+		return f, buf[8:], nil
+	case 2:
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return f, nil, fmt.Errorf("invalid length of field %d", f.num)
+		}
+		f.bytes = buf[n : n+int(l)]
+		return f, buf[n+int(l):], nil
+	case 5:
+		if len(buf) < 4 {
+			return f, nil, fmt.Errorf("invalid fixed32 of field %d", f.num)
+		}
+		return f, buf[4:], nil
+	default:
+		return f, nil, fmt.Errorf("unsupported wire type %d of field %d", f.wireType, f.num)
+	}
+}
+
+// decodeMetadata decodes the metadata of an uncompressed WriteRequest.
+func decodeMetadata(reqBuf []byte) ([]model.Metadata, error) {
+	var metadata []model.Metadata
+	for len(reqBuf) > 0 {
+		f, rest, err := nextProtoField(reqBuf)
+		if err != nil {
+			return nil, err
+		}
+		reqBuf = rest
+		if f.num != writeRequestMetadataField || f.wireType != 2 {
+			continue
+		}
+
+		m, err := decodeMetricMetadata(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		if m.MetricName == "" {
+			continue
+		}
+		metadata = append(metadata, m)
+	}
+	return metadata, nil
+}
+
+func decodeMetricMetadata(buf []byte) (model.Metadata, error) {
+	m := model.Metadata{Type: metricTypes[0]}
+	for len(buf) > 0 {
+		f, rest, err := nextProtoField(buf)
+		if err != nil {
+			return m, err
+		}
+		buf = rest
+
+		switch {
+		case f.num == metricMetadataTypeField && f.wireType == 0:
+			if f.varint < uint64(len(metricTypes)) {
+				m.Type = metricTypes[f.varint]
+			}
+		case f.num == metricMetadataFamilyNameField && f.wireType == 2:
+			m.MetricName = string(f.bytes)
+		case f.num == metricMetadataHelpField && f.wireType == 2:
+			m.Help = string(f.bytes)
+		case f.num == metricMetadataUnitField && f.wireType == 2:
+			m.Unit = string(f.bytes)
+		}
+	}
+	return m, nil
+}
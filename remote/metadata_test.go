@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendProtoVarint(buf []byte, num, v uint64) []byte {
+	return appendUvarint(appendUvarint(buf, num<<3), v)
+}
+
+func appendProtoBytes(buf []byte, num uint64, b []byte) []byte {
+	buf = appendUvarint(appendUvarint(buf, num<<3|2), uint64(len(b)))
+	return append(buf, b...)
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "api_http_requests_total"}},
+			Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+		}},
+	}
+	reqBuf, err := req.Marshal()
+	require.NoError(t, err)
+
+	var counter []byte
+	counter = appendProtoVarint(counter, metricMetadataTypeField, 1)
+	counter = appendProtoBytes(counter, metricMetadataFamilyNameField, []byte("api_http_requests_total"))
+	counter = appendProtoBytes(counter, metricMetadataHelpField, []byte("Total HTTP requests."))
+	reqBuf = appendProtoBytes(reqBuf, writeRequestMetadataField, counter)
+
+	var gauge []byte
+	gauge = appendProtoBytes(gauge, metricMetadataFamilyNameField, []byte("process_resident_memory"))
+	gauge = appendProtoVarint(gauge, metricMetadataTypeField, 2)
+	gauge = appendProtoBytes(gauge, metricMetadataUnitField, []byte("bytes"))
+	reqBuf = appendProtoBytes(reqBuf, writeRequestMetadataField, gauge)
+
+	// metadata without metric name is ignored
+	reqBuf = appendProtoBytes(reqBuf, writeRequestMetadataField, appendProtoVarint(nil, metricMetadataTypeField, 3))
+
+	decoded := &prompb.WriteRequest{}
+	require.NoError(t, decoded.Unmarshal(reqBuf))
+	require.Equal(t, req, decoded)
+
+	metadata, err := decodeMetadata(reqBuf)
+	require.NoError(t, err)
+	require.Equal(t, []model.Metadata{{
+		MetricName: "api_http_requests_total",
+		Type:       "counter",
+		Help:       "Total HTTP requests.",
+	}, {
+		MetricName: "process_resident_memory",
+		Type:       "gauge",
+		Unit:       "bytes",
+	}}, metadata)
+
+	_, err = decodeMetadata(reqBuf[:len(reqBuf)-1])
+	require.Error(t, err)
+}
@@ -38,36 +38,9 @@ func ReadHandler(storage store.MetricStorage) http.HandlerFunc {
 		queryResults := queryResultP.Get()
 		defer queryResultP.Put(queryResults)
 
-	OUTER:
 		for _, query := range req.Queries {
-			var metricName string
-			var matcher []model.Matcher
-
-			for _, qMatcher := range query.Matchers {
-				if qMatcher.Name == "__name__" {
-					if qMatcher.Type == prompb.LabelMatcher_EQ {
-						metricName = qMatcher.Value
-					} else {
-						log.Warn("not support other matchers for metric name except equal", zap.Any("query", query))
-						continue OUTER
-					}
-				} else {
-					matcher = append(matcher, model.Matcher{
-						LabelName:  qMatcher.Name,
-						LabelValue: qMatcher.Value,
-						IsRE:       qMatcher.Type == prompb.LabelMatcher_NRE || qMatcher.Type == prompb.LabelMatcher_RE,
-						IsNegative: qMatcher.Type == prompb.LabelMatcher_NEQ || qMatcher.Type == prompb.LabelMatcher_NRE,
-					})
-				}
-			}
-
-			if metricName == "" {
-				log.Warn("metric name not found, ignored", zap.Any("query", query))
-				*queryResults = append(*queryResults, nil)
-				continue
-			}
-
-			ts, err := storage.Query(ctx, query.StartTimestampMs, query.EndTimestampMs, metricName, matcher)
+			metricName, matchers := toModelMatchers(query.Matchers)
+			ts, err := storage.Query(ctx, query.StartTimestampMs, query.EndTimestampMs, metricName, matchers)
 			if err != nil {
 				log.Warn("failed to query", zap.Any("query", query), zap.Error(err))
 				*queryResults = append(*queryResults, nil)
@@ -120,6 +93,32 @@ func ReadHandler(storage store.MetricStorage) http.HandlerFunc {
 	}
 }
 
+// toModelMatchers splits matchers into the metric name and the storage
+// matchers. If the metric name isn't matched by equality, it's empty and the
+// storage selects the metrics by the matchers of __name__.
+func toModelMatchers(matchers []*prompb.LabelMatcher) (string, []model.Matcher) {
+	var metricName string
+	res := make([]model.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == "__name__" && m.Type == prompb.LabelMatcher_EQ && metricName == "" {
+			metricName = m.Value
+			continue
+		}
+		matcher := model.Matcher{
+			LabelName:  m.Name,
+			LabelValue: m.Value,
+			IsRE:       m.Type == prompb.LabelMatcher_NRE || m.Type == prompb.LabelMatcher_RE,
+			IsNegative: m.Type == prompb.LabelMatcher_NEQ || m.Type == prompb.LabelMatcher_NRE,
+		}
+		if matcher.IsRE {
+			// regexps are fully anchored, but REGEXP in TiDB is not
+			matcher.LabelValue = "^(?:" + m.Value + ")$"
+		}
+		res = append(res, matcher)
+	}
+	return metricName, res
+}
+
 func decodeReadRequest(r io.Reader) (*prompb.ReadRequest, error) {
 	compressed, err := ioutil.ReadAll(r)
 	if err != nil {
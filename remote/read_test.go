@@ -151,6 +151,26 @@ func (s *testRemoteReadSuite) TestBasic() {
 				Name:  "method",
 				Value: "PO.*",
 			}},
+		}, {
+			StartTimestampMs: now,
+			EndTimestampMs:   now,
+			Matchers: []*prompb.LabelMatcher{{
+				Type:  prompb.LabelMatcher_RE,
+				Name:  "__name__",
+				Value: "api_http_.*",
+			}, {
+				Type:  prompb.LabelMatcher_EQ,
+				Name:  "method",
+				Value: "POST",
+			}},
+		}, {
+			StartTimestampMs: now,
+			EndTimestampMs:   now,
+			Matchers: []*prompb.LabelMatcher{{
+				Type:  prompb.LabelMatcher_RE,
+				Name:  "__name__",
+				Value: "http_.*",
+			}},
 		}},
 	}
 	pt, err := req.Marshal()
@@ -281,5 +301,24 @@ func (s *testRemoteReadSuite) TestBasic() {
 				Value:     100.0,
 			}},
 		}},
+	}, {
+		Timeseries: []*prompb.TimeSeries{{
+			Labels: []*prompb.Label{{
+				Name:  "__name__",
+				Value: "api_http_requests_total",
+			}, {
+				Name:  "handler",
+				Value: "/messages",
+			}, {
+				Name:  "method",
+				Value: "POST",
+			}},
+			Samples: []prompb.Sample{{
+				Timestamp: now,
+				Value:     77.0,
+			}},
+		}},
+	}, {
+		Timeseries: nil,
 	}}})
 }
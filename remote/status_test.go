@@ -0,0 +1,32 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/store/wal"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreErrorStatus(t *testing.T) {
+	for _, c := range []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{wal.ErrFull, http.StatusTooManyRequests, retryAfter},
+		{fmt.Errorf("%w: closed", wal.ErrUnavailable), http.StatusServiceUnavailable, retryAfter},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, retryAfter},
+		{errors.New("too many labels"), http.StatusInternalServerError, ""},
+	} {
+		w := utils.NewRespWriter(bytes.NewBuffer(nil))
+		require.Equal(t, c.status, storeErrorStatus(w, c.err), c.err.Error())
+		require.Equal(t, c.retryAfter, w.Header().Get("Retry-After"), c.err.Error())
+	}
+}
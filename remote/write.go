@@ -2,6 +2,7 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/showhand-lab/flash-metrics/store"
 	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/store/wal"
 
 	"github.com/golang/snappy"
 	"github.com/pingcap/log"
@@ -19,6 +21,10 @@ import (
 
 const (
 	defaultWriteTimeout = 1 * time.Minute
+
+	// retryAfter is the seconds the clients are asked to wait before retrying
+	// the writes rejected by backpressure.
+	retryAfter = "5"
 )
 
 var (
@@ -31,7 +37,7 @@ func WriteHandler(storage store.MetricStorage) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(context.Background(), defaultWriteTimeout)
 		defer cancel()
 
-		req, err := decodeWriteRequest(r.Body)
+		req, metadata, err := decodeWriteRequest(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -81,29 +87,57 @@ func WriteHandler(storage store.MetricStorage) http.HandlerFunc {
 
 		if err = storage.BatchStore(ctx, *storeTSs); err != nil {
 			log.Warn("failed to store time series", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), storeErrorStatus(w, err))
 			return
 		}
 
+		if metadataStorage, ok := storage.(store.MetadataStorage); ok && len(metadata) > 0 {
+			if err = metadataStorage.StoreMetadata(ctx, metadata); err != nil {
+				log.Warn("failed to store metadata", zap.Error(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
 		_, _ = w.Write([]byte("ok"))
 	}
 }
 
-func decodeWriteRequest(r io.Reader) (*prompb.WriteRequest, error) {
+// storeErrorStatus returns the status of the error of storing time series. The
+// writes rejected by backpressure are asked to retry later, rather than being
+// dropped by the clients.
+func storeErrorStatus(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, wal.ErrFull):
+		w.Header().Set("Retry-After", retryAfter)
+		return http.StatusTooManyRequests
+	case errors.Is(err, wal.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		w.Header().Set("Retry-After", retryAfter)
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func decodeWriteRequest(r io.Reader) (*prompb.WriteRequest, []model.Metadata, error) {
 	compressed, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req := &prompb.WriteRequest{}
 	if err = req.Unmarshal(reqBuf); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	metadata, err := decodeMetadata(reqBuf)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return req, nil
+	return req, metadata, nil
 }
@@ -0,0 +1,513 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/table"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	day = 24 * time.Hour
+
+	// seriesGracePeriod is how long new series are kept without updated dates,
+	// which are inserted after the series.
+	seriesGracePeriod = day
+
+	// maxMetricsPerStatement is the max number of metric names in the IN list
+	// of a statement.
+	maxMetricsPerStatement = 100
+)
+
+var (
+	wg              sync.WaitGroup
+	cancelRetention context.CancelFunc
+)
+
+// Init starts enforcing the retention in background if any period is set,
+// including the periods of the rollups.
+func Init(flashMetricsConfig *config.FlashMetricsConfig, storage *store.DefaultMetricStorage) {
+	cfg := &flashMetricsConfig.Retention
+	rollups := rollupTables(&flashMetricsConfig.Rollup, storage.Tables())
+	if cfg.Period == 0 && len(cfg.Metrics) == 0 && len(rollups) == 0 {
+		return
+	}
+	w, err := newWorker(cfg, storage.DB, storage.Tables(), storage.PurgeTSIDCache)
+	if err != nil {
+		log.Fatal("invalid retention config", zap.Error(err))
+	}
+	w.rollups = rollups
+	w.invalidate = storage.Invalidate
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRetention = cancel
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.loop(ctx)
+	}()
+}
+
+func Stop() {
+	if cancelRetention != nil {
+		cancelRetention()
+	}
+	wg.Wait()
+}
+
+// rollupTable is a table of rollups kept for period, zero if forever.
+type rollupTable struct {
+	name       string
+	resolution time.Duration
+	period     time.Duration
+}
+
+// rollupTables returns the tables of the rollups if enabled.
+func rollupTables(cfg *config.RollupConfig, tables table.Tables) []rollupTable {
+	if !cfg.Enabled {
+		return nil
+	}
+	return []rollupTable{
+		{name: tables.Rollup5m, resolution: 5 * time.Minute, period: cfg.Retention5m},
+		{name: tables.Rollup1h, resolution: time.Hour, period: cfg.Retention1h},
+	}
+}
+
+type rule struct {
+	re     *regexp.Regexp
+	period time.Duration
+}
+
+type worker struct {
+	db     *sql.DB
+	tables table.Tables
+	// purgeCache is called once series are deleted.
+	purgeCache func()
+	// invalidate is called with the ranges of the expired samples and
+	// rollups, if not nil.
+	invalidate func(ctx context.Context, start, end time.Time) error
+
+	period          time.Duration
+	rules           []rule
+	rollups         []rollupTable
+	interval        time.Duration
+	partitionsAhead int
+	batchSize       int
+}
+
+func newWorker(cfg *config.RetentionConfig, db *sql.DB, tables table.Tables, purgeCache func()) (*worker, error) {
+	w := &worker{
+		db:              db,
+		tables:          tables,
+		purgeCache:      purgeCache,
+		period:          cfg.Period,
+		interval:        cfg.Interval,
+		partitionsAhead: cfg.PartitionsAhead,
+		batchSize:       cfg.DeleteBatchSize,
+	}
+	if w.interval <= 0 {
+		w.interval = config.DefaultFlashMetricsConfig.Retention.Interval
+	}
+	if w.batchSize <= 0 {
+		w.batchSize = config.DefaultFlashMetricsConfig.Retention.DeleteBatchSize
+	}
+	if w.period < 0 {
+		return nil, fmt.Errorf("negative retention period %s", w.period)
+	}
+	for _, m := range cfg.Metrics {
+		re, err := regexp.Compile("^(?:" + m.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention pattern %q: %w", m.Pattern, err)
+		}
+		if m.Period < 0 {
+			return nil, fmt.Errorf("negative retention period %s of %q", m.Period, m.Pattern)
+		}
+		w.rules = append(w.rules, rule{re: re, period: m.Period})
+	}
+	return w, nil
+}
+
+// periodOf returns the retention period of a metric, zero if forever.
+func (w *worker) periodOf(metricName string) time.Duration {
+	for _, r := range w.rules {
+		if r.re.MatchString(metricName) {
+			return r.period
+		}
+	}
+	return w.period
+}
+
+// seriesPeriod returns how long the series of a metric kept for period are
+// kept, which the rollups refer to as well. Zero if forever.
+func (w *worker) seriesPeriod(period time.Duration) time.Duration {
+	for _, r := range w.rollups {
+		if r.period == 0 {
+			return 0
+		}
+		if r.period > period {
+			period = r.period
+		}
+	}
+	return period
+}
+
+// longestPeriod returns the longest retention period of all the metrics, zero
+// if any metric is kept forever.
+func (w *worker) longestPeriod() time.Duration {
+	longest := w.period
+	for _, r := range w.rules {
+		if r.period == 0 || longest == 0 {
+			return 0
+		}
+		if r.period > longest {
+			longest = r.period
+		}
+	}
+	return longest
+}
+
+func (w *worker) loop(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.run(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Warn("failed to enforce retention", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run enforces the retention at now.
+func (w *worker) run(ctx context.Context, now time.Time) error {
+	start := time.Now()
+	var expired []expiredRange
+	partitioned, dropped, err := w.maintainPartitions(ctx, now, w.tables.Data, w.longestPeriod())
+	if err != nil {
+		return err
+	}
+	if dropped {
+		expired = append(expired, w.expiredRange(now, w.longestPeriod(), true))
+	}
+	for _, r := range w.rollups {
+		rollupsExpired, err := w.expireRollups(ctx, now, r)
+		if err != nil {
+			return err
+		}
+		if rollupsExpired {
+			expired = append(expired, w.expiredRange(now, r.period, true))
+		}
+	}
+
+	periods, err := w.metricPeriods(ctx)
+	if err != nil {
+		return err
+	}
+	var samples, dates, series int64
+	for period, names := range periods {
+		if period == 0 {
+			continue
+		}
+		// the samples expire with the partitions
+		deleteSamples := !partitioned || period != w.longestPeriod()
+		var periodSamples int64
+		for len(names) > 0 {
+			n := len(names)
+			if n > maxMetricsPerStatement {
+				n = maxMetricsPerStatement
+			}
+			s, d, r, err := w.expireMetrics(ctx, now, period, w.seriesPeriod(period), names[:n], deleteSamples)
+			samples, dates, series = samples+s, dates+d, series+r
+			periodSamples += s
+			if err != nil {
+				return err
+			}
+			names = names[n:]
+		}
+		if periodSamples > 0 {
+			expired = append(expired, w.expiredRange(now, period, false))
+		}
+	}
+	if series > 0 {
+		w.purgeCache()
+	}
+	if w.invalidate != nil {
+		for _, r := range expired {
+			if err = w.invalidate(ctx, r.start, r.end); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("enforce retention done",
+		zap.Duration("in", time.Since(start)),
+		zap.Int64("deleted-samples", samples),
+		zap.Int64("deleted-dates", dates),
+		zap.Int64("deleted-series", series))
+	return nil
+}
+
+// metricPeriods groups the metrics by retention periods.
+func (w *worker) metricPeriods(ctx context.Context) (map[time.Duration][]string, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT DISTINCT metric_name FROM "+w.tables.Index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := map[time.Duration][]string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		period := w.periodOf(name)
+		periods[period] = append(periods[period], name)
+	}
+	return periods, rows.Err()
+}
+
+// expireMetrics deletes the samples of the metrics older than period, and the
+// updated dates older than seriesPeriod, then the series without updated
+// dates. The dates and series are kept forever if seriesPeriod is zero.
+func (w *worker) expireMetrics(ctx context.Context, now time.Time, period, seriesPeriod time.Duration, names []string, deleteSamples bool) (samples, dates, series int64, err error) {
+	inNames := " IN (?" + strings.Repeat(", ?", len(names)-1) + ")"
+	nameArgs := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		nameArgs = append(nameArgs, name)
+	}
+	cutoff := now.Add(-period)
+
+	if deleteSamples {
+		samples, err = w.deleteBatches(ctx, "DELETE FROM "+w.tables.Data+
+			" WHERE tsid IN (SELECT _tidb_rowid FROM "+w.tables.Index+" WHERE metric_name"+inNames+")"+
+			" AND ts < ?", nameArgs, formatTimestamp(cutoff))
+		if err != nil {
+			return
+		}
+	}
+	if seriesPeriod == 0 {
+		return
+	}
+	cutoff = now.Add(-seriesPeriod)
+
+	dates, err = w.deleteBatches(ctx, "DELETE FROM "+w.tables.Update+
+		" WHERE tsid IN (SELECT _tidb_rowid FROM "+w.tables.Index+" WHERE metric_name"+inNames+")"+
+		" AND updated_date < ?", nameArgs, cutoff.UTC().Format("2006-01-02"))
+	if err != nil {
+		return
+	}
+
+	created := cutoff
+	if grace := now.Add(-seriesGracePeriod); grace.Before(created) {
+		created = grace
+	}
+	series, err = w.deleteBatches(ctx, "DELETE FROM "+w.tables.Index+
+		" WHERE metric_name"+inNames+" AND created_at < ?"+
+		" AND NOT EXISTS (SELECT 1 FROM "+w.tables.Update+" u WHERE u.tsid = "+w.tables.Index+"._tidb_rowid)",
+		nameArgs, formatTimestamp(created))
+	return
+}
+
+// deleteBatches runs the DELETE statement with LIMIT until no more rows are
+// deleted, it returns the number of deleted rows.
+func (w *worker) deleteBatches(ctx context.Context, query string, args []interface{}, moreArgs ...interface{}) (int64, error) {
+	query += " LIMIT ?"
+	all := make([]interface{}, 0, len(args)+len(moreArgs)+1)
+	all = append(all, args...)
+	all = append(all, moreArgs...)
+	all = append(all, w.batchSize)
+
+	var total int64
+	for {
+		res, err := w.db.ExecContext(ctx, query, all...)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(w.batchSize) {
+			return total, nil
+		}
+	}
+}
+
+// expiredRange is a range of the samples or the rollups expired by a run.
+type expiredRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// expiredRange returns the range expired by a run at now for period, which is
+// the range since the last run, plus the day before if a partition is dropped.
+// The ranges expired while the worker is stopped are left to the TTL of the
+// results cache.
+func (w *worker) expiredRange(now time.Time, period time.Duration, partition bool) expiredRange {
+	cutoff := now.Add(-period)
+	start := cutoff.Add(-w.interval)
+	if partition {
+		start = start.Add(-day)
+	}
+	return expiredRange{start: start, end: cutoff}
+}
+
+// expireRollups drops the rollups older than the period of r, and moves the
+// start of the rollups so that queries no longer read them. It returns whether
+// any rollup is dropped.
+func (w *worker) expireRollups(ctx context.Context, now time.Time, r rollupTable) (bool, error) {
+	partitioned, dropped, err := w.maintainPartitions(ctx, now, r.name, r.period)
+	if err != nil || r.period == 0 {
+		return dropped, err
+	}
+	cutoff := now.Add(-r.period)
+	if !partitioned {
+		n, err := w.deleteBatches(ctx, "DELETE FROM "+r.name+" WHERE ts < ?", nil, formatTimestamp(cutoff))
+		if err != nil {
+			return dropped, err
+		}
+		dropped = n > 0
+	}
+
+	start := cutoff.Truncate(r.resolution)
+	if start.Before(cutoff) {
+		start = start.Add(r.resolution)
+	}
+	_, err = w.db.ExecContext(ctx, "UPDATE "+w.tables.RollupState+" SET start_ts = GREATEST(start_ts, ?) WHERE resolution = ?",
+		formatTimestamp(start), int64(r.resolution/time.Second))
+	return dropped, err
+}
+
+// partition is a partition of a table partitioned by day, whose rows are
+// before bound in seconds.
+type partition struct {
+	name  string
+	bound int64
+}
+
+// maintainPartitions splits the daily partitions of the table ahead and drops
+// the ones older than period. It returns whether the table is partitioned by
+// range, and whether any partition is dropped.
+func (w *worker) maintainPartitions(ctx context.Context, now time.Time, tableName string, period time.Duration) (partitioned, dropped bool, err error) {
+	partitions, ok, err := w.listPartitions(ctx, tableName)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	splits, drops := planPartitions(partitions, now, w.partitionsAhead, period)
+	if len(splits) > 0 {
+		var sb strings.Builder
+		sb.WriteString("ALTER TABLE ")
+		sb.WriteString(tableName)
+		sb.WriteString(" REORGANIZE PARTITION ")
+		sb.WriteString(table.MaxPartition)
+		sb.WriteString(" INTO (")
+		for _, bound := range splits {
+			sb.WriteString("PARTITION ")
+			sb.WriteString(partitionName(bound))
+			sb.WriteString(" VALUES LESS THAN (")
+			sb.WriteString(strconv.FormatInt(bound, 10))
+			sb.WriteString("), ")
+		}
+		sb.WriteString("PARTITION ")
+		sb.WriteString(table.MaxPartition)
+		sb.WriteString(" VALUES LESS THAN (MAXVALUE))")
+		if _, err = w.db.ExecContext(ctx, sb.String()); err != nil {
+			return true, false, err
+		}
+		log.Info("split partitions", zap.String("table", tableName), zap.Int("count", len(splits)))
+	}
+
+	if len(drops) > 0 {
+		if _, err = w.db.ExecContext(ctx, "ALTER TABLE "+tableName+" DROP PARTITION "+strings.Join(drops, ", ")); err != nil {
+			return true, false, err
+		}
+		log.Info("drop expired partitions", zap.String("table", tableName), zap.Strings("partitions", drops))
+	}
+	return true, len(drops) > 0, nil
+}
+
+func (w *worker) listPartitions(ctx context.Context, tableName string) ([]partition, bool, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT partition_name, partition_method, partition_description
+FROM information_schema.partitions
+WHERE table_schema = DATABASE() AND table_name = ?
+ORDER BY partition_ordinal_position`, tableName)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var partitions []partition
+	for rows.Next() {
+		var name, method, description sql.NullString
+		if err = rows.Scan(&name, &method, &description); err != nil {
+			return nil, false, err
+		}
+		if method.String != "RANGE" {
+			return nil, false, rows.Err()
+		}
+		p := partition{name: name.String, bound: math.MaxInt64}
+		if description.String != "MAXVALUE" {
+			if p.bound, err = strconv.ParseInt(description.String, 10, 64); err != nil {
+				return nil, false, fmt.Errorf("unexpected bound of partition %s: %s", name.String, description.String)
+			}
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, len(partitions) > 0, rows.Err()
+}
+
+// planPartitions returns the bounds of the daily partitions to split from the
+// max partition so that there are ahead partitions after today, and the
+// partitions whose samples are all older than period.
+func planPartitions(partitions []partition, now time.Time, ahead int, period time.Duration) (splits []int64, drops []string) {
+	if len(partitions) > 0 && partitions[len(partitions)-1].name == table.MaxPartition {
+		next := now.UTC().Truncate(day).Add(day).Unix()
+		if len(partitions) > 1 {
+			if last := partitions[len(partitions)-2].bound + int64(day/time.Second); last > next {
+				next = last
+			}
+		}
+		target := now.UTC().Truncate(day).Add(time.Duration(ahead+1) * day).Unix()
+		for bound := next; bound <= target; bound += int64(day / time.Second) {
+			splits = append(splits, bound)
+		}
+	}
+
+	if period > 0 {
+		cutoff := now.Add(-period).Unix()
+		for _, p := range partitions {
+			if p.name != table.MaxPartition && p.bound <= cutoff {
+				drops = append(drops, p.name)
+			}
+		}
+	}
+	return
+}
+
+// partitionName names the daily partition before bound after its day.
+func partitionName(bound int64) string {
+	return "p" + time.Unix(bound, 0).Add(-day).UTC().Format("20060102")
+}
+
+// formatTimestamp formats the time the same way as samples are stored.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.999 -0700")
+}
@@ -0,0 +1,179 @@
+package retention
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/table"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodOf(t *testing.T) {
+	w, err := newWorker(&config.RetentionConfig{
+		Period: 15 * day,
+		Metrics: []config.MetricRetentionConfig{
+			{Pattern: "go_.*", Period: 3 * day},
+			{Pattern: "go_gc_.*", Period: time.Hour},
+			{Pattern: "tidb_server_.*", Period: 90 * day},
+		},
+	}, nil, table.DefaultTables, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3*day, w.periodOf("go_gc_duration_seconds"))
+	require.Equal(t, 90*day, w.periodOf("tidb_server_query_total"))
+	require.Equal(t, 15*day, w.periodOf("up"))
+	require.Equal(t, 15*day, w.periodOf("my_go_goroutines"))
+	require.Equal(t, 90*day, w.longestPeriod())
+	require.Equal(t, 3*day, w.seriesPeriod(3*day))
+
+	// the series are kept as long as the rollups
+	w.rollups = rollupTables(&config.RollupConfig{Enabled: true, Retention5m: 30 * day, Retention1h: 365 * day}, table.DefaultTables)
+	require.Equal(t, 365*day, w.seriesPeriod(3*day))
+	w.rollups = rollupTables(&config.RollupConfig{Enabled: true, Retention5m: 30 * day}, table.DefaultTables)
+	require.Equal(t, time.Duration(0), w.seriesPeriod(3*day))
+
+	w, err = newWorker(&config.RetentionConfig{
+		Metrics: []config.MetricRetentionConfig{{Pattern: "go_.*", Period: 3 * day}},
+	}, nil, table.DefaultTables, nil)
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), w.periodOf("up"))
+	require.Equal(t, time.Duration(0), w.longestPeriod())
+
+	_, err = newWorker(&config.RetentionConfig{
+		Metrics: []config.MetricRetentionConfig{{Pattern: "go_(", Period: 3 * day}},
+	}, nil, table.DefaultTables, nil)
+	require.Error(t, err)
+	_, err = newWorker(&config.RetentionConfig{Period: -day}, nil, table.DefaultTables, nil)
+	require.Error(t, err)
+}
+
+func TestExpiredRange(t *testing.T) {
+	w, err := newWorker(&config.RetentionConfig{Interval: time.Hour}, nil, table.DefaultTables, nil)
+	require.NoError(t, err)
+	now := time.Date(2021, 10, 17, 13, 0, 0, 0, time.UTC)
+	require.Equal(t, expiredRange{start: now.Add(-3*day - time.Hour), end: now.Add(-3 * day)}, w.expiredRange(now, 3*day, false))
+	require.Equal(t, expiredRange{start: now.Add(-4*day - time.Hour), end: now.Add(-3 * day)}, w.expiredRange(now, 3*day, true))
+}
+
+func TestPlanPartitions(t *testing.T) {
+	now := time.Date(2021, 10, 17, 13, 0, 0, 0, time.UTC)
+	bound := func(year int, month time.Month, d int) int64 {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	maxPartition := partition{name: table.MaxPartition, bound: math.MaxInt64}
+
+	// split the history from the max partition
+	splits, drops := planPartitions([]partition{maxPartition}, now, 2, 0)
+	require.Equal(t, []int64{bound(2021, 10, 18), bound(2021, 10, 19), bound(2021, 10, 20)}, splits)
+	require.Empty(t, drops)
+	require.Equal(t, "p20211017", partitionName(splits[0]))
+
+	partitions := []partition{
+		{name: "p20211014", bound: bound(2021, 10, 15)},
+		{name: "p20211015", bound: bound(2021, 10, 16)},
+		{name: "p20211016", bound: bound(2021, 10, 17)},
+		{name: "p20211017", bound: bound(2021, 10, 18)},
+		{name: "p20211018", bound: bound(2021, 10, 19)},
+		maxPartition,
+	}
+	splits, drops = planPartitions(partitions, now, 2, 2*day)
+	require.Equal(t, []int64{bound(2021, 10, 20)}, splits)
+	require.Equal(t, []string{"p20211014"}, drops)
+
+	splits, drops = planPartitions(partitions, now, 1, 37*time.Hour)
+	require.Empty(t, splits)
+	require.Equal(t, []string{"p20211014", "p20211015"}, drops)
+
+	// the partitions far behind
+	splits, _ = planPartitions(partitions[:2], now, 0, 0)
+	require.Empty(t, splits)
+	splits, _ = planPartitions(append(partitions[:1:1], maxPartition), now, 0, 0)
+	require.Equal(t, []int64{bound(2021, 10, 18)}, splits)
+
+	// not split without the max partition
+	splits, drops = planPartitions(partitions[:5], now, 3, day)
+	require.Empty(t, splits)
+	require.Equal(t, []string{"p20211014", "p20211015"}, drops)
+}
+
+func TestRetention(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDB("test_retention")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_retention", db))
+	}()
+
+	storage := store.NewDefaultMetricStorage(db)
+	defer storage.Close()
+
+	now := time.Now()
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	oldMs := now.Add(-10*day).UnixNano() / int64(time.Millisecond)
+	for _, ts := range []model.TimeSeries{{
+		Name:    "go_goroutines",
+		Labels:  []model.Label{{Name: "instance", Value: "a"}},
+		Samples: []model.Sample{{TimestampMs: oldMs, Value: 1}, {TimestampMs: nowMs, Value: 2}},
+	}, {
+		Name:    "go_goroutines",
+		Labels:  []model.Label{{Name: "instance", Value: "b"}},
+		Samples: []model.Sample{{TimestampMs: oldMs, Value: 3}},
+	}, {
+		Name:    "up",
+		Labels:  []model.Label{{Name: "instance", Value: "a"}},
+		Samples: []model.Sample{{TimestampMs: oldMs, Value: 1}, {TimestampMs: nowMs, Value: 1}},
+	}} {
+		require.NoError(t, storage.Store(context.Background(), ts))
+	}
+	_, err = db.Exec("UPDATE flash_metrics_index SET created_at = ?", formatTimestamp(now.Add(-10*day)))
+	require.NoError(t, err)
+
+	w, err := newWorker(&config.RetentionConfig{
+		Period:          30 * day,
+		Metrics:         []config.MetricRetentionConfig{{Pattern: "go_.*", Period: 5 * day}},
+		PartitionsAhead: 2,
+		DeleteBatchSize: 1,
+	}, db, table.DefaultTables, storage.PurgeTSIDCache)
+	require.NoError(t, err)
+	var invalidated []expiredRange
+	w.invalidate = func(_ context.Context, start, end time.Time) error {
+		invalidated = append(invalidated, expiredRange{start: start, end: end})
+		return nil
+	}
+	require.NoError(t, w.run(context.Background(), now))
+	require.Equal(t, []expiredRange{w.expiredRange(now, 5*day, false)}, invalidated)
+
+	partitions, ok, err := w.listPartitions(context.Background(), table.DefaultTables.Data)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, partitions, 4)
+	require.Equal(t, table.MaxPartition, partitions[3].name)
+
+	series, err := storage.QuerySeries(context.Background(), oldMs, nowMs, "go_goroutines", nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.TimeSeries{{Name: "go_goroutines", Labels: []model.Label{{Name: "instance", Value: "a"}}}}, series)
+	ts, err := storage.Query(context.Background(), oldMs, nowMs, "go_goroutines", nil)
+	require.NoError(t, err)
+	require.Len(t, ts, 1)
+	require.Equal(t, []model.Sample{{TimestampMs: nowMs, Value: 2}}, ts[0].Samples)
+	ts, err = storage.Query(context.Background(), oldMs, nowMs, "up", nil)
+	require.NoError(t, err)
+	require.Len(t, ts, 1)
+	require.Len(t, ts[0].Samples, 2)
+
+	// running again changes nothing
+	invalidated = nil
+	require.NoError(t, w.run(context.Background(), now))
+	require.Empty(t, invalidated)
+	partitions, _, err = w.listPartitions(context.Background(), table.DefaultTables.Data)
+	require.NoError(t, err)
+	require.Len(t, partitions, 4)
+}
@@ -0,0 +1,343 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/table"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// maxDirtyRanges is the max number of the ranges of late samples rolled up
+// again in a run.
+const maxDirtyRanges = 1000
+
+var (
+	wg           sync.WaitGroup
+	cancelRollup context.CancelFunc
+)
+
+// Init starts rolling up the samples in background if enabled, and lets the
+// storage serve queries from the rollups.
+func Init(flashMetricsConfig *config.FlashMetricsConfig, storage *store.DefaultMetricStorage) {
+	cfg := &flashMetricsConfig.Rollup
+	if !cfg.Enabled {
+		return
+	}
+	w := newWorker(cfg, storage.DB, storage.Tables())
+	w.invalidate = storage.Invalidate
+	storage.EnableRollups(w.delay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRollup = cancel
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.loop(ctx)
+	}()
+}
+
+func Stop() {
+	if cancelRollup != nil {
+		cancelRollup()
+	}
+	wg.Wait()
+}
+
+// level is a resolution of rollups, whose buckets are aggregated from the
+// samples of src.
+type level struct {
+	resolution time.Duration
+	table      string
+	src        string
+	// fromRaw is whether src is the table of raw samples.
+	fromRaw bool
+	// chunk is the time range of buckets rolled up by a statement.
+	chunk time.Duration
+}
+
+type worker struct {
+	db       *sql.DB
+	tables   table.Tables
+	levels   []level
+	interval time.Duration
+	delay    time.Duration
+	// invalidate is called with the ranges of the buckets rolled up again, if
+	// not nil.
+	invalidate func(ctx context.Context, start, end time.Time) error
+}
+
+func newWorker(cfg *config.RollupConfig, db *sql.DB, tables table.Tables) *worker {
+	w := &worker{
+		db:     db,
+		tables: tables,
+		// the finer level goes first as it's the source of the coarser one
+		levels: []level{{
+			resolution: 5 * time.Minute,
+			table:      tables.Rollup5m,
+			src:        tables.Data,
+			fromRaw:    true,
+			chunk:      time.Hour,
+		}, {
+			resolution: time.Hour,
+			table:      tables.Rollup1h,
+			src:        tables.Rollup5m,
+			chunk:      24 * time.Hour,
+		}},
+		interval: cfg.Interval,
+		delay:    cfg.Delay,
+	}
+	if w.interval <= 0 {
+		w.interval = config.DefaultFlashMetricsConfig.Rollup.Interval
+	}
+	if w.delay < 0 {
+		w.delay = 0
+	}
+	return w
+}
+
+func (w *worker) loop(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.run(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Warn("failed to roll up samples", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run rolls up the buckets ending before now minus the delay, then the ones
+// of the late samples.
+func (w *worker) run(ctx context.Context, now time.Time) error {
+	srcWatermark := now.Add(-w.delay)
+	for _, l := range w.levels {
+		watermark, err := w.rollUp(ctx, l, srcWatermark)
+		if err != nil {
+			return err
+		}
+		srcWatermark = watermark
+	}
+	return w.rollUpDirty(ctx)
+}
+
+// timeRange is a range of time in [start, end).
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// rollUpDirty rolls up again the buckets of the ranges of late samples, which
+// are recorded by the storage, and removes the ranges.
+func (w *worker) rollUpDirty(ctx context.Context) error {
+	rows, err := w.db.QueryContext(ctx, "SELECT id, FLOOR(UNIX_TIMESTAMP(start_ts)), FLOOR(UNIX_TIMESTAMP(end_ts)) FROM "+
+		w.tables.RollupDirty+" ORDER BY id LIMIT ?", maxDirtyRanges)
+	if err != nil {
+		return err
+	}
+	var ids []interface{}
+	var ranges []timeRange
+	for rows.Next() {
+		var id, start, end int64
+		if err = rows.Scan(&id, &start, &end); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		// the end is inclusive
+		ranges = append(ranges, timeRange{start: time.Unix(start, 0), end: time.Unix(end+1, 0)})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	ranges = mergeRanges(ranges)
+	for _, l := range w.levels {
+		startTs, watermark, ok, err := w.state(ctx, l)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		for _, r := range ranges {
+			// the buckets out of [startTs, watermark) are never served
+			from := r.start.Truncate(l.resolution)
+			to := r.end.Add(l.resolution - 1).Truncate(l.resolution)
+			if from.Before(startTs) {
+				from = startTs
+			}
+			if to.After(watermark) {
+				to = watermark
+			}
+			for from.Before(to) {
+				end := from.Add(l.chunk)
+				if end.After(to) {
+					end = to
+				}
+				if _, err = w.db.ExecContext(ctx, rollupSQL(l), formatTimestamp(from), formatTimestamp(end)); err != nil {
+					return err
+				}
+				from = end
+			}
+		}
+	}
+
+	if w.invalidate != nil {
+		for _, r := range ranges {
+			if err = w.invalidate(ctx, r.start, r.end); err != nil {
+				return err
+			}
+		}
+	}
+	// the ranges recorded meanwhile are left to the next run
+	if _, err = w.db.ExecContext(ctx, "DELETE FROM "+w.tables.RollupDirty+" WHERE id IN (?"+
+		strings.Repeat(", ?", len(ids)-1)+")", ids...); err != nil {
+		return err
+	}
+	log.Info("roll up late samples done", zap.Int("ranges", len(ids)), zap.Duration("in", time.Since(start)))
+	return nil
+}
+
+// mergeRanges returns the union of the ranges ordered by start, the ranges
+// within an hour, the coarsest resolution, are merged.
+func mergeRanges(ranges []timeRange) []timeRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Before(ranges[j].start) })
+	var merged []timeRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && !r.start.After(merged[n-1].end.Add(time.Hour)) {
+			if r.end.After(merged[n-1].end) {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rollUp rolls up the buckets of the level ending before srcWatermark, and
+// returns the new watermark of the level.
+func (w *worker) rollUp(ctx context.Context, l level, srcWatermark time.Time) (time.Time, error) {
+	target := srcWatermark.Truncate(l.resolution)
+	// a new level starts from the first whole bucket in its source
+	initial := target
+	if initial.Before(srcWatermark) {
+		initial = initial.Add(l.resolution)
+	}
+	watermark, err := w.watermark(ctx, l, initial)
+	if err != nil {
+		return watermark, err
+	}
+
+	start := time.Now()
+	from := watermark
+	for watermark.Before(target) {
+		end := watermark.Add(l.chunk)
+		if end.After(target) {
+			end = target
+		}
+		if _, err = w.db.ExecContext(ctx, rollupSQL(l), formatTimestamp(watermark), formatTimestamp(end)); err != nil {
+			return watermark, err
+		}
+		if _, err = w.db.ExecContext(ctx, "UPDATE "+w.tables.RollupState+
+			" SET watermark = GREATEST(watermark, ?) WHERE resolution = ?",
+			formatTimestamp(end), int64(l.resolution/time.Second)); err != nil {
+			return watermark, err
+		}
+		watermark = end
+	}
+	if watermark.After(from) {
+		log.Info("roll up samples done",
+			zap.Duration("resolution", l.resolution),
+			zap.Time("from", from),
+			zap.Time("to", watermark),
+			zap.Duration("in", time.Since(start)))
+	}
+	return watermark, nil
+}
+
+// watermark returns the end of the rolled up buckets of the level. The rollups
+// of a new level start from initial.
+func (w *worker) watermark(ctx context.Context, l level, initial time.Time) (time.Time, error) {
+	resolution := int64(l.resolution / time.Second)
+	if _, err := w.db.ExecContext(ctx, "INSERT IGNORE INTO "+w.tables.RollupState+
+		" (resolution, start_ts, watermark) VALUES (?, ?, ?)",
+		resolution, formatTimestamp(initial), formatTimestamp(initial)); err != nil {
+		return time.Time{}, err
+	}
+
+	var watermark int64
+	if err := w.db.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(watermark) FROM "+w.tables.RollupState+
+		" WHERE resolution = ?", resolution).Scan(&watermark); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(watermark, 0), nil
+}
+
+// state returns the range of the rolled up buckets of the level, ok is false
+// if the level isn't rolled up yet.
+func (w *worker) state(ctx context.Context, l level) (startTs, watermark time.Time, ok bool, err error) {
+	var start, end int64
+	err = w.db.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(start_ts), UNIX_TIMESTAMP(watermark) FROM "+
+		w.tables.RollupState+" WHERE resolution = ?", int64(l.resolution/time.Second)).Scan(&start, &end)
+	if err == sql.ErrNoRows {
+		return startTs, watermark, false, nil
+	}
+	if err != nil {
+		return startTs, watermark, false, err
+	}
+	return time.Unix(start, 0), time.Unix(end, 0), true, nil
+}
+
+// rollupSQL returns the statement rolling up the buckets of the level in
+// [?, ?). The last sample of a bucket is picked by ROW_NUMBER(), and the
+// buckets rolled up again are overwritten.
+func rollupSQL(l level) string {
+	resolution := int64(l.resolution / time.Second)
+	// the columns of the samples and the aggregates of them in src
+	lastTs, v := "ts", "v"
+	minV, maxV, sumV, countV := "MIN(v)", "MAX(v)", "SUM(v)", "COUNT(*)"
+	where := " AND x.v IS NOT NULL"
+	if !l.fromRaw {
+		lastTs, v = "last_ts", "last_v"
+		minV, maxV, sumV, countV = "MIN(min_v)", "MAX(max_v)", "SUM(sum_v)", "SUM(count_v)"
+		where = ""
+	}
+	return fmt.Sprintf(`INSERT INTO %[1]s (tsid, ts, min_v, max_v, sum_v, count_v, last_ts, last_v)
+SELECT tsid, FROM_UNIXTIME(b * %[3]d), %[6]s, %[7]s, %[8]s, %[9]s, MAX(%[4]s), MAX(IF(rn = 1, %[5]s, NULL))
+FROM (
+  SELECT x.*, FLOOR(UNIX_TIMESTAMP(x.ts) / %[3]d) AS b,
+    ROW_NUMBER() OVER (PARTITION BY x.tsid, FLOOR(UNIX_TIMESTAMP(x.ts) / %[3]d) ORDER BY x.%[4]s DESC) AS rn
+  FROM %[2]s x
+  WHERE ? <= x.ts AND x.ts < ?%[10]s
+) y
+GROUP BY tsid, b
+ON DUPLICATE KEY UPDATE
+  min_v = VALUES(min_v), max_v = VALUES(max_v), sum_v = VALUES(sum_v), count_v = VALUES(count_v),
+  last_ts = VALUES(last_ts), last_v = VALUES(last_v)`,
+		l.table, l.src, resolution, lastTs, v, minV, maxV, sumV, countV, where)
+}
+
+// formatTimestamp formats the time the same way as samples are stored.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.999 -0700")
+}
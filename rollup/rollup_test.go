@@ -0,0 +1,112 @@
+package rollup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/table"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollup(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDB("test_rollup")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_rollup", db))
+	}()
+
+	storage := store.NewDefaultMetricStorage(db)
+	defer storage.Close()
+
+	// two hours of samples every 15s ending an hour ago
+	end := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	begin := end.Add(-2 * time.Hour)
+	ts := model.TimeSeries{Name: "up", Labels: []model.Label{{Name: "instance", Value: "a"}}}
+	for t := begin; t.Before(end); t = t.Add(15 * time.Second) {
+		ts.Samples = append(ts.Samples, model.Sample{
+			TimestampMs: t.UnixNano() / int64(time.Millisecond),
+			Value:       float64(t.Sub(begin) / (15 * time.Second)),
+		})
+	}
+	require.NoError(t, storage.Store(context.Background(), ts))
+
+	// roll up from the beginning of the samples
+	for _, resolution := range []int64{300, 3600} {
+		_, err = db.Exec("INSERT INTO flash_metrics_rollup VALUES (?, ?, ?)",
+			resolution, formatTimestamp(begin), formatTimestamp(begin))
+		require.NoError(t, err)
+	}
+	w := newWorker(&config.RollupConfig{Delay: time.Minute}, db, table.DefaultTables)
+	require.NoError(t, w.run(context.Background(), time.Now()))
+
+	var count, sumCount int64
+	var minV, maxV, lastV float64
+	require.NoError(t, db.QueryRow("SELECT COUNT(*), MIN(min_v), MAX(max_v), SUM(count_v) FROM flash_metrics_data_5m").
+		Scan(&count, &minV, &maxV, &sumCount))
+	require.Equal(t, int64(24), count)
+	require.Equal(t, int64(len(ts.Samples)), sumCount)
+	require.Equal(t, ts.Samples[0].Value, minV)
+	require.Equal(t, ts.Samples[len(ts.Samples)-1].Value, maxV)
+
+	require.NoError(t, db.QueryRow("SELECT COUNT(*), SUM(count_v), MAX(last_v) FROM flash_metrics_data_1h").
+		Scan(&count, &sumCount, &lastV))
+	require.Equal(t, int64(2), count)
+	require.Equal(t, int64(len(ts.Samples)), sumCount)
+	require.Equal(t, ts.Samples[len(ts.Samples)-1].Value, lastV)
+
+	// rolling up again changes nothing
+	require.NoError(t, w.run(context.Background(), time.Now()))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM flash_metrics_data_5m").Scan(&count))
+	require.Equal(t, int64(24), count)
+
+	// the buckets of a late sample are rolled up again
+	storage.EnableRollups(w.delay)
+	late := model.TimeSeries{Name: "up", Labels: ts.Labels, Samples: []model.Sample{{
+		TimestampMs: begin.Add(time.Second).UnixNano() / int64(time.Millisecond),
+		Value:       -1,
+	}}}
+	require.NoError(t, storage.BatchStore(context.Background(), []*model.TimeSeries{&late}))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM flash_metrics_rollup_dirty").Scan(&count))
+	require.Equal(t, int64(1), count)
+	require.NoError(t, w.run(context.Background(), time.Now()))
+	for _, table := range []string{"flash_metrics_data_5m", "flash_metrics_data_1h"} {
+		require.NoError(t, db.QueryRow("SELECT SUM(count_v), MIN(min_v) FROM "+table).Scan(&sumCount, &minV))
+		require.Equal(t, int64(len(ts.Samples)+1), sumCount, table)
+		require.Equal(t, float64(-1), minV, table)
+	}
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM flash_metrics_rollup_dirty").Scan(&count))
+	require.Equal(t, int64(0), count)
+
+	// a query with a step of an hour reads the last sample of the whole bucket,
+	// and the raw samples after it
+	ctx := store.WithSelectHints(context.Background(), store.SelectHints{StepMs: int64(time.Hour / time.Millisecond)})
+	res, err := storage.Query(ctx, ts.Samples[0].TimestampMs, ts.Samples[len(ts.Samples)-1].TimestampMs, "up", nil)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, append([]model.Sample{ts.Samples[239]}, ts.Samples[240:]...), res[0].Samples)
+}
+
+func TestMergeRanges(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Unix(0, 0).Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+	require.Equal(t, []timeRange{
+		{start: at(0, 0), end: at(3, 0)},
+		{start: at(5, 0), end: at(5, 1)},
+	}, mergeRanges([]timeRange{
+		{start: at(5, 0), end: at(5, 1)},
+		{start: at(2, 0), end: at(3, 0)},
+		{start: at(0, 0), end: at(1, 0)},
+		{start: at(0, 30), end: at(0, 40)},
+	}))
+	require.Empty(t, mergeRanges(nil))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,16 @@ func storeTimeSeries(ctx context.Context, metricStore store.MetricStorage, timeS
 	}
 }
 
+func storeMetadata(ctx context.Context, metricStore store.MetricStorage, metadata []model.Metadata) {
+	metadataStore, ok := metricStore.(store.MetadataStorage)
+	if !ok || len(metadata) == 0 {
+		return
+	}
+	if err := metadataStore.StoreMetadata(ctx, metadata); err != nil {
+		log.Warn("failed to store metadata", zap.Error(err))
+	}
+}
+
 func scrapeLoop(ctx context.Context, scrapeConfig *config.ScrapeConfig, metricStore store.MetricStorage) {
 	ticker := time.NewTicker(scrapeConfig.ScrapeInterval)
 	defer ticker.Stop()
@@ -68,7 +79,7 @@ func scrapeLoop(ctx context.Context, scrapeConfig *config.ScrapeConfig, metricSt
 							wg.Done()
 						}()
 
-						err, timeSeries := scrapeTarget(
+						err, timeSeries, metadata := scrapeTarget(
 							ctx,
 							scrapeConfig,
 							targetInstance,
@@ -80,6 +91,7 @@ func scrapeLoop(ctx context.Context, scrapeConfig *config.ScrapeConfig, metricSt
 							return
 						}
 						storeTimeSeries(ctx, metricStore, timeSeries)
+						storeMetadata(ctx, metricStore, metadata)
 
 					}(targetInstance, &defaultLabels)
 				}
@@ -96,7 +108,7 @@ func scrapeTarget(
 	ctx context.Context,
 	scrapeConfig *config.ScrapeConfig,
 	targetInstance string,
-	defaultLabels *[]model.Label) (err error, timeSeries []*model.TimeSeries) {
+	defaultLabels *[]model.Label) (err error, timeSeries []*model.TimeSeries, metadata []model.Metadata) {
 
 	now := time.Now()
 	defer func() {
@@ -157,6 +169,15 @@ func scrapeTarget(
 
 	nowMs := now.UnixNano() / int64(time.Millisecond)
 	for name, metricFamily := range metricFamilyMap {
+		// the text format has no unit
+		metadata = append(metadata, model.Metadata{
+			MetricName: name,
+			Job:        scrapeConfig.JobName,
+			Instance:   targetInstance,
+			Type:       metricTypeName(metricFamily.GetType()),
+			Help:       metricFamily.GetHelp(),
+		})
+
 		// TODO: support extra labels from scrape configs
 		for _, metric := range metricFamily.GetMetric() {
 			labels := make([]model.Label, len(*defaultLabels))
@@ -204,7 +225,8 @@ func scrapeTarget(
 			case io_prometheus_client.MetricType_SUMMARY:
 				summary := metric.GetSummary()
 				for _, quantile := range summary.GetQuantile() {
-					quantileLabels := append(labels, model.Label{
+					// copy labels, the quantiles can't share the backing array
+					quantileLabels := append(append(make([]model.Label, 0, len(labels)+1), labels...), model.Label{
 						Name:  "quantile",
 						Value: fmt.Sprintf("%v", quantile.GetQuantile()),
 					})
@@ -236,7 +258,8 @@ func scrapeTarget(
 			case io_prometheus_client.MetricType_HISTOGRAM:
 				histogram := metric.GetHistogram()
 				for _, bucket := range histogram.GetBucket() {
-					histogramLabels := append(labels, model.Label{
+					// copy labels, the buckets can't share the backing array
+					histogramLabels := append(append(make([]model.Label, 0, len(labels)+1), labels...), model.Label{
 						Name:  "le",
 						Value: fmt.Sprintf("%v", bucket.GetUpperBound()),
 					})
@@ -272,3 +295,11 @@ func scrapeTarget(
 	}
 	return
 }
+
+// metricTypeName returns the metric type as in the metadata API of Prometheus.
+func metricTypeName(metricType io_prometheus_client.MetricType) string {
+	if metricType == io_prometheus_client.MetricType_UNTYPED {
+		return "unknown"
+	}
+	return strings.ToLower(metricType.String())
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/parser"
 	"github.com/showhand-lab/flash-metrics/remote"
 	"github.com/showhand-lab/flash-metrics/store"
 
@@ -16,14 +18,25 @@ var (
 	httpServer *http.Server = nil
 )
 
-func ServeHTTP(listener net.Listener, storage store.MetricStorage) {
+func ServeHTTP(listener net.Listener, storage store.MetricStorage, engine *parser.Engine, cfg *config.QueryConfig) {
+	// the read paths share the scheduler
+	s := newScheduler(cfg.MaxConcurrency, cfg.MaxQueueLength)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/write", remote.WriteHandler(storage))
-	mux.HandleFunc("/read", remote.ReadHandler(storage))
+	mux.HandleFunc("/read", schedule(s, remote.ReadHandler(storage)))
 
-	mux.HandleFunc("/api/v1/query", QueryHandler(storage))
-	mux.HandleFunc("/api/v1/query_range", QueryRangeHandler(storage))
-	// mux.HandleFunc("/match", _)
+	mux.HandleFunc("/api/v1/query", schedule(s, QueryHandler(engine)))
+	mux.HandleFunc("/api/v1/query_range", schedule(s, QueryRangeHandler(engine)))
+	if series, ok := storage.(store.SeriesStorage); ok {
+		mux.HandleFunc("/api/v1/series", schedule(s, SeriesHandler(series)))
+		mux.HandleFunc("/api/v1/labels", schedule(s, LabelNamesHandler(series)))
+		mux.HandleFunc(labelValuesPrefix, schedule(s, LabelValuesHandler(series)))
+	}
+	if metadata, ok := storage.(store.MetadataStorage); ok {
+		mux.HandleFunc("/api/v1/metadata", schedule(s, MetadataHandler(metadata)))
+		mux.HandleFunc("/api/v1/targets/metadata", schedule(s, TargetsMetadataHandler(metadata)))
+	}
 
 	mux.HandleFunc("/", DefaultHandler)
 
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/showhand-lab/flash-metrics/store"
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+type targetMetadata struct {
+	Target map[string]string `json:"target"`
+	Metric string            `json:"metric,omitempty"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Unit   string            `json:"unit"`
+}
+
+// parseLimit parses the optional limit parameter, where a negative value
+// means no limit.
+func parseLimit(r *http.Request) (int, error) {
+	s := r.Form.Get("limit")
+	if s == "" {
+		return -1, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("limit must be a number")
+	}
+	return limit, nil
+}
+
+// MetadataHandler serves /api/v1/metadata, the distinct metadata of metrics
+// across targets.
+func MetadataHandler(storage store.MetadataStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		limit, err := parseLimit(r)
+		if err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+
+		metadata, err := storage.QueryMetadata(r.Context(), r.Form.Get("metric"))
+		if err != nil {
+			respondError(w, errorExec, err)
+			return
+		}
+
+		res := map[string][]metricMetadata{}
+		seen := map[model.Metadata]struct{}{}
+		for _, m := range metadata {
+			entries, ok := res[m.MetricName]
+			if !ok && limit >= 0 && len(res) >= limit {
+				continue
+			}
+			key := model.Metadata{MetricName: m.MetricName, Type: m.Type, Help: m.Help, Unit: m.Unit}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			res[m.MetricName] = append(entries, metricMetadata{Type: m.Type, Help: m.Help, Unit: m.Unit})
+		}
+		respond(w, res)
+	}
+}
+
+// TargetsMetadataHandler serves /api/v1/targets/metadata, the metadata of
+// metrics by the scraped targets matching match_target.
+func TargetsMetadataHandler(storage store.MetadataStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		limit, err := parseLimit(r)
+		if err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		var matchers []*labels.Matcher
+		if s := r.Form.Get("match_target"); s != "" {
+			if matchers, err = promql.ParseMetricSelector(s); err != nil {
+				respondError(w, errorBadData, err)
+				return
+			}
+		}
+
+		metric := r.Form.Get("metric")
+		metadata, err := storage.QueryMetadata(r.Context(), metric)
+		if err != nil {
+			respondError(w, errorExec, err)
+			return
+		}
+
+		res := []targetMetadata{}
+		for _, m := range metadata {
+			if limit >= 0 && len(res) >= limit {
+				break
+			}
+			// the metadata from remote write has no target
+			if m.Job == "" && m.Instance == "" {
+				continue
+			}
+			target := labels.FromStrings("instance", m.Instance, "job", m.Job)
+			if !matchTarget(matchers, target) {
+				continue
+			}
+
+			entry := targetMetadata{Target: target.Map(), Type: m.Type, Help: m.Help, Unit: m.Unit}
+			if metric == "" {
+				entry.Metric = m.MetricName
+			}
+			res = append(res, entry)
+		}
+		respond(w, res)
+	}
+}
+
+func matchTarget(matchers []*labels.Matcher, target labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(target.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -14,18 +15,29 @@ import (
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pingcap/log"
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/promql"
-	"github.com/prometheus/prometheus/util/stats"
 	"go.uber.org/zap"
 )
 
 type QueryData struct {
 	ResultType promql.ValueType  `json:"resultType"`
 	Result     promql.Value      `json:"result"`
-	Stats      *stats.QueryStats `json:"stats,omitempty"`
+	Stats      *store.QueryStats `json:"stats,omitempty"`
 }
 
+type errorType string
+
+const (
+	errorTimeout     errorType = "timeout"
+	errorCanceled    errorType = "canceled"
+	errorExec        errorType = "execution"
+	errorBadData     errorType = "bad_data"
+	errorInternal    errorType = "internal"
+	errorUnavailable errorType = "unavailable"
+)
+
 type Response struct {
 	Status    string      `json:"status"`
 	Data      interface{} `json:"data,omitempty"`
@@ -60,85 +72,126 @@ func parseDuration(s string) (time.Duration, error) {
 	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
 }
 
-func QueryHandler(storage store.MetricStorage) http.HandlerFunc {
+func QueryHandler(engine *parser.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
 			return
 		}
 
-		log.Debug("received http request:", zap.ByteString("request", compressed))
-
-		values, err := url.ParseQuery(string(compressed))
+		ts, err := parseTimeParam(r, "time", time.Now())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			respondError(w, errorBadData, err)
 			return
 		}
 
-		for key, value := range values {
-			log.Debug("", zap.String("key", key), zap.Strings("value", value))
+		ctx, stats := queryStats(r)
+		result, err := engine.InstantQuery(ctx, r.Form.Get("query"), ts)
+		if err != nil {
+			respondError(w, queryErrorType(err), err)
+			return
 		}
 
-		scalar := promql.Scalar{T: 1, V: 1.0}
-		data := QueryData{
-			ResultType: "scalar",
-			Result:     scalar,
-		}
-		respond(w, data)
+		respond(w, QueryData{
+			ResultType: result.Type(),
+			Result:     result,
+			Stats:      stats,
+		})
 	}
 }
 
-func QueryRangeHandler(storage store.MetricStorage) http.HandlerFunc {
+func QueryRangeHandler(engine *parser.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
 			return
 		}
 
-		log.Debug("received http request:", zap.ByteString("request", compressed))
-
-		values, err := url.ParseQuery(string(compressed))
+		start, err := parseTimeParam(r, "start", time.Time{})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			respondError(w, errorBadData, err)
 			return
 		}
-
-		for key, value := range values {
-			log.Debug("", zap.String("key", key), zap.Strings("value", value))
+		end, err := parseTimeParam(r, "end", time.Time{})
+		if err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		if end.Before(start) {
+			respondError(w, errorBadData, errors.New("invalid parameter \"end\": end timestamp must not be before start time"))
+			return
 		}
 
-		start, err := parseTime(values["start"][0])
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		s := r.Form.Get("step")
+		if s == "" {
+			respondError(w, errorBadData, errors.New("invalid parameter \"step\": missing"))
+			return
 		}
-		end, err := parseTime(values["end"][0])
+		step, err := parseDuration(s)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			respondError(w, errorBadData, errors.Wrap(err, "invalid parameter \"step\""))
+			return
 		}
-		step, err := parseDuration(values["step"][0])
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if step <= 0 {
+			respondError(w, errorBadData, errors.New("invalid parameter \"step\": zero or negative query resolution step widths are not accepted. Try a positive integer"))
+			return
 		}
 
-		result, err := parser.NewRangeQuery(storage, values["query"][0], start, end, step)
+		ctx, stats := queryStats(r)
+		result, err := engine.RangeQuery(ctx, r.Form.Get("query"), start, end, step)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-
-		if result == nil {
+			respondError(w, queryErrorType(err), err)
 			return
 		}
 
 		respond(w, QueryData{
 			ResultType: result.Type(),
 			Result:     result,
+			Stats:      stats,
 		})
-		// db.execute(sql)
 	}
 }
 
+// parseForm parses both the URL query of GET requests and the body of form
+// POST requests.
+func parseForm(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return errors.Wrap(err, "error parsing form values")
+	}
+	for key, value := range r.Form {
+		log.Debug("", zap.String("key", key), zap.Strings("value", value))
+	}
+	return nil
+}
+
+// queryStats collects the stats of the query if the stats parameter is set,
+// or also the explained SQL statements if the explain parameter is true.
+func queryStats(r *http.Request) (context.Context, *store.QueryStats) {
+	explain, _ := strconv.ParseBool(r.Form.Get("explain"))
+	if r.Form.Get("stats") == "" && !explain {
+		return r.Context(), nil
+	}
+	stats := store.NewQueryStats(explain)
+	return store.WithQueryStats(r.Context(), stats), stats
+}
+
+// parseTimeParam parses the time parameter name, which is required if
+// defaultValue is zero.
+func parseTimeParam(r *http.Request, name string, defaultValue time.Time) (time.Time, error) {
+	s := r.Form.Get(name)
+	if s == "" {
+		if defaultValue.IsZero() {
+			return time.Time{}, errors.Errorf("invalid parameter %q: missing", name)
+		}
+		return defaultValue, nil
+	}
+	t, err := parseTime(s)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid parameter %q", name)
+	}
+	return t, nil
+}
+
 func DefaultHandler(w http.ResponseWriter, r *http.Request) {
 	compressed, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -161,6 +214,54 @@ func DefaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// queryErrorType classifies the errors of queries as Prometheus does.
+func queryErrorType(err error) errorType {
+	switch errors.Cause(err).(type) {
+	case *promql.ParseErr:
+		return errorBadData
+	case promql.ErrQueryTimeout:
+		return errorTimeout
+	case promql.ErrQueryCanceled:
+		return errorCanceled
+	}
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded:
+		return errorTimeout
+	case context.Canceled:
+		return errorCanceled
+	}
+	return errorExec
+}
+
+func respondError(w http.ResponseWriter, typ errorType, err error) {
+	b, jsonErr := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(&Response{
+		Status:    "error",
+		ErrorType: string(typ),
+		Error:     err.Error(),
+	})
+	if jsonErr != nil {
+		log.Warn("error marshaling json response", zap.Error(jsonErr))
+		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusInternalServerError
+	switch typ {
+	case errorBadData:
+		code = http.StatusBadRequest
+	case errorExec:
+		code = http.StatusUnprocessableEntity
+	case errorCanceled, errorTimeout, errorUnavailable:
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if n, err := w.Write(b); err != nil {
+		log.Warn("error writing response", zap.Int("bytesWritten", n), zap.Error(err))
+	}
+}
+
 func respond(w http.ResponseWriter, data interface{}) {
 	b, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(&Response{
 		Status: "success",
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/parser"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/require"
+)
+
+func serveQuery(t *testing.T, handler http.HandlerFunc, req *http.Request) (int, map[string]interface{}) {
+	body := bytes.NewBuffer(nil)
+	w := utils.NewRespWriter(body)
+	handler(w, req)
+
+	var resp map[string]interface{}
+	require.NoError(t, jsoniter.Unmarshal(body.Bytes(), &resp), body.String())
+	return w.Code, resp
+}
+
+func TestQueryParameters(t *testing.T) {
+	engine, err := parser.NewEngine(nil, &config.QueryConfig{Engine: parser.EngineFlash})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "/api/v1/query?query=1%2B1&time=100", nil)
+	require.NoError(t, err)
+	code, resp := serveQuery(t, QueryHandler(engine), req)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "success", resp["status"])
+	require.Equal(t, []interface{}{100.0, "2"}, resp["data"].(map[string]interface{})["result"])
+
+	req, err = http.NewRequest("GET", "/api/v1/query?query=1%2B1&stats=all", nil)
+	require.NoError(t, err)
+	code, resp = serveQuery(t, QueryHandler(engine), req)
+	require.Equal(t, http.StatusOK, code)
+	stats := resp["data"].(map[string]interface{})["stats"].(map[string]interface{})
+	require.Contains(t, stats["timings"], "parseTime")
+	require.Contains(t, stats, "rowsScanned")
+
+	// time defaults to now
+	req, err = http.NewRequest("GET", "/api/v1/query?query=1", nil)
+	require.NoError(t, err)
+	code, resp = serveQuery(t, QueryHandler(engine), req)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "success", resp["status"])
+
+	req, err = http.NewRequest("POST", "/api/v1/query_range", strings.NewReader("query=1&start=0&end=60&step=15"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	code, resp = serveQuery(t, QueryRangeHandler(engine), req)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "matrix", resp["data"].(map[string]interface{})["resultType"])
+
+	for _, query := range []string{
+		"/api/v1/query_range?query=1&end=60&step=15",
+		"/api/v1/query_range?query=1&start=0&end=60",
+		"/api/v1/query_range?query=1&start=60&end=0&step=15",
+		"/api/v1/query_range?query=1&start=0&end=60&step=0",
+		"/api/v1/query_range?query=1&start=x&end=60&step=15",
+		"/api/v1/query_range?query=sum(&start=0&end=60&step=15",
+	} {
+		req, err = http.NewRequest("GET", query, nil)
+		require.NoError(t, err)
+		code, resp = serveQuery(t, QueryRangeHandler(engine), req)
+		require.Equal(t, http.StatusBadRequest, code, query)
+		require.Equal(t, "error", resp["status"], query)
+		require.Equal(t, "bad_data", resp["errorType"], query)
+		require.NotEmpty(t, resp["error"], query)
+	}
+
+	req, err = http.NewRequest("GET", "/api/v1/query?query=1&time=x", nil)
+	require.NoError(t, err)
+	code, resp = serveQuery(t, QueryHandler(engine), req)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "bad_data", resp["errorType"])
+}
@@ -0,0 +1,177 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errQueueFull = errors.New("too many queries are waiting, try again later")
+
+// waiter is a query waiting in the queue, ready is closed once it's admitted.
+type waiter struct {
+	ready    chan struct{}
+	admitted bool
+}
+
+// scheduler admits at most maxConcurrency queries at the same time. The
+// others wait in the queues of their clients, which take turns when a query
+// is done, so that a client sending many queries can't starve the others.
+type scheduler struct {
+	sync.Mutex
+
+	maxConcurrency int
+	maxQueueLength int
+
+	running int
+	queued  int
+	queues  map[string][]*waiter
+	// clients are the clients with waiting queries in turn order, next is
+	// the index of the client to take the next turn.
+	clients []string
+	next    int
+}
+
+// newScheduler returns nil if maxConcurrency isn't positive, which admits
+// every query.
+func newScheduler(maxConcurrency, maxQueueLength int) *scheduler {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	return &scheduler{
+		maxConcurrency: maxConcurrency,
+		maxQueueLength: maxQueueLength,
+		queues:         map[string][]*waiter{},
+	}
+}
+
+// acquire waits until the query of client is admitted, the returned release
+// must be called once the query is done.
+func (s *scheduler) acquire(ctx context.Context, client string) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	s.Lock()
+	if s.running < s.maxConcurrency && s.queued == 0 {
+		s.running++
+		s.Unlock()
+		return s.release, nil
+	}
+	if s.queued >= s.maxQueueLength {
+		s.Unlock()
+		return nil, errQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	if len(s.queues[client]) == 0 {
+		s.clients = append(s.clients, client)
+	}
+	s.queues[client] = append(s.queues[client], w)
+	s.queued++
+	s.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if w.admitted {
+		// admitted at the same time, give the turn to the next query
+		s.running--
+		s.dispatch()
+	} else {
+		s.remove(client, w)
+	}
+	return nil, ctx.Err()
+}
+
+func (s *scheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch admits the waiting queries of the clients in turn while there are
+// free slots.
+func (s *scheduler) dispatch() {
+	for s.running < s.maxConcurrency && s.queued > 0 {
+		if s.next >= len(s.clients) {
+			s.next = 0
+		}
+		client := s.clients[s.next]
+		queue := s.queues[client]
+		w := queue[0]
+		if len(queue) == 1 {
+			delete(s.queues, client)
+			s.clients = append(s.clients[:s.next], s.clients[s.next+1:]...)
+		} else {
+			s.queues[client] = queue[1:]
+			s.next++
+		}
+
+		s.queued--
+		s.running++
+		w.admitted = true
+		close(w.ready)
+	}
+}
+
+func (s *scheduler) remove(client string, w *waiter) {
+	queue := s.queues[client]
+	for i := range queue {
+		if queue[i] != w {
+			continue
+		}
+		s.queued--
+		if len(queue) > 1 {
+			s.queues[client] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+
+		delete(s.queues, client)
+		for j, c := range s.clients {
+			if c != client {
+				continue
+			}
+			s.clients = append(s.clients[:j], s.clients[j+1:]...)
+			if j < s.next {
+				s.next--
+			}
+			break
+		}
+		return
+	}
+}
+
+// clientOf identifies the client of r by its address.
+func clientOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// schedule runs handler once the request is admitted by s.
+func schedule(s *scheduler, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, err := s.acquire(r.Context(), clientOf(r))
+		if err != nil {
+			if err == errQueueFull {
+				respondError(w, errorUnavailable, err)
+			} else {
+				respondError(w, queryErrorType(err), err)
+			}
+			return
+		}
+		defer release()
+		handler(w, r)
+	}
+}
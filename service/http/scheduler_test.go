@@ -0,0 +1,73 @@
+package http
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// enqueue acquires for client in the background and waits until it's queued.
+func enqueue(t *testing.T, s *scheduler, ctx context.Context, client string, admitted chan<- string) {
+	s.Lock()
+	queued := s.queued
+	s.Unlock()
+
+	go func() {
+		release, err := s.acquire(ctx, client)
+		if err != nil {
+			admitted <- err.Error()
+			return
+		}
+		admitted <- client
+		release()
+	}()
+
+	require.Eventually(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.queued == queued+1
+	}, time.Second, time.Millisecond)
+}
+
+func TestScheduler(t *testing.T) {
+	require.Nil(t, newScheduler(0, 10))
+	release, err := (*scheduler)(nil).acquire(context.Background(), "a")
+	require.NoError(t, err)
+	release()
+
+	s := newScheduler(1, 5)
+	release, err = s.acquire(context.Background(), "a")
+	require.NoError(t, err)
+
+	// the waiting clients take turns
+	admitted := make(chan string, 8)
+	ctx := context.Background()
+	enqueue(t, s, ctx, "a", admitted)
+	enqueue(t, s, ctx, "a", admitted)
+	enqueue(t, s, ctx, "a", admitted)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	enqueue(t, s, cancelCtx, "c", admitted)
+	enqueue(t, s, ctx, "b", admitted)
+
+	_, err = s.acquire(ctx, "d")
+	require.Equal(t, errQueueFull, err)
+
+	cancel()
+	require.Equal(t, context.Canceled.Error(), <-admitted)
+
+	release()
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, <-admitted)
+	}
+	require.Equal(t, []string{"a", "b", "a", "a"}, order)
+
+	s.Lock()
+	defer s.Unlock()
+	require.Equal(t, 0, s.running)
+	require.Equal(t, 0, s.queued)
+	require.Empty(t, s.queues)
+	require.Empty(t, s.clients)
+}
@@ -0,0 +1,193 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/parser"
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const labelValuesPrefix = "/api/v1/label/"
+
+// parseTimeRange parses the optional start and end of metadata queries.
+func parseTimeRange(r *http.Request) (start, end time.Time, err error) {
+	start, end = time.Unix(0, 0), time.Now()
+	if s := r.Form.Get("start"); s != "" {
+		if start, err = parseTime(s); err != nil {
+			return
+		}
+	}
+	if s := r.Form.Get("end"); s != "" {
+		if end, err = parseTime(s); err != nil {
+			return
+		}
+	}
+	if end.Before(start) {
+		err = errors.New("end timestamp must not be before start time")
+	}
+	return
+}
+
+func parseMatcherSets(matches []string) ([][]*labels.Matcher, error) {
+	matcherSets := make([][]*labels.Matcher, 0, len(matches))
+	for _, s := range matches {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	return matcherSets, nil
+}
+
+// querySeries parses the match[], start and end parameters of r, then
+// queries the matched series.
+func querySeries(r *http.Request, storage store.SeriesStorage) ([]labels.Labels, error) {
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		return nil, err
+	}
+	matcherSets, err := parseMatcherSets(r.Form["match[]"])
+	if err != nil {
+		return nil, err
+	}
+	return parser.Series(r.Context(), storage, matcherSets, start, end)
+}
+
+func SeriesHandler(storage store.SeriesStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		if len(r.Form["match[]"]) == 0 {
+			respondError(w, errorBadData, errors.New("no match[] parameter provided"))
+			return
+		}
+
+		series, err := querySeries(r, storage)
+		if err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+		if series == nil {
+			series = []labels.Labels{}
+		}
+		respond(w, series)
+	}
+}
+
+func LabelNamesHandler(storage store.SeriesStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+
+		var names []string
+		if len(r.Form["match[]"]) > 0 {
+			series, err := querySeries(r, storage)
+			if err != nil {
+				respondError(w, errorBadData, err)
+				return
+			}
+			names = collectLabels(series, func(l labels.Label) string { return l.Name })
+		} else {
+			start, end, err := parseTimeRange(r)
+			if err != nil {
+				respondError(w, errorBadData, err)
+				return
+			}
+			names, err = storage.QueryLabelNames(r.Context(), timeMilliseconds(start), timeMilliseconds(end))
+			if err != nil {
+				respondError(w, errorExec, err)
+				return
+			}
+		}
+		if names == nil {
+			names = []string{}
+		}
+		respond(w, names)
+	}
+}
+
+// LabelValuesHandler serves /api/v1/label/{name}/values.
+func LabelValuesHandler(storage store.SeriesStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, labelValuesPrefix)
+		if !strings.HasSuffix(name, "/values") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/values")
+		if !model.LabelName(name).IsValid() {
+			respondError(w, errorBadData, errors.Errorf("invalid label name: %q", name))
+			return
+		}
+		if err := parseForm(r); err != nil {
+			respondError(w, errorBadData, err)
+			return
+		}
+
+		var values []string
+		if len(r.Form["match[]"]) > 0 {
+			series, err := querySeries(r, storage)
+			if err != nil {
+				respondError(w, errorBadData, err)
+				return
+			}
+			values = collectLabels(series, func(l labels.Label) string {
+				if l.Name != name {
+					return ""
+				}
+				return l.Value
+			})
+		} else {
+			start, end, err := parseTimeRange(r)
+			if err != nil {
+				respondError(w, errorBadData, err)
+				return
+			}
+			values, err = storage.QueryLabelValues(r.Context(), timeMilliseconds(start), timeMilliseconds(end), name)
+			if err != nil {
+				respondError(w, errorExec, err)
+				return
+			}
+		}
+		if values == nil {
+			values = []string{}
+		}
+		respond(w, values)
+	}
+}
+
+// collectLabels returns the sorted distinct non-empty results of f on the
+// labels of series.
+func collectLabels(series []labels.Labels, f func(l labels.Label) string) []string {
+	set := map[string]struct{}{}
+	for _, metric := range series {
+		for _, l := range metric {
+			if s := f(l); s != "" {
+				set[s] = struct{}{}
+			}
+		}
+	}
+	res := make([]string, 0, len(set))
+	for s := range set {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func timeMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 
 	"github.com/showhand-lab/flash-metrics/config"
+	"github.com/showhand-lab/flash-metrics/parser"
 	"github.com/showhand-lab/flash-metrics/service/http"
 	"github.com/showhand-lab/flash-metrics/store"
 
@@ -21,7 +22,12 @@ func Init(cfg *config.FlashMetricsConfig, storage store.MetricStorage) {
 		)
 	}
 
-	go http.ServeHTTP(listener, storage)
+	engine, err := parser.NewEngine(storage, &cfg.QueryConfig)
+	if err != nil {
+		log.Fatal("failed to create query engine", zap.Error(err))
+	}
+
+	go http.ServeHTTP(listener, storage, engine, &cfg.QueryConfig)
 
 	log.Info(
 		"starting http service",
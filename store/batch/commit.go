@@ -0,0 +1,93 @@
+package batch
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/table"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// CommitWorker inserts the updated dates and the samples of a batch in a
+// transaction, so that either both are stored or neither is. Otherwise the
+// samples without updated dates are invisible to queries.
+type CommitWorker struct {
+	ctx context.Context
+
+	db     *sql.DB
+	tables table.Tables
+
+	commitTasks chan Task
+
+	retrier   *Retrier
+	batchSize int
+}
+
+func NewCommitWorker(
+	ctx context.Context,
+	db *sql.DB,
+	tables table.Tables,
+	commitTasks chan Task,
+	retrier *Retrier,
+	batchSize int,
+) *CommitWorker {
+	return &CommitWorker{
+		ctx:         ctx,
+		db:          db,
+		tables:      tables,
+		commitTasks: commitTasks,
+		retrier:     retrier,
+		batchSize:   batchSize,
+	}
+}
+
+func (c *CommitWorker) Start() {
+	for {
+		select {
+		case t := <-c.commitTasks:
+			err := c.retrier.retry(&t, "commit", func() error {
+				return c.commit(t.Ctx, t.Data)
+			})
+			t.Result <- c.retrier.result(&t, err)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *CommitWorker) commit(ctx context.Context, timeSeries []*TimeSeries) (err error) {
+	now := time.Now()
+	defer func() {
+		log.Debug("batch commit", zap.Duration("in", time.Since(now)), zap.Int("size", len(timeSeries)), zap.Error(err))
+	}()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Warn("failed to roll back batch", zap.Error(rbErr))
+		}
+	}()
+
+	if err = batchUpdateDate(ctx, tx, c.tables, timeSeries, c.batchSize); err != nil {
+		return err
+	}
+	err = splitBatch(c.batchSize, timeSeries, func(batch []*TimeSeries) error {
+		return insertSample(ctx, tx, c.tables, batch)
+	})
+	if err != nil {
+		return err
+	}
+	// the write conflicts of optimistic transactions are raised by the
+	// commit, which is retried like the statements, as the updated dates and
+	// the samples are written idempotently even if it has been committed
+	return tx.Commit()
+}
@@ -3,7 +3,6 @@ package batch
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"strconv"
 	"strings"
 	"time"
@@ -24,14 +23,15 @@ var (
 type FetchTSIDWorker struct {
 	ctx context.Context
 
-	cache *LRU
-	meta  metas.MetaStorage
-	db    *sql.DB
+	cache  *LRU
+	meta   metas.MetaStorage
+	db     *sql.DB
+	tables table.Tables
 
-	fetchTSIDTasks    chan Task
-	updateDateTasks   chan Task
-	insertSampleTasks chan Task
+	fetchTSIDTasks chan Task
+	commitTasks    chan Task
 
+	retrier   *Retrier
 	batchSize int
 }
 
@@ -39,24 +39,26 @@ func NewFetchTSIDWorker(
 	ctx context.Context,
 	meta metas.MetaStorage,
 	db *sql.DB,
+	tables table.Tables,
 	fetchTSIDTasks chan Task,
-	updateDateTasks chan Task,
-	insertSampleTasks chan Task,
+	commitTasks chan Task,
 	cache *LRU,
+	retrier *Retrier,
 	batchSize int,
 ) *FetchTSIDWorker {
 
 	return &FetchTSIDWorker{
 		ctx: ctx,
 
-		cache: cache,
-		meta:  meta,
-		db:    db,
+		cache:  cache,
+		meta:   meta,
+		db:     db,
+		tables: tables,
 
-		fetchTSIDTasks:    fetchTSIDTasks,
-		updateDateTasks:   updateDateTasks,
-		insertSampleTasks: insertSampleTasks,
+		fetchTSIDTasks: fetchTSIDTasks,
+		commitTasks:    commitTasks,
 
+		retrier:   retrier,
 		batchSize: batchSize,
 	}
 }
@@ -65,56 +67,44 @@ func (f *FetchTSIDWorker) Start() {
 	for {
 		select {
 		case t := <-f.fetchTSIDTasks:
-			if err := f.handleTask(t); err != nil {
-				select {
-				case t.ErrCh <- err:
-				default:
-				}
+			if err := f.handleTask(&t); err != nil {
+				t.Result <- f.retrier.result(&t, err)
 			}
-			t.WG.Done()
 		case <-f.ctx.Done():
 			return
 		}
 	}
 }
 
-func (f *FetchTSIDWorker) handleTask(t Task) error {
-	return f.splitBatch(f.batchSize, t.Data, func(batch []*TimeSeries) error {
-		if err := f.batchFillSortedLabelValues(t.Ctx, batch); err != nil {
-			return err
-		}
-		if err := f.batchFillTSID(t.Ctx, batch); err != nil {
-			return err
-		}
-		newTask := Task{
-			WG:    t.WG,
-			Ctx:   t.Ctx,
-			ErrCh: t.ErrCh,
-			Data:  batch,
-		}
-		return f.scheduleToNextWorker(newTask)
+// handleTask fills the tsids of the whole batch, then passes the batch to the
+// CommitWorker. The series inserted into flash_metrics_index are harmless if
+// the batch fails later, as they're inserted again by the retries.
+func (f *FetchTSIDWorker) handleTask(t *Task) error {
+	err := splitBatch(f.batchSize, t.Data, func(batch []*TimeSeries) error {
+		return f.retrier.retry(t, "fetch tsid", func() error {
+			if err := f.batchFillSortedLabelValues(t.Ctx, batch); err != nil {
+				return err
+			}
+			return f.batchFillTSID(t.Ctx, batch)
+		})
 	})
+	if err != nil {
+		return err
+	}
+	return f.scheduleToNextWorker(*t)
 }
 
+// scheduleToNextWorker passes the task to the next worker, it waits for the
+// workers if they're busy so that the task is never dropped.
 func (f *FetchTSIDWorker) scheduleToNextWorker(t Task) error {
-	t.WG.Add(1)
-	select {
-	case f.updateDateTasks <- t:
-	default:
-		log.Warn("update date workers are busy, drop task")
-		t.WG.Done()
-		return errors.New("update date workers are busy")
-	}
-
-	t.WG.Add(1)
 	select {
-	case f.insertSampleTasks <- t:
-	default:
-		log.Warn("insert sample workers are busy, drop task")
-		t.WG.Done()
-		return errors.New("insert sample workers are busy")
+	case f.commitTasks <- t:
+		return nil
+	case <-t.Ctx.Done():
+		return t.Ctx.Err()
+	case <-f.ctx.Done():
+		return f.ctx.Err()
 	}
-	return nil
 }
 
 func (f *FetchTSIDWorker) batchFillSortedLabelValues(ctx context.Context, timeSeries []*TimeSeries) error {
@@ -132,9 +122,20 @@ func (f *FetchTSIDWorker) batchFillSortedLabelValues(ctx context.Context, timeSe
 		for i := 0; i < table.MaxLabelCount; i++ {
 			ts.sortedLabelValue = append(ts.sortedLabelValue, "")
 		}
+		var overflow map[metas.LabelID]string
 		for _, label := range ts.Labels {
-			ts.sortedLabelValue[meta.Labels[metas.LabelName(label.Name)]] = label.Value
+			labelID := meta.Labels[metas.LabelName(label.Name)]
+			if labelID < table.MaxLabelCount {
+				ts.sortedLabelValue[labelID] = label.Value
+				continue
+			}
+			if overflow == nil {
+				overflow = map[metas.LabelID]string{}
+			}
+			overflow[labelID] = label.Value
 		}
+		ts.hasOverflow = meta.HasOverflow()
+		ts.overflowValue, ts.overflowKey = metas.OverflowLabels(overflow)
 	}
 
 	return nil
@@ -174,18 +175,40 @@ func (f *FetchTSIDWorker) batchFillTSID(ctx context.Context, timeSeries []*TimeS
 	args := interfaceSliceP.Get()
 	defer interfaceSliceP.Put(args)
 
+	// the overflow columns only exist if created by table.CreateIndexOverflow
+	hasOverflow := false
+	for _, ts := range *slowPathTs {
+		hasOverflow = hasOverflow || ts.hasOverflow
+	}
+
 	writeCount := 0
 	var sb strings.Builder
-	sb.WriteString("INSERT IGNORE INTO flash_metrics_index VALUES")
+	sb.WriteString("INSERT IGNORE INTO ")
+	sb.WriteString(f.tables.Index)
+	sb.WriteString(" (metric_name")
+	for i := 0; i < table.MaxLabelCount; i++ {
+		sb.WriteString(", label")
+		sb.WriteString(strconv.Itoa(i))
+	}
+	if hasOverflow {
+		sb.WriteString(", label_overflow, overflow_key")
+	}
+	sb.WriteString(") VALUES")
 	for _, ts := range *slowPathTs {
 		if writeCount != 0 {
 			sb.WriteByte(',')
 		}
-		sb.WriteString(" (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		sb.WriteString(" (?")
+		sb.WriteString(strings.Repeat(", ?", table.MaxLabelCount))
 		*args = append(*args, ts.Name)
 		for _, lv := range ts.sortedLabelValue {
 			*args = append(*args, lv)
 		}
+		if hasOverflow {
+			sb.WriteString(", ?, ?")
+			*args = append(*args, sql.NullString{String: ts.overflowValue, Valid: ts.overflowValue != ""}, ts.overflowKey)
+		}
+		sb.WriteByte(')')
 		writeCount += 1
 	}
 
@@ -203,7 +226,9 @@ func (f *FetchTSIDWorker) batchFillTSID(ctx context.Context, timeSeries []*TimeS
 		}
 		sb.WriteString("SELECT ")
 		sb.WriteString(strconv.Itoa(i))
-		sb.WriteString(" AS id, _tidb_rowid tsid FROM flash_metrics_index WHERE metric_name = ? ")
+		sb.WriteString(" AS id, _tidb_rowid tsid FROM ")
+		sb.WriteString(f.tables.Index)
+		sb.WriteString(" WHERE metric_name = ? ")
 		*args = append(*args, ts.Name)
 		for j, lv := range ts.sortedLabelValue {
 			sb.WriteString("AND label")
@@ -211,6 +236,10 @@ func (f *FetchTSIDWorker) batchFillTSID(ctx context.Context, timeSeries []*TimeS
 			sb.WriteString(" = ? ")
 			*args = append(*args, lv)
 		}
+		if ts.hasOverflow {
+			sb.WriteString("AND overflow_key = ? ")
+			*args = append(*args, ts.overflowKey)
+		}
 		readCount += 1
 	}
 	sb.WriteString(") t ORDER BY id")
@@ -239,7 +268,9 @@ func (f *FetchTSIDWorker) batchFillTSID(ctx context.Context, timeSeries []*TimeS
 	return nil
 }
 
-func (f *FetchTSIDWorker) splitBatch(batchSize int, timeSeries []*TimeSeries, accessBatches func([]*TimeSeries) error) error {
+// splitBatch calls accessBatches with the consecutive parts of timeSeries having
+// about batchSize samples.
+func splitBatch(batchSize int, timeSeries []*TimeSeries, accessBatches func([]*TimeSeries) error) error {
 	begin := 0
 	currentBatchSize := 0
 
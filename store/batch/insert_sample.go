@@ -7,55 +7,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/showhand-lab/flash-metrics/table"
+
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
 
-type InsertSampleWorker struct {
-	ctx context.Context
-
-	db *sql.DB
-
-	fetchTSIDTasks    chan Task
-	insertSampleTasks chan Task
-}
-
-func NewInsertSampleWorker(
-	ctx context.Context,
-	db *sql.DB,
-	fetchTSIDTasks chan Task,
-	insertSampleTasks chan Task,
-) *InsertSampleWorker {
-	return &InsertSampleWorker{
-		ctx:               ctx,
-		db:                db,
-		fetchTSIDTasks:    fetchTSIDTasks,
-		insertSampleTasks: insertSampleTasks,
-	}
-}
-
-func (i *InsertSampleWorker) Start() {
-	for {
-		select {
-		case t := <-i.insertSampleTasks:
-			if err := i.handleTask(t); err != nil {
-				select {
-				case t.ErrCh <- err:
-				default:
-				}
-			}
-			t.WG.Done()
-		case <-i.ctx.Done():
-			return
-		}
-	}
-}
-
-func (i *InsertSampleWorker) handleTask(t Task) error {
-	return i.insertSample(t.Ctx, t.Data)
-}
-
-func (i *InsertSampleWorker) insertSample(ctx context.Context, timeSeries []*TimeSeries) (err error) {
+// insertSample inserts the samples of the time series in tx by a statement.
+// The samples stored before are overwritten, so that a batch can be stored
+// again by the retries and the replays of the WAL.
+func insertSample(ctx context.Context, tx *sql.Tx, tables table.Tables, timeSeries []*TimeSeries) (err error) {
 	now := time.Now()
 	defer func() {
 		log.Debug("batch insert sample", zap.Duration("in", time.Since(now)), zap.Int("size", len(timeSeries)))
@@ -66,7 +27,9 @@ func (i *InsertSampleWorker) insertSample(ctx context.Context, timeSeries []*Tim
 
 	writeCount := 0
 	var sb strings.Builder
-	sb.WriteString("INSERT INTO flash_metrics_data (tsid, ts, v) VALUES")
+	sb.WriteString("INSERT INTO ")
+	sb.WriteString(tables.Data)
+	sb.WriteString(" (tsid, ts, v) VALUES")
 
 	for _, ts := range timeSeries {
 		for _, sample := range ts.Samples {
@@ -89,6 +52,7 @@ func (i *InsertSampleWorker) insertSample(ctx context.Context, timeSeries []*Tim
 		return nil
 	}
 
-	_, err = i.db.ExecContext(ctx, sb.String(), *args...)
+	sb.WriteString(" ON DUPLICATE KEY UPDATE v = VALUES(v)")
+	_, err = tx.ExecContext(ctx, sb.String(), *args...)
 	return err
 }
@@ -3,16 +3,29 @@ package batch
 import (
 	"bytes"
 	"context"
-	"sync"
 
 	"github.com/showhand-lab/flash-metrics/store/model"
 )
 
+// Task is a batch of time series passing through the workers. The result of
+// the task is sent to Result exactly once, by the worker failing it or the
+// CommitWorker committing it, so Result must be buffered.
 type Task struct {
-	WG    *sync.WaitGroup
-	Ctx   context.Context
-	ErrCh chan error
-	Data  []*TimeSeries
+	Ctx    context.Context
+	Result chan error
+	Data   []*TimeSeries
+
+	// retries is the number of retries of the task so far, see RetryPolicy.
+	retries int
+}
+
+// NewTask returns a task of the batch.
+func NewTask(ctx context.Context, data []*TimeSeries) Task {
+	return Task{
+		Ctx:    ctx,
+		Result: make(chan error, 1),
+		Data:   data,
+	}
 }
 
 type TimeSeries struct {
@@ -25,6 +38,13 @@ type TimeSeries struct {
 	// [   v0    ,    v1    ,    v2    , ... ,    v14   ]
 	sortedLabelValue []string
 
+	// an internal fields for store
+	// used to organize the labels beyond the label columns, hasOverflow is
+	// whether the metric has such labels, see metas.OverflowLabels.
+	hasOverflow   bool
+	overflowValue string
+	overflowKey   string
+
 	// an internal fields for store
 	tsid int64
 }
@@ -35,4 +55,8 @@ func (ts *TimeSeries) marshalSortedLabel(buffer *bytes.Buffer) {
 		buffer.WriteByte('$')
 		buffer.WriteString(v)
 	}
+	if ts.overflowKey != "" {
+		buffer.WriteByte('$')
+		buffer.WriteString(ts.overflowKey)
+	}
 }
@@ -0,0 +1,145 @@
+package batch
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy is how the workers retry the transient errors of a task.
+type RetryPolicy struct {
+	// Budget is the max number of retries of a task, shared by the workers
+	// the task passes through.
+	Budget int
+	// MinBackoff is the wait before the first retry, which doubles with each
+	// retry up to MaxBackoff. The waits are jittered by up to a half.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Budget:     5,
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// DeadLetterSink takes the batches exhausting their retries, so that they can
+// be replayed later.
+type DeadLetterSink interface {
+	Put(timeSeries []*model.TimeSeries) error
+}
+
+// Retrier retries the tasks by the policy, and puts the batches exhausting
+// their retries into the dead-letter sink if any.
+type Retrier struct {
+	Policy     RetryPolicy
+	DeadLetter DeadLetterSink
+}
+
+// retry calls f until it succeeds, fails with a fatal error or the budget of
+// the task runs out.
+func (r *Retrier) retry(t *Task, stage string, f func() error) error {
+	for {
+		err := f()
+		if err == nil || !IsRetryable(err) || t.retries >= r.Policy.Budget {
+			return err
+		}
+		t.retries++
+		backoff := r.backoff(t.retries)
+		log.Warn("retry batch", zap.String("stage", stage), zap.Int("retry", t.retries),
+			zap.Duration("backoff", backoff), zap.Error(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-t.Ctx.Done():
+			timer.Stop()
+			return t.Ctx.Err()
+		}
+	}
+}
+
+// backoff returns the wait before the nth retry.
+func (r *Retrier) backoff(n int) time.Duration {
+	d := r.Policy.MinBackoff
+	for i := 1; i < n && d < r.Policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.Policy.MaxBackoff {
+		d = r.Policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// result returns the result of a task failed by err. The batch is put into the
+// dead-letter sink if it exhausts the retries, and the task succeeds then.
+func (r *Retrier) result(t *Task, err error) error {
+	if err == nil || r.DeadLetter == nil || !IsRetryable(err) || t.retries < r.Policy.Budget {
+		return err
+	}
+
+	timeSeries := make([]*model.TimeSeries, 0, len(t.Data))
+	for _, ts := range t.Data {
+		timeSeries = append(timeSeries, ts.TimeSeries)
+	}
+	if putErr := r.DeadLetter.Put(timeSeries); putErr != nil {
+		log.Error("failed to put batch into dead letter", zap.Error(putErr))
+		return err
+	}
+	log.Error("put batch into dead letter", zap.Int("series", len(timeSeries)),
+		zap.Int("retries", t.retries), zap.Error(err))
+	return nil
+}
+
+// retryableCodes are the MySQL error codes of TiDB that may succeed on retry.
+var retryableCodes = map[uint16]struct{}{
+	1040: {}, // too many connections
+	1053: {}, // server shutdown in progress
+	1205: {}, // lock wait timeout
+	1213: {}, // deadlock
+	8002: {}, // select for update conflict
+	8022: {}, // transaction retryable
+	8027: {}, // information schema out of date
+	8028: {}, // information schema changed
+	9001: {}, // PD server timeout
+	9002: {}, // TiKV server timeout
+	9003: {}, // TiKV server busy
+	9004: {}, // resolve lock timeout
+	9005: {}, // region unavailable
+	9007: {}, // write conflict
+	9010: {}, // TiKV stale command
+}
+
+// IsRetryable returns whether err is transient, which are the retryable errors
+// of TiDB and the broken connections. The errors of the contexts are fatal.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		_, ok := retryableCodes[mysqlErr.Number]
+		return ok
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,101 @@
+package batch
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+type sink struct {
+	batches [][]*model.TimeSeries
+}
+
+func (s *sink) Put(timeSeries []*model.TimeSeries) error {
+	s.batches = append(s.batches, timeSeries)
+	return nil
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&mysql.MySQLError{Number: 9007, Message: "Write conflict"}, true},
+		{fmt.Errorf("commit: %w", &mysql.MySQLError{Number: 9005, Message: "Region is unavailable"}), true},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, false},
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{fmt.Errorf("commit: %w", &mysql.MySQLError{Number: 9007, Message: "Write conflict"}), true},
+		{context.DeadlineExceeded, false},
+		{errors.New("too many labels"), false},
+	} {
+		require.Equal(t, c.retryable, IsRetryable(c.err), c.err.Error())
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	s := &sink{}
+	r := &Retrier{Policy: RetryPolicy{Budget: 3, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}}
+	for n := 1; n <= 5; n++ {
+		d := r.backoff(n)
+		require.True(t, d >= time.Millisecond/2 && d <= 2*time.Millisecond, d.String())
+	}
+
+	ts := &model.TimeSeries{Name: "up"}
+	task := NewTask(context.Background(), []*TimeSeries{{TimeSeries: ts}})
+	conflict := &mysql.MySQLError{Number: 9007, Message: "Write conflict"}
+
+	// the budget is shared by the stages
+	calls := 0
+	err := r.retry(&task, "fetch tsid", func() error {
+		calls++
+		if calls < 3 {
+			return conflict
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, task.retries)
+	calls = 0
+	err = r.retry(&task, "commit", func() error {
+		calls++
+		return conflict
+	})
+	require.Equal(t, conflict, err)
+	require.Equal(t, 2, calls)
+	require.Equal(t, 3, task.retries)
+
+	// exhausted without and with a dead letter
+	require.Equal(t, conflict, r.result(&task, err))
+	r.DeadLetter = s
+	require.NoError(t, r.result(&task, err))
+	require.Equal(t, [][]*model.TimeSeries{{ts}}, s.batches)
+
+	// fatal errors are never retried or put into the dead letter
+	fatal := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	task = NewTask(context.Background(), []*TimeSeries{{TimeSeries: ts}})
+	calls = 0
+	err = r.retry(&task, "commit", func() error {
+		calls++
+		return fatal
+	})
+	require.Equal(t, fatal, err)
+	require.Equal(t, 1, calls)
+	require.Equal(t, fatal, r.result(&task, err))
+	require.Len(t, s.batches, 1)
+
+	// canceled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task = NewTask(ctx, nil)
+	err = r.retry(&task, "commit", func() error { return conflict })
+	require.Equal(t, context.Canceled, err)
+}
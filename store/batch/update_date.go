@@ -3,93 +3,86 @@ package batch
 import (
 	"context"
 	"database/sql"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/showhand-lab/flash-metrics/table"
+
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
 
-type UpdateDateWorker struct {
-	ctx context.Context
-
-	db *sql.DB
-
-	updateDateTasks chan Task
-}
-
-func NewUpdateDateWorker(
-	ctx context.Context,
-	db *sql.DB,
-	updateDateTasks chan Task,
-) *UpdateDateWorker {
-	return &UpdateDateWorker{
-		ctx:             ctx,
-		db:              db,
-		updateDateTasks: updateDateTasks,
-	}
+type updatedDate struct {
+	tsid int64
+	date string
 }
 
-func (u *UpdateDateWorker) Start() {
-	for {
-		select {
-		case t := <-u.updateDateTasks:
-			if err := u.handleTask(t); err != nil {
-				select {
-				case t.ErrCh <- err:
-				default:
-				}
-			}
-			t.WG.Done()
-		case <-u.ctx.Done():
-			return
-		}
-	}
-}
-
-func (u *UpdateDateWorker) handleTask(t Task) error {
-	return u.batchUpdateDate(t.Ctx, t.Data)
-	//return nil
-}
-
-func (u *UpdateDateWorker) batchUpdateDate(ctx context.Context, timeSeries []*TimeSeries) error {
+// batchUpdateDate inserts the updated dates of the time series in tx, at most
+// batchSize rows a statement. The rows are inserted in the order of the primary
+// key, so that concurrent transactions lock them in the same order.
+func batchUpdateDate(ctx context.Context, tx *sql.Tx, tables table.Tables, timeSeries []*TimeSeries, batchSize int) error {
 	now := time.Now()
 	defer func() {
 		log.Debug("batch update date", zap.Duration("in", time.Since(now)), zap.Int("size", len(timeSeries)))
 	}()
 
-	args := interfaceSliceP.Get()
-	defer interfaceSliceP.Put(args)
-
-	writeCount := 0
-	var sb strings.Builder
-	sb.WriteString("INSERT IGNORE INTO flash_metrics_update (tsid, updated_date) VALUES")
-
-	dateMap := map[string]struct{}{}
-	for _, ts := range timeSeries {
-		for k := range dateMap {
-			delete(dateMap, k)
+	dates := updatedDates(timeSeries)
+	for len(dates) > 0 {
+		n := len(dates)
+		if n > batchSize {
+			n = batchSize
+		}
+		if err := insertUpdatedDates(ctx, tx, tables, dates[:n]); err != nil {
+			return err
 		}
+		dates = dates[n:]
+	}
+	return nil
+}
 
+// updatedDates returns the distinct updated dates of the time series ordered
+// by tsid and date.
+func updatedDates(timeSeries []*TimeSeries) []updatedDate {
+	var dates []updatedDate
+	for _, ts := range timeSeries {
 		for _, sample := range ts.Samples {
 			date := time.Unix(sample.TimestampMs/1000, (sample.TimestampMs%1000)*1_000_000).UTC().Format("2006-01-02")
-			dateMap[date] = struct{}{}
+			dates = append(dates, updatedDate{tsid: ts.tsid, date: date})
 		}
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		if dates[i].tsid != dates[j].tsid {
+			return dates[i].tsid < dates[j].tsid
+		}
+		return dates[i].date < dates[j].date
+	})
 
-		for k := range dateMap {
-			if writeCount > 0 {
-				sb.WriteByte(',')
-			}
-			sb.WriteString(" (?, ?)")
-			*args = append(*args, ts.tsid, k)
-			writeCount += 1
+	distinct := dates[:0]
+	for _, d := range dates {
+		if len(distinct) == 0 || d != distinct[len(distinct)-1] {
+			distinct = append(distinct, d)
 		}
 	}
+	return distinct
+}
 
-	if writeCount == 0 {
-		return nil
+func insertUpdatedDates(ctx context.Context, tx *sql.Tx, tables table.Tables, dates []updatedDate) error {
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString("INSERT IGNORE INTO ")
+	sb.WriteString(tables.Update)
+	sb.WriteString(" (tsid, updated_date) VALUES")
+	for i, d := range dates {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(" (?, ?)")
+		*args = append(*args, d.tsid, d.date)
 	}
 
-	_, err := u.db.ExecContext(ctx, sb.String(), *args...)
+	_, err := tx.ExecContext(ctx, sb.String(), *args...)
 	return err
 }
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// maxMetadataEntries is the number of the metadata stored lately kept at most,
+// the least recently stored ones are evicted and written again next time.
+const maxMetadataEntries = 102400
+
+// metadataKey is the primary key of flash_metrics_metadata.
+type metadataKey struct {
+	metricName string
+	job        string
+	instance   string
+}
+
+var _ MetadataStorage = &DefaultMetricStorage{}
+
+func newMetadataCache() *simplelru.LRU {
+	c, _ := simplelru.NewLRU(maxMetadataEntries, nil)
+	return c
+}
+
+// StoreMetadata implements interface MetadataStorage, only the changed
+// metadata is written, as the same metadata comes with every scrape.
+//
+//	INSERT INTO flash_metrics_metadata (metric_name, job, instance, type, help, unit)
+//	VALUES (?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?)
+//	ON DUPLICATE KEY UPDATE type = VALUES(type), help = VALUES(help), unit = VALUES(unit);
+func (d *DefaultMetricStorage) StoreMetadata(ctx context.Context, metadata []model.Metadata) error {
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+
+	changed := make(map[metadataKey]model.Metadata)
+	for _, m := range metadata {
+		key := metadataKey{metricName: m.MetricName, job: m.Job, instance: m.Instance}
+		if stored, ok := d.metadata.Get(key); ok && stored.(model.Metadata) == m {
+			continue
+		}
+		changed[key] = m
+	}
+
+	batch := make([]model.Metadata, 0, defaultBatchSize)
+	for _, m := range changed {
+		batch = append(batch, m)
+		if len(batch) == defaultBatchSize {
+			if err := d.insertMetadata(ctx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := d.insertMetadata(ctx, batch); err != nil {
+			return err
+		}
+	}
+
+	for key, m := range changed {
+		d.metadata.Add(key, m)
+	}
+	return nil
+}
+
+func (d *DefaultMetricStorage) insertMetadata(ctx context.Context, metadata []model.Metadata) error {
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO " + d.tables.Metadata + " (metric_name, job, instance, type, help, unit) VALUES ")
+	for i, m := range metadata {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?)")
+		*args = append(*args, m.MetricName, m.Job, m.Instance, m.Type, m.Help, m.Unit)
+	}
+	sb.WriteString(" ON DUPLICATE KEY UPDATE type = VALUES(type), help = VALUES(help), unit = VALUES(unit)")
+	_, err := d.DB.ExecContext(ctx, sb.String(), *args...)
+	return err
+}
+
+// QueryMetadata implements interface MetadataStorage
+//
+//	SELECT metric_name, job, instance, type, help, unit
+//	FROM flash_metrics_metadata
+//	WHERE metric_name = ?
+//	ORDER BY metric_name, job, instance;
+func (d *DefaultMetricStorage) QueryMetadata(ctx context.Context, metricName string) ([]model.Metadata, error) {
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString("SELECT metric_name, job, instance, type, help, unit FROM " + d.tables.Metadata)
+	if metricName != "" {
+		sb.WriteString(" WHERE metric_name = ?")
+		*args = append(*args, metricName)
+	}
+	sb.WriteString(" ORDER BY metric_name, job, instance")
+
+	rows, err := d.ReadDB.QueryContext(ctx, sb.String(), *args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []model.Metadata
+	for rows.Next() {
+		var m model.Metadata
+		if err = rows.Scan(&m.MetricName, &m.Job, &m.Instance, &m.Type, &m.Help, &m.Unit); err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,7 +14,10 @@ import (
 	"github.com/showhand-lab/flash-metrics/metas"
 	"github.com/showhand-lab/flash-metrics/store/batch"
 	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/store/wal"
+	"github.com/showhand-lab/flash-metrics/table"
 
+	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -21,12 +25,13 @@ import (
 const (
 	defaultBatchSize = 500
 
-	defaultFetchTSIDWorkers    = 8
-	defaultUpdateDateWorkers   = 8
-	defaultInsertSampleWorkers = 8
+	defaultFetchTSIDWorkers = 8
+	defaultCommitWorkers    = 16
 )
 
 var (
+	errStorageClosed = errors.New("storage is closed")
+
 	interfaceSliceP  = batch.InterfaceSlicePool{}
 	timeSeriesSliceP = batch.TimeSeriesSlicePool{}
 	timeSeriesP      = batch.TimeSeriesPool{}
@@ -39,30 +44,66 @@ type DefaultMetricStorage struct {
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
 	DB         *sql.DB
+	tables     table.Tables
 	batchTasks chan batch.Task
+	tsidCache  *batch.LRU
+	rollups    bool
+	// rollupDelay is the delay of the rollups, see EnableRollups.
+	rollupDelay time.Duration
+	// lateAge is the age in nanoseconds of the late samples, see
+	// WatchLateSamples.
+	lateAge     int64
+	generations generations
+	// wal persists the batches before they're stored if not nil.
+	wal *wal.WAL
+	// retrier retries the batches of the workers, and deadLetter keeps the
+	// ones exhausting the retries if not nil.
+	retrier    *batch.Retrier
+	deadLetter *wal.DeadLetter
+
+	// ReadDB serves queries, it's DB unless set to a separate pool so that
+	// queries can't starve ingestion.
+	ReadDB *sql.DB
+
+	// metadata is the metadata stored lately by metadataKey, so that the
+	// unchanged one isn't written again.
+	metadataMu sync.Mutex
+	metadata   *simplelru.LRU
 }
 
 func NewDefaultMetricStorage(db *sql.DB) *DefaultMetricStorage {
+	return NewDefaultMetricStorageWithTables(db, table.DefaultTables)
+}
+
+// NewDefaultMetricStorageWithTables returns a DefaultMetricStorage on the
+// tables with a prefix.
+func NewDefaultMetricStorageWithTables(db *sql.DB, tables table.Tables) *DefaultMetricStorage {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	ms := &DefaultMetricStorage{
-		MetaStorage: metas.NewDefaultMetaStorage(db),
+		MetaStorage: metas.NewDefaultMetaStorageWithTables(db, tables),
 		ctx:         ctx,
 		cancel:      cancel,
 		DB:          db,
+		tables:      tables,
+		ReadDB:      db,
 		batchTasks:  make(chan batch.Task, 1024),
+		tsidCache:   batch.NewLRU(102400),
+		retrier:     &batch.Retrier{Policy: batch.DefaultRetryPolicy},
+		metadata:    newMetadataCache(),
 	}
 
-	updateDateTasks := make(chan batch.Task, 1024)
-	insertSampleTasks := make(chan batch.Task, 1024)
+	commitTasks := make(chan batch.Task, 1024)
 
-	for i := 0; i < defaultInsertSampleWorkers; i++ {
+	for i := 0; i < defaultCommitWorkers; i++ {
 		ms.wg.Add(1)
-		worker := batch.NewInsertSampleWorker(
+		worker := batch.NewCommitWorker(
 			ms.ctx,
 			ms.DB,
-			ms.batchTasks,
-			insertSampleTasks,
+			ms.tables,
+			commitTasks,
+			ms.retrier,
+			defaultBatchSize,
 		)
 		go func() {
 			worker.Start()
@@ -70,30 +111,23 @@ func NewDefaultMetricStorage(db *sql.DB) *DefaultMetricStorage {
 		}()
 	}
 
-	for i := 0; i < defaultUpdateDateWorkers; i++ {
-		ms.wg.Add(1)
-		worker := batch.NewUpdateDateWorker(
-			ms.ctx,
-			ms.DB,
-			updateDateTasks,
-		)
-		go func() {
-			worker.Start()
-			ms.wg.Done()
-		}()
-	}
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		ms.invalidateLoop()
+	}()
 
-	cache := batch.NewLRU(102400)
 	for i := 0; i < defaultFetchTSIDWorkers; i++ {
 		ms.wg.Add(1)
 		worker := batch.NewFetchTSIDWorker(
 			ms.ctx,
 			ms.MetaStorage,
 			ms.DB,
+			ms.tables,
 			ms.batchTasks,
-			updateDateTasks,
-			insertSampleTasks,
-			cache,
+			commitTasks,
+			ms.tsidCache,
+			ms.retrier,
 			defaultBatchSize,
 		)
 		go func() {
@@ -107,7 +141,83 @@ func NewDefaultMetricStorage(db *sql.DB) *DefaultMetricStorage {
 
 var _ MetricStorage = &DefaultMetricStorage{}
 
-func (d *DefaultMetricStorage) Store(ctx context.Context, timeSeries model.TimeSeries) error {
+// Tables returns the tables of the storage.
+func (d *DefaultMetricStorage) Tables() table.Tables {
+	return d.tables
+}
+
+// PurgeTSIDCache forgets the cached tsids of series, which must be called once
+// series are deleted from flash_metrics_index.
+func (d *DefaultMetricStorage) PurgeTSIDCache() {
+	d.tsidCache.Lock()
+	defer d.tsidCache.Unlock()
+
+	d.tsidCache.Inner.Purge()
+}
+
+// EnableOverflowLabels allows metrics to have up to table.MaxOverflowLabelCount
+// labels, flash_metrics_index must be created by table.CreateIndexOverflow.
+func (d *DefaultMetricStorage) EnableOverflowLabels() {
+	if m, ok := d.MetaStorage.(interface{ EnableOverflowLabels() }); ok {
+		m.EnableOverflowLabels()
+	}
+}
+
+// EnableWAL persists the batches of BatchStore into the write-ahead log in dir
+// before acknowledging them, which are stored in background, including the
+// ones left by the last run. The batches failed by fatal errors are put into
+// the dead letter if enabled before.
+func (d *DefaultMetricStorage) EnableWAL(dir string, opts wal.Options) error {
+	if d.deadLetter != nil {
+		opts.DeadLetter = d.deadLetter
+		opts.IsRetryable = batch.IsRetryable
+	}
+	w, err := wal.Open(dir, opts, d.batchStore)
+	if err != nil {
+		return err
+	}
+	d.wal = w
+	return nil
+}
+
+// SetRetryPolicy sets how the batches are retried on the transient errors of
+// TiDB, it must be called before storing.
+func (d *DefaultMetricStorage) SetRetryPolicy(policy batch.RetryPolicy) {
+	d.retrier.Policy = policy
+}
+
+// EnableDeadLetter keeps the batches exhausting their retries in the dead
+// letter in dir instead of failing them, they're stored again by
+// ReplayDeadLetter.
+func (d *DefaultMetricStorage) EnableDeadLetter(dir string) error {
+	dl, err := wal.OpenDeadLetter(dir)
+	if err != nil {
+		return err
+	}
+	d.deadLetter = dl
+	d.retrier.DeadLetter = dl
+	return nil
+}
+
+// ReplayDeadLetter stores the batches of the dead letter again, and returns
+// the numbers of the replayed and the failed batches. The generations of the
+// days of the replayed batches are bumped, as they're usually in the past.
+func (d *DefaultMetricStorage) ReplayDeadLetter(ctx context.Context) (int, int, error) {
+	if d.deadLetter == nil {
+		return 0, 0, errors.New("dead letter is not enabled")
+	}
+	flushed, failed, err := d.deadLetter.Replay(ctx, func(ctx context.Context, timeSeries []*model.TimeSeries) error {
+		if err := d.batchStore(ctx, timeSeries); err != nil {
+			return err
+		}
+		d.addLateDays(timeSeries, math.MaxInt64)
+		return nil
+	})
+	d.invalidateLate()
+	return flushed, failed, err
+}
+
+func (d *DefaultMetricStorage) Store(ctx context.Context, timeSeries model.TimeSeries) (err error) {
 	if len(timeSeries.Samples) == 0 {
 		return nil
 	}
@@ -133,16 +243,42 @@ func (d *DefaultMetricStorage) Store(ctx context.Context, timeSeries model.TimeS
 		return err
 	}
 
-	// insert updated date
-	if err = d.insertUpdatedDate(ctx, tsid, timeSeries); err != nil {
+	// insert updated date and data in a transaction
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
-
-	// insert data
-	return d.insertData(ctx, tsid, timeSeries)
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = d.insertUpdatedDate(ctx, tx, tsid, timeSeries); err != nil {
+		return err
+	}
+	if err = d.insertData(ctx, tx, tsid, timeSeries); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return d.markLateSamples(ctx, []*model.TimeSeries{&timeSeries})
 }
 
+// BatchStore implements interface MetricStorage. If the WAL is enabled, it
+// returns once the batch is persisted in the WAL, or wal.ErrFull if the WAL
+// can't take more.
 func (d *DefaultMetricStorage) BatchStore(ctx context.Context, timeSeries []*model.TimeSeries) error {
+	if d.wal != nil {
+		return d.wal.Append(timeSeries)
+	}
+	return d.batchStore(ctx, timeSeries)
+}
+
+// batchStore stores the batch by the workers, it waits for the workers if
+// they're busy. The updated dates and the samples of the batch are committed
+// in a transaction, so nothing but the series is stored if it fails.
+func (d *DefaultMetricStorage) batchStore(ctx context.Context, timeSeries []*model.TimeSeries) error {
 	now := time.Now()
 	defer func() {
 		log.Info("batch store", zap.Duration("in", time.Since(now)), zap.Int("size", len(timeSeries)))
@@ -152,7 +288,12 @@ func (d *DefaultMetricStorage) BatchStore(ctx context.Context, timeSeries []*mod
 	defer cancel()
 
 	tss := timeSeriesSliceP.Get()
+	// the workers may still access the batch if not done, which is left to GC then
+	done := true
 	defer func() {
+		if !done {
+			return
+		}
 		for _, ts := range *tss {
 			timeSeriesP.Put(ts)
 		}
@@ -165,64 +306,74 @@ func (d *DefaultMetricStorage) BatchStore(ctx context.Context, timeSeries []*mod
 		*tss = append(*tss, ts)
 	}
 
-	t := batch.Task{
-		WG:    &sync.WaitGroup{},
-		Ctx:   ctx,
-		ErrCh: make(chan error),
-		Data:  *tss,
-	}
-
-	t.WG.Add(1)
+	t := batch.NewTask(ctx, *tss)
 	select {
 	case d.batchTasks <- t:
-	default:
-		log.Warn("fetch tsid workers are busy, drop task")
-		t.WG.Done()
-		return errors.New("fetch tsid workers are busy")
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return errStorageClosed
 	}
 
-	done := make(chan struct{})
-	go func() {
-		t.WG.Wait()
-		close(done)
-	}()
-
 	select {
-	case err := <-t.ErrCh:
-		return err
+	case err := <-t.Result:
+		if err != nil {
+			return err
+		}
+		return d.markLateSamples(ctx, timeSeries)
 	case <-ctx.Done():
+		done = false
 		return ctx.Err()
-	case <-done:
-		return nil
+	case <-d.ctx.Done():
+		done = false
+		return errStorageClosed
 	}
 }
 
-// Query implements interface MetricStorage
+// Query implements interface MetricStorage. If metricsName is empty, the
+// metrics are selected by the matchers of __name__ in matchers.
+func (d *DefaultMetricStorage) Query(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+	return d.queryMetrics(ctx, start, end, metricsName, matchers, d.queryMetric)
+}
+
+// queryMetric queries the series of a single metric.
 //
 // SELECT
 //    tsid, label0, label1, CAST(UNIX_TIMESTAMP(ts)*1000 AS UNSIGNED) AS t, v
 //  FROM
 //    flash_metrics_index
-//    INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
-//    INNER JOIN flash_metrics_data USING (tsid)
+//    INNER JOIN flash_metrics_data ON (flash_metrics_index._tidb_rowid = tsid)
 //  WHERE
 //    metric_name = "xxx"
 //    AND label0 != "yyy"
 //    AND label1 REGEXP "zzz.*"
-//    AND DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts)
+//    AND tsid IN (
+//      SELECT tsid FROM flash_metrics_update
+//      WHERE DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts)
+//    )
 //    AND start_ts <= ts AND ts <= end_ts
 //  ORDER BY tsid, t;
-func (d *DefaultMetricStorage) Query(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+//
+// The series are filtered by the updated dates instead of joining them, which
+// would duplicate the samples for every updated date in the range.
+//
+// If the rollups are enabled and ctx has SelectHints planned on a resolution,
+// flash_metrics_data is replaced by the raw samples outside the rolled up
+// buckets together with the samples of the buckets, see planRollup.
+func (d *DefaultMetricStorage) queryMetric(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
 	m, err := d.QueryMeta(ctx, metricsName)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check query label exists. If contains non-exist label in matchers, return empty set.
-	for _, matcher := range matchers {
-		if _, ok := m.Labels[metas.LabelName(matcher.LabelName)]; !ok {
-			return nil, nil
-		}
+	matchers, ok, err := knownMatchers(m, matchers)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	plan, err := d.planRollup(ctx, start, end)
+	if err != nil {
+		return nil, err
 	}
 
 	args := interfaceSliceP.Get()
@@ -232,52 +383,41 @@ func (d *DefaultMetricStorage) Query(ctx context.Context, start, end int64, metr
 	sb.WriteString("SELECT tsid, ")
 	names := make([]string, 0, len(m.Labels))
 	for n, v := range m.Labels {
-		sb.WriteString("label")
-		sb.WriteString(strconv.Itoa(int(v)))
+		sb.WriteString(metas.LabelColumn(v))
 		sb.WriteString(", ")
 		names = append(names, string(n))
 	}
-	sb.WriteString("CAST(UNIX_TIMESTAMP(ts)*1000 AS UNSIGNED) AS t, v\n")
+	if plan == nil {
+		sb.WriteString("CAST(UNIX_TIMESTAMP(ts)*1000 AS UNSIGNED) AS t, v\n")
+	} else {
+		sb.WriteString("t, v\n")
+	}
 	sb.WriteString(`
 FROM
-  flash_metrics_index
-  INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
-  INNER JOIN flash_metrics_data USING (tsid)
+  ` + d.tables.Index + `
+  INNER JOIN `)
+	if plan == nil {
+		sb.WriteString(d.tables.Data)
+	} else {
+		plan.writeSamples(&sb, args, d.tables.Data, start, end)
+	}
+	sb.WriteString(` ON (` + d.tables.Index + `._tidb_rowid = tsid)
 WHERE
   metric_name = ?
 `)
 	*args = append(*args, metricsName)
 
-	for _, matcher := range matchers {
-		labelID := m.Labels[metas.LabelName(matcher.LabelName)]
-		sb.WriteString("AND label")
-		sb.WriteString(strconv.Itoa(int(labelID)))
-
-		if matcher.IsRE {
-			if matcher.IsNegative {
-				sb.WriteString(" NOT REGEXP ?\n")
-			} else {
-				sb.WriteString(" REGEXP ?\n")
-			}
-		} else {
-			if matcher.IsNegative {
-				sb.WriteString(" != ?\n")
-			} else {
-				sb.WriteString(" = ?\n")
-			}
-		}
-		*args = append(*args, matcher.LabelValue)
+	writeMatchers(&sb, args, m, matchers)
+	sb.WriteString("AND tsid IN (SELECT tsid FROM " + d.tables.Update + " WHERE ? <= updated_date AND updated_date <= ?)\n")
+	*args = append(*args, formatDate(start), formatDate(end))
+	if plan == nil {
+		sb.WriteString("AND ? <= ts AND ts <= ?\n")
+		*args = append(*args, formatMs(start), formatMs(end))
 	}
-
-	sb.WriteString("AND ? <= updated_date AND updated_date <= ?\n")
-	*args = append(*args, time.Unix(start/1000, (start%1000)*1_000_000).UTC().Format("2006-01-02"))
-	*args = append(*args, time.Unix(end/1000, (end%1000)*1_000_000).UTC().Format("2006-01-02"))
-	sb.WriteString("AND ? <= ts AND ts <= ?\n")
 	sb.WriteString("ORDER BY tsid, t;")
-	*args = append(*args, time.Unix(start/1000, (start%1000)*1_000_000).UTC().Format("2006-01-02 15:04:05.999 -0700"))
-	*args = append(*args, time.Unix(end/1000, (end%1000)*1_000_000).UTC().Format("2006-01-02 15:04:05.999 -0700"))
 
-	rows, err := d.DB.QueryContext(ctx, sb.String(), *args...)
+	now := time.Now()
+	rows, err := d.ReadDB.QueryContext(ctx, sb.String(), *args...)
 	if err != nil {
 		return nil, err
 	}
@@ -295,17 +435,26 @@ WHERE
 		*destP = append(*destP, &(*dest)[i])
 	}
 
+	limiter := QueryLimiterFromContext(ctx)
 	var res []model.TimeSeries
 	tsid := int64(0)
 	var timeSeries *model.TimeSeries
+	rowCount := 0
 	for rows.Next() {
 		if err = rows.Scan(*destP...); err != nil {
 			return nil, err
 		}
+		rowCount++
+		if err = limiter.AddSamples(1); err != nil {
+			return nil, err
+		}
 
 		curTSID := (*dest)[0].(int64)
 		if tsid != curTSID {
 			tsid = curTSID
+			if err = limiter.CheckSeries(len(res) + 1); err != nil {
+				return nil, err
+			}
 			res = append(res, model.TimeSeries{})
 			timeSeries = &res[len(res)-1]
 			timeSeries.Name = metricsName
@@ -331,13 +480,28 @@ WHERE
 			Value:       v,
 		})
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
+	QueryStatsFromContext(ctx).ObserveSQL(sb.String(), *args, rowCount, len(res), time.Since(now))
 	return res, nil
 }
 
 func (d *DefaultMetricStorage) Close() {
+	// stop flushing the WAL before the workers
+	if d.wal != nil {
+		if err := d.wal.Close(); err != nil {
+			log.Warn("failed to close write-ahead log", zap.Error(err))
+		}
+	}
 	d.cancel()
 	d.wg.Wait()
+	if d.deadLetter != nil {
+		if err := d.deadLetter.Close(); err != nil {
+			log.Warn("failed to close dead letter", zap.Error(err))
+		}
+	}
 }
 
 // INSERT IGNORE INTO flash_metrics_index (metric_name, label0, label1) VALUES (?, ?, ?);
@@ -346,18 +510,24 @@ func (d *DefaultMetricStorage) insertIndex(ctx context.Context, timeSeries model
 	defer interfaceSliceP.Put(args)
 	var sb strings.Builder
 
-	sb.WriteString("INSERT IGNORE INTO flash_metrics_index (metric_name")
+	sb.WriteString("INSERT IGNORE INTO " + d.tables.Index + " (metric_name")
 	*args = append(*args, timeSeries.Name)
 	for _, label := range timeSeries.Labels {
 		labelID := m.Labels[metas.LabelName(label.Name)]
+		if labelID >= table.MaxLabelCount {
+			continue
+		}
 		sb.WriteString(", label")
 		sb.WriteString(strconv.Itoa(int(labelID)))
 		*args = append(*args, label.Value)
 	}
-	sb.WriteString(") VALUES (?")
-	for range timeSeries.Labels {
-		sb.WriteString(", ?")
+	if m.HasOverflow() {
+		value, key := overflowOf(timeSeries, m)
+		sb.WriteString(", label_overflow, overflow_key")
+		*args = append(*args, sql.NullString{String: value, Valid: value != ""}, key)
 	}
+	sb.WriteString(") VALUES (?")
+	sb.WriteString(strings.Repeat(", ?", len(*args)-1))
 	sb.WriteString(");")
 
 	_, err := d.DB.ExecContext(ctx, sb.String(), *args...)
@@ -370,15 +540,23 @@ func (d *DefaultMetricStorage) getTSID(ctx context.Context, timeSeries model.Tim
 	defer interfaceSliceP.Put(args)
 	var sb strings.Builder
 
-	sb.WriteString("SELECT _tidb_rowid FROM flash_metrics_index WHERE metric_name = ?")
+	sb.WriteString("SELECT _tidb_rowid FROM " + d.tables.Index + " WHERE metric_name = ? ")
 	*args = append(*args, timeSeries.Name)
 	for _, label := range timeSeries.Labels {
 		labelID := m.Labels[metas.LabelName(label.Name)]
+		if labelID >= table.MaxLabelCount {
+			continue
+		}
 		sb.WriteString("AND label")
 		sb.WriteString(strconv.Itoa(int(labelID)))
 		sb.WriteString(" = ? ")
 		*args = append(*args, label.Value)
 	}
+	if m.HasOverflow() {
+		_, key := overflowOf(timeSeries, m)
+		sb.WriteString("AND overflow_key = ? ")
+		*args = append(*args, key)
+	}
 	sb.WriteByte(';')
 	row := d.DB.QueryRowContext(ctx, sb.String(), *args...)
 	var res int64
@@ -388,14 +566,23 @@ func (d *DefaultMetricStorage) getTSID(ctx context.Context, timeSeries model.Tim
 	return res, nil
 }
 
+// overflowOf returns label_overflow and overflow_key of the series.
+func overflowOf(timeSeries model.TimeSeries, m *metas.Meta) (value, key string) {
+	values := map[metas.LabelID]string{}
+	for _, label := range timeSeries.Labels {
+		values[m.Labels[metas.LabelName(label.Name)]] = label.Value
+	}
+	return metas.OverflowLabels(values)
+}
+
 // INSERT IGNORE INTO flash_metrics_update (tsid, updated_date) VALUES (?, ?), (?, ?), (?, ?);
-func (d *DefaultMetricStorage) insertUpdatedDate(ctx context.Context, tsid int64, timeSeries model.TimeSeries) error {
+func (d *DefaultMetricStorage) insertUpdatedDate(ctx context.Context, tx *sql.Tx, tsid int64, timeSeries model.TimeSeries) error {
 	args := interfaceSliceP.Get()
 	defer interfaceSliceP.Put(args)
 
 	writeCount := 0
 	var sb strings.Builder
-	sb.WriteString("INSERT IGNORE INTO flash_metrics_update (tsid, updated_date) VALUES")
+	sb.WriteString("INSERT IGNORE INTO " + d.tables.Update + " (tsid, updated_date) VALUES")
 
 	dateMap := map[string]struct{}{}
 	for k := range dateMap {
@@ -420,18 +607,18 @@ func (d *DefaultMetricStorage) insertUpdatedDate(ctx context.Context, tsid int64
 		return nil
 	}
 
-	_, err := d.DB.ExecContext(ctx, sb.String(), *args...)
+	_, err := tx.ExecContext(ctx, sb.String(), *args...)
 	return err
 }
 
-// INSERT INTO flash_metrics_data (tsid, ts, v) VALUES (?, ?, ?), (?, ?, ?), (?, ?, ?);
-func (d *DefaultMetricStorage) insertData(ctx context.Context, tsid int64, timeSeries model.TimeSeries) error {
+// INSERT INTO flash_metrics_data (tsid, ts, v) VALUES (?, ?, ?), (?, ?, ?) ON DUPLICATE KEY UPDATE v = VALUES(v);
+func (d *DefaultMetricStorage) insertData(ctx context.Context, tx *sql.Tx, tsid int64, timeSeries model.TimeSeries) error {
 	args := interfaceSliceP.Get()
 	defer interfaceSliceP.Put(args)
 
 	writeCount := 0
 	var sb strings.Builder
-	sb.WriteString("INSERT INTO flash_metrics_data (tsid, ts, v) VALUES")
+	sb.WriteString("INSERT INTO " + d.tables.Data + " (tsid, ts, v) VALUES")
 
 	for _, sample := range timeSeries.Samples {
 		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 1) || math.IsInf(sample.Value, -1) {
@@ -452,6 +639,158 @@ func (d *DefaultMetricStorage) insertData(ctx context.Context, tsid int64, timeS
 		return nil
 	}
 
-	_, err := d.DB.ExecContext(ctx, sb.String(), *args...)
+	sb.WriteString(" ON DUPLICATE KEY UPDATE v = VALUES(v)")
+	_, err := tx.ExecContext(ctx, sb.String(), *args...)
 	return err
 }
+
+type queryMetricFunc func(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error)
+
+// queryMetrics calls query for every metric matched by metricsName and the
+// matchers of __name__, with the matchers of the other labels. The candidate
+// metrics are the ones updated in [start, end] and matched by the matchers of
+// __name__ in TiDB if metricsName is empty, which are bounded by the limits.
+func (d *DefaultMetricStorage) queryMetrics(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher, query queryMetricFunc) ([]model.TimeSeries, error) {
+	var nameMatchers, labelMatchers []model.Matcher
+	for _, matcher := range matchers {
+		if matcher.LabelName == metricNameLabel {
+			nameMatchers = append(nameMatchers, matcher)
+		} else {
+			labelMatchers = append(labelMatchers, matcher)
+		}
+	}
+
+	metricNames := []string{metricsName}
+	if metricsName == "" {
+		var err error
+		if metricNames, err = d.queryMetricNames(ctx, start, end, nameMatchers...); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, matcher := range nameMatchers {
+			matched, err := matchValue(matcher, metricsName)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				return nil, nil
+			}
+		}
+	}
+
+	limiter := QueryLimiterFromContext(ctx)
+	if err := limiter.CheckMetrics(len(metricNames)); err != nil {
+		return nil, err
+	}
+	var res []model.TimeSeries
+	for _, name := range metricNames {
+		timeSeries, err := query(ctx, start, end, name, labelMatchers)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, timeSeries...)
+		if err = limiter.CheckSeries(len(res)); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// knownMatchers checks query label exists. A non-exist label has an empty
+// value for all series, so return false if the matcher doesn't match the empty
+// value, otherwise the matcher can be ignored.
+func knownMatchers(m *metas.Meta, matchers []model.Matcher) ([]model.Matcher, bool, error) {
+	known := make([]model.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		if _, ok := m.Labels[metas.LabelName(matcher.LabelName)]; ok {
+			known = append(known, matcher)
+			continue
+		}
+		matched, err := matchEmpty(matcher)
+		if err != nil {
+			return nil, false, err
+		}
+		if !matched {
+			return nil, false, nil
+		}
+	}
+	return known, true, nil
+}
+
+// AND label0 != ?
+// AND label1 REGEXP ?
+func writeMatchers(sb *strings.Builder, args *[]interface{}, m *metas.Meta, matchers []model.Matcher) {
+	for _, matcher := range matchers {
+		labelID := m.Labels[metas.LabelName(matcher.LabelName)]
+		sb.WriteString("AND ")
+		sb.WriteString(metas.LabelColumn(labelID))
+
+		if matcher.IsRE {
+			if matcher.IsNegative {
+				sb.WriteString(" NOT REGEXP ?\n")
+			} else {
+				sb.WriteString(" REGEXP ?\n")
+			}
+		} else {
+			if matcher.IsNegative {
+				sb.WriteString(" != ?\n")
+			} else {
+				sb.WriteString(" = ?\n")
+			}
+		}
+		*args = append(*args, matcher.LabelValue)
+	}
+}
+
+// AND metric_name != ?
+// AND metric_name REGEXP ?
+func writeNameMatchers(sb *strings.Builder, args *[]interface{}, matchers []model.Matcher) {
+	for _, matcher := range matchers {
+		sb.WriteString("AND metric_name")
+		if matcher.IsRE {
+			if matcher.IsNegative {
+				sb.WriteString(" NOT REGEXP ?\n")
+			} else {
+				sb.WriteString(" REGEXP ?\n")
+			}
+		} else {
+			if matcher.IsNegative {
+				sb.WriteString(" != ?\n")
+			} else {
+				sb.WriteString(" = ?\n")
+			}
+		}
+		*args = append(*args, matcher.LabelValue)
+	}
+}
+
+// AND DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts)
+func writeUpdatedDate(sb *strings.Builder, args *[]interface{}, start, end int64) {
+	sb.WriteString("AND ? <= updated_date AND updated_date <= ?\n")
+	*args = append(*args, formatDate(start), formatDate(end))
+}
+
+// formatDate formats the UTC date of the unix milliseconds ms.
+func formatDate(ms int64) string {
+	return time.Unix(ms/1000, (ms%1000)*1_000_000).UTC().Format("2006-01-02")
+}
+
+// matchEmpty returns whether the matcher matches an empty label value.
+func matchEmpty(matcher model.Matcher) (bool, error) {
+	return matchValue(matcher, "")
+}
+
+// matchValue returns whether the matcher matches the label value.
+func matchValue(matcher model.Matcher, value string) (bool, error) {
+	var matched bool
+	if matcher.IsRE {
+		re, err := regexp.Compile(matcher.LabelValue)
+		if err != nil {
+			return false, err
+		}
+		matched = re.MatchString(value)
+	} else {
+		matched = matcher.LabelValue == value
+	}
+	return matched != matcher.IsNegative, nil
+}
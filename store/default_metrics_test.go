@@ -3,14 +3,17 @@ package store_test
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/showhand-lab/flash-metrics/store"
 	"github.com/showhand-lab/flash-metrics/store/model"
+	"github.com/showhand-lab/flash-metrics/table"
 	"github.com/showhand-lab/flash-metrics/utils"
 
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -272,3 +275,372 @@ func (s *testDefaultMetricsSuite) TestDefaultMetricsBasic() {
 		}},
 	}})
 }
+
+func (s *testDefaultMetricsSuite) TestDefaultMetricsSeries() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	metricStorage := store.NewDefaultMetricStorage(s.db)
+	defer metricStorage.Close()
+
+	err := metricStorage.BatchStore(context.Background(), []*model.TimeSeries{{
+		Name: "series_requests_total",
+		Labels: []model.Label{{
+			Name:  "method",
+			Value: "GET",
+		}},
+		Samples: []model.Sample{{
+			TimestampMs: now,
+			Value:       1.0,
+		}},
+	}, {
+		Name: "series_requests_total",
+		Labels: []model.Label{{
+			Name:  "method",
+			Value: "POST",
+		}, {
+			Name:  "handler",
+			Value: "/series",
+		}},
+		Samples: []model.Sample{{
+			TimestampMs: now,
+			Value:       2.0,
+		}},
+	}})
+	s.NoError(err)
+
+	ts, err := metricStorage.QuerySeries(context.Background(), now, now, "series_requests_total", []model.Matcher{{
+		LabelName:  "method",
+		LabelValue: "GET",
+	}})
+	s.NoError(err)
+	s.Equal([]model.TimeSeries{{
+		Name: "series_requests_total",
+		Labels: []model.Label{{
+			Name:  "method",
+			Value: "GET",
+		}},
+	}}, ts)
+
+	names, err := metricStorage.QueryLabelNames(context.Background(), now, now)
+	s.NoError(err)
+	s.Subset(names, []string{"__name__", "handler", "method"})
+
+	values, err := metricStorage.QueryLabelValues(context.Background(), now, now, "method")
+	s.NoError(err)
+	s.Subset(values, []string{"GET", "POST"})
+
+	values, err = metricStorage.QueryLabelValues(context.Background(), now, now, "__name__")
+	s.NoError(err)
+	s.Contains(values, "series_requests_total")
+
+	values, err = metricStorage.QueryLabelValues(context.Background(), now, now, "unknown")
+	s.NoError(err)
+	s.Empty(values)
+
+	// without a metric name
+	ts, err = metricStorage.QuerySeries(context.Background(), now, now, "", []model.Matcher{{
+		LabelName:  "__name__",
+		LabelValue: "^(?:series_.*)$",
+		IsRE:       true,
+	}, {
+		LabelName:  "handler",
+		LabelValue: "/series",
+	}})
+	s.NoError(err)
+	s.Len(ts, 1)
+	s.Equal("series_requests_total", ts[0].Name)
+
+	ts, err = metricStorage.Query(context.Background(), now, now, "", []model.Matcher{{
+		LabelName:  "method",
+		LabelValue: "POST",
+	}})
+	s.NoError(err)
+	s.Len(ts, 1)
+	s.Equal("series_requests_total", ts[0].Name)
+	s.Equal([]model.Sample{{TimestampMs: now, Value: 2.0}}, ts[0].Samples)
+
+	// the metrics selected are bounded before querying any of them
+	s.NoError(metricStorage.Store(context.Background(), model.TimeSeries{
+		Name:    "series_errors_total",
+		Samples: []model.Sample{{TimestampMs: now, Value: 1.0}},
+	}))
+	limited := store.WithQueryLimits(context.Background(), store.QueryLimits{MaxMetrics: 1})
+	ts, err = metricStorage.QuerySeries(limited, now, now, "", []model.Matcher{{
+		LabelName:  "__name__",
+		LabelValue: "^(?:series_requests_total)$",
+		IsRE:       true,
+	}})
+	s.NoError(err)
+	s.Len(ts, 1)
+	_, err = metricStorage.Query(limited, now, now, "", []model.Matcher{{
+		LabelName:  "__name__",
+		LabelValue: "^(?:series_.*)$",
+		IsRE:       true,
+	}})
+	s.IsType(&store.LimitError{}, err)
+}
+
+func (s *testDefaultMetricsSuite) TestDefaultMetricsMetadata() {
+	metricStorage := store.NewDefaultMetricStorage(s.db)
+	defer metricStorage.Close()
+
+	counter := model.Metadata{
+		MetricName: "metadata_requests_total",
+		Job:        "api",
+		Instance:   "localhost:8080",
+		Type:       "counter",
+		Help:       "Total requests.",
+	}
+	gauge := model.Metadata{
+		MetricName: "metadata_memory",
+		Type:       "gauge",
+		Help:       "Memory in use.",
+		Unit:       "bytes",
+	}
+	s.NoError(metricStorage.StoreMetadata(context.Background(), []model.Metadata{counter, gauge}))
+
+	metadata, err := metricStorage.QueryMetadata(context.Background(), "metadata_requests_total")
+	s.NoError(err)
+	s.Equal([]model.Metadata{counter}, metadata)
+
+	counter.Help = "Total HTTP requests."
+	s.NoError(metricStorage.StoreMetadata(context.Background(), []model.Metadata{counter, gauge}))
+
+	metadata, err = metricStorage.QueryMetadata(context.Background(), "")
+	s.NoError(err)
+	s.Equal([]model.Metadata{gauge, counter}, metadata)
+}
+
+func (s *testDefaultMetricsSuite) TestDefaultMetricsAtomicBatch() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	metricStorage := store.NewDefaultMetricStorage(s.db)
+	defer metricStorage.Close()
+
+	updatedDates := func() int {
+		var count int
+		s.NoError(s.db.QueryRow(`SELECT COUNT(*) FROM flash_metrics_update u
+INNER JOIN flash_metrics_index i ON (i._tidb_rowid = u.tsid)
+WHERE i.metric_name = 'atomic_batch'`).Scan(&count))
+		return count
+	}
+
+	// the sample before 1970 of the second series is rejected by TIMESTAMP,
+	// which fails the batch after the updated dates are inserted
+	err := metricStorage.BatchStore(context.Background(), []*model.TimeSeries{{
+		Name:    "atomic_batch",
+		Labels:  []model.Label{{Name: "instance", Value: "a"}},
+		Samples: []model.Sample{{TimestampMs: now, Value: 1}},
+	}, {
+		Name:    "atomic_batch",
+		Labels:  []model.Label{{Name: "instance", Value: "b"}},
+		Samples: []model.Sample{{TimestampMs: now, Value: 2}, {TimestampMs: -1000, Value: 3}},
+	}})
+	s.Error(err)
+	s.Equal(0, updatedDates())
+
+	ts, err := metricStorage.QuerySeries(context.Background(), now, now, "atomic_batch", nil)
+	s.NoError(err)
+	s.Empty(ts)
+	ts, err = metricStorage.Query(context.Background(), now, now, "atomic_batch", nil)
+	s.NoError(err)
+	s.Empty(ts)
+
+	// so is a single series
+	err = metricStorage.Store(context.Background(), model.TimeSeries{
+		Name:    "atomic_batch",
+		Labels:  []model.Label{{Name: "instance", Value: "c"}},
+		Samples: []model.Sample{{TimestampMs: now, Value: 4}, {TimestampMs: -1000, Value: 5}},
+	})
+	s.Error(err)
+	s.Equal(0, updatedDates())
+	ts, err = metricStorage.QuerySeries(context.Background(), now, now, "atomic_batch", nil)
+	s.NoError(err)
+	s.Empty(ts)
+
+	// the batch is stored once valid
+	err = metricStorage.BatchStore(context.Background(), []*model.TimeSeries{{
+		Name:    "atomic_batch",
+		Labels:  []model.Label{{Name: "instance", Value: "b"}},
+		Samples: []model.Sample{{TimestampMs: now, Value: 2}},
+	}})
+	s.NoError(err)
+	s.Equal(1, updatedDates())
+}
+
+func TestOverflowLabels(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupOverflowDB("test_overflow_labels")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_overflow_labels", db))
+	}()
+
+	metricStorage := store.NewDefaultMetricStorage(db)
+	metricStorage.EnableOverflowLabels()
+	defer metricStorage.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	newSeries := func(pod string, extra int, v float64) *model.TimeSeries {
+		ts := &model.TimeSeries{
+			Name:    "kube_pod_info",
+			Labels:  []model.Label{{Name: "pod", Value: pod}},
+			Samples: []model.Sample{{TimestampMs: now, Value: v}},
+		}
+		for i := 0; i < extra; i++ {
+			ts.Labels = append(ts.Labels, model.Label{Name: fmt.Sprintf("label_%02d", i), Value: fmt.Sprintf("%s-%d", pod, i)})
+		}
+		return ts
+	}
+
+	// the series differ in the labels beyond the label columns only
+	require.NoError(t, metricStorage.Store(context.Background(), *newSeries("a", 19, 1)))
+	require.NoError(t, metricStorage.BatchStore(context.Background(), []*model.TimeSeries{
+		newSeries("b", 19, 2),
+		newSeries("b", 12, 3),
+	}))
+	require.NoError(t, metricStorage.Store(context.Background(), *newSeries("b", 12, 4)))
+
+	ts, err := metricStorage.Query(context.Background(), now, now, "kube_pod_info", []model.Matcher{{
+		LabelName:  "pod",
+		LabelValue: "b",
+	}})
+	require.NoError(t, err)
+	require.Len(t, ts, 2)
+	sort.Slice(ts, func(i, j int) bool { return len(ts[i].Labels) < len(ts[j].Labels) })
+	require.Len(t, ts[0].Labels, 13)
+	require.Equal(t, []model.Sample{{TimestampMs: now, Value: 3}, {TimestampMs: now, Value: 4}}, ts[0].Samples)
+	require.Len(t, ts[1].Labels, 20)
+	require.Equal(t, []model.Sample{{TimestampMs: now, Value: 2}}, ts[1].Samples)
+
+	// matchers on the labels beyond the label columns
+	ts, err = metricStorage.QuerySeries(context.Background(), now, now, "kube_pod_info", []model.Matcher{{
+		LabelName:  "label_18",
+		LabelValue: "^(?:a-.*)$",
+		IsRE:       true,
+	}})
+	require.NoError(t, err)
+	require.Len(t, ts, 1)
+	require.Contains(t, ts[0].Labels, model.Label{Name: "pod", Value: "a"})
+	require.Contains(t, ts[0].Labels, model.Label{Name: "label_18", Value: "a-18"})
+
+	values, err := metricStorage.QueryLabelValues(context.Background(), now, now, "label_18")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a-18", "b-18"}, values)
+}
+
+func TestTablePrefix(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDBWithOptions("test_table_prefix", table.SchemaOptions{TablePrefix: "staging_"})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_table_prefix", db))
+	}()
+	require.NoError(t, table.Migrate(context.Background(), db, table.NewTables("production_"),
+		table.Migrations(table.SchemaOptions{TablePrefix: "production_"}), false, nil))
+
+	staging := store.NewDefaultMetricStorageWithTables(db, table.NewTables("staging_"))
+	defer staging.Close()
+	production := store.NewDefaultMetricStorageWithTables(db, table.NewTables("production_"))
+	defer production.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	newSeries := func(env string, v float64) *model.TimeSeries {
+		return &model.TimeSeries{
+			Name:    "up",
+			Labels:  []model.Label{{Name: "env", Value: env}},
+			Samples: []model.Sample{{TimestampMs: now, Value: v}},
+		}
+	}
+	require.NoError(t, staging.Store(context.Background(), *newSeries("staging", 1)))
+	require.NoError(t, production.BatchStore(context.Background(), []*model.TimeSeries{newSeries("production", 2)}))
+
+	for _, c := range []struct {
+		storage *store.DefaultMetricStorage
+		env     string
+		v       float64
+	}{{staging, "staging", 1}, {production, "production", 2}} {
+		ts, err := c.storage.Query(context.Background(), now, now, "up", nil)
+		require.NoError(t, err)
+		require.Equal(t, []model.TimeSeries{{
+			Name:    "up",
+			Labels:  []model.Label{{Name: "env", Value: c.env}},
+			Samples: []model.Sample{{TimestampMs: now, Value: c.v}},
+		}}, ts)
+
+		values, err := c.storage.QueryLabelValues(context.Background(), now, now, "env")
+		require.NoError(t, err)
+		require.Equal(t, []string{c.env}, values)
+	}
+}
+
+func (s *testDefaultMetricsSuite) TestQueryAcrossDays() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	yesterday := now - int64(24*time.Hour/time.Millisecond)
+
+	metricStorage := store.NewDefaultMetricStorage(s.db)
+	defer metricStorage.Close()
+
+	// the series has an updated date for each of the two days
+	ctx := context.Background()
+	s.NoError(metricStorage.Store(ctx, model.TimeSeries{
+		Name:    "across_days_total",
+		Labels:  []model.Label{{Name: "job", Value: "api"}},
+		Samples: []model.Sample{{TimestampMs: yesterday, Value: 1}, {TimestampMs: now, Value: 2}},
+	}))
+
+	timeSeries, err := metricStorage.Query(ctx, yesterday, now, "across_days_total", nil)
+	s.NoError(err)
+	s.Len(timeSeries, 1)
+	s.Equal([]model.Sample{{TimestampMs: yesterday, Value: 1}, {TimestampMs: now, Value: 2}}, timeSeries[0].Samples)
+}
+
+func (s *testDefaultMetricsSuite) TestGeneration() {
+	late := time.Now().Add(-48 * time.Hour)
+	other := late.Add(-24 * time.Hour)
+
+	metricStorage := store.NewDefaultMetricStorage(s.db)
+	defer metricStorage.Close()
+
+	// the generations are loaded in background once watched
+	ctx := context.Background()
+	metricStorage.WatchLateSamples(time.Hour)
+	var generation, otherGeneration int64
+	s.Eventually(func() bool {
+		var err error
+		generation, err = metricStorage.Generation(ctx, late)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	otherGeneration, err := metricStorage.Generation(ctx, other)
+	s.NoError(err)
+
+	// only the days invalidated are bumped
+	s.NoError(metricStorage.Invalidate(ctx, late, late))
+	next, err := metricStorage.Generation(ctx, late)
+	s.NoError(err)
+	s.Equal(generation+1, next)
+	next, err = metricStorage.Generation(ctx, other)
+	s.NoError(err)
+	s.Equal(otherGeneration, next)
+
+	// and the days of the late samples only
+	s.NoError(metricStorage.Store(ctx, model.TimeSeries{
+		Name:    "generation",
+		Samples: []model.Sample{{TimestampMs: time.Now().UnixNano() / int64(time.Millisecond), Value: 1}},
+	}))
+	s.NoError(metricStorage.Store(ctx, model.TimeSeries{
+		Name:    "generation",
+		Samples: []model.Sample{{TimestampMs: late.UnixNano() / int64(time.Millisecond), Value: 1}},
+	}))
+	s.Eventually(func() bool {
+		next, err = metricStorage.Generation(ctx, late)
+		return err == nil && next == generation+2
+	}, 5*time.Second, 100*time.Millisecond)
+	next, err = metricStorage.Generation(ctx, other)
+	s.NoError(err)
+	s.Equal(otherGeneration, next)
+}
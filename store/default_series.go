@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/showhand-lab/flash-metrics/metas"
+	"github.com/showhand-lab/flash-metrics/store/model"
+)
+
+const metricNameLabel = "__name__"
+
+var _ SeriesStorage = &DefaultMetricStorage{}
+
+// QuerySeries implements interface SeriesStorage. If metricsName is empty,
+// the metrics are selected by the matchers of __name__ in matchers.
+func (d *DefaultMetricStorage) QuerySeries(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+	return d.queryMetrics(ctx, start, end, metricsName, matchers, d.queryMetricSeries)
+}
+
+// queryMetricSeries queries the series of a single metric.
+//
+//	SELECT DISTINCT
+//	  metric_name, label0, label1
+//	FROM
+//	  flash_metrics_index
+//	  INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
+//	WHERE
+//	  metric_name = "xxx"
+//	  AND label0 != "yyy"
+//	  AND DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts);
+func (d *DefaultMetricStorage) queryMetricSeries(ctx context.Context, start, end int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error) {
+	m, err := d.QueryMeta(ctx, metricsName)
+	if err != nil {
+		return nil, err
+	}
+	matchers, ok, err := knownMatchers(m, matchers)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString("SELECT DISTINCT metric_name")
+	names := make([]string, 0, len(m.Labels))
+	for n, v := range m.Labels {
+		sb.WriteString(", ")
+		sb.WriteString(metas.LabelColumn(v))
+		names = append(names, string(n))
+	}
+	sb.WriteString(`
+FROM
+  ` + d.tables.Index + `
+  INNER JOIN ` + d.tables.Update + ` ON (_tidb_rowid = tsid)
+WHERE
+  metric_name = ?
+`)
+	*args = append(*args, metricsName)
+	writeMatchers(&sb, args, m, matchers)
+	writeUpdatedDate(&sb, args, start, end)
+
+	rows, err := d.ReadDB.QueryContext(ctx, sb.String(), *args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metricName string
+	values := make([]string, len(names))
+	dest := make([]interface{}, 0, len(names)+1)
+	dest = append(dest, &metricName)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+
+	limiter := QueryLimiterFromContext(ctx)
+	var res []model.TimeSeries
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if err = limiter.CheckSeries(len(res) + 1); err != nil {
+			return nil, err
+		}
+		timeSeries := model.TimeSeries{Name: metricsName}
+		for i, name := range names {
+			if values[i] != "" {
+				timeSeries.Labels = append(timeSeries.Labels, model.Label{Name: name, Value: values[i]})
+			}
+		}
+		res = append(res, timeSeries)
+	}
+	return res, rows.Err()
+}
+
+// QueryLabelNames implements interface SeriesStorage. The metrics without
+// labels are joined as __name__, so that the result is empty only if there is
+// no metric in the range.
+//
+//	SELECT DISTINCT IFNULL(label_name, "__name__")
+//	FROM (
+//	  SELECT DISTINCT metric_name
+//	  FROM
+//	    flash_metrics_index
+//	    INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
+//	  WHERE DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts)
+//	) metrics
+//	LEFT JOIN flash_metrics_meta USING (metric_name);
+func (d *DefaultMetricStorage) QueryLabelNames(ctx context.Context, start, end int64) ([]string, error) {
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString(`
+SELECT DISTINCT IFNULL(label_name, ?)
+FROM (
+  SELECT DISTINCT metric_name
+  FROM
+    ` + d.tables.Index + `
+    INNER JOIN ` + d.tables.Update + ` ON (_tidb_rowid = tsid)
+  WHERE TRUE
+  `)
+	*args = append(*args, metricNameLabel)
+	writeUpdatedDate(&sb, args, start, end)
+	sb.WriteString(") metrics\nLEFT JOIN " + d.tables.Meta + " USING (metric_name)")
+
+	var res []string
+	if err := d.queryStrings(ctx, &res, sb.String(), *args...); err != nil || len(res) == 0 {
+		return nil, err
+	}
+	sort.Strings(res)
+	if i := sort.SearchStrings(res, metricNameLabel); i == len(res) || res[i] != metricNameLabel {
+		res = append(res, metricNameLabel)
+		sort.Strings(res)
+	}
+	return res, nil
+}
+
+// QueryLabelValues implements interface SeriesStorage
+//
+//	SELECT DISTINCT label0
+//	FROM
+//	  flash_metrics_index
+//	  INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
+//	WHERE
+//	  metric_name IN ("xxx", "yyy")
+//	  AND label0 != ""
+//	  AND DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts)
+//	UNION
+//	SELECT DISTINCT label1
+//	...
+func (d *DefaultMetricStorage) QueryLabelValues(ctx context.Context, start, end int64, labelName string) ([]string, error) {
+	if labelName == metricNameLabel {
+		return d.queryMetricNames(ctx, start, end)
+	}
+
+	// the metrics having the label, by the column of it
+	rows, err := d.ReadDB.QueryContext(ctx, "SELECT metric_name, label_id FROM "+d.tables.Meta+" WHERE label_name = ?", labelName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metricNames := map[metas.LabelID][]interface{}{}
+	var labelIDs []metas.LabelID
+	for rows.Next() {
+		var metricName string
+		var labelID metas.LabelID
+		if err = rows.Scan(&metricName, &labelID); err != nil {
+			return nil, err
+		}
+		if _, ok := metricNames[labelID]; !ok {
+			labelIDs = append(labelIDs, labelID)
+		}
+		metricNames[labelID] = append(metricNames[labelID], metricName)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(labelIDs) == 0 {
+		return nil, nil
+	}
+
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	for i, labelID := range labelIDs {
+		if i > 0 {
+			sb.WriteString("UNION\n")
+		}
+		column := metas.LabelColumn(labelID)
+		sb.WriteString("SELECT DISTINCT ")
+		sb.WriteString(column)
+		sb.WriteString(`
+FROM
+  ` + d.tables.Index + `
+  INNER JOIN ` + d.tables.Update + ` ON (_tidb_rowid = tsid)
+WHERE
+  metric_name IN (?`)
+		sb.WriteString(strings.Repeat(", ?", len(metricNames[labelID])-1))
+		sb.WriteString(")\nAND ")
+		sb.WriteString(column)
+		sb.WriteString(" != ''\n")
+		*args = append(*args, metricNames[labelID]...)
+		writeUpdatedDate(&sb, args, start, end)
+	}
+
+	var res []string
+	if err = d.queryStrings(ctx, &res, sb.String(), *args...); err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// queryMetricNames returns the metrics with series updated in the time range,
+// whose names are matched by the matchers of __name__.
+//
+//	SELECT DISTINCT metric_name
+//	FROM
+//	  flash_metrics_index
+//	  INNER JOIN flash_metrics_update ON (_tidb_rowid = tsid)
+//	WHERE
+//	  metric_name REGEXP ?
+//	  AND DATE(start_ts) <= updated_date AND updated_date <= DATE(end_ts);
+func (d *DefaultMetricStorage) queryMetricNames(ctx context.Context, start, end int64, nameMatchers ...model.Matcher) ([]string, error) {
+	args := interfaceSliceP.Get()
+	defer interfaceSliceP.Put(args)
+
+	var sb strings.Builder
+	sb.WriteString(`
+SELECT DISTINCT metric_name
+FROM
+  ` + d.tables.Index + `
+  INNER JOIN ` + d.tables.Update + ` ON (_tidb_rowid = tsid)
+WHERE TRUE
+`)
+	writeNameMatchers(&sb, args, nameMatchers)
+	writeUpdatedDate(&sb, args, start, end)
+
+	var res []string
+	if err := d.queryStrings(ctx, &res, sb.String(), *args...); err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// queryStrings appends the values of the only column of the rows to res.
+func (d *DefaultMetricStorage) queryStrings(ctx context.Context, res *[]string, query string, args ...interface{}) error {
+	rows, err := d.ReadDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return err
+		}
+		*res = append(*res, s)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// invalidateInterval is how often the generations of the days of late
+	// samples are bumped, and the generations are loaded, at most.
+	invalidateInterval = time.Second
+	invalidateTimeout  = 10 * time.Second
+	// maxGenerationsAge is how long the generations loaded are used for, the
+	// results derived from the samples aren't cached if they're older.
+	maxGenerationsAge = 10 * invalidateInterval
+
+	day = 24 * time.Hour
+)
+
+var errStaleGenerations = errors.New("generations of samples are stale")
+
+// generations are the generations of the samples by the UTC days, which are
+// bumped once the samples of the days change.
+type generations struct {
+	sync.Mutex
+	// byDay are the generations by the unix seconds of the days, loaded at
+	// loadedAt, zero if absent.
+	byDay    map[int64]int64
+	loadedAt time.Time
+	// lateDays are the days of the late samples whose generations are to be
+	// bumped.
+	lateDays map[int64]struct{}
+}
+
+// Generation returns the generation of the samples of the UTC day of t, which
+// is bumped by Invalidate once the samples of the day change, so that the
+// results derived from them can be cached with the generation. The generations
+// are shared by the instances on the same tables, and loaded in background
+// once WatchLateSamples is called.
+func (d *DefaultMetricStorage) Generation(_ context.Context, t time.Time) (int64, error) {
+	d.generations.Lock()
+	defer d.generations.Unlock()
+	if time.Since(d.generations.loadedAt) > maxGenerationsAge {
+		return 0, errStaleGenerations
+	}
+	return d.generations.byDay[dayOf(t)], nil
+}
+
+// Invalidate bumps the generations of the UTC days in [start, end], which must
+// be called after the samples of the days change, such as the expired ones
+// and the rollups.
+func (d *DefaultMetricStorage) Invalidate(ctx context.Context, start, end time.Time) error {
+	var days []int64
+	for t := dayOf(start); t <= dayOf(end); t += int64(day / time.Second) {
+		days = append(days, t)
+	}
+	return d.bumpGenerations(ctx, days)
+}
+
+// WatchLateSamples takes the samples older than age once stored as late, the
+// generations of their days are bumped in background. The least of the ages
+// watched is taken.
+func (d *DefaultMetricStorage) WatchLateSamples(age time.Duration) {
+	if age <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&d.lateAge)
+		if old != 0 && old <= int64(age) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&d.lateAge, old, int64(age)) {
+			return
+		}
+	}
+}
+
+// watchSamples records the days of the samples older than the watched age.
+func (d *DefaultMetricStorage) watchSamples(timeSeries []*model.TimeSeries) {
+	age := atomic.LoadInt64(&d.lateAge)
+	if age == 0 {
+		return
+	}
+	lateMs := time.Now().Add(-time.Duration(age)).UnixNano() / int64(time.Millisecond)
+	d.addLateDays(timeSeries, lateMs)
+}
+
+// addLateDays records the days of the samples before lateMs.
+func (d *DefaultMetricStorage) addLateDays(timeSeries []*model.TimeSeries, lateMs int64) {
+	var days []int64
+	for _, ts := range timeSeries {
+		for _, s := range ts.Samples {
+			if s.TimestampMs >= lateMs {
+				continue
+			}
+			t := dayOf(time.Unix(0, s.TimestampMs*int64(time.Millisecond)))
+			if n := len(days); n == 0 || days[n-1] != t {
+				days = append(days, t)
+			}
+		}
+	}
+	if len(days) == 0 {
+		return
+	}
+
+	d.generations.Lock()
+	defer d.generations.Unlock()
+	if d.generations.lateDays == nil {
+		d.generations.lateDays = map[int64]struct{}{}
+	}
+	for _, t := range days {
+		d.generations.lateDays[t] = struct{}{}
+	}
+}
+
+// invalidateLoop bumps the generations of the days of late samples, and loads
+// the generations if watched, once an invalidateInterval until the storage is
+// closed.
+func (d *DefaultMetricStorage) invalidateLoop() {
+	ticker := time.NewTicker(invalidateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			// the last late samples before closing
+			d.invalidateLate()
+			return
+		}
+		d.invalidateLate()
+		if atomic.LoadInt64(&d.lateAge) != 0 {
+			d.loadGenerations()
+		}
+	}
+}
+
+// invalidateLate bumps the generations of the days of late samples, which are
+// bumped again by the next call if it fails.
+func (d *DefaultMetricStorage) invalidateLate() {
+	d.generations.Lock()
+	lateDays := d.generations.lateDays
+	d.generations.lateDays = nil
+	d.generations.Unlock()
+	if len(lateDays) == 0 {
+		return
+	}
+
+	days := make([]int64, 0, len(lateDays))
+	for t := range lateDays {
+		days = append(days, t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), invalidateTimeout)
+	defer cancel()
+	if err := d.bumpGenerations(ctx, days); err != nil {
+		log.Warn("failed to bump the generations for late samples", zap.Int("days", len(days)), zap.Error(err))
+		d.generations.Lock()
+		if d.generations.lateDays == nil {
+			d.generations.lateDays = map[int64]struct{}{}
+		}
+		for _, t := range days {
+			d.generations.lateDays[t] = struct{}{}
+		}
+		d.generations.Unlock()
+	}
+}
+
+// bumpGenerations bumps the generations of the days, and the ones loaded so
+// that the bumps take effect in this instance at once.
+func (d *DefaultMetricStorage) bumpGenerations(ctx context.Context, days []int64) error {
+	if len(days) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(days))
+	for _, t := range days {
+		args = append(args, time.Unix(t, 0).UTC().Format("2006-01-02"))
+	}
+	if _, err := d.DB.ExecContext(ctx, "INSERT INTO "+d.tables.Generation+" (day, generation) VALUES (?, 1)"+
+		strings.Repeat(", (?, 1)", len(days)-1)+" ON DUPLICATE KEY UPDATE generation = generation + 1", args...); err != nil {
+		return err
+	}
+
+	d.generations.Lock()
+	defer d.generations.Unlock()
+	if d.generations.byDay == nil {
+		d.generations.byDay = map[int64]int64{}
+	}
+	for _, t := range days {
+		d.generations.byDay[t]++
+	}
+	return nil
+}
+
+// loadGenerations loads the generations of all the days.
+func (d *DefaultMetricStorage) loadGenerations() {
+	ctx, cancel := context.WithTimeout(d.ctx, invalidateTimeout)
+	defer cancel()
+	rows, err := d.ReadDB.QueryContext(ctx, "SELECT DATE_FORMAT(day, '%Y-%m-%d'), generation FROM "+d.tables.Generation)
+	if err != nil {
+		log.Warn("failed to load the generations of samples", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+	byDay := map[int64]int64{}
+	for rows.Next() {
+		var date string
+		var generation int64
+		if err = rows.Scan(&date, &generation); err != nil {
+			log.Warn("failed to load the generations of samples", zap.Error(err))
+			return
+		}
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			log.Warn("failed to load the generations of samples", zap.Error(err))
+			return
+		}
+		byDay[t.Unix()] = generation
+	}
+	if err = rows.Err(); err != nil {
+		log.Warn("failed to load the generations of samples", zap.Error(err))
+		return
+	}
+
+	d.generations.Lock()
+	defer d.generations.Unlock()
+	d.generations.byDay = byDay
+	d.generations.loadedAt = time.Now()
+}
+
+// dayOf returns the unix seconds of the UTC day of t.
+func dayOf(t time.Time) int64 {
+	return t.Truncate(day).Unix()
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// QueryLimits bounds the data a query can load, a zero limit means no limit.
+type QueryLimits struct {
+	// MaxSeries is the max number of series a selector can select.
+	MaxSeries int
+	// MaxMetrics is the max number of metrics a selector can select.
+	MaxMetrics int
+	// MaxSamples is the max number of samples a query can load in total.
+	MaxSamples int
+}
+
+// LimitError is returned if a query exceeds its limits.
+type LimitError struct {
+	msg string
+}
+
+func NewLimitError(format string, args ...interface{}) *LimitError {
+	return &LimitError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+type queryLimiterKey struct{}
+
+// QueryLimiter enforces the limits of a query across its selectors. A nil
+// QueryLimiter enforces no limit.
+type QueryLimiter struct {
+	limits  QueryLimits
+	samples int64
+}
+
+// WithQueryLimits returns a context whose queries are bounded by limits.
+func WithQueryLimits(ctx context.Context, limits QueryLimits) context.Context {
+	return context.WithValue(ctx, queryLimiterKey{}, &QueryLimiter{limits: limits})
+}
+
+// QueryLimiterFromContext returns the limiter of the query, or nil if there is none.
+func QueryLimiterFromContext(ctx context.Context) *QueryLimiter {
+	l, _ := ctx.Value(queryLimiterKey{}).(*QueryLimiter)
+	return l
+}
+
+// CheckSeries returns an error if a selector selects the series more than the limit.
+func (l *QueryLimiter) CheckSeries(series int) error {
+	if l == nil || l.limits.MaxSeries <= 0 || series <= l.limits.MaxSeries {
+		return nil
+	}
+	return NewLimitError("query selects more than %d series, try narrowing down the selector", l.limits.MaxSeries)
+}
+
+// CheckMetrics returns an error if a selector selects the metrics more than the limit.
+func (l *QueryLimiter) CheckMetrics(metrics int) error {
+	if l == nil || l.limits.MaxMetrics <= 0 || metrics <= l.limits.MaxMetrics {
+		return nil
+	}
+	return NewLimitError("query selects more than %d metrics, try narrowing down the selector", l.limits.MaxMetrics)
+}
+
+// AddSamples counts the loaded samples and returns an error if they are more than the limit.
+func (l *QueryLimiter) AddSamples(samples int) error {
+	if l == nil || l.limits.MaxSamples <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&l.samples, int64(samples)) <= int64(l.limits.MaxSamples) {
+		return nil
+	}
+	return NewLimitError("query loads more than %d samples, try decreasing the time range", l.limits.MaxSamples)
+}
@@ -0,0 +1,34 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	require.Nil(t, store.QueryLimiterFromContext(context.Background()))
+	var noLimiter *store.QueryLimiter
+	require.NoError(t, noLimiter.CheckSeries(1<<30))
+	require.NoError(t, noLimiter.CheckMetrics(1<<30))
+	require.NoError(t, noLimiter.AddSamples(1<<30))
+
+	ctx := store.WithQueryLimits(context.Background(), store.QueryLimits{MaxSeries: 2, MaxMetrics: 1, MaxSamples: 10})
+	limiter := store.QueryLimiterFromContext(ctx)
+	require.NoError(t, limiter.CheckSeries(2))
+	require.IsType(t, &store.LimitError{}, limiter.CheckSeries(3))
+	require.NoError(t, limiter.CheckMetrics(1))
+	require.IsType(t, &store.LimitError{}, limiter.CheckMetrics(2))
+
+	require.NoError(t, limiter.AddSamples(6))
+	require.NoError(t, limiter.AddSamples(4))
+	require.IsType(t, &store.LimitError{}, limiter.AddSamples(1))
+
+	unlimited := store.QueryLimiterFromContext(store.WithQueryLimits(context.Background(), store.QueryLimits{}))
+	require.NoError(t, unlimited.CheckSeries(1<<30))
+	require.NoError(t, unlimited.CheckMetrics(1<<30))
+	require.NoError(t, unlimited.AddSamples(1<<30))
+}
@@ -9,6 +9,24 @@ import (
 type MetricStorage interface {
 	Store(ctx context.Context, timeSeries model.TimeSeries) error
 	BatchStore(ctx context.Context, timeSeries []*model.TimeSeries) error
+	// Query queries the samples of the series of metricsName selected by
+	// matchers. If metricsName is empty, the metrics are selected by the
+	// matchers of __name__ in matchers, or all metrics if there is none.
 	Query(ctx context.Context, startMs, endMs int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error)
 	Close()
 }
+
+// SeriesStorage queries the series and labels updated in a time range, without samples.
+type SeriesStorage interface {
+	// QuerySeries selects the series the same way as MetricStorage.Query.
+	QuerySeries(ctx context.Context, startMs, endMs int64, metricsName string, matchers []model.Matcher) ([]model.TimeSeries, error)
+	QueryLabelNames(ctx context.Context, startMs, endMs int64) ([]string, error)
+	QueryLabelValues(ctx context.Context, startMs, endMs int64, labelName string) ([]string, error)
+}
+
+// MetadataStorage stores the type, help and unit of metrics.
+type MetadataStorage interface {
+	StoreMetadata(ctx context.Context, metadata []model.Metadata) error
+	// QueryMetadata queries the metadata of the metric, or all metrics if metricName is empty.
+	QueryMetadata(ctx context.Context, metricName string) ([]model.Metadata, error)
+}
@@ -22,3 +22,14 @@ type Matcher struct {
 	IsRE       bool
 	IsNegative bool
 }
+
+// Metadata is the type, help and unit of a metric. Job and Instance are the
+// target it's scraped from, they are empty if it's received by remote write.
+type Metadata struct {
+	MetricName string
+	Job        string
+	Instance   string
+	Type       string
+	Help       string
+	Unit       string
+}
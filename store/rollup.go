@@ -0,0 +1,203 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+)
+
+// RollupResolutions are the resolutions of the rollups from the coarsest.
+var RollupResolutions = []time.Duration{time.Hour, 5 * time.Minute}
+
+// rollupColumns are the columns of the rollups serving the selectors of the
+// functions, the selectors of other functions are served by raw samples. The
+// selectors outside functions are served by the last samples in the buckets.
+var rollupColumns = map[string]string{
+	"":              "last_v",
+	"rate":          "last_v",
+	"increase":      "last_v",
+	"irate":         "last_v",
+	"delta":         "last_v",
+	"max_over_time": "max_v",
+	"min_over_time": "min_v",
+	"sum_over_time": "sum_v",
+}
+
+// SelectHints describe how the samples of a selector are evaluated, so that
+// the storage can serve them from rollups.
+type SelectHints struct {
+	// StepMs is the interval between the evaluation steps.
+	StepMs int64
+	// Func is the function taking the selector, empty for a vector selector.
+	Func string
+	// RangeMs is the range of a matrix selector.
+	RangeMs int64
+}
+
+type selectHintsKey struct{}
+
+// WithSelectHints returns a context whose queries are described by hints.
+func WithSelectHints(ctx context.Context, hints SelectHints) context.Context {
+	return context.WithValue(ctx, selectHintsKey{}, hints)
+}
+
+func selectHintsFromContext(ctx context.Context) (SelectHints, bool) {
+	hints, ok := ctx.Value(selectHintsKey{}).(SelectHints)
+	return hints, ok
+}
+
+// PlanResolution returns the coarsest resolution of rollups not coarser than
+// the step, which still leaves the range of a function at least a bucket, or
+// two buckets for the functions of counters. It returns 0 if the selector
+// should be served by raw samples.
+func PlanResolution(hints SelectHints) time.Duration {
+	if _, ok := rollupColumns[hints.Func]; !ok {
+		return 0
+	}
+	for _, r := range RollupResolutions {
+		ms := int64(r / time.Millisecond)
+		if ms > hints.StepMs {
+			continue
+		}
+		if hints.Func != "" {
+			buckets := int64(1)
+			if rollupColumns[hints.Func] == "last_v" {
+				buckets = 2
+			}
+			if hints.RangeMs < buckets*ms {
+				continue
+			}
+		}
+		return r
+	}
+	return 0
+}
+
+// EnableRollups serves the selectors with large steps from the rollups, which
+// are maintained by package rollup with the delay. The ranges of the samples
+// older than the delay are recorded once stored, as their buckets may have
+// been rolled up, see markLateSamples.
+func (d *DefaultMetricStorage) EnableRollups(delay time.Duration) {
+	d.rollups = true
+	d.rollupDelay = delay
+}
+
+// RollupsEnabled returns whether the selectors may be served from rollups.
+func (d *DefaultMetricStorage) RollupsEnabled() bool {
+	return d.rollups
+}
+
+// markLateSamples records the range of the samples older than the delay of
+// the rollups into flash_metrics_rollup_dirty, so that their buckets are
+// rolled up again. They're the samples of lagging writers and the ones
+// replayed by the WAL and the dead letter, the generation is bumped for them
+// too, see WatchLateSamples. It must be called after the samples are stored,
+// and the samples must be stored again if it fails.
+func (d *DefaultMetricStorage) markLateSamples(ctx context.Context, timeSeries []*model.TimeSeries) error {
+	d.watchSamples(timeSeries)
+	if !d.rollups {
+		return nil
+	}
+	lateMs := time.Now().Add(-d.rollupDelay).UnixNano() / int64(time.Millisecond)
+	startMs, endMs := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, ts := range timeSeries {
+		for _, s := range ts.Samples {
+			if s.TimestampMs >= lateMs {
+				continue
+			}
+			if s.TimestampMs < startMs {
+				startMs = s.TimestampMs
+			}
+			if s.TimestampMs > endMs {
+				endMs = s.TimestampMs
+			}
+		}
+	}
+	if startMs > endMs {
+		return nil
+	}
+	_, err := d.DB.ExecContext(ctx, "INSERT INTO "+d.tables.RollupDirty+" (start_ts, end_ts) VALUES (?, ?)",
+		formatMs(startMs), formatMs(endMs))
+	return err
+}
+
+// rollupPlan serves the samples in [start, lo) and [hi, end] from raw samples
+// and the buckets in [lo, hi) from the rollup table.
+type rollupPlan struct {
+	table  string
+	column string
+	lo     int64
+	hi     int64
+}
+
+// planRollup returns the plan of a query in [start, end] with the hints in
+// ctx, or nil if the query should only read raw samples.
+func (d *DefaultMetricStorage) planRollup(ctx context.Context, start, end int64) (*rollupPlan, error) {
+	if !d.rollups {
+		return nil, nil
+	}
+	hints, ok := selectHintsFromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	r := PlanResolution(hints)
+	if r == 0 {
+		return nil, nil
+	}
+
+	var startTs, watermark int64
+	err := d.ReadDB.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(start_ts), UNIX_TIMESTAMP(watermark) FROM "+
+		d.tables.RollupState+" WHERE resolution = ?", int64(r/time.Second)).Scan(&startTs, &watermark)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ms := int64(r / time.Millisecond)
+	plan := &rollupPlan{
+		table:  d.tables.Rollup5m,
+		column: rollupColumns[hints.Func],
+		lo:     (start + ms - 1) / ms * ms,
+		hi:     end / ms * ms,
+	}
+	if r == time.Hour {
+		plan.table = d.tables.Rollup1h
+	}
+	if startTs*1000 > plan.lo {
+		plan.lo = startTs * 1000
+	}
+	if watermark*1000 < plan.hi {
+		plan.hi = watermark * 1000
+	}
+	if plan.lo >= plan.hi {
+		return nil, nil
+	}
+	return plan, nil
+}
+
+// writeSamples writes the derived table of the samples of the plan in
+// [start, end], the samples served by a rollup bucket are at the last sample
+// in the bucket.
+func (p *rollupPlan) writeSamples(sb *strings.Builder, args *[]interface{}, data string, start, end int64) {
+	sb.WriteString("(\n  SELECT tsid, CAST(UNIX_TIMESTAMP(ts)*1000 AS UNSIGNED) AS t, v FROM ")
+	sb.WriteString(data)
+	sb.WriteString(" WHERE (? <= ts AND ts < ?) OR (? <= ts AND ts <= ?)\n  UNION ALL\n")
+	sb.WriteString("  SELECT tsid, CAST(UNIX_TIMESTAMP(last_ts)*1000 AS UNSIGNED) AS t, ")
+	sb.WriteString(p.column)
+	sb.WriteString(" AS v FROM ")
+	sb.WriteString(p.table)
+	sb.WriteString(" WHERE ? <= ts AND ts < ?\n) samples")
+	*args = append(*args,
+		formatMs(start), formatMs(p.lo), formatMs(p.hi), formatMs(end),
+		formatMs(p.lo), formatMs(p.hi))
+}
+
+func formatMs(ms int64) string {
+	return time.Unix(ms/1000, (ms%1000)*1_000_000).UTC().Format("2006-01-02 15:04:05.999 -0700")
+}
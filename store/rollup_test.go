@@ -0,0 +1,32 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanResolution(t *testing.T) {
+	minute := int64(time.Minute / time.Millisecond)
+	for _, c := range []struct {
+		hints    store.SelectHints
+		expected time.Duration
+	}{
+		{store.SelectHints{StepMs: 15 * 1000}, 0},
+		{store.SelectHints{StepMs: 5 * minute}, 5 * time.Minute},
+		{store.SelectHints{StepMs: 30 * minute}, 5 * time.Minute},
+		{store.SelectHints{StepMs: 2 * 60 * minute}, time.Hour},
+		// counters need two buckets in the range
+		{store.SelectHints{StepMs: 60 * minute, Func: "rate", RangeMs: 60 * minute}, 5 * time.Minute},
+		{store.SelectHints{StepMs: 60 * minute, Func: "rate", RangeMs: 120 * minute}, time.Hour},
+		{store.SelectHints{StepMs: 60 * minute, Func: "rate", RangeMs: 5 * minute}, 0},
+		{store.SelectHints{StepMs: 60 * minute, Func: "max_over_time", RangeMs: 60 * minute}, time.Hour},
+		// no rollup serves the functions of all samples
+		{store.SelectHints{StepMs: 60 * minute, Func: "quantile_over_time", RangeMs: 60 * minute}, 0},
+	} {
+		require.Equal(t, c.expected, store.PlanResolution(c.hints), "%+v", c.hints)
+	}
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryStats collects the statistics of a query across its SQL statements.
+// A nil QueryStats collects nothing.
+type QueryStats struct {
+	mu sync.Mutex
+
+	Timings       QueryTimings `json:"timings"`
+	RowsScanned   int64        `json:"rowsScanned"`
+	SeriesTouched int64        `json:"seriesTouched"`
+	// Statements are the SQL statements executed by the query, collected in
+	// explain mode only.
+	Statements []*SQLStatement `json:"statements,omitempty"`
+
+	explain bool
+}
+
+// QueryTimings are in seconds, ResultAssemblyTime is the rest of
+// ExecTotalTime, spent on evaluating and assembling results in process.
+type QueryTimings struct {
+	ParseTime          float64 `json:"parseTime"`
+	PlanTime           float64 `json:"planTime"`
+	SQLExecTime        float64 `json:"sqlExecTime"`
+	ResultAssemblyTime float64 `json:"resultAssemblyTime"`
+	ExecTotalTime      float64 `json:"execTotalTime"`
+}
+
+type SQLStatement struct {
+	SQL      string        `json:"sql"`
+	Args     []interface{} `json:"args"`
+	Rows     int64         `json:"rows"`
+	ExecTime float64       `json:"execTime"`
+	// Explain is the output of EXPLAIN ANALYZE, in tab separated rows with
+	// the column names first.
+	Explain string `json:"explain,omitempty"`
+}
+
+// NewQueryStats returns a QueryStats, which also collects the SQL statements
+// if explain.
+func NewQueryStats(explain bool) *QueryStats {
+	return &QueryStats{explain: explain}
+}
+
+type queryStatsKey struct{}
+
+// WithQueryStats returns a context whose queries are collected by stats.
+func WithQueryStats(ctx context.Context, stats *QueryStats) context.Context {
+	return context.WithValue(ctx, queryStatsKey{}, stats)
+}
+
+// QueryStatsFromContext returns the stats of the query, or nil if there is none.
+func QueryStatsFromContext(ctx context.Context) *QueryStats {
+	s, _ := ctx.Value(queryStatsKey{}).(*QueryStats)
+	return s
+}
+
+func (s *QueryStats) AddParseTime(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Timings.ParseTime += d.Seconds()
+}
+
+func (s *QueryStats) AddPlanTime(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Timings.PlanTime += d.Seconds()
+}
+
+// ObserveSQL records a statement which returned rows of series in d.
+func (s *QueryStats) ObserveSQL(query string, args []interface{}, rows, series int, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Timings.SQLExecTime += d.Seconds()
+	s.RowsScanned += int64(rows)
+	s.SeriesTouched += int64(series)
+	if s.explain {
+		s.Statements = append(s.Statements, &SQLStatement{
+			SQL:      query,
+			Args:     append([]interface{}(nil), args...),
+			Rows:     int64(rows),
+			ExecTime: d.Seconds(),
+		})
+	}
+}
+
+// Finish records the total time of the query.
+func (s *QueryStats) Finish(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Timings.ExecTotalTime = d.Seconds()
+	t := &s.Timings
+	t.ResultAssemblyTime = t.ExecTotalTime - t.ParseTime - t.PlanTime - t.SQLExecTime
+	if t.ResultAssemblyTime < 0 {
+		t.ResultAssemblyTime = 0
+	}
+}
+
+// ExplainAnalyze fills the EXPLAIN ANALYZE output of the collected statements.
+// The statements are explained without holding the lock, as explaining runs
+// them again.
+func (s *QueryStats) ExplainAnalyze(ctx context.Context, db *sql.DB) error {
+	if s == nil || !s.explain {
+		return nil
+	}
+	s.mu.Lock()
+	stmts := make([]SQLStatement, len(s.Statements))
+	for i, stmt := range s.Statements {
+		stmts[i] = SQLStatement{SQL: stmt.SQL, Args: stmt.Args}
+	}
+	s.mu.Unlock()
+
+	explains := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		explain, err := explainAnalyze(ctx, db, stmt.SQL, stmt.Args)
+		if err != nil {
+			return err
+		}
+		explains[i] = explain
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, explain := range explains {
+		s.Statements[i].Explain = explain
+	}
+	return nil
+}
+
+func explainAnalyze(ctx context.Context, db *sql.DB, query string, args []interface{}) (string, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN ANALYZE "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(strings.Join(columns, "\t"))
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		sb.WriteByte('\n')
+		for i, v := range values {
+			if i > 0 {
+				sb.WriteByte('\t')
+			}
+			sb.WriteString(v.String)
+		}
+	}
+	return sb.String(), rows.Err()
+}
@@ -0,0 +1,53 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryStats(t *testing.T) {
+	require.Nil(t, store.QueryStatsFromContext(context.Background()))
+	var noStats *store.QueryStats
+	noStats.AddParseTime(time.Second)
+	noStats.ObserveSQL("SELECT 1", nil, 1, 1, time.Second)
+	noStats.Finish(time.Second)
+	require.NoError(t, noStats.ExplainAnalyze(context.Background(), nil))
+
+	stats := store.NewQueryStats(false)
+	ctx := store.WithQueryStats(context.Background(), stats)
+	require.Same(t, stats, store.QueryStatsFromContext(ctx))
+
+	stats.AddParseTime(time.Second)
+	stats.AddPlanTime(2 * time.Second)
+	stats.ObserveSQL("SELECT ?", []interface{}{1}, 10, 2, 3*time.Second)
+	stats.ObserveSQL("SELECT ?", []interface{}{2}, 5, 1, time.Second)
+	stats.Finish(10 * time.Second)
+	require.Equal(t, store.QueryTimings{
+		ParseTime:          1,
+		PlanTime:           2,
+		SQLExecTime:        4,
+		ResultAssemblyTime: 3,
+		ExecTotalTime:      10,
+	}, stats.Timings)
+	require.Equal(t, int64(15), stats.RowsScanned)
+	require.Equal(t, int64(3), stats.SeriesTouched)
+	require.Empty(t, stats.Statements)
+	// nothing to explain
+	require.NoError(t, stats.ExplainAnalyze(context.Background(), nil))
+
+	stats = store.NewQueryStats(true)
+	args := []interface{}{1}
+	stats.ObserveSQL("SELECT ?", args, 10, 2, time.Second)
+	args[0] = 2
+	require.Equal(t, []*store.SQLStatement{{
+		SQL:      "SELECT ?",
+		Args:     []interface{}{1},
+		Rows:     10,
+		ExecTime: 1,
+	}}, stats.Statements)
+}
@@ -0,0 +1,184 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var errDeadLetterClosed = errors.New("dead letter is closed")
+
+// DeadLetter keeps the batches of time series failed to be stored in the files
+// of a directory, in the records of the WAL, so that they can be replayed
+// later. A file is created by the first batch after opening or replaying.
+type DeadLetter struct {
+	dir string
+
+	mu     sync.Mutex
+	active *os.File
+	// nextSeq is the sequence number of the next file to create.
+	nextSeq int
+	closed  bool
+}
+
+// OpenDeadLetter opens the dead letter in dir.
+func OpenDeadLetter(dir string) (*DeadLetter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &DeadLetter{dir: dir, nextSeq: 1}
+	if len(seqs) > 0 {
+		d.nextSeq = seqs[len(seqs)-1] + 1
+	}
+	return d, nil
+}
+
+// Put persists the batch of time series.
+func (d *DeadLetter) Put(timeSeries []*model.TimeSeries) error {
+	rec := encodeRecord(timeSeries)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errDeadLetterClosed
+	}
+	if d.active == nil {
+		f, err := os.OpenFile(d.path(d.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		d.active = f
+		d.nextSeq++
+	}
+	_, err := d.active.Write(rec)
+	if err == nil {
+		err = d.active.Sync()
+	}
+	if err != nil {
+		// the file may be left with a part of the record, whose reader skips
+		// the torn tail, so move on to a new one
+		d.closeActive()
+	}
+	return err
+}
+
+// Replay flushes the batches put before, and removes them. The batches failed
+// to flush are put back, and a batch may be flushed more than once if Replay
+// is interrupted. It returns the numbers of the flushed and the failed batches.
+func (d *DeadLetter) Replay(ctx context.Context, flush FlushFunc) (flushed, failed int, err error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return 0, 0, errDeadLetterClosed
+	}
+	// the batches put from now on, including the failed ones, are left to
+	// the next replay
+	d.closeActive()
+	limit := d.nextSeq
+	d.mu.Unlock()
+
+	seqs, err := listSegments(d.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, seq := range seqs {
+		if seq >= limit {
+			break
+		}
+		n, m, err := d.replayFile(ctx, seq, flush)
+		flushed, failed = flushed+n, failed+m
+		if err != nil {
+			return flushed, failed, err
+		}
+		if err = os.Remove(d.path(seq)); err != nil {
+			return flushed, failed, err
+		}
+	}
+	return flushed, failed, nil
+}
+
+func (d *DeadLetter) replayFile(ctx context.Context, seq int, flush FlushFunc) (flushed, failed int, err error) {
+	f, err := os.Open(d.path(seq))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		payload, err := readRecord(br)
+		if err == io.EOF {
+			return flushed, failed, nil
+		}
+		if err == errCorruptRecord {
+			log.Warn("skip the corrupt tail of dead letter", zap.Int("file", seq))
+			return flushed, failed, nil
+		}
+		if err != nil {
+			return flushed, failed, err
+		}
+		timeSeries, err := decodeRecord(payload)
+		if err != nil {
+			log.Warn("skip the corrupt record of dead letter", zap.Int("file", seq), zap.Error(err))
+			continue
+		}
+
+		if err = flush(ctx, timeSeries); err != nil {
+			if ctx.Err() != nil {
+				return flushed, failed, ctx.Err()
+			}
+			log.Warn("failed to replay the batch of dead letter", zap.Int("series", len(timeSeries)), zap.Error(err))
+			if err = d.Put(timeSeries); err != nil {
+				return flushed, failed, err
+			}
+			failed++
+			continue
+		}
+		flushed++
+	}
+}
+
+// Close closes the dead letter, the batches are kept for the next replay.
+func (d *DeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.active == nil {
+		return nil
+	}
+	err := d.active.Close()
+	d.active = nil
+	return err
+}
+
+// closeActive closes the file being put, d.mu must be held.
+func (d *DeadLetter) closeActive() {
+	if d.active == nil {
+		return
+	}
+	if err := d.active.Close(); err != nil {
+		log.Warn("failed to close dead letter", zap.Error(err))
+	}
+	d.active = nil
+}
+
+func (d *DeadLetter) path(seq int) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%08d", seq))
+}
@@ -0,0 +1,50 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := OpenDeadLetter(dir)
+	require.NoError(t, err)
+	require.NoError(t, d.Put(series("a")))
+	require.NoError(t, d.Put(series("b")))
+	require.NoError(t, d.Close())
+
+	// the failed batches are put back
+	d, err = OpenDeadLetter(dir)
+	require.NoError(t, err)
+	r := &recorder{err: errors.New("unavailable")}
+	flushed, failed, err := d.Replay(context.Background(), r.flush)
+	require.NoError(t, err)
+	require.Equal(t, 0, flushed)
+	require.Equal(t, 2, failed)
+	require.NoError(t, d.Put(series("c")))
+
+	r.err = nil
+	flushed, failed, err = d.Replay(context.Background(), r.flush)
+	require.NoError(t, err)
+	require.Equal(t, 3, flushed)
+	require.Equal(t, 0, failed)
+	require.Equal(t, []string{"a", "b", "c"}, r.names())
+
+	// nothing is left
+	flushed, _, err = d.Replay(context.Background(), r.flush)
+	require.NoError(t, err)
+	require.Equal(t, 0, flushed)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+	require.NoError(t, d.Close())
+	require.Error(t, d.Put(series("d")))
+}
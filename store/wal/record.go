@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+)
+
+const (
+	// recordHeaderSize is the size of the header of a record, which is the
+	// length and the CRC32 of the payload.
+	recordHeaderSize = 8
+	// maxRecordSize is the max size of the payload of a record, so that a
+	// corrupt length can't exhaust the memory.
+	maxRecordSize = 256 << 20
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// encodeRecord encodes the time series into a record:
+//
+//	record:  length uint32 | crc32 uint32 | payload
+//	payload: count uvarint | series...
+//	series:  name string | count uvarint | (name string | value string)... |
+//	         count uvarint | (timestamp varint | value float64)...
+//	string:  length uvarint | bytes
+func encodeRecord(timeSeries []*model.TimeSeries) []byte {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+64*len(timeSeries))
+	buf = appendUvarint(buf, uint64(len(timeSeries)))
+	for _, ts := range timeSeries {
+		buf = appendString(buf, ts.Name)
+		buf = appendUvarint(buf, uint64(len(ts.Labels)))
+		for _, l := range ts.Labels {
+			buf = appendString(buf, l.Name)
+			buf = appendString(buf, l.Value)
+		}
+		buf = appendUvarint(buf, uint64(len(ts.Samples)))
+		for _, s := range ts.Samples {
+			buf = appendVarint(buf, s.TimestampMs)
+			buf = appendUint64(buf, math.Float64bits(s.Value))
+		}
+	}
+
+	payload := buf[recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, castagnoli))
+	return buf
+}
+
+// readRecord reads the payload of the next record from r, it returns io.EOF
+// if there is no more record, or errCorruptRecord if the record is torn or
+// corrupt.
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errCorruptRecord
+	}
+	return payload, nil
+}
+
+// decodeRecord decodes the time series in the payload of a record.
+func decodeRecord(payload []byte) ([]*model.TimeSeries, error) {
+	d := decoder{buf: payload}
+	timeSeries := make([]*model.TimeSeries, d.uvarint())
+	for i := range timeSeries {
+		ts := &model.TimeSeries{Name: d.string()}
+		if n := d.uvarint(); n > 0 {
+			ts.Labels = make([]model.Label, n)
+			for j := range ts.Labels {
+				ts.Labels[j].Name = d.string()
+				ts.Labels[j].Value = d.string()
+			}
+		}
+		if n := d.uvarint(); n > 0 {
+			ts.Samples = make([]model.Sample, n)
+			for j := range ts.Samples {
+				ts.Samples[j].TimestampMs = d.varint()
+				ts.Samples[j].Value = math.Float64frombits(d.uint64())
+			}
+		}
+		timeSeries[i] = ts
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = errCorruptRecord
+	}
+	return timeSeries, d.err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decoder decodes the fields of a payload, the first error is kept in err and
+// the later fields are zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 || v > uint64(len(d.buf)-n) {
+		// a count or a length can't exceed the rest of the payload
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
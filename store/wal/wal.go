@@ -0,0 +1,672 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSegmentSize      = 64 << 20
+	defaultMaxSize          = 1 << 30
+	defaultFlushConcurrency = 8
+
+	checkpointFile = "checkpoint"
+	// the checkpoint is written once checkpointRecords records are flushed
+	// or checkpointInterval passes, whichever comes first.
+	checkpointRecords  = 128
+	checkpointInterval = time.Second
+
+	minFlushBackoff = 100 * time.Millisecond
+	maxFlushBackoff = 10 * time.Second
+)
+
+var (
+	// ErrFull is returned by Append if the records not yet flushed exceed the
+	// max size, the writes should be retried later.
+	ErrFull = errors.New("write-ahead log is full")
+	// ErrUnavailable is returned by Append if the record can't be persisted.
+	ErrUnavailable = errors.New("write-ahead log is unavailable")
+)
+
+// Options are the options of a WAL, zero values mean the defaults.
+type Options struct {
+	// SegmentSize is the max size of a segment file in bytes.
+	SegmentSize int64
+	// MaxSize is the max size of the records not yet flushed in bytes.
+	MaxSize int64
+	// FlushConcurrency is the max number of records flushed at once.
+	FlushConcurrency int
+	// DeadLetter takes the records failed by the errors not retryable by
+	// IsRetryable, which are retried like the others if nil.
+	DeadLetter  *DeadLetter
+	IsRetryable func(error) bool
+}
+
+// FlushFunc stores the time series of a record.
+type FlushFunc func(ctx context.Context, timeSeries []*model.TimeSeries) error
+
+// WAL is a write-ahead log in front of the ingestion. A batch of time series
+// is acknowledged once appended to the segment files in the directory and
+// synced, the appends waiting meanwhile are synced together. The records are
+// flushed in background by up to FlushConcurrency at once, and the checkpoint
+// advances in order up to the first record not yet flushed. The segments are
+// deleted once flushed, and the records after the checkpoint are flushed
+// again after restart, so a record may be flushed more than once, which
+// overwrites the samples stored before.
+type WAL struct {
+	dir   string
+	opts  Options
+	flush FlushFunc
+
+	mu sync.Mutex
+	// active is the segment being appended, whose records before activeSize
+	// are written and the ones before syncedSize are persisted.
+	active     *os.File
+	activeSeq  int
+	activeSize int64
+	syncedSize int64
+	// failed are the segments failed to be synced, whose appends waiting to
+	// be synced are rejected.
+	failed map[int]struct{}
+	// size is the total size of the records not yet flushed.
+	size   int64
+	closed bool
+	// syncMu serializes the syncs of the active segment.
+	syncMu sync.Mutex
+
+	// window is the records being flushed in order, and the checkpoint is
+	// the position after the last record flushed before them, which are only
+	// accessed by flushLoop.
+	window      []*pendingRecord
+	ckSeq       int
+	ckOffset    int64
+	ckRecords   int
+	ckWrittenAt time.Time
+
+	notify chan struct{}
+	// flushDone is signaled once a record is flushed.
+	flushDone chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// pendingRecord is a record being flushed, which ends at end of the segment
+// seq, or the end of the segment seq if sealed.
+type pendingRecord struct {
+	seq    int
+	end    int64
+	size   int64
+	sealed bool
+	// err is set before done is closed, the record isn't flushed if not nil.
+	err  error
+	done chan struct{}
+}
+
+// Open opens the WAL in dir and starts flushing the records left by the last
+// run, as well as the appended ones, by flush.
+func Open(dir string, opts Options, flush FlushFunc) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+	if opts.FlushConcurrency <= 0 {
+		opts.FlushConcurrency = defaultFlushConcurrency
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	seq, offset, err := readCheckpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WAL{
+		dir:       dir,
+		opts:      opts,
+		flush:     flush,
+		failed:    map[int]struct{}{},
+		notify:    make(chan struct{}, 1),
+		flushDone: make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	// the flushed segments may be left if the last run stopped before deleting them
+	var left []int
+	for _, s := range seqs {
+		if s < seq {
+			if err = os.Remove(w.segmentPath(s)); err != nil {
+				cancel()
+				return nil, err
+			}
+			continue
+		}
+		left = append(left, s)
+	}
+	if len(left) == 0 || left[0] != seq {
+		offset = 0
+	}
+	for _, s := range left {
+		info, err := os.Stat(w.segmentPath(s))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		w.size += info.Size()
+	}
+	w.size -= offset
+
+	// never append to the segments of the last run, whose tails may be torn
+	w.activeSeq = 1
+	if len(left) > 0 {
+		w.activeSeq = left[len(left)-1] + 1
+		if seq < left[0] {
+			seq, offset = left[0], 0
+		}
+	} else if seq > 0 {
+		w.activeSeq = seq
+	}
+	if seq == 0 {
+		seq = w.activeSeq
+	}
+	w.ckSeq, w.ckOffset, w.ckWrittenAt = seq, offset, time.Now()
+	if w.active, err = w.createSegment(w.activeSeq); err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(left) > 0 {
+		log.Info("replay write-ahead log", zap.Int("segments", len(left)), zap.Int64("size", w.size))
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.flushLoop(seq, offset)
+	}()
+	return w, nil
+}
+
+// Append persists the time series into the WAL, they're copied so that the
+// caller can reuse them once it returns.
+func (w *WAL) Append(timeSeries []*model.TimeSeries) error {
+	rec := encodeRecord(timeSeries)
+	if len(rec)-recordHeaderSize > maxRecordSize {
+		return fmt.Errorf("too large record of %d bytes", len(rec))
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: closed", ErrUnavailable)
+	}
+	// a record larger than the max size is accepted if there is nothing else
+	if w.size > 0 && w.size+int64(len(rec)) > w.opts.MaxSize {
+		w.mu.Unlock()
+		return ErrFull
+	}
+
+	_, failed := w.failed[w.activeSeq]
+	if failed || (w.activeSize > 0 && w.activeSize+int64(len(rec)) > w.opts.SegmentSize) {
+		if err := w.cut(); err != nil {
+			w.mu.Unlock()
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
+	if _, err := w.active.Write(rec); err != nil {
+		// the segment may be left with a part of the record, so move on to
+		// a new one, whose reader skips the torn tail
+		if cutErr := w.cut(); cutErr != nil {
+			log.Warn("failed to cut write-ahead log segment", zap.Error(cutErr))
+		}
+		w.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	w.activeSize += int64(len(rec))
+	w.size += int64(len(rec))
+	seq, end := w.activeSeq, w.activeSize
+	w.mu.Unlock()
+
+	return w.sync(seq, end)
+}
+
+// sync persists the active segment up to end if it's seq, the appends waiting
+// for the sync of another one are synced together by the next one.
+func (w *WAL) sync(seq int, end int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	if _, ok := w.failed[seq]; ok {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: failed to sync segment %d", ErrUnavailable, seq)
+	}
+	// the sealed segments are synced by cut
+	if seq < w.activeSeq || end <= w.syncedSize {
+		w.mu.Unlock()
+		return nil
+	}
+	f, target := w.active, w.activeSize
+	w.mu.Unlock()
+
+	err := f.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active != f {
+		// cut meanwhile, which synced the segment
+		if _, ok := w.failed[seq]; ok {
+			return fmt.Errorf("%w: failed to sync segment %d", ErrUnavailable, seq)
+		}
+		return nil
+	}
+	if err != nil {
+		// the appends not yet synced are rejected, and move on to a new
+		// segment, whose reader flushes the rest of the records anyway
+		w.failed[seq] = struct{}{}
+		if cutErr := w.cut(); cutErr != nil {
+			log.Warn("failed to cut write-ahead log segment", zap.Error(cutErr))
+		}
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	w.syncedSize = target
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops flushing, the records not yet flushed are flushed after the WAL
+// is opened again.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	w.cancel()
+	w.wg.Wait()
+	return w.active.Close()
+}
+
+// cut syncs and seals the active segment and starts a new one, w.mu must be
+// held.
+func (w *WAL) cut() error {
+	f, err := w.createSegment(w.activeSeq + 1)
+	if err != nil {
+		return err
+	}
+	if w.syncedSize < w.activeSize {
+		if err = w.active.Sync(); err != nil {
+			w.failed[w.activeSeq] = struct{}{}
+			log.Warn("failed to sync write-ahead log segment", zap.Int("segment", w.activeSeq), zap.Error(err))
+		}
+	}
+	if err = w.active.Close(); err != nil {
+		log.Warn("failed to close write-ahead log segment", zap.Error(err))
+	}
+	w.active = f
+	w.activeSeq++
+	w.activeSize = 0
+	w.syncedSize = 0
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *WAL) createSegment(seq int) (*os.File, error) {
+	return os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+func (w *WAL) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", seq))
+}
+
+// flushLoop flushes the records from offset of the segment seq in order.
+func (w *WAL) flushLoop(seq int, offset int64) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	defer func() {
+		// the records flushed so far are skipped after restart
+		w.retire(false)
+		w.checkpoint(true)
+	}()
+
+	for {
+		if !w.retire(false) {
+			return
+		}
+		w.mu.Lock()
+		activeSeq, syncedSize := w.activeSeq, w.syncedSize
+		w.mu.Unlock()
+
+		if seq > activeSeq || (seq == activeSeq && offset >= syncedSize) {
+			if len(w.window) == 0 {
+				w.checkpoint(true)
+			}
+			select {
+			case <-w.notify:
+			case <-w.flushDone:
+			case <-ticker.C:
+				w.checkpoint(false)
+			case <-w.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		// the records of the active segment are read up to the synced size
+		limit := int64(-1)
+		if seq == activeSeq {
+			limit = syncedSize
+		}
+		next, err := w.flushSegment(seq, offset, limit)
+		offset = next
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warn("failed to read write-ahead log segment", zap.Int("segment", seq), zap.Error(err))
+			w.waitBackoff(maxFlushBackoff)
+			continue
+		}
+		if seq == activeSeq {
+			continue
+		}
+
+		// the segment is sealed and all read, which is removed once the
+		// records are flushed
+		if !w.dispatch(&pendingRecord{seq: seq, sealed: true}, nil) {
+			return
+		}
+		seq, offset = seq+1, 0
+	}
+}
+
+// flushSegment flushes the records from offset to limit of the segment seq, or
+// to the end if limit is negative, and returns the offset after the records
+// being flushed. The rest of the segment is skipped if a record is corrupt.
+func (w *WAL) flushSegment(seq int, offset, limit int64) (int64, error) {
+	f, err := os.Open(w.segmentPath(seq))
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit-offset)
+	}
+	br := bufio.NewReader(r)
+	for limit < 0 || offset < limit {
+		payload, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err == errCorruptRecord {
+			end := limit
+			if end < 0 {
+				info, statErr := f.Stat()
+				if statErr != nil {
+					return offset, statErr
+				}
+				end = info.Size()
+			}
+			log.Warn("skip the corrupt tail of write-ahead log segment",
+				zap.Int("segment", seq), zap.Int64("offset", offset), zap.Int64("size", end-offset))
+			if !w.dispatch(&pendingRecord{seq: seq, end: end, size: end - offset}, nil) {
+				return offset, w.ctx.Err()
+			}
+			return end, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		n := int64(recordHeaderSize + len(payload))
+		if !w.dispatch(&pendingRecord{seq: seq, end: offset + n, size: n}, payload) {
+			return offset, w.ctx.Err()
+		}
+		offset += n
+	}
+	return offset, nil
+}
+
+// dispatch flushes the payload of the record in background, or takes the
+// record as flushed if the payload is nil. It waits for the records before
+// if there are FlushConcurrency records being flushed, and returns false if
+// the WAL is closed meanwhile.
+func (w *WAL) dispatch(p *pendingRecord, payload []byte) bool {
+	for len(w.window) >= w.opts.FlushConcurrency {
+		if !w.retire(true) {
+			return false
+		}
+	}
+	p.done = make(chan struct{})
+	w.window = append(w.window, p)
+	if payload == nil {
+		close(p.done)
+		return true
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		p.err = w.flushRecord(payload)
+		close(p.done)
+		select {
+		case w.flushDone <- struct{}{}:
+		default:
+		}
+	}()
+	return true
+}
+
+// retire moves the checkpoint past the records flushed in order, and removes
+// the segments sealed before it. It waits for the first record if block. It
+// returns false if the WAL is closed.
+func (w *WAL) retire(block bool) bool {
+	for len(w.window) > 0 {
+		p := w.window[0]
+		if block {
+			select {
+			case <-p.done:
+			case <-w.ctx.Done():
+				return false
+			}
+			block = false
+		} else {
+			select {
+			case <-p.done:
+			default:
+				return true
+			}
+		}
+		if p.err != nil {
+			return false
+		}
+		w.window = w.window[1:]
+		w.flushed(p.size)
+		w.ckRecords++
+
+		if !p.sealed {
+			w.ckSeq, w.ckOffset = p.seq, p.end
+			w.checkpoint(false)
+			continue
+		}
+		if err := os.Remove(w.segmentPath(p.seq)); err != nil && !os.IsNotExist(err) {
+			log.Warn("failed to remove write-ahead log segment", zap.Int("segment", p.seq), zap.Error(err))
+		}
+		w.mu.Lock()
+		delete(w.failed, p.seq)
+		w.mu.Unlock()
+		w.ckSeq, w.ckOffset = p.seq+1, 0
+		w.checkpoint(true)
+	}
+	return w.ctx.Err() == nil
+}
+
+// checkpoint writes the checkpoint if any record is flushed since the last
+// one, once checkpointRecords records are flushed or checkpointInterval
+// passes unless force.
+func (w *WAL) checkpoint(force bool) {
+	if w.ckRecords == 0 {
+		return
+	}
+	if !force && w.ckRecords < checkpointRecords && time.Since(w.ckWrittenAt) < checkpointInterval {
+		return
+	}
+	w.writeCheckpoint(w.ckSeq, w.ckOffset)
+	w.ckRecords = 0
+	w.ckWrittenAt = time.Now()
+}
+
+// flushRecord flushes a record with retries, it only fails if the WAL is closed.
+// The record is never given up, as it's acknowledged to the writers, so the
+// checkpoint stays before it and the WAL fills up and pushes back on them by
+// ErrFull until it's stored, unless it fails by a fatal error and is put into
+// the dead letter instead.
+func (w *WAL) flushRecord(payload []byte) error {
+	timeSeries, err := decodeRecord(payload)
+	if err != nil {
+		log.Warn("skip the corrupt record of write-ahead log", zap.Error(err))
+		return nil
+	}
+
+	backoff := minFlushBackoff
+	for attempt := 1; ; attempt++ {
+		err = w.flush(w.ctx, timeSeries)
+		if err == nil || w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		if w.opts.DeadLetter != nil && w.opts.IsRetryable != nil && !w.opts.IsRetryable(err) {
+			putErr := w.opts.DeadLetter.Put(timeSeries)
+			if putErr == nil {
+				log.Error("put the record of write-ahead log into dead letter",
+					zap.Int("series", len(timeSeries)), zap.Error(err))
+				return nil
+			}
+			log.Warn("failed to put the record of write-ahead log into dead letter", zap.Error(putErr))
+		}
+		log.Warn("failed to flush the record of write-ahead log", zap.Int("attempt", attempt), zap.Error(err))
+		w.waitBackoff(backoff)
+		if backoff *= 2; backoff > maxFlushBackoff {
+			backoff = maxFlushBackoff
+		}
+	}
+}
+
+func (w *WAL) waitBackoff(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-w.ctx.Done():
+	}
+}
+
+// flushed releases the size of the flushed records.
+func (w *WAL) flushed(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size -= n
+}
+
+// Size returns the size of the records not yet flushed.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// writeCheckpoint records the position of the next record to flush, the
+// records before are skipped after restart.
+func (w *WAL) writeCheckpoint(seq int, offset int64) {
+	f, err := ioutil.TempFile(w.dir, "tmp-")
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d %d\n", seq, offset)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(w.dir, checkpointFile))
+		}
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		// the records are flushed again after restart
+		log.Warn("failed to write write-ahead log checkpoint", zap.Error(err))
+	}
+}
+
+// readCheckpoint returns the position of the next record to flush, zero if
+// there is no checkpoint.
+func readCheckpoint(dir string) (int, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var seq int
+	var offset int64
+	if _, err = fmt.Sscanf(string(b), "%d %d", &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid write-ahead log checkpoint %q: %w", strings.TrimSpace(string(b)), err)
+	}
+	return seq, offset, nil
+}
+
+// listSegments returns the sequence numbers of the segments in dir in order.
+func listSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, f := range files {
+		seq, err := strconv.Atoi(f.Name())
+		if err != nil || f.IsDir() {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
@@ -0,0 +1,255 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/showhand-lab/flash-metrics/store/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder records the flushed time series, and fails the flushes while err
+// is set, or the flushes of the series named stuck.
+type recorder struct {
+	sync.Mutex
+	flushed []string
+	err     error
+	stuck   string
+}
+
+func (r *recorder) flush(_ context.Context, timeSeries []*model.TimeSeries) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	for _, ts := range timeSeries {
+		if ts.Name == r.stuck {
+			return errors.New("stuck")
+		}
+	}
+	for _, ts := range timeSeries {
+		r.flushed = append(r.flushed, ts.Name)
+	}
+	return nil
+}
+
+func (r *recorder) setErr(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.err = err
+}
+
+func (r *recorder) names() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.flushed...)
+}
+
+func series(name string) []*model.TimeSeries {
+	return []*model.TimeSeries{{
+		Name:    name,
+		Labels:  []model.Label{{Name: "instance", Value: "a"}},
+		Samples: []model.Sample{{TimestampMs: 1, Value: 1.5}, {TimestampMs: -2, Value: -3}},
+	}}
+}
+
+func TestRecord(t *testing.T) {
+	timeSeries := []*model.TimeSeries{series("up")[0], {Name: "empty"}}
+	rec := encodeRecord(timeSeries)
+	payload, err := readRecord(bytes.NewReader(rec))
+	require.NoError(t, err)
+	decoded, err := decodeRecord(payload)
+	require.NoError(t, err)
+	require.Equal(t, timeSeries, decoded)
+
+	// torn and corrupt records
+	_, err = readRecord(bytes.NewReader(rec[:len(rec)-1]))
+	require.Equal(t, errCorruptRecord, err)
+	rec[len(rec)-1]++
+	_, err = readRecord(bytes.NewReader(rec))
+	require.Equal(t, errCorruptRecord, err)
+	_, err = decodeRecord(payload[:len(payload)-3])
+	require.Equal(t, errCorruptRecord, err)
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &recorder{err: errors.New("unavailable")}
+	w, err := Open(dir, Options{SegmentSize: 100, MaxSize: 200}, r.flush)
+	require.NoError(t, err)
+
+	// appended while the flushes fail
+	n := 0
+	for ; n < 10; n++ {
+		err = w.Append(series(string(rune('a' + n))))
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, errors.Is(err, ErrFull))
+	require.True(t, n > 1)
+	require.NoError(t, w.Close())
+	require.True(t, errors.Is(w.Append(series("x")), ErrUnavailable))
+
+	// replayed after restart
+	var expected []string
+	for i := 0; i < n; i++ {
+		expected = append(expected, string(rune('a'+i)))
+	}
+	r.err = nil
+	w, err = Open(dir, Options{SegmentSize: 100, MaxSize: 200}, r.flush)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Append(series("z")))
+	expected = append(expected, "z")
+	require.Eventually(t, func() bool { return len(r.names()) == len(expected) }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, expected, r.names())
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Close())
+
+	// nothing is flushed again, and the flushed segments are removed except
+	// the new one
+	w, err = Open(dir, Options{}, r.flush)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), w.Size())
+	require.Eventually(t, func() bool {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		return len(files) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Close())
+	require.ElementsMatch(t, expected, r.names())
+}
+
+func TestFlushRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the record is kept until stored, however long the flushes fail
+	r := &recorder{err: errors.New("unavailable")}
+	w, err := Open(dir, Options{}, r.flush)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(series("a")))
+	time.Sleep(time.Second)
+	require.NotZero(t, w.Size())
+	require.Empty(t, r.names())
+
+	r.setErr(nil)
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a"}, r.names())
+	require.NoError(t, w.Close())
+}
+
+func TestFlushConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the records after a stuck one are flushed, but the checkpoint stays
+	// before it
+	r := &recorder{stuck: "a"}
+	w, err := Open(dir, Options{SegmentSize: 100}, r.flush)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, w.Append(series(name)))
+	}
+	require.Eventually(t, func() bool { return len(r.names()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{"b", "c", "d"}, r.names())
+	require.NotZero(t, w.Size())
+	require.NoError(t, w.Close())
+
+	r.Lock()
+	r.stuck, r.flushed = "", nil
+	r.Unlock()
+	w, err = Open(dir, Options{SegmentSize: 100}, r.flush)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{"a", "b", "c", "d"}, r.names())
+	require.NoError(t, w.Close())
+
+	// the concurrent appends are all persisted
+	r.Lock()
+	r.flushed = nil
+	r.Unlock()
+	w, err = Open(dir, Options{}, r.flush)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	var expected []string
+	for i := 0; i < 50; i++ {
+		name := string(rune('A' + i))
+		expected = append(expected, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, w.Append(series(name)))
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, expected, r.names())
+	require.NoError(t, w.Close())
+}
+
+func TestTornSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rec := encodeRecord(series("a"))
+	torn := encodeRecord(series("b"))
+	rec = append(rec, torn[:len(torn)-1]...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000003"), rec, 0644))
+
+	r := &recorder{}
+	w, err := Open(dir, Options{}, r.flush)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(series("c")))
+	require.Eventually(t, func() bool { return len(r.names()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{"a", "c"}, r.names())
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Close())
+}
+
+func TestFlushDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dl, err := OpenDeadLetter(filepath.Join(dir, "dead-letter"))
+	require.NoError(t, err)
+	fatal := errors.New("too many labels")
+	r := &recorder{err: fatal}
+	w, err := Open(dir, Options{
+		DeadLetter:  dl,
+		IsRetryable: func(err error) bool { return err != fatal },
+	}, r.flush)
+	require.NoError(t, err)
+
+	// the record failed by a fatal error doesn't block the others
+	require.NoError(t, w.Append(series("a")))
+	require.Eventually(t, func() bool { return w.Size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	r.setErr(nil)
+	require.NoError(t, w.Append(series("b")))
+	require.Eventually(t, func() bool { return len(r.names()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Close())
+
+	flushed, failed, err := dl.Replay(context.Background(), r.flush)
+	require.NoError(t, err)
+	require.Equal(t, 1, flushed)
+	require.Equal(t, 0, failed)
+	require.Equal(t, []string{"b", "a"}, r.names())
+	require.NoError(t, dl.Close())
+}
@@ -4,4 +4,32 @@ const (
 	AlterTiflashData   = "ALTER TABLE flash_metrics_data SET TIFLASH REPLICA 1;"
 	AlterTiflashIndex  = "ALTER TABLE flash_metrics_index SET TIFLASH REPLICA 1;"
 	AlterTiflashUpdate = "ALTER TABLE flash_metrics_update SET TIFLASH REPLICA 1;"
+
+	// MaxPartition is the last partition of flash_metrics_data, which the daily
+	// partitions are split from in advance.
+	MaxPartition = "p_max"
+	// PartitionDataByTime partitions flash_metrics_data by the range of ts so
+	// that expired samples are dropped by partitions. The writes are scattered
+	// by SHARD_ROW_ID_BITS instead of the hash of tsid.
+	PartitionDataByTime = "ALTER TABLE flash_metrics_data PARTITION BY RANGE (UNIX_TIMESTAMP(ts)) (PARTITION " + MaxPartition + " VALUES LESS THAN (MAXVALUE));"
+	ShardData           = "ALTER TABLE flash_metrics_data SHARD_ROW_ID_BITS = 4;"
+	// AddIndexCreatedAt records when series are created, so that new series
+	// aren't taken as expired before their updated dates are inserted.
+	AddIndexCreatedAt = "ALTER TABLE flash_metrics_index ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;"
+	// DedupeData removes the samples stored more than once before they're
+	// keyed by AddDataUniqueKey, the last stored one of them is kept.
+	DedupeData = `
+DELETE d FROM flash_metrics_data d
+INNER JOIN (
+  SELECT tsid, ts, MAX(_tidb_rowid) AS last_rowid
+  FROM flash_metrics_data
+  GROUP BY tsid, ts
+  HAVING COUNT(*) > 1
+) dup ON (d.tsid = dup.tsid AND d.ts = dup.ts)
+WHERE d._tidb_rowid < dup.last_rowid;
+`
+	// AddDataUniqueKey keys the samples by series and time, so that storing a
+	// sample again overwrites it instead of duplicating it. It includes ts as
+	// required by the partitions.
+	AddDataUniqueKey = "ALTER TABLE flash_metrics_data ADD UNIQUE INDEX IF NOT EXISTS uk_tsid_ts (tsid, ts);"
 )
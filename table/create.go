@@ -33,6 +33,101 @@ CREATE TABLE IF NOT EXISTS flash_metrics_index (
       label7, label8, label9, label10, label11,
       label12, label13, label14)
 );
+`
+
+	// MaxOverflowLabelCount is the max number of labels of a metric if the
+	// labels beyond the label columns overflow to label_overflow, as label_id
+	// in flash_metrics_meta is a TINYINT.
+	MaxOverflowLabelCount = 128
+	// CreateIndexOverflow is the alternative of CreateIndex allowing up to
+	// MaxOverflowLabelCount labels. The labels beyond the label columns are in
+	// the JSON object label_overflow, overflow_key is the hash of it and empty
+	// if there is none.
+	CreateIndexOverflow = `
+CREATE TABLE IF NOT EXISTS flash_metrics_index (
+    metric_name VARCHAR(128) NOT NULL,
+    label0 VARCHAR(128),
+    label1 VARCHAR(128),
+    label2 VARCHAR(128),
+    label3 VARCHAR(128),
+    label4 VARCHAR(128),
+    label5 VARCHAR(128),
+    label6 VARCHAR(128),
+    label7 VARCHAR(128),
+    label8 VARCHAR(128),
+    label9 VARCHAR(128),
+    label10 VARCHAR(128),
+    label11 VARCHAR(128),
+    label12 VARCHAR(128),
+    label13 VARCHAR(128),
+    label14 VARCHAR(128),
+    label_overflow JSON,
+    overflow_key VARCHAR(40) NOT NULL DEFAULT '',
+    PRIMARY KEY (metric_name, label0, label1,
+      label2, label3, label4, label5, label6,
+      label7, label8, label9, label10, label11,
+      label12, label13, label14, overflow_key)
+);
+`
+
+	// CreateRollup5m and CreateRollup1h are the aggregates of the samples of
+	// every series in the buckets of 5m and 1h starting at ts. last_ts and
+	// last_v are the last sample in the bucket.
+	CreateRollup5m = `
+CREATE TABLE IF NOT EXISTS flash_metrics_data_5m (
+    tsid BIGINT NOT NULL,
+    ts TIMESTAMP NOT NULL,
+    min_v DOUBLE NOT NULL,
+    max_v DOUBLE NOT NULL,
+    sum_v DOUBLE NOT NULL,
+    count_v BIGINT NOT NULL,
+    last_ts TIMESTAMP(3) NOT NULL,
+    last_v DOUBLE NOT NULL,
+    PRIMARY KEY (tsid, ts) NONCLUSTERED
+) SHARD_ROW_ID_BITS = 4 PARTITION BY RANGE (UNIX_TIMESTAMP(ts)) (PARTITION p_max VALUES LESS THAN (MAXVALUE));
+`
+	CreateRollup1h = `
+CREATE TABLE IF NOT EXISTS flash_metrics_data_1h (
+    tsid BIGINT NOT NULL,
+    ts TIMESTAMP NOT NULL,
+    min_v DOUBLE NOT NULL,
+    max_v DOUBLE NOT NULL,
+    sum_v DOUBLE NOT NULL,
+    count_v BIGINT NOT NULL,
+    last_ts TIMESTAMP(3) NOT NULL,
+    last_v DOUBLE NOT NULL,
+    PRIMARY KEY (tsid, ts) NONCLUSTERED
+) SHARD_ROW_ID_BITS = 4 PARTITION BY RANGE (UNIX_TIMESTAMP(ts)) (PARTITION p_max VALUES LESS THAN (MAXVALUE));
+`
+
+	// CreateRollupState records the rollups of every resolution in seconds,
+	// which cover the buckets in [start_ts, watermark).
+	CreateRollupState = `
+CREATE TABLE IF NOT EXISTS flash_metrics_rollup (
+    resolution INT NOT NULL PRIMARY KEY,
+    start_ts TIMESTAMP NOT NULL,
+    watermark TIMESTAMP NOT NULL
+);
+`
+
+	// CreateRollupDirty records the ranges of the samples stored after their
+	// buckets may have been rolled up, which are rolled up again.
+	CreateRollupDirty = `
+CREATE TABLE IF NOT EXISTS flash_metrics_rollup_dirty (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    start_ts TIMESTAMP(3) NOT NULL,
+    end_ts TIMESTAMP(3) NOT NULL
+);
+`
+
+	// CreateGeneration has the generations of the samples by the UTC days,
+	// which are bumped once the samples of the days change, so that the
+	// results cached with older generations are stale.
+	CreateGeneration = `
+CREATE TABLE IF NOT EXISTS flash_metrics_generation (
+    day DATE NOT NULL PRIMARY KEY,
+    generation BIGINT NOT NULL
+);
 `
 
 	CreateUpdate = `
@@ -50,5 +145,17 @@ CREATE TABLE IF NOT EXISTS flash_metrics_meta (
     label_id TINYINT NOT NULL,
     PRIMARY KEY (metric_name, label_name)
 );
+`
+
+	CreateMetadata = `
+CREATE TABLE IF NOT EXISTS flash_metrics_metadata (
+    metric_name VARCHAR(255) NOT NULL,
+    job VARCHAR(255) NOT NULL,
+    instance VARCHAR(255) NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    help TEXT NOT NULL,
+    unit VARCHAR(64) NOT NULL,
+    PRIMARY KEY (metric_name, job, instance)
+);
 `
 )
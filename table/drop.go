@@ -1,8 +1,16 @@
 package table
 
 const (
-	DropData   = "DROP TABLE IF EXISTS flash_metrics_data;"
-	DropIndex  = "DROP TABLE IF EXISTS flash_metrics_index;"
-	DropUpdate = "DROP TABLE IF EXISTS flash_metrics_update;"
-	DropMeta   = "DROP TABLE IF EXISTS flash_metrics_meta;"
+	DropData     = "DROP TABLE IF EXISTS flash_metrics_data;"
+	DropIndex    = "DROP TABLE IF EXISTS flash_metrics_index;"
+	DropUpdate   = "DROP TABLE IF EXISTS flash_metrics_update;"
+	DropMeta     = "DROP TABLE IF EXISTS flash_metrics_meta;"
+	DropMetadata = "DROP TABLE IF EXISTS flash_metrics_metadata;"
+
+	DropRollup5m      = "DROP TABLE IF EXISTS flash_metrics_data_5m;"
+	DropRollup1h      = "DROP TABLE IF EXISTS flash_metrics_data_1h;"
+	DropRollupState   = "DROP TABLE IF EXISTS flash_metrics_rollup;"
+	DropRollupDirty   = "DROP TABLE IF EXISTS flash_metrics_rollup_dirty;"
+	DropGeneration    = "DROP TABLE IF EXISTS flash_metrics_generation;"
+	DropSchemaVersion = "DROP TABLE IF EXISTS flash_metrics_schema_version;"
 )
@@ -0,0 +1,189 @@
+package table
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// CreateSchemaVersion records the applied migrations, the schema version is
+	// the max version in it.
+	CreateSchemaVersion = `
+CREATE TABLE IF NOT EXISTS flash_metrics_schema_version (
+    version INT NOT NULL PRIMARY KEY,
+    description VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+	insertSchemaVersion = "INSERT IGNORE INTO flash_metrics_schema_version (version, description) VALUES (?, ?);"
+)
+
+// Migration is an up-migration of the schema. Its statements are executed in
+// order and must be safe to run again, as DDL statements aren't transactional
+// and a migration may be interrupted before its version is recorded.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// SchemaOptions are the options of the schema which are chosen once when the
+// tables are created.
+type SchemaOptions struct {
+	// TablePrefix is the prefix of the table names, see NewTables.
+	TablePrefix string
+	// OverflowLabels creates flash_metrics_index by CreateIndexOverflow.
+	OverflowLabels bool
+}
+
+// Migrations returns all the migrations in the order of versions. New
+// migrations must be appended with the next version, the existing ones must
+// never change as they may have been applied.
+func Migrations(opts SchemaOptions) []Migration {
+	createIndex := CreateIndex
+	if opts.OverflowLabels {
+		createIndex = CreateIndexOverflow
+	}
+
+	migrations := []Migration{{
+		// the tables created before the migrations, which are adopted as is
+		Version:     1,
+		Description: "create tables",
+		Statements:  []string{CreateMeta, createIndex, CreateUpdate, CreateData, CreateMetadata},
+	}, {
+		Version:     2,
+		Description: "partition samples by time",
+		Statements:  []string{PartitionDataByTime, ShardData},
+	}, {
+		Version:     3,
+		Description: "record the creation time of series",
+		Statements:  []string{AddIndexCreatedAt},
+	}, {
+		Version:     4,
+		Description: "create rollup tables",
+		Statements:  []string{CreateRollup5m, CreateRollup1h, CreateRollupState},
+	}, {
+		// the samples stored more than once by the retries are removed first
+		Version:     5,
+		Description: "key samples by series and time",
+		Statements:  []string{DedupeData, AddDataUniqueKey},
+	}, {
+		Version:     6,
+		Description: "record the ranges of late samples",
+		Statements:  []string{CreateRollupDirty},
+	}, {
+		Version:     7,
+		Description: "record the generations of samples by day",
+		Statements:  []string{CreateGeneration},
+	}}
+
+	tables := NewTables(opts.TablePrefix)
+	for i := range migrations {
+		for j, stmt := range migrations[i].Statements {
+			migrations[i].Statements[j] = tables.Rename(stmt)
+		}
+	}
+	return migrations
+}
+
+// LatestVersion returns the version the migrations migrate to.
+func LatestVersion(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the schema of tables in the database,
+// zero if no migration has been applied.
+func SchemaVersion(ctx context.Context, db *sql.DB, tables Tables) (int, error) {
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.tables
+WHERE table_schema = DATABASE() AND table_name = ?`, tables.SchemaVersion).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM "+tables.SchemaVersion).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate applies the migrations newer than the schema of tables in the
+// database, which are returned by Migrations with the same prefix. It
+// refuses to run against a schema newer than the migrations, which is
+// migrated by a newer version of flash-metrics. If dryRun is set, the SQL is
+// written to w instead of being executed.
+func Migrate(ctx context.Context, db *sql.DB, tables Tables, migrations []Migration, dryRun bool, w io.Writer) error {
+	current, err := SchemaVersion(ctx, db, tables)
+	if err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+	latest := LatestVersion(migrations)
+	if current > latest {
+		return fmt.Errorf("schema version %d is newer than the latest known version %d", current, latest)
+	}
+	if current == latest {
+		log.Info("schema is up to date", zap.Int("version", current))
+		return nil
+	}
+
+	exec := func(query string, args ...interface{}) error {
+		if dryRun {
+			_, err := fmt.Fprintln(w, strings.TrimSpace(formatSQL(query, args...)))
+			return err
+		}
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+
+	if err = exec(tables.Rename(CreateSchemaVersion)); err != nil {
+		return fmt.Errorf("failed to create schema version table: %w", err)
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if dryRun {
+			if _, err = fmt.Fprintf(w, "-- version %d: %s\n", m.Version, m.Description); err != nil {
+				return err
+			}
+		} else {
+			log.Info("applying migration", zap.Int("version", m.Version), zap.String("description", m.Description))
+		}
+		for _, stmt := range m.Statements {
+			if err = exec(stmt); err != nil {
+				return fmt.Errorf("failed to apply migration %d: %w", m.Version, err)
+			}
+		}
+		if err = exec(tables.Rename(insertSchemaVersion), m.Version, m.Description); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// formatSQL inlines the args of the placeholders for printing.
+func formatSQL(query string, args ...interface{}) string {
+	for _, arg := range args {
+		var v string
+		switch arg := arg.(type) {
+		case string:
+			v = "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+		default:
+			v = fmt.Sprint(arg)
+		}
+		query = strings.Replace(query, "?", v, 1)
+	}
+	return query
+}
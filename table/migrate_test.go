@@ -0,0 +1,78 @@
+package table_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/table"
+	"github.com/showhand-lab/flash-metrics/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, opts := range []table.SchemaOptions{{}, {OverflowLabels: true}} {
+		migrations := table.Migrations(opts)
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			require.Equal(t, i+1, m.Version)
+			require.NotEmpty(t, m.Description)
+			require.NotEmpty(t, m.Statements)
+		}
+		require.Equal(t, len(migrations), table.LatestVersion(migrations))
+	}
+	require.Equal(t, 0, table.LatestVersion(nil))
+}
+
+func TestMigrate(t *testing.T) {
+	if err := utils.PingTiDB(); err != nil {
+		t.Skip("failed to ping database", err)
+	}
+	db, err := utils.SetupDB("test_migrate")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, utils.TearDownDB("test_migrate", db))
+	}()
+
+	ctx := context.Background()
+	migrations := table.Migrations(table.SchemaOptions{})
+	version, err := table.SchemaVersion(ctx, db, table.DefaultTables)
+	require.NoError(t, err)
+	require.Equal(t, table.LatestVersion(migrations), version)
+
+	// nothing to print if up to date
+	var buf bytes.Buffer
+	require.NoError(t, table.Migrate(ctx, db, table.DefaultTables, migrations, true, &buf))
+	require.Empty(t, buf.String())
+
+	// a new migration is printed only in dry-run
+	next := append(migrations, table.Migration{
+		Version:     table.LatestVersion(migrations) + 1,
+		Description: "add o'clock",
+		Statements:  []string{"ALTER TABLE flash_metrics_metadata ADD COLUMN IF NOT EXISTS oclock INT;"},
+	})
+	require.NoError(t, table.Migrate(ctx, db, table.DefaultTables, next, true, &buf))
+	require.True(t, strings.Contains(buf.String(), "ADD COLUMN IF NOT EXISTS oclock"), buf.String())
+	require.True(t, strings.Contains(buf.String(), "'add o''clock'"), buf.String())
+	version, err = table.SchemaVersion(ctx, db, table.DefaultTables)
+	require.NoError(t, err)
+	require.Equal(t, table.LatestVersion(migrations), version)
+
+	require.NoError(t, table.Migrate(ctx, db, table.DefaultTables, next, false, nil))
+	version, err = table.SchemaVersion(ctx, db, table.DefaultTables)
+	require.NoError(t, err)
+	require.Equal(t, table.LatestVersion(next), version)
+	_, err = db.Exec("SELECT oclock FROM flash_metrics_metadata")
+	require.NoError(t, err)
+
+	// keying the samples can be applied again if interrupted before recorded
+	for _, stmt := range migrations[4].Statements {
+		_, err = db.Exec(stmt)
+		require.NoError(t, err, stmt)
+	}
+
+	// refuse to run against a newer schema
+	require.Error(t, table.Migrate(ctx, db, table.DefaultTables, migrations, false, nil))
+}
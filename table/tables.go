@@ -0,0 +1,75 @@
+package table
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultPrefix is the common prefix of the default table names.
+const defaultPrefix = "flash_metrics_"
+
+var prefixRegexp = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// Tables are the names of the tables, which start with a configurable prefix
+// so that several deployments can share a database.
+type Tables struct {
+	Index         string
+	Update        string
+	Data          string
+	Meta          string
+	Metadata      string
+	Rollup5m      string
+	Rollup1h      string
+	RollupState   string
+	RollupDirty   string
+	Generation    string
+	SchemaVersion string
+}
+
+// DefaultTables are the tables without a prefix.
+var DefaultTables = NewTables("")
+
+// NewTables returns the names of the tables starting with prefix, which must
+// be checked by CheckPrefix.
+func NewTables(prefix string) Tables {
+	return Tables{
+		Index:         prefix + defaultPrefix + "index",
+		Update:        prefix + defaultPrefix + "update",
+		Data:          prefix + defaultPrefix + "data",
+		Meta:          prefix + defaultPrefix + "meta",
+		Metadata:      prefix + defaultPrefix + "metadata",
+		Rollup5m:      prefix + defaultPrefix + "data_5m",
+		Rollup1h:      prefix + defaultPrefix + "data_1h",
+		RollupState:   prefix + defaultPrefix + "rollup",
+		RollupDirty:   prefix + defaultPrefix + "rollup_dirty",
+		Generation:    prefix + defaultPrefix + "generation",
+		SchemaVersion: prefix + defaultPrefix + "schema_version",
+	}
+}
+
+// CheckPrefix returns an error if prefix can't be put in unquoted table names.
+func CheckPrefix(prefix string) error {
+	if !prefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid table prefix %q, only letters, digits and underscores are allowed", prefix)
+	}
+	return nil
+}
+
+// Rename renames the tables in stmt, which is one of the statements of this
+// package written with the default names.
+func (t Tables) Rename(stmt string) string {
+	return strings.NewReplacer(
+		DefaultTables.Index, t.Index,
+		DefaultTables.Update, t.Update,
+		DefaultTables.Rollup5m, t.Rollup5m,
+		DefaultTables.Rollup1h, t.Rollup1h,
+		DefaultTables.RollupDirty, t.RollupDirty,
+		DefaultTables.RollupState, t.RollupState,
+		DefaultTables.Generation, t.Generation,
+		DefaultTables.Data, t.Data,
+		DefaultTables.Metadata, t.Metadata,
+		DefaultTables.Meta, t.Meta,
+		DefaultTables.SchemaVersion, t.SchemaVersion,
+	).Replace(stmt)
+}
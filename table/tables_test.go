@@ -0,0 +1,34 @@
+package table_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/showhand-lab/flash-metrics/table"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTables(t *testing.T) {
+	require.Equal(t, "flash_metrics_data", table.DefaultTables.Data)
+	require.Equal(t, table.CreateMeta, table.DefaultTables.Rename(table.CreateMeta))
+
+	tables := table.NewTables("staging_")
+	require.Equal(t, "staging_flash_metrics_meta", tables.Meta)
+	require.Equal(t, "staging_flash_metrics_metadata", tables.Metadata)
+	require.Equal(t, "DROP TABLE IF EXISTS staging_flash_metrics_metadata;", tables.Rename(table.DropMetadata))
+	require.Equal(t, "DROP TABLE IF EXISTS staging_flash_metrics_meta;", tables.Rename(table.DropMeta))
+	require.Equal(t, "DROP TABLE IF EXISTS staging_flash_metrics_rollup;", tables.Rename(table.DropRollupState))
+	require.Equal(t, "DROP TABLE IF EXISTS staging_flash_metrics_rollup_dirty;", tables.Rename(table.DropRollupDirty))
+	require.Equal(t, "DROP TABLE IF EXISTS staging_flash_metrics_generation;", tables.Rename(table.DropGeneration))
+	for _, m := range table.Migrations(table.SchemaOptions{TablePrefix: "staging_"}) {
+		for _, stmt := range m.Statements {
+			require.NotContains(t, strings.ReplaceAll(stmt, "staging_flash_metrics_", ""), "flash_metrics_")
+		}
+	}
+
+	require.NoError(t, table.CheckPrefix(""))
+	require.NoError(t, table.CheckPrefix("team_a_"))
+	require.Error(t, table.CheckPrefix("a-b"))
+	require.Error(t, table.CheckPrefix("a; DROP TABLE b"))
+}
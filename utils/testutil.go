@@ -1,16 +1,47 @@
 package utils
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
 
+	"github.com/showhand-lab/flash-metrics/config"
 	"github.com/showhand-lab/flash-metrics/table"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// TestTiDBConfig returns the config of the TiDB used by tests, connecting to
+// the database if not empty. The defaults can be overridden by the environment
+// variables FLASH_METRICS_TEST_TIDB_ADDRESS, FLASH_METRICS_TEST_TIDB_USER and
+// FLASH_METRICS_TEST_TIDB_PASSWORD.
+func TestTiDBConfig(database string) config.TiDBConfig {
+	cfg := config.DefaultFlashMetricsConfig.TiDBConfig
+	cfg.Database = database
+	if v, ok := os.LookupEnv("FLASH_METRICS_TEST_TIDB_ADDRESS"); ok {
+		cfg.Address = v
+	}
+	if v, ok := os.LookupEnv("FLASH_METRICS_TEST_TIDB_USER"); ok {
+		cfg.User = v
+	}
+	if v, ok := os.LookupEnv("FLASH_METRICS_TEST_TIDB_PASSWORD"); ok {
+		cfg.Password = v
+	}
+	return cfg
+}
+
+func openTestDB(database string) (*sql.DB, error) {
+	cfg := TestTiDBConfig(database)
+	dsn, err := cfg.DSN()
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("mysql", dsn)
+}
+
 func PingTiDB() error {
-	db, err := sql.Open("mysql", "root@(127.0.0.1:4000)/")
+	db, err := openTestDB("")
 	if err != nil {
 		return err
 	}
@@ -24,34 +55,37 @@ func PingTiDB() error {
 }
 
 func SetupDB(dbName string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", "root@(127.0.0.1:4000)/")
-	defer func() {
-		if err != nil {
-			_ = db.Close()
-		}
-	}()
+	return SetupDBWithOptions(dbName, table.SchemaOptions{})
+}
+
+// SetupOverflowDB creates flash_metrics_index by table.CreateIndexOverflow.
+func SetupOverflowDB(dbName string) (*sql.DB, error) {
+	return SetupDBWithOptions(dbName, table.SchemaOptions{OverflowLabels: true})
+}
+
+// SetupDBWithOptions creates the database and migrates the tables of opts.
+func SetupDBWithOptions(dbName string, opts table.SchemaOptions) (*sql.DB, error) {
+	db, err := openTestDB("")
 	if err != nil {
 		return nil, err
 	}
-
 	if _, err = db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", dbName)); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-	if _, err = db.Exec(fmt.Sprintf("USE %s", dbName)); err != nil {
+	if err = db.Close(); err != nil {
 		return nil, err
 	}
 
-	for _, stmt := range []string{table.CreateMeta, table.CreateIndex, table.CreateUpdate, table.CreateData} {
-		if _, err = db.Exec(stmt); err != nil {
-			return nil, err
-		}
+	db, err = openTestDB(dbName)
+	if err != nil {
+		return nil, err
 	}
-
-	if err = db.Close(); err != nil {
+	if err = table.Migrate(context.Background(), db, table.NewTables(opts.TablePrefix), table.Migrations(opts), false, nil); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-
-	return sql.Open("mysql", fmt.Sprintf("root@(127.0.0.1:4000)/%s", dbName))
+	return db, nil
 }
 
 func TearDownDB(dbName string, db *sql.DB) error {